@@ -0,0 +1,118 @@
+// Package disk reads the partition table of a whole disk image, MBR or
+// GPT, and gives access to each partition, so that the filesystems in it
+// can be opened with ext4.NewFS.
+//
+// Images in other formats are read through the qcow2, vhd, vmdk and simg
+// subpackages. Their Image is an io.ReaderAt of the raw disk with a Size
+// method, so that io.NewSectionReader(img, 0, img.Size()) can be passed to
+// Open, or to ext4.NewFS when the image holds a bare filesystem.
+package disk
+
+import (
+	"io"
+
+	"golang.org/x/xerrors"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4"
+)
+
+// ErrNoPartitionTable is returned by Open when the disk has neither an MBR
+// nor a GPT. The image may hold a bare filesystem.
+var ErrNoPartitionTable = xerrors.New("no partition table")
+
+// Scheme is the partitioning scheme of a disk.
+type Scheme string
+
+const (
+	SchemeMBR Scheme = "mbr"
+	SchemeGPT Scheme = "gpt"
+)
+
+// Partition is a partition of a disk. Offset and Size are in bytes.
+type Partition struct {
+	// Index is the partition number, as Linux numbers them: 1 to 4 for the
+	// MBR primary partitions, 5 and up for the logical partitions, and the
+	// entry number plus one for GPT.
+	Index  int
+	Offset int64
+	Size   int64
+
+	// Type is the MBR partition type, zero for GPT partitions.
+	Type byte
+	// Bootable is the MBR active flag.
+	Bootable bool
+
+	// TypeGUID, GUID, Name and Attributes come from the GPT entry, and are
+	// zero for MBR partitions.
+	TypeGUID   GUID
+	GUID       GUID
+	Name       string
+	Attributes uint64
+
+	r io.ReaderAt
+}
+
+// SectionReader returns a reader of the content of the partition.
+func (p Partition) SectionReader() *io.SectionReader {
+	return io.NewSectionReader(p.r, p.Offset, p.Size)
+}
+
+// IsExt reports whether the partition holds an ext2, ext3 or ext4
+// filesystem, according to ext4.Check.
+func (p Partition) IsExt() bool {
+	return ext4.Check(p.SectionReader())
+}
+
+// Disk is a partitioned disk.
+type Disk struct {
+	Scheme Scheme
+	// SectorSize is the logical sector size the partition table uses.
+	SectorSize int64
+	// GUID is the disk GUID of a GPT disk.
+	GUID       GUID
+	Partitions []Partition
+}
+
+// ExtPartitions returns the partitions holding an ext2, ext3 or ext4
+// filesystem.
+func (d *Disk) ExtPartitions() []Partition {
+	var parts []Partition
+	for _, p := range d.Partitions {
+		if p.IsExt() {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// Open reads the partition table of the disk image r of size bytes. A GPT
+// is used when the MBR is a protective one or is missing; the backup GPT
+// header is used when the primary one is damaged. The extended MBR
+// partitions are replaced by the logical partitions they hold.
+func Open(r io.ReaderAt, size int64) (*Disk, error) {
+	mbr, err := readMBR(r, 0)
+	if err != nil && !xerrors.Is(err, ErrNoPartitionTable) {
+		return nil, xerrors.Errorf("failed to read MBR: %w", err)
+	}
+	if mbr != nil && !mbr.protective() {
+		return mbr.disk(r)
+	}
+
+	d, err := readGPT(r, size)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read GPT: %w", err)
+	}
+	return d, nil
+}
+
+// readSectors reads len(b) bytes at off, failing on short reads.
+func readSectors(r io.ReaderAt, b []byte, off int64) error {
+	n, err := r.ReadAt(b, off)
+	if n == len(b) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return xerrors.Errorf("failed to read %d bytes at %#x: %w", len(b), off, err)
+}
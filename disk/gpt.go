@@ -0,0 +1,212 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	gptSignature     = "EFI PART"
+	gptHeaderMinSize = 92
+	gptEntryMinSize  = 128
+	// maxGPTEntriesSize is a thousand times the usual 16KB entry array.
+	maxGPTEntriesSize = 16 << 20
+)
+
+// gptSectorSizes are the logical sector sizes tried to find the GPT header,
+// which is in the second sector.
+var gptSectorSizes = []int64{512, 4096}
+
+// GUID is a GPT GUID, stored with its first three fields little endian.
+type GUID [16]byte
+
+// Well-known GPT partition types.
+var (
+	TypeEFISystem          = mustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	TypeBIOSBoot           = mustParseGUID("21686148-6449-6E6F-744E-656564454649")
+	TypeMicrosoftBasicData = mustParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
+	TypeLinuxFilesystem    = mustParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	TypeLinuxRootX86_64    = mustParseGUID("4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709")
+	TypeLinuxHome          = mustParseGUID("933AC7E1-2EB4-4F13-B844-0E14E2AEF915")
+	TypeLinuxSwap          = mustParseGUID("0657FD6D-A4AB-43C4-84E5-0933C84B4F4F")
+	TypeLinuxLVM           = mustParseGUID("E6D6D379-F507-44C2-A23C-238F2A3DF928")
+)
+
+// ParseGUID parses a GUID in its textual form, such as
+// "0FC63DAF-8483-4772-8E79-3D69D8477DE4".
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 {
+		return g, xerrors.Errorf("invalid GUID %q", s)
+	}
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil || len(b) != 16 {
+		return g, xerrors.Errorf("invalid GUID %q", s)
+	}
+	copy(g[:], b)
+	g.swap()
+	return g, nil
+}
+
+func mustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// swap converts between the stored and the textual byte order.
+func (g *GUID) swap() {
+	g[0], g[1], g[2], g[3] = g[3], g[2], g[1], g[0]
+	g[4], g[5] = g[5], g[4]
+	g[6], g[7] = g[7], g[6]
+}
+
+func (g GUID) String() string {
+	g.swap()
+	return fmt.Sprintf("%X-%X-%X-%X-%X", g[0:4], g[4:6], g[6:8], g[8:10], g[10:16])
+}
+
+// IsZero reports whether g is the nil GUID, which marks unused entries.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+type gptHeader struct {
+	Signature      [8]byte
+	Revision       uint32
+	HeaderSize     uint32
+	HeaderCRC32    uint32
+	_              uint32
+	CurrentLBA     uint64
+	BackupLBA      uint64
+	FirstUsableLBA uint64
+	LastUsableLBA  uint64
+	DiskGUID       GUID
+	EntriesLBA     uint64
+	NumEntries     uint32
+	EntrySize      uint32
+	EntriesCRC32   uint32
+}
+
+type gptEntry struct {
+	TypeGUID   GUID
+	GUID       GUID
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       [36]uint16
+}
+
+// readGPT reads the primary GPT, or the backup one at the end of the disk
+// when the primary one is damaged. ErrNoPartitionTable is returned when
+// there is no GPT header at all.
+func readGPT(r io.ReaderAt, size int64) (*Disk, error) {
+	var firstErr error
+	for _, sectorSize := range gptSectorSizes {
+		for _, lba := range []int64{1, size/sectorSize - 1} {
+			if lba < 1 {
+				continue
+			}
+			d, err := readGPTAt(r, sectorSize, lba)
+			if err == nil {
+				return d, nil
+			}
+			if firstErr == nil || xerrors.Is(firstErr, ErrNoPartitionTable) && !xerrors.Is(err, ErrNoPartitionTable) {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr == nil {
+		return nil, ErrNoPartitionTable
+	}
+	return nil, firstErr
+}
+
+// readGPTAt reads the GPT whose header is at sector lba.
+func readGPTAt(r io.ReaderAt, sectorSize, lba int64) (*Disk, error) {
+	b := make([]byte, sectorSize)
+	if err := readSectors(r, b, lba*sectorSize); err != nil {
+		return nil, err
+	}
+	if string(b[:len(gptSignature)]) != gptSignature {
+		return nil, ErrNoPartitionTable
+	}
+	var h gptHeader
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return nil, xerrors.Errorf("failed to parse GPT header: %w", err)
+	}
+	if h.HeaderSize < gptHeaderMinSize || int64(h.HeaderSize) > sectorSize {
+		return nil, xerrors.Errorf("GPT header at sector %d: invalid header size %d", lba, h.HeaderSize)
+	}
+	header := append([]byte(nil), b[:h.HeaderSize]...)
+	binary.LittleEndian.PutUint32(header[16:], 0)
+	if sum := crc32.ChecksumIEEE(header); sum != h.HeaderCRC32 {
+		return nil, xerrors.Errorf("GPT header at sector %d: CRC32 %#08x, want %#08x", lba, sum, h.HeaderCRC32)
+	}
+	if h.CurrentLBA != uint64(lba) {
+		return nil, xerrors.Errorf("GPT header at sector %d claims to be at sector %d", lba, h.CurrentLBA)
+	}
+
+	if h.EntrySize < gptEntryMinSize || h.EntrySize%8 != 0 {
+		return nil, xerrors.Errorf("GPT header at sector %d: invalid entry size %d", lba, h.EntrySize)
+	}
+	entriesSize := int64(h.NumEntries) * int64(h.EntrySize)
+	if entriesSize > maxGPTEntriesSize {
+		return nil, xerrors.Errorf("GPT header at sector %d: %d entries of %d bytes are too many", lba, h.NumEntries, h.EntrySize)
+	}
+	entries := make([]byte, entriesSize)
+	if err := readSectors(r, entries, int64(h.EntriesLBA)*sectorSize); err != nil {
+		return nil, xerrors.Errorf("failed to read GPT entries: %w", err)
+	}
+	if sum := crc32.ChecksumIEEE(entries); sum != h.EntriesCRC32 {
+		return nil, xerrors.Errorf("GPT entries at sector %d: CRC32 %#08x, want %#08x", h.EntriesLBA, sum, h.EntriesCRC32)
+	}
+
+	d := &Disk{Scheme: SchemeGPT, SectorSize: sectorSize, GUID: h.DiskGUID}
+	for i := 0; i < int(h.NumEntries); i++ {
+		var e gptEntry
+		raw := entries[i*int(h.EntrySize):]
+		if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &e); err != nil {
+			return nil, xerrors.Errorf("failed to parse GPT entry %d: %w", i, err)
+		}
+		if e.TypeGUID.IsZero() {
+			continue
+		}
+		if e.LastLBA < e.FirstLBA {
+			return nil, xerrors.Errorf("GPT entry %d ends at sector %d before its start %d", i, e.LastLBA, e.FirstLBA)
+		}
+		d.Partitions = append(d.Partitions, Partition{
+			Index:      i + 1,
+			Offset:     int64(e.FirstLBA) * sectorSize,
+			Size:       int64(e.LastLBA-e.FirstLBA+1) * sectorSize,
+			TypeGUID:   e.TypeGUID,
+			GUID:       e.GUID,
+			Name:       gptName(e.Name[:]),
+			Attributes: e.Attributes,
+			r:          r,
+		})
+	}
+	return d, nil
+}
+
+// gptName decodes a NUL terminated UTF-16 partition name.
+func gptName(name []uint16) string {
+	for i, c := range name {
+		if c == 0 {
+			name = name[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(name))
+}
@@ -0,0 +1,126 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+type testGPTPartition struct {
+	typeGUID GUID
+	guid     GUID
+	first    uint64
+	last     uint64
+	name     string
+}
+
+// writeGPT writes a protective MBR and the primary and backup GPT of a
+// disk with the given sector size.
+func writeGPT(img []byte, sectorSize int64, parts ...testGPTPartition) {
+	const numEntries = 128
+	lastLBA := uint64(int64(len(img))/sectorSize - 1)
+	writeBootRecord(img, 0, mbrEntry{Type: MBRTypeProtective, StartLBA: 1, Sectors: uint32(lastLBA)})
+
+	entries := make([]byte, numEntries*gptEntryMinSize)
+	for i, p := range parts {
+		e := gptEntry{TypeGUID: p.typeGUID, GUID: p.guid, FirstLBA: p.first, LastLBA: p.last}
+		copy(e.Name[:], utf16.Encode([]rune(p.name)))
+		buf := &bytes.Buffer{}
+		binary.Write(buf, binary.LittleEndian, e)
+		copy(entries[i*gptEntryMinSize:], buf.Bytes())
+	}
+	entriesSectors := uint64(len(entries)) / uint64(sectorSize)
+
+	for _, h := range []gptHeader{
+		{CurrentLBA: 1, BackupLBA: lastLBA, EntriesLBA: 2},
+		{CurrentLBA: lastLBA, BackupLBA: 1, EntriesLBA: lastLBA - entriesSectors},
+	} {
+		copy(h.Signature[:], gptSignature)
+		h.Revision = 0x10000
+		h.HeaderSize = gptHeaderMinSize
+		h.FirstUsableLBA = 2 + entriesSectors
+		h.LastUsableLBA = lastLBA - entriesSectors - 1
+		h.DiskGUID = mustParseGUID("01234567-89AB-CDEF-0123-456789ABCDEF")
+		h.NumEntries = numEntries
+		h.EntrySize = gptEntryMinSize
+		h.EntriesCRC32 = crc32.ChecksumIEEE(entries)
+		buf := &bytes.Buffer{}
+		binary.Write(buf, binary.LittleEndian, h)
+		h.HeaderCRC32 = crc32.ChecksumIEEE(buf.Bytes())
+		buf.Reset()
+		binary.Write(buf, binary.LittleEndian, h)
+
+		copy(img[int64(h.CurrentLBA)*sectorSize:], buf.Bytes())
+		copy(img[int64(h.EntriesLBA)*sectorSize:], entries)
+	}
+}
+
+func TestOpenGPT(t *testing.T) {
+	esp := mustParseGUID("8E3A6B5C-0000-4000-8000-000000000001")
+	root := mustParseGUID("8E3A6B5C-0000-4000-8000-000000000002")
+	for _, sectorSize := range []int64{512, 4096} {
+		img := make([]byte, testDiskSize)
+		writeGPT(img, sectorSize,
+			testGPTPartition{typeGUID: TypeEFISystem, guid: esp, first: 40, last: 99, name: "EFI system"},
+			testGPTPartition{},
+			testGPTPartition{typeGUID: TypeLinuxFilesystem, guid: root, first: 100, last: 1000, name: "root"},
+		)
+		writeExtMagic(img, 100*sectorSize)
+
+		want := []Partition{
+			{Index: 1, Offset: 40 * sectorSize, Size: 60 * sectorSize, TypeGUID: TypeEFISystem, GUID: esp, Name: "EFI system"},
+			{Index: 3, Offset: 100 * sectorSize, Size: 901 * sectorSize, TypeGUID: TypeLinuxFilesystem, GUID: root, Name: "root"},
+		}
+		d, err := Open(bytes.NewReader(img), int64(len(img)))
+		if err != nil {
+			t.Fatalf("Open() with %d byte sectors error: %v", sectorSize, err)
+		}
+		if d.Scheme != SchemeGPT || d.SectorSize != sectorSize {
+			t.Errorf("Open() scheme = %s, sector size = %d, want gpt and %d", d.Scheme, d.SectorSize, sectorSize)
+		}
+		ext := d.ExtPartitions()
+		if len(ext) != 1 || ext[0].Index != 3 {
+			t.Errorf("ExtPartitions() = %+v, want partition 3", ext)
+		}
+		if got := clearPartitions(d.Partitions); !reflect.DeepEqual(got, want) {
+			t.Errorf("Partitions = %+v, want %+v", got, want)
+		}
+
+		// A damaged primary header falls back to the backup one.
+		img[sectorSize+gptHeaderMinSize-1] ^= 0xff
+		d, err = Open(bytes.NewReader(img), int64(len(img)))
+		if err != nil {
+			t.Fatalf("Open() with a damaged primary header error: %v", err)
+		}
+		if got := clearPartitions(d.Partitions); !reflect.DeepEqual(got, want) {
+			t.Errorf("Partitions from the backup header = %+v, want %+v", got, want)
+		}
+
+		img[int64(len(img))-sectorSize+gptHeaderMinSize-1] ^= 0xff
+		if _, err := Open(bytes.NewReader(img), int64(len(img))); err == nil {
+			t.Error("Open() with both headers damaged succeeded")
+		}
+	}
+}
+
+func TestGUID(t *testing.T) {
+	const s = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	g, err := ParseGUID(s)
+	if err != nil {
+		t.Fatalf("ParseGUID() error: %v", err)
+	}
+	// The on-disk form of the Linux filesystem type.
+	want := GUID{0xaf, 0x3d, 0xc6, 0x0f, 0x83, 0x84, 0x72, 0x47, 0x8e, 0x79, 0x3d, 0x69, 0xd8, 0x47, 0x7d, 0xe4}
+	if g != want {
+		t.Errorf("ParseGUID() = % x, want % x", g[:], want[:])
+	}
+	if g.String() != s {
+		t.Errorf("String() = %s, want %s", g, s)
+	}
+	if _, err := ParseGUID("0FC63DAF-8483"); err == nil {
+		t.Error("ParseGUID() of a truncated GUID succeeded")
+	}
+}
@@ -0,0 +1,272 @@
+package lvm
+
+import (
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// section is a section of the metadata text, with its values by key in
+// order: strings, int64 numbers, float64 numbers, lists of values and
+// sections.
+type section struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newSection() *section {
+	return &section{values: map[string]interface{}{}}
+}
+
+func (s *section) set(key string, v interface{}) {
+	if _, ok := s.values[key]; !ok {
+		s.keys = append(s.keys, key)
+	}
+	s.values[key] = v
+}
+
+// sections returns the keys of the subsections, in order.
+func (s *section) sections() []string {
+	var keys []string
+	for _, key := range s.keys {
+		if _, ok := s.values[key].(*section); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *section) section(key string) (*section, error) {
+	v, ok := s.values[key].(*section)
+	if !ok {
+		return nil, xerrors.Errorf("no section %q", key)
+	}
+	return v, nil
+}
+
+func (s *section) str(key string) (string, error) {
+	v, ok := s.values[key].(string)
+	if !ok {
+		return "", xerrors.Errorf("no string %q", key)
+	}
+	return v, nil
+}
+
+func (s *section) int(key string) (int64, error) {
+	v, ok := s.values[key].(int64)
+	if !ok {
+		return 0, xerrors.Errorf("no number %q", key)
+	}
+	return v, nil
+}
+
+func (s *section) list(key string) ([]interface{}, error) {
+	v, ok := s.values[key].([]interface{})
+	if !ok {
+		return nil, xerrors.Errorf("no list %q", key)
+	}
+	return v, nil
+}
+
+// strs returns the strings of the list key, empty when there is none.
+func (s *section) strs(key string) []string {
+	list, _ := s.values[key].([]interface{})
+	var strs []string
+	for _, v := range list {
+		if str, ok := v.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
+
+// maxDepth bounds the nesting of sections and lists.
+const maxDepth = 32
+
+// parser parses the metadata text: assignments of values to keys, and
+// sections in braces. Comments start with '#'.
+type parser struct {
+	text  string
+	pos   int
+	line  int
+	depth int
+}
+
+// enter enters a nested section or list, to be left by calling leave.
+func (p *parser) enter() error {
+	if p.depth++; p.depth > maxDepth {
+		return xerrors.New("too deeply nested")
+	}
+	p.pos++
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+// parseConfig parses the metadata text.
+func parseConfig(text string) (*section, error) {
+	p := &parser{text: text, line: 1}
+	s, err := p.parseSection(false)
+	if err != nil {
+		return nil, xerrors.Errorf("line %d: %w", p.line, err)
+	}
+	return s, nil
+}
+
+// skip skips spaces and comments.
+func (p *parser) skip() {
+	for p.pos < len(p.text) {
+		switch c := p.text[p.pos]; {
+		case c == '#':
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '\n':
+			p.line++
+			p.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next character, or zero at the end of the text.
+func (p *parser) peek() byte {
+	p.skip()
+	if p.pos == len(p.text) {
+		return 0
+	}
+	return p.text[p.pos]
+}
+
+func isWordChar(c byte) bool {
+	return !strings.ContainsRune(" \t\r\n={}[],\"#", rune(c))
+}
+
+func (p *parser) word() string {
+	start := p.pos
+	for p.pos < len(p.text) && isWordChar(p.text[p.pos]) {
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+// parseSection parses the content of a section, ended by a closing brace
+// if nested or by the end of the text.
+func (p *parser) parseSection(nested bool) (*section, error) {
+	s := newSection()
+	for {
+		switch c := p.peek(); {
+		case c == 0:
+			if nested {
+				return nil, xerrors.New("unterminated section")
+			}
+			return s, nil
+		case c == '}':
+			if !nested {
+				return nil, xerrors.New("unexpected '}'")
+			}
+			p.pos++
+			return s, nil
+		case !isWordChar(c):
+			return nil, xerrors.Errorf("unexpected %q", c)
+		}
+
+		key := p.word()
+		switch p.peek() {
+		case '{':
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			sub, err := p.parseSection(true)
+			if err != nil {
+				return nil, err
+			}
+			p.leave()
+			s.set(key, sub)
+		case '=':
+			p.pos++
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, xerrors.Errorf("%s: %w", key, err)
+			}
+			s.set(key, v)
+		default:
+			return nil, xerrors.Errorf("expected '=' or '{' after %q", key)
+		}
+	}
+}
+
+func (p *parser) parseValue() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		return p.parseString()
+	case c == '[':
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		list := []interface{}{}
+		if p.peek() == ']' {
+			p.pos++
+			return list, nil
+		}
+		for {
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			switch p.peek() {
+			case ',':
+				p.pos++
+			case ']':
+				p.pos++
+				return list, nil
+			default:
+				return nil, xerrors.New("expected ',' or ']' in list")
+			}
+		}
+	case c == '-' || c >= '0' && c <= '9':
+		w := p.word()
+		if i, err := strconv.ParseInt(w, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(w, 64)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid number %q", w)
+		}
+		return f, nil
+	}
+	return nil, xerrors.New("expected a value")
+}
+
+// parseString parses a quoted string, in which backslashes escape the next
+// character.
+func (p *parser) parseString() (string, error) {
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.pos == len(p.text) {
+				return "", xerrors.New("unterminated string")
+			}
+			c = p.text[p.pos]
+			p.pos++
+		case '\n':
+			p.line++
+		}
+		b.WriteByte(c)
+	}
+	return "", xerrors.New("unterminated string")
+}
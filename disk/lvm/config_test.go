@@ -0,0 +1,72 @@
+package lvm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	s, err := parseConfig(`# comment
+name = "a \"quoted\" \\ name"	# trailing comment
+n = -12
+f = 1.5
+empty = []
+list = [
+	"x", 1,
+	["y"]
+]
+sub {
+	inner {
+		k = "v"
+	}
+}
+`)
+	if err != nil {
+		t.Fatalf("parseConfig() error: %v", err)
+	}
+	if got, _ := s.str("name"); got != `a "quoted" \ name` {
+		t.Errorf("name = %q", got)
+	}
+	if got, _ := s.int("n"); got != -12 {
+		t.Errorf("n = %d", got)
+	}
+	if got := s.values["f"]; got != 1.5 {
+		t.Errorf("f = %v", got)
+	}
+	if got, _ := s.list("empty"); got == nil || len(got) != 0 {
+		t.Errorf("empty = %v", got)
+	}
+	want := []interface{}{"x", int64(1), []interface{}{"y"}}
+	if got, _ := s.list("list"); !reflect.DeepEqual(got, want) {
+		t.Errorf("list = %v, want %v", got, want)
+	}
+	if got := s.sections(); !reflect.DeepEqual(got, []string{"sub"}) {
+		t.Errorf("sections() = %q", got)
+	}
+	sub, _ := s.section("sub")
+	inner, err := sub.section("inner")
+	if err != nil {
+		t.Fatalf("section(inner) error: %v", err)
+	}
+	if got, _ := inner.str("k"); got != "v" {
+		t.Errorf("k = %q", got)
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for _, text := range []string{
+		`a {`,
+		`}`,
+		`a = "unterminated`,
+		`a = [1 2]`,
+		`a = 1x`,
+		`a`,
+		`= 1`,
+		strings.Repeat("a {", maxDepth+1) + strings.Repeat("}", maxDepth+1),
+	} {
+		if _, err := parseConfig(text); err == nil {
+			t.Errorf("parseConfig(%q) succeeded", text)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package lvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	sectorSize = 512
+
+	labelID   = "LABELONE"
+	labelType = "LVM2 001"
+	// labelSectors is the number of sectors at the start of the device
+	// searched for the label.
+	labelSectors = 4
+	// labelCRCOffset is the offset of the part of the label sector its
+	// checksum covers.
+	labelCRCOffset = 20
+
+	mdaMagic      = " LVM2 x[5A%r0N*>"
+	mdaVersion    = 1
+	mdaHeaderSize = 512
+	// rawLocnIgnored marks a metadata area not to be used.
+	rawLocnIgnored = 1
+
+	// initialCRC is the initial value of LVM checksums.
+	initialCRC = 0xf597a6cf
+
+	// maxMetadataSize bounds the metadata text read from a possibly
+	// damaged area.
+	maxMetadataSize = 64 << 20
+)
+
+// ErrNoLabel is returned when a device has no LVM2 physical volume label.
+var ErrNoLabel = xerrors.New("no physical volume label")
+
+// Area is an area of a physical volume.
+type Area struct {
+	Offset int64
+	Size   int64
+}
+
+// Label is the label of a physical volume, with the areas of its data and
+// metadata.
+type Label struct {
+	// Sector is the sector of the device holding the label.
+	Sector int64
+	// PVID is the UUID of the physical volume, without dashes.
+	PVID string
+	// DeviceSize is the size of the device in bytes.
+	DeviceSize    int64
+	DataAreas     []Area
+	MetadataAreas []Area
+}
+
+type labelHeader struct {
+	ID     [8]byte
+	Sector uint64
+	CRC    uint32
+	Offset uint32
+	Type   [8]byte
+}
+
+type pvHeader struct {
+	UUID       [32]byte
+	DeviceSize uint64
+}
+
+type mdaHeader struct {
+	Checksum uint32
+	Magic    [16]byte
+	Version  uint32
+	Start    uint64
+	Size     uint64
+}
+
+type rawLocation struct {
+	Offset   uint64
+	Size     uint64
+	Checksum uint32
+	Flags    uint32
+}
+
+// checksum returns the LVM checksum of b, continuing from crc: a CRC-32
+// without its final inversion.
+func checksum(crc uint32, b []byte) uint32 {
+	return ^crc32.Update(^crc, crc32.IEEETable, b)
+}
+
+// ReadLabel reads the physical volume label in the first sectors of r. As
+// in LVM, a label recording another sector than the one it is in is
+// ignored.
+func ReadLabel(r io.ReaderAt) (*Label, error) {
+	b := make([]byte, sectorSize)
+	for sector := int64(0); sector < labelSectors; sector++ {
+		if _, err := r.ReadAt(b, sector*sectorSize); err != nil {
+			return nil, xerrors.Errorf("failed to read sector %d: %w", sector, err)
+		}
+		var h labelHeader
+		if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+			return nil, xerrors.Errorf("failed to parse label: %w", err)
+		}
+		if string(h.ID[:]) != labelID || h.Sector != uint64(sector) {
+			continue
+		}
+		if sum := checksum(initialCRC, b[labelCRCOffset:]); sum != h.CRC {
+			return nil, xerrors.Errorf("label in sector %d: checksum %#x, want %#x", sector, sum, h.CRC)
+		}
+		if string(h.Type[:]) != labelType {
+			return nil, xerrors.Errorf("unsupported label type %q", h.Type[:])
+		}
+		if h.Offset < uint32(binary.Size(h)) || h.Offset >= sectorSize {
+			return nil, xerrors.Errorf("invalid physical volume header offset %d", h.Offset)
+		}
+		return parsePVHeader(b[h.Offset:], sector)
+	}
+	return nil, ErrNoLabel
+}
+
+// parsePVHeader parses the physical volume header, followed by the lists
+// of data and metadata areas, each ended by an empty area.
+func parsePVHeader(b []byte, sector int64) (*Label, error) {
+	br := bytes.NewReader(b)
+	var h pvHeader
+	if err := binary.Read(br, binary.LittleEndian, &h); err != nil {
+		return nil, xerrors.Errorf("failed to parse physical volume header: %w", err)
+	}
+	l := &Label{Sector: sector, PVID: string(h.UUID[:]), DeviceSize: int64(h.DeviceSize)}
+	for _, areas := range []*[]Area{&l.DataAreas, &l.MetadataAreas} {
+		for {
+			var a struct{ Offset, Size uint64 }
+			if err := binary.Read(br, binary.LittleEndian, &a); err != nil {
+				return nil, xerrors.Errorf("failed to parse areas: %w", err)
+			}
+			if a.Offset == 0 {
+				break
+			}
+			*areas = append(*areas, Area{Offset: int64(a.Offset), Size: int64(a.Size)})
+		}
+	}
+	return l, nil
+}
+
+// readMetadata reads the current metadata text of the metadata area a. It
+// returns an empty text when the area is ignored.
+func readMetadata(r io.ReaderAt, a Area) (string, error) {
+	b := make([]byte, mdaHeaderSize)
+	if _, err := r.ReadAt(b, a.Offset); err != nil {
+		return "", xerrors.Errorf("failed to read metadata area header: %w", err)
+	}
+	br := bytes.NewReader(b)
+	var h mdaHeader
+	if err := binary.Read(br, binary.LittleEndian, &h); err != nil {
+		return "", xerrors.Errorf("failed to parse metadata area header: %w", err)
+	}
+	if string(h.Magic[:]) != mdaMagic {
+		return "", xerrors.Errorf("invalid metadata area magic %q", h.Magic[:])
+	}
+	if sum := checksum(initialCRC, b[4:]); sum != h.Checksum {
+		return "", xerrors.Errorf("metadata area header: checksum %#x, want %#x", sum, h.Checksum)
+	}
+	if h.Version != mdaVersion {
+		return "", xerrors.Errorf("unsupported metadata area version %d", h.Version)
+	}
+	if int64(h.Start) != a.Offset || h.Size <= mdaHeaderSize {
+		return "", xerrors.Errorf("metadata area header of %d bytes at %#x, want %#x", h.Size, h.Start, a.Offset)
+	}
+
+	// The first location is the current metadata.
+	var loc rawLocation
+	if err := binary.Read(br, binary.LittleEndian, &loc); err != nil {
+		return "", xerrors.Errorf("failed to parse metadata location: %w", err)
+	}
+	if loc.Offset == 0 || loc.Flags&rawLocnIgnored != 0 {
+		return "", nil
+	}
+	if loc.Size > maxMetadataSize || loc.Offset < mdaHeaderSize || loc.Offset >= h.Size || loc.Size > h.Size-mdaHeaderSize {
+		return "", xerrors.Errorf("invalid metadata location of %d bytes at %#x", loc.Size, loc.Offset)
+	}
+
+	// The text wraps around the end of the area, after its header.
+	text := make([]byte, loc.Size)
+	first := text
+	if rest := h.Size - loc.Offset; uint64(len(first)) > rest {
+		first = first[:rest]
+	}
+	if _, err := r.ReadAt(first, a.Offset+int64(loc.Offset)); err != nil {
+		return "", xerrors.Errorf("failed to read metadata: %w", err)
+	}
+	if second := text[len(first):]; len(second) > 0 {
+		if _, err := r.ReadAt(second, a.Offset+mdaHeaderSize); err != nil {
+			return "", xerrors.Errorf("failed to read metadata: %w", err)
+		}
+	}
+	if sum := checksum(initialCRC, text); sum != loc.Checksum {
+		return "", xerrors.Errorf("metadata: checksum %#x, want %#x", sum, loc.Checksum)
+	}
+	return strings.TrimRight(string(text), "\x00"), nil
+}
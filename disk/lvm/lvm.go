@@ -0,0 +1,484 @@
+// Package lvm reads LVM2 volume groups from their physical volumes: the
+// label, the text metadata, and the logical volumes made of linear and
+// striped segments. A logical volume can be passed to ext4.NewFS through an
+// io.SectionReader of its size.
+package lvm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	// ErrUnsupported is returned by LogicalVolume.Open for logical volumes
+	// with segments other than linear, striped or zero ones, such as thin
+	// pools, thin volumes, mirrors and RAID.
+	ErrUnsupported = xerrors.New("unsupported segment type")
+	// ErrMissingPhysicalVolume is returned by LogicalVolume.Open when a
+	// physical volume holding the logical volume was not supplied.
+	ErrMissingPhysicalVolume = xerrors.New("missing physical volume")
+)
+
+// Segment types.
+const (
+	SegmentStriped = "striped"
+	SegmentZero    = "zero"
+)
+
+// VolumeGroup is a volume group, as described by the most recent metadata
+// of its physical volumes.
+type VolumeGroup struct {
+	Name  string
+	ID    string
+	Seqno int64
+	// ExtentSize is the size of the extents in bytes.
+	ExtentSize      int64
+	PhysicalVolumes []*PhysicalVolume
+	LogicalVolumes  []*LogicalVolume
+}
+
+// PhysicalVolume is a physical volume of a volume group.
+type PhysicalVolume struct {
+	// Name is the name of the physical volume in the metadata, such as
+	// "pv0".
+	Name string
+	ID   string
+	// Device is the path of the device when the metadata was written.
+	Device string
+	// Start is the offset of the first extent in bytes.
+	Start   int64
+	Extents int64
+
+	// r is the device, nil when it was not supplied.
+	r io.ReaderAt
+}
+
+// LogicalVolume is a logical volume of a volume group.
+type LogicalVolume struct {
+	Name     string
+	ID       string
+	Status   []string
+	Segments []Segment
+
+	vg *VolumeGroup
+}
+
+// Segment is a range of extents of a logical volume.
+type Segment struct {
+	StartExtent int64
+	ExtentCount int64
+	Type        string
+	// StripeSize is the size of the stripes in bytes, for segments of
+	// several stripes.
+	StripeSize int64
+	// Stripes are the extents of physical volumes the segment is made of,
+	// one for linear segments.
+	Stripes []Stripe
+}
+
+// Stripe is a range of extents of a physical volume, from StartExtent.
+type Stripe struct {
+	PhysicalVolume string
+	StartExtent    int64
+}
+
+// Open reads the volume group of the physical volumes pvs, such as
+// partitions of type disk.TypeLinuxLVM or disk.MBRTypeLinuxLVM, from the
+// most recent of their metadata. The physical volumes must belong to the
+// same volume group, but need not be all of them.
+func Open(pvs ...io.ReaderAt) (*VolumeGroup, error) {
+	devices := map[string]io.ReaderAt{}
+	var config *section
+	var seqno int64
+	var lastErr error
+	for i, r := range pvs {
+		label, err := ReadLabel(r)
+		if err != nil {
+			return nil, xerrors.Errorf("physical volume %d: %w", i, err)
+		}
+		devices[label.PVID] = r
+		for _, area := range label.MetadataAreas {
+			c, n, err := readConfig(r, area)
+			if err != nil {
+				lastErr = xerrors.Errorf("physical volume %d: %w", i, err)
+				continue
+			}
+			if c != nil && (config == nil || n > seqno) {
+				config, seqno = c, n
+			}
+		}
+	}
+	if config == nil {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, xerrors.New("no metadata")
+	}
+
+	vg, err := parseVolumeGroup(config)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse metadata: %w", err)
+	}
+	var matched int
+	for _, pv := range vg.PhysicalVolumes {
+		if r, ok := devices[strings.ReplaceAll(pv.ID, "-", "")]; ok {
+			pv.r = r
+			matched++
+		}
+	}
+	if matched != len(devices) {
+		return nil, xerrors.Errorf("%d physical volumes are not in volume group %s", len(devices)-matched, vg.Name)
+	}
+	return vg, nil
+}
+
+// readConfig reads the metadata in area, nil when the area is ignored, and
+// returns it with its sequence number.
+func readConfig(r io.ReaderAt, area Area) (*section, int64, error) {
+	text, err := readMetadata(r, area)
+	if err != nil || text == "" {
+		return nil, 0, err
+	}
+	config, err := parseConfig(text)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("failed to parse metadata: %w", err)
+	}
+	vgs := config.sections()
+	if len(vgs) != 1 {
+		return nil, 0, xerrors.Errorf("metadata of %d volume groups", len(vgs))
+	}
+	vg, _ := config.section(vgs[0])
+	seqno, err := vg.int("seqno")
+	if err != nil {
+		return nil, 0, err
+	}
+	return config, seqno, nil
+}
+
+// parseVolumeGroup parses the metadata of a volume group, its only
+// section. Sizes are in sectors.
+func parseVolumeGroup(config *section) (*VolumeGroup, error) {
+	name := config.sections()[0]
+	s, _ := config.section(name)
+	vg := &VolumeGroup{Name: name}
+	var err error
+	if vg.ID, err = s.str("id"); err != nil {
+		return nil, err
+	}
+	if vg.Seqno, err = s.int("seqno"); err != nil {
+		return nil, err
+	}
+	extentSize, err := s.int("extent_size")
+	if err != nil {
+		return nil, err
+	}
+	if extentSize <= 0 {
+		return nil, xerrors.Errorf("invalid extent size %d", extentSize)
+	}
+	vg.ExtentSize = extentSize * sectorSize
+
+	pvs, err := s.section("physical_volumes")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range pvs.sections() {
+		pv, err := parsePhysicalVolume(pvs, name)
+		if err != nil {
+			return nil, xerrors.Errorf("physical volume %s: %w", name, err)
+		}
+		vg.PhysicalVolumes = append(vg.PhysicalVolumes, pv)
+	}
+
+	// A volume group may have no logical volume.
+	lvs, err := s.section("logical_volumes")
+	if err != nil {
+		return vg, nil
+	}
+	for _, name := range lvs.sections() {
+		lv, err := parseLogicalVolume(lvs, name)
+		if err != nil {
+			return nil, xerrors.Errorf("logical volume %s: %w", name, err)
+		}
+		lv.vg = vg
+		vg.LogicalVolumes = append(vg.LogicalVolumes, lv)
+	}
+	return vg, nil
+}
+
+func parsePhysicalVolume(pvs *section, name string) (*PhysicalVolume, error) {
+	s, _ := pvs.section(name)
+	pv := &PhysicalVolume{Name: name}
+	var err error
+	if pv.ID, err = s.str("id"); err != nil {
+		return nil, err
+	}
+	pv.Device, _ = s.str("device")
+	start, err := s.int("pe_start")
+	if err != nil {
+		return nil, err
+	}
+	pv.Start = start * sectorSize
+	if pv.Extents, err = s.int("pe_count"); err != nil {
+		return nil, err
+	}
+	return pv, nil
+}
+
+func parseLogicalVolume(lvs *section, name string) (*LogicalVolume, error) {
+	s, _ := lvs.section(name)
+	lv := &LogicalVolume{Name: name, Status: s.strs("status")}
+	var err error
+	if lv.ID, err = s.str("id"); err != nil {
+		return nil, err
+	}
+	count, err := s.int("segment_count")
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(1); i <= count; i++ {
+		seg, err := s.section(fmt.Sprintf("segment%d", i))
+		if err != nil {
+			return nil, err
+		}
+		segment, err := parseSegment(seg)
+		if err != nil {
+			return nil, xerrors.Errorf("segment %d: %w", i, err)
+		}
+		lv.Segments = append(lv.Segments, segment)
+	}
+	sort.Slice(lv.Segments, func(i, j int) bool {
+		return lv.Segments[i].StartExtent < lv.Segments[j].StartExtent
+	})
+	return lv, nil
+}
+
+// parseSegment parses a segment. The stripes of striped segments are a
+// list of physical volume names and extents.
+func parseSegment(s *section) (Segment, error) {
+	var seg Segment
+	var err error
+	if seg.StartExtent, err = s.int("start_extent"); err != nil {
+		return seg, err
+	}
+	if seg.ExtentCount, err = s.int("extent_count"); err != nil {
+		return seg, err
+	}
+	if seg.Type, err = s.str("type"); err != nil {
+		return seg, err
+	}
+	if seg.Type != SegmentStriped {
+		return seg, nil
+	}
+
+	count, err := s.int("stripe_count")
+	if err != nil {
+		return seg, err
+	}
+	if count > 1 {
+		size, err := s.int("stripe_size")
+		if err != nil {
+			return seg, err
+		}
+		seg.StripeSize = size * sectorSize
+	}
+	stripes, err := s.list("stripes")
+	if err != nil {
+		return seg, err
+	}
+	if count < 1 || int64(len(stripes)) != 2*count {
+		return seg, xerrors.Errorf("%d stripes listed for a stripe count of %d", len(stripes)/2, count)
+	}
+	for i := 0; i < len(stripes); i += 2 {
+		name, ok := stripes[i].(string)
+		extent, ok2 := stripes[i+1].(int64)
+		if !ok || !ok2 {
+			return seg, xerrors.Errorf("invalid stripe %d", i/2)
+		}
+		seg.Stripes = append(seg.Stripes, Stripe{PhysicalVolume: name, StartExtent: extent})
+	}
+	return seg, nil
+}
+
+// LogicalVolume returns the logical volume name, nil when there is none.
+func (vg *VolumeGroup) LogicalVolume(name string) *LogicalVolume {
+	for _, lv := range vg.LogicalVolumes {
+		if lv.Name == name {
+			return lv
+		}
+	}
+	return nil
+}
+
+func (vg *VolumeGroup) physicalVolume(name string) *PhysicalVolume {
+	for _, pv := range vg.PhysicalVolumes {
+		if pv.Name == name {
+			return pv
+		}
+	}
+	return nil
+}
+
+// Visible reports whether the logical volume is visible, rather than an
+// internal volume of another one, such as the metadata of a thin pool.
+func (lv *LogicalVolume) Visible() bool {
+	for _, s := range lv.Status {
+		if s == "VISIBLE" {
+			return true
+		}
+	}
+	return false
+}
+
+// Size returns the size of the logical volume in bytes.
+func (lv *LogicalVolume) Size() int64 {
+	var extents int64
+	for _, seg := range lv.Segments {
+		extents += seg.ExtentCount
+	}
+	return extents * lv.vg.ExtentSize
+}
+
+// Open opens the logical volume for reading. It fails with ErrUnsupported
+// for segment types other than striped and zero, and with
+// ErrMissingPhysicalVolume when a physical volume it is on was not
+// supplied.
+func (lv *LogicalVolume) Open() (*Volume, error) {
+	v := &Volume{lv: lv, extentSize: lv.vg.ExtentSize}
+	var next int64
+	for i, seg := range lv.Segments {
+		if seg.StartExtent != next {
+			return nil, xerrors.Errorf("segment %d starts at extent %d, want %d", i, seg.StartExtent, next)
+		}
+		next += seg.ExtentCount
+		s := volumeSegment{Segment: seg, start: seg.StartExtent * v.extentSize, size: seg.ExtentCount * v.extentSize}
+		switch seg.Type {
+		case SegmentZero:
+		case SegmentStriped:
+			n := int64(len(seg.Stripes))
+			if n > 1 && (seg.StripeSize <= 0 || seg.ExtentCount%n != 0 || s.size/n%seg.StripeSize != 0) {
+				return nil, xerrors.Errorf("segment %d: invalid stripe size %d for %d stripes", i, seg.StripeSize, n)
+			}
+			for _, stripe := range seg.Stripes {
+				pv := lv.vg.physicalVolume(stripe.PhysicalVolume)
+				if pv == nil {
+					return nil, xerrors.Errorf("segment %d: unknown physical volume %s", i, stripe.PhysicalVolume)
+				}
+				if pv.r == nil {
+					return nil, xerrors.Errorf("%w: %s (%s)", ErrMissingPhysicalVolume, pv.Name, pv.ID)
+				}
+				if stripe.StartExtent+seg.ExtentCount/n > pv.Extents {
+					return nil, xerrors.Errorf("segment %d: extents past the end of %s", i, pv.Name)
+				}
+				s.devices = append(s.devices, stripeDevice{r: pv.r, offset: pv.Start + stripe.StartExtent*v.extentSize})
+			}
+		default:
+			return nil, xerrors.Errorf("%w: %s", ErrUnsupported, seg.Type)
+		}
+		v.segments = append(v.segments, s)
+	}
+	v.size = next * v.extentSize
+	return v, nil
+}
+
+// Volume is an opened logical volume. It implements io.ReaderAt and is
+// safe for concurrent use.
+type Volume struct {
+	lv         *LogicalVolume
+	extentSize int64
+	size       int64
+	segments   []volumeSegment
+}
+
+// volumeSegment is a segment at byte offset start of the volume.
+type volumeSegment struct {
+	Segment
+	start   int64
+	size    int64
+	devices []stripeDevice
+}
+
+// stripeDevice is the device of a stripe, from byte offset offset.
+type stripeDevice struct {
+	r      io.ReaderAt
+	offset int64
+}
+
+// LogicalVolume returns the logical volume opened.
+func (v *Volume) LogicalVolume() *LogicalVolume {
+	return v.lv
+}
+
+// Size returns the size of the volume.
+func (v *Volume) Size() int64 {
+	return v.size
+}
+
+// ReadAt reads the volume at off.
+func (v *Volume) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, xerrors.Errorf("negative offset %d", off)
+	}
+	var n int
+	for _, s := range v.segments {
+		if n == len(p) {
+			break
+		}
+		pos := off + int64(n)
+		if pos >= s.start+s.size {
+			continue
+		}
+		chunk := p[n:]
+		if rest := s.start + s.size - pos; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if err := s.readAt(chunk, pos-s.start); err != nil {
+			return n, xerrors.Errorf("failed to read at %#x: %w", pos, err)
+		}
+		n += len(chunk)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readAt fills p from byte offset off of the segment. Striped segments
+// spread stripe sized chunks over their stripes in turn.
+func (s volumeSegment) readAt(p []byte, off int64) error {
+	if s.Type == SegmentZero {
+		for i := range p {
+			p[i] = 0
+		}
+		return nil
+	}
+	if len(s.devices) == 1 {
+		return readFull(s.devices[0], p, off)
+	}
+	stripes := int64(len(s.devices))
+	for len(p) > 0 {
+		chunk, inChunk := off/s.StripeSize, off%s.StripeSize
+		buf := p
+		if rest := s.StripeSize - inChunk; int64(len(buf)) > rest {
+			buf = buf[:rest]
+		}
+		d := s.devices[chunk%stripes]
+		if err := readFull(d, buf, chunk/stripes*s.StripeSize+inChunk); err != nil {
+			return err
+		}
+		p = p[len(buf):]
+		off += int64(len(buf))
+	}
+	return nil
+}
+
+func readFull(d stripeDevice, p []byte, off int64) error {
+	n, err := d.r.ReadAt(p, d.offset+off)
+	if err == io.EOF && n == len(p) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,316 @@
+package lvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	testExtentSize = 8 * sectorSize
+	testPEStart    = 1 << 20
+	testPECount    = 8
+	testMDAOffset  = 4096
+	testMDASize    = 8192
+)
+
+var testPVIDs = []string{
+	"aaaaaa-aaaa-aaaa-aaaa-aaaa-aaaa-aaaaaa",
+	"bbbbbb-bbbb-bbbb-bbbb-bbbb-bbbb-bbbbbb",
+}
+
+// testMetadata returns the metadata of a volume group of two physical
+// volumes, with the logical volumes:
+//
+//	linear   extents 0 and 1 of pv0, then extent 0 of pv1
+//	striped  extents 4 and 5 of pv0 and pv1, in stripes of 1KiB
+//	pool     a thin pool
+//
+// Metadata older than seqno 2 has no striped volume.
+func testMetadata(seqno int) string {
+	striped := ""
+	if seqno >= 2 {
+		striped = `
+		striped {
+			id = "Sssss-ssss"
+			status = ["READ", "WRITE", "VISIBLE"]
+			segment_count = 1
+
+			segment1 {
+				start_extent = 0
+				extent_count = 4
+				type = "striped"
+				stripe_count = 2
+				stripe_size = 2
+				stripes = [
+					"pv0", 4,
+					"pv1", 4
+				]
+			}
+		}
+`
+	}
+	return fmt.Sprintf(`vg0 {
+	id = "Vvvvvv-vvvv"
+	seqno = %d
+	format = "lvm2"	# informational
+	status = ["RESIZEABLE", "READ", "WRITE"]
+	extent_size = 8
+	max_lv = 0
+
+	physical_volumes {
+
+		pv0 {
+			id = "%s"
+			device = "/dev/sda2"	# Hint only
+			status = ["ALLOCATABLE"]
+			pe_start = 2048
+			pe_count = 8
+		}
+
+		pv1 {
+			id = "%s"
+			device = "/dev/sdb"
+			status = ["ALLOCATABLE"]
+			pe_start = 2048
+			pe_count = 8
+		}
+	}
+
+	logical_volumes {
+
+		linear {
+			id = "Lllll-llll"
+			status = ["READ", "WRITE", "VISIBLE"]
+			creation_host = "host \"one\""
+			segment_count = 2
+
+			segment2 {
+				start_extent = 2
+				extent_count = 1
+				type = "striped"
+				stripe_count = 1
+				stripes = [
+					"pv1", 0
+				]
+			}
+
+			segment1 {
+				start_extent = 0
+				extent_count = 2
+				type = "striped"
+				stripe_count = 1	# linear
+				stripes = [
+					"pv0", 0
+				]
+			}
+		}
+%s
+		pool {
+			id = "Ppppp-pppp"
+			status = ["READ", "WRITE", "VISIBLE"]
+			segment_count = 1
+
+			segment1 {
+				start_extent = 0
+				extent_count = 1
+				type = "thin-pool"
+				metadata = "pool_tmeta"
+				pool = "pool_tdata"
+				transaction_id = 0
+			}
+		}
+	}
+}
+# Generated by LVM2
+contents = "Text Format Volume Group"
+version = 1
+creation_time = 1700000000	# Tue Nov 14 22:13:20 2023
+`, seqno, testPVIDs[0], testPVIDs[1], striped)
+}
+
+// testData returns the extents of physical volume i, every 4 bytes
+// holding i and their offset.
+func testData(i int) []byte {
+	b := make([]byte, testPECount*testExtentSize)
+	for off := 0; off < len(b); off += 4 {
+		binary.LittleEndian.PutUint32(b[off:], uint32(i)<<24|uint32(off))
+	}
+	return b
+}
+
+// buildPV builds physical volume i with its label in sector 1, a metadata
+// area at 4KiB holding text at textOffset in it, and its extents from 1MiB.
+func buildPV(i int, text string, textOffset uint64) []byte {
+	pv := make([]byte, testPEStart)
+	pv = append(pv, testData(i)...)
+
+	var label bytes.Buffer
+	h := labelHeader{Sector: 1, Offset: 32}
+	copy(h.ID[:], labelID)
+	copy(h.Type[:], labelType)
+	binary.Write(&label, binary.LittleEndian, h)
+	var ph pvHeader
+	copy(ph.UUID[:], strings.ReplaceAll(testPVIDs[i], "-", ""))
+	ph.DeviceSize = uint64(len(pv))
+	binary.Write(&label, binary.LittleEndian, ph)
+	binary.Write(&label, binary.LittleEndian, []uint64{
+		testPEStart, 0, 0, 0,
+		testMDAOffset, testMDASize, 0, 0,
+	})
+	sector := pv[sectorSize : 2*sectorSize]
+	copy(sector, label.Bytes())
+	binary.LittleEndian.PutUint32(sector[8+8:], checksum(initialCRC, sector[labelCRCOffset:]))
+
+	var mda bytes.Buffer
+	m := mdaHeader{Version: mdaVersion, Start: testMDAOffset, Size: testMDASize}
+	copy(m.Magic[:], mdaMagic)
+	binary.Write(&mda, binary.LittleEndian, m)
+	binary.Write(&mda, binary.LittleEndian, rawLocation{
+		Offset:   textOffset,
+		Size:     uint64(len(text)),
+		Checksum: checksum(initialCRC, []byte(text)),
+	})
+	header := pv[testMDAOffset : testMDAOffset+mdaHeaderSize]
+	copy(header, mda.Bytes())
+	binary.LittleEndian.PutUint32(header, checksum(initialCRC, header[4:]))
+
+	// Write the text in the circular buffer after the header.
+	area := pv[testMDAOffset : testMDAOffset+testMDASize]
+	pos := textOffset
+	for _, c := range []byte(text) {
+		if pos == testMDASize {
+			pos = mdaHeaderSize
+		}
+		area[pos] = c
+		pos++
+	}
+	return pv
+}
+
+func readAll(t *testing.T, v *Volume) []byte {
+	t.Helper()
+	got, err := io.ReadAll(io.NewSectionReader(v, 0, v.Size()))
+	if err != nil {
+		t.Fatalf("ReadAll() error: %v", err)
+	}
+	return got
+}
+
+func TestReadLabel(t *testing.T) {
+	pv := buildPV(0, testMetadata(1), mdaHeaderSize)
+	label, err := ReadLabel(bytes.NewReader(pv))
+	if err != nil {
+		t.Fatalf("ReadLabel() error: %v", err)
+	}
+	want := &Label{
+		Sector:        1,
+		PVID:          strings.Repeat("a", 32),
+		DeviceSize:    int64(len(pv)),
+		DataAreas:     []Area{{Offset: testPEStart}},
+		MetadataAreas: []Area{{Offset: testMDAOffset, Size: testMDASize}},
+	}
+	if !reflect.DeepEqual(label, want) {
+		t.Errorf("ReadLabel() = %+v, want %+v", label, want)
+	}
+
+	if _, err := ReadLabel(bytes.NewReader(make([]byte, 4096))); err != ErrNoLabel {
+		t.Errorf("ReadLabel() of zeros error = %v, want ErrNoLabel", err)
+	}
+	// A label copied to another sector, as by a misaligned copy of the
+	// device, is not found.
+	moved := append([]byte(nil), pv...)
+	copy(moved[2*sectorSize:3*sectorSize], pv[sectorSize:2*sectorSize])
+	copy(moved[sectorSize:2*sectorSize], make([]byte, sectorSize))
+	if _, err := ReadLabel(bytes.NewReader(moved)); err != ErrNoLabel {
+		t.Errorf("ReadLabel() of a moved label error = %v, want ErrNoLabel", err)
+	}
+	pv[sectorSize+100]++
+	if _, err := ReadLabel(bytes.NewReader(pv)); err == nil {
+		t.Error("ReadLabel() of a corrupted label succeeded")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	// The newer metadata of pv1 wraps around the end of its area.
+	newer := testMetadata(2)
+	pv0 := buildPV(0, testMetadata(1), mdaHeaderSize)
+	pv1 := buildPV(1, newer, testMDASize-uint64(len(newer))/2)
+
+	vg, err := Open(bytes.NewReader(pv0), bytes.NewReader(pv1))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if vg.Name != "vg0" || vg.Seqno != 2 || vg.ExtentSize != testExtentSize {
+		t.Errorf("Open() = %s, seqno %d, extent size %d", vg.Name, vg.Seqno, vg.ExtentSize)
+	}
+	var names []string
+	for _, lv := range vg.LogicalVolumes {
+		names = append(names, lv.Name)
+	}
+	if want := []string{"linear", "striped", "pool"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("logical volumes = %q, want %q", names, want)
+	}
+	if pv := vg.PhysicalVolumes[0]; pv.Device != "/dev/sda2" || pv.Start != testPEStart || pv.Extents != testPECount {
+		t.Errorf("pv0 = %+v", pv)
+	}
+
+	data := [][]byte{testData(0), testData(1)}
+	linear := vg.LogicalVolume("linear")
+	if linear.Size() != 3*testExtentSize || !linear.Visible() {
+		t.Errorf("linear: size %d, status %q", linear.Size(), linear.Status)
+	}
+	v, err := linear.Open()
+	if err != nil {
+		t.Fatalf("Open() of linear error: %v", err)
+	}
+	want := append(append([]byte(nil), data[0][:2*testExtentSize]...), data[1][:testExtentSize]...)
+	if got := readAll(t, v); !bytes.Equal(got, want) {
+		t.Error("linear: content differs")
+	}
+
+	v, err = vg.LogicalVolume("striped").Open()
+	if err != nil {
+		t.Fatalf("Open() of striped error: %v", err)
+	}
+	const stripeSize = 1024
+	want = nil
+	for chunk := 0; chunk < 4*testExtentSize/stripeSize; chunk++ {
+		off := 4*testExtentSize + chunk/2*stripeSize
+		want = append(want, data[chunk%2][off:off+stripeSize]...)
+	}
+	if got := readAll(t, v); !bytes.Equal(got, want) {
+		t.Error("striped: content differs")
+	}
+	// A read across stripes.
+	p := make([]byte, 2*stripeSize)
+	if _, err := v.ReadAt(p, stripeSize/2); err != nil {
+		t.Fatalf("ReadAt() error: %v", err)
+	}
+	if !bytes.Equal(p, want[stripeSize/2:stripeSize/2+len(p)]) {
+		t.Error("striped: ReadAt() across stripes differs")
+	}
+
+	if _, err := vg.LogicalVolume("pool").Open(); !xerrors.Is(err, ErrUnsupported) {
+		t.Errorf("Open() of pool error = %v, want ErrUnsupported", err)
+	}
+}
+
+func TestOpenMissingPV(t *testing.T) {
+	vg, err := Open(bytes.NewReader(buildPV(0, testMetadata(1), mdaHeaderSize)))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if vg.Seqno != 1 || vg.LogicalVolume("striped") != nil {
+		t.Errorf("Open() = seqno %d, logical volumes %d", vg.Seqno, len(vg.LogicalVolumes))
+	}
+	if _, err := vg.LogicalVolume("linear").Open(); !xerrors.Is(err, ErrMissingPhysicalVolume) {
+		t.Errorf("Open() of linear error = %v, want ErrMissingPhysicalVolume", err)
+	}
+}
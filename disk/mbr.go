@@ -0,0 +1,142 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	mbrSectorSize      = 512
+	mbrEntriesOffset   = 446
+	mbrSignatureOffset = 510
+	mbrSignature       = 0xaa55
+	// maxLogicalPartitions bounds the chain of extended boot records, which
+	// may loop on a damaged disk.
+	maxLogicalPartitions = 256
+)
+
+// MBR partition types.
+const (
+	MBRTypeExtended      = 0x05
+	MBRTypeExtendedLBA   = 0x0f
+	MBRTypeLinux         = 0x83
+	MBRTypeLinuxExtended = 0x85
+	MBRTypeLinuxLVM      = 0x8e
+	MBRTypeProtective    = 0xee
+)
+
+type mbrEntry struct {
+	Status   uint8
+	_        [3]byte
+	Type     uint8
+	_        [3]byte
+	StartLBA uint32
+	Sectors  uint32
+}
+
+func (e mbrEntry) used() bool {
+	return e.Type != 0 && e.Sectors != 0
+}
+
+func (e mbrEntry) extended() bool {
+	return e.Type == MBRTypeExtended || e.Type == MBRTypeExtendedLBA || e.Type == MBRTypeLinuxExtended
+}
+
+// mbr is a master or extended boot record.
+type mbr struct {
+	entries [4]mbrEntry
+}
+
+// readMBR reads the boot record at byte offset off. ErrNoPartitionTable is
+// returned when it has no boot signature.
+func readMBR(r io.ReaderAt, off int64) (*mbr, error) {
+	b := make([]byte, mbrSectorSize)
+	if err := readSectors(r, b, off); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint16(b[mbrSignatureOffset:]) != mbrSignature {
+		return nil, ErrNoPartitionTable
+	}
+	m := &mbr{}
+	if err := binary.Read(bytes.NewReader(b[mbrEntriesOffset:mbrSignatureOffset]), binary.LittleEndian, &m.entries); err != nil {
+		return nil, xerrors.Errorf("failed to parse partition entries: %w", err)
+	}
+	return m, nil
+}
+
+// protective reports whether the MBR only protects a GPT.
+func (m *mbr) protective() bool {
+	for _, e := range m.entries {
+		if e.Type == MBRTypeProtective {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mbr) disk(r io.ReaderAt) (*Disk, error) {
+	d := &Disk{Scheme: SchemeMBR, SectorSize: mbrSectorSize}
+	next := 5
+	for i, e := range m.entries {
+		if !e.used() {
+			continue
+		}
+		if !e.extended() {
+			d.Partitions = append(d.Partitions, mbrPartition(r, i+1, 0, e))
+			continue
+		}
+		logical, err := readLogicalPartitions(r, e.StartLBA, next)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read logical partitions of partition %d: %w", i+1, err)
+		}
+		d.Partitions = append(d.Partitions, logical...)
+		next += len(logical)
+	}
+	return d, nil
+}
+
+// readLogicalPartitions follows the chain of extended boot records of the
+// extended partition starting at sector start. The first entry of each
+// record is a logical partition relative to the record, the second one
+// links to the next record relative to the extended partition.
+func readLogicalPartitions(r io.ReaderAt, start uint32, index int) ([]Partition, error) {
+	var parts []Partition
+	seen := map[uint32]bool{}
+	ebr := start
+	for i := 0; i < maxLogicalPartitions; i++ {
+		if seen[ebr] {
+			return nil, xerrors.Errorf("extended boot record at sector %d loops", ebr)
+		}
+		seen[ebr] = true
+
+		m, err := readMBR(r, int64(ebr)*mbrSectorSize)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read extended boot record at sector %d: %w", ebr, err)
+		}
+		if e := m.entries[0]; e.used() {
+			parts = append(parts, mbrPartition(r, index+len(parts), ebr, e))
+		}
+		link := m.entries[1]
+		if !link.used() || !link.extended() {
+			return parts, nil
+		}
+		ebr = start + link.StartLBA
+	}
+	return nil, xerrors.Errorf("more than %d logical partitions", maxLogicalPartitions)
+}
+
+// mbrPartition returns the partition of entry e, whose start is relative
+// to sector base.
+func mbrPartition(r io.ReaderAt, index int, base uint32, e mbrEntry) Partition {
+	return Partition{
+		Index:    index,
+		Offset:   (int64(base) + int64(e.StartLBA)) * mbrSectorSize,
+		Size:     int64(e.Sectors) * mbrSectorSize,
+		Type:     e.Type,
+		Bootable: e.Status&0x80 != 0,
+		r:        r,
+	}
+}
@@ -0,0 +1,92 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+const testDiskSize = 8 << 20
+
+// writeBootRecord writes a boot record with entries at sector lba.
+func writeBootRecord(img []byte, lba int64, entries ...mbrEntry) {
+	b := img[lba*mbrSectorSize:]
+	for i, e := range entries {
+		buf := &bytes.Buffer{}
+		binary.Write(buf, binary.LittleEndian, e)
+		copy(b[mbrEntriesOffset+16*i:], buf.Bytes())
+	}
+	binary.LittleEndian.PutUint16(b[mbrSignatureOffset:], mbrSignature)
+}
+
+// writeExtMagic makes the partition at byte offset off look like an ext
+// filesystem to ext4.Check.
+func writeExtMagic(img []byte, off int64) {
+	binary.LittleEndian.PutUint16(img[off+1024+56:], 0xef53)
+}
+
+// clearPartitions drops the readers so that partitions can be compared.
+func clearPartitions(parts []Partition) []Partition {
+	for i := range parts {
+		parts[i].r = nil
+	}
+	return parts
+}
+
+func TestOpenMBR(t *testing.T) {
+	img := make([]byte, testDiskSize)
+	writeBootRecord(img, 0,
+		mbrEntry{Status: 0x80, Type: MBRTypeLinux, StartLBA: 64, Sectors: 1024},
+		mbrEntry{Type: MBRTypeExtended, StartLBA: 2048, Sectors: 4096},
+	)
+	writeBootRecord(img, 2048,
+		mbrEntry{Type: MBRTypeLinux, StartLBA: 32, Sectors: 1000},
+		mbrEntry{Type: MBRTypeExtended, StartLBA: 1024, Sectors: 600},
+	)
+	writeBootRecord(img, 3072, mbrEntry{Type: MBRTypeLinuxLVM, StartLBA: 32, Sectors: 500})
+	writeExtMagic(img, 64*mbrSectorSize)
+
+	d, err := Open(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if d.Scheme != SchemeMBR || d.SectorSize != mbrSectorSize {
+		t.Errorf("Open() scheme = %s, sector size = %d", d.Scheme, d.SectorSize)
+	}
+	want := []Partition{
+		{Index: 1, Offset: 64 * 512, Size: 1024 * 512, Type: MBRTypeLinux, Bootable: true},
+		{Index: 5, Offset: (2048 + 32) * 512, Size: 1000 * 512, Type: MBRTypeLinux},
+		{Index: 6, Offset: (3072 + 32) * 512, Size: 500 * 512, Type: MBRTypeLinuxLVM},
+	}
+	ext := d.ExtPartitions()
+	if got := clearPartitions(d.Partitions); !reflect.DeepEqual(got, want) {
+		t.Errorf("Partitions = %+v, want %+v", got, want)
+	}
+	if len(ext) != 1 || ext[0].Index != 1 {
+		t.Errorf("ExtPartitions() = %+v, want partition 1", ext)
+	}
+}
+
+func TestOpenMBRLoop(t *testing.T) {
+	img := make([]byte, testDiskSize)
+	writeBootRecord(img, 0, mbrEntry{Type: MBRTypeExtendedLBA, StartLBA: 2048, Sectors: 4096})
+	writeBootRecord(img, 2048,
+		mbrEntry{Type: MBRTypeLinux, StartLBA: 32, Sectors: 100},
+		mbrEntry{Type: MBRTypeExtended, StartLBA: 0, Sectors: 4096},
+	)
+	if _, err := Open(bytes.NewReader(img), int64(len(img))); err == nil {
+		t.Error("Open() of a looping extended partition succeeded")
+	}
+}
+
+func TestOpenNoPartitionTable(t *testing.T) {
+	img := make([]byte, testDiskSize)
+	writeExtMagic(img, 0)
+	_, err := Open(bytes.NewReader(img), int64(len(img)))
+	if !xerrors.Is(err, ErrNoPartitionTable) {
+		t.Errorf("Open() error = %v, want ErrNoPartitionTable", err)
+	}
+}
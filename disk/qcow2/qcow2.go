@@ -0,0 +1,389 @@
+// Package qcow2 reads QEMU copy-on-write images, versions 2 and 3, as the
+// raw disk they hold. Backing files are opened by the caller, and
+// compressed clusters are inflated on read.
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+const magic = 0x514649fb // "QFI\xfb"
+
+const (
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	// l1OffsetMask and l2OffsetMask extract the host offsets of L1 and
+	// standard L2 entries.
+	l1OffsetMask = 0x00fffffffffffe00
+	l2OffsetMask = 0x00fffffffffffe00
+	// l2Compressed marks a compressed cluster descriptor.
+	l2Compressed = 1 << 62
+	// l2Zero marks a cluster reading as zeros, in version 3.
+	l2Zero = 1
+
+	compressedSectorSize = 512
+
+	// maxCachedTables bounds the number of L2 tables kept in memory.
+	maxCachedTables = 64
+	// maxL1Size is the largest L1 table QEMU accepts, in bytes.
+	maxL1Size = 32 << 20
+	// maxBackingFileSize is the longest backing file name QEMU accepts.
+	maxBackingFileSize = 1023
+)
+
+// Incompatible features.
+const (
+	IncompatDirty           = 1 << 0
+	IncompatCorrupt         = 1 << 1
+	IncompatExternalData    = 1 << 2
+	IncompatCompressionType = 1 << 3
+	IncompatExtendedL2      = 1 << 4
+)
+
+// ErrBackingFileRequired is returned by Open when the image has a backing
+// file and none was supplied with WithBackingFile.
+var ErrBackingFileRequired = xerrors.New("backing file required")
+
+// Header is the header of a qcow2 image.
+type Header struct {
+	Version     uint32
+	ClusterBits uint32
+	// Size is the virtual size of the image in bytes.
+	Size uint64
+	// BackingFile is the name of the backing file, empty when the image
+	// has none.
+	BackingFile          string
+	CryptMethod          uint32
+	L1Size               uint32
+	L1TableOffset        uint64
+	IncompatibleFeatures uint64
+	CompressionType      uint8
+}
+
+// rawHeader is the on-disk header. Version 2 images end at
+// IncompatibleFeatures.
+type rawHeader struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	IncompatibleFeatures  uint64
+	CompatibleFeatures    uint64
+	AutoclearFeatures     uint64
+	RefcountOrder         uint32
+	HeaderLength          uint32
+	CompressionType       uint8
+}
+
+// v2HeaderLength is the length of a version 2 header, and
+// compressionTypeOffset the offset of the compression type in version 3.
+const (
+	v2HeaderLength        = 72
+	compressionTypeOffset = 104
+)
+
+// ReadHeader reads the header of the qcow2 image r.
+func ReadHeader(r io.ReaderAt) (*Header, error) {
+	b := make([]byte, compressionTypeOffset+1)
+	n, err := r.ReadAt(b, 0)
+	if n < v2HeaderLength {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, xerrors.Errorf("failed to read header: %w", err)
+	}
+	var raw rawHeader
+	// The bytes of a short version 2 header past its end read as zeros.
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &raw); err != nil {
+		return nil, xerrors.Errorf("failed to parse header: %w", err)
+	}
+	if raw.Magic != magic {
+		return nil, xerrors.Errorf("invalid magic %#x", raw.Magic)
+	}
+	h := &Header{
+		Version:       raw.Version,
+		ClusterBits:   raw.ClusterBits,
+		Size:          raw.Size,
+		CryptMethod:   raw.CryptMethod,
+		L1Size:        raw.L1Size,
+		L1TableOffset: raw.L1TableOffset,
+	}
+	switch raw.Version {
+	case 2:
+	case 3:
+		h.IncompatibleFeatures = raw.IncompatibleFeatures
+		if raw.HeaderLength > compressionTypeOffset {
+			h.CompressionType = raw.CompressionType
+		}
+	default:
+		return nil, xerrors.Errorf("unsupported version %d", raw.Version)
+	}
+	if raw.ClusterBits < minClusterBits || raw.ClusterBits > maxClusterBits {
+		return nil, xerrors.Errorf("invalid cluster bits %d", raw.ClusterBits)
+	}
+
+	if raw.BackingFileOffset != 0 {
+		// As in QEMU, the name lies in the first cluster.
+		clusterSize := uint64(1) << raw.ClusterBits
+		if raw.BackingFileOffset > clusterSize {
+			return nil, xerrors.Errorf("invalid backing file offset %d", raw.BackingFileOffset)
+		}
+		if raw.BackingFileSize > maxBackingFileSize || uint64(raw.BackingFileSize) > clusterSize-raw.BackingFileOffset {
+			return nil, xerrors.Errorf("backing file name of %d bytes is too long", raw.BackingFileSize)
+		}
+		name := make([]byte, raw.BackingFileSize)
+		if _, err := r.ReadAt(name, int64(raw.BackingFileOffset)); err != nil {
+			return nil, xerrors.Errorf("failed to read backing file name: %w", err)
+		}
+		h.BackingFile = string(name)
+	}
+	return h, nil
+}
+
+// Option configures an Image opened by Open.
+type Option func(*Image)
+
+// WithBackingFile supplies the backing file of the image, itself possibly
+// an *Image. The clusters not allocated in the image are read from it.
+func WithBackingFile(r io.ReaderAt) Option {
+	return func(img *Image) {
+		img.backing = r
+	}
+}
+
+// Image is a qcow2 image read as the disk it holds. It implements
+// io.ReaderAt and is safe for concurrent use.
+type Image struct {
+	r       io.ReaderAt
+	header  *Header
+	backing io.ReaderAt
+
+	clusterSize int64
+	l2Entries   int64
+	l1          []uint64
+
+	mu sync.Mutex
+	// l2 caches the L2 tables by host offset.
+	l2 map[uint64][]uint64
+	// compressed caches the last decompressed cluster.
+	compressedOffset uint64
+	compressed       []byte
+}
+
+// Open opens the qcow2 image r. Compressed clusters are read with the
+// default zlib compression type, a raw deflate stream. Encrypted images,
+// images with an external data file, extended L2 entries or zstd
+// compression are not supported.
+func Open(r io.ReaderAt, opts ...Option) (*Image, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{
+		r:           r,
+		header:      h,
+		clusterSize: 1 << h.ClusterBits,
+		l2Entries:   1 << (h.ClusterBits - 3),
+		l2:          map[uint64][]uint64{},
+	}
+	for _, opt := range opts {
+		opt(img)
+	}
+
+	if h.CryptMethod != 0 {
+		return nil, xerrors.Errorf("encrypted images are not supported")
+	}
+	if f := h.IncompatibleFeatures &^ (IncompatDirty | IncompatCorrupt | IncompatCompressionType); f != 0 {
+		return nil, xerrors.Errorf("unsupported incompatible features %#x", f)
+	}
+	if h.CompressionType != 0 {
+		return nil, xerrors.Errorf("unsupported compression type %d", h.CompressionType)
+	}
+	if h.BackingFile != "" && img.backing == nil {
+		return nil, xerrors.Errorf("%w: %s", ErrBackingFileRequired, h.BackingFile)
+	}
+
+	if 8*int64(h.L1Size) > maxL1Size {
+		return nil, xerrors.Errorf("L1 table of %d entries is too large", h.L1Size)
+	}
+	// The L1 table must cover the virtual size.
+	clusters := (int64(h.Size) + img.clusterSize - 1) / img.clusterSize
+	if need := (clusters + img.l2Entries - 1) / img.l2Entries; int64(h.L1Size) < need {
+		return nil, xerrors.Errorf("L1 table of %d entries is too small for %d clusters", h.L1Size, clusters)
+	}
+	b := make([]byte, 8*int64(h.L1Size))
+	if _, err := r.ReadAt(b, int64(h.L1TableOffset)); err != nil {
+		return nil, xerrors.Errorf("failed to read L1 table: %w", err)
+	}
+	img.l1 = make([]uint64, h.L1Size)
+	for i := range img.l1 {
+		img.l1[i] = binary.BigEndian.Uint64(b[8*i:])
+	}
+	return img, nil
+}
+
+// Header returns the header of the image.
+func (img *Image) Header() Header {
+	return *img.header
+}
+
+// Size returns the virtual size of the image.
+func (img *Image) Size() int64 {
+	return int64(img.header.Size)
+}
+
+// ReadAt reads the virtual disk at off.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, xerrors.Errorf("negative offset %d", off)
+	}
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= img.Size() {
+			return n, io.EOF
+		}
+		inCluster := pos % img.clusterSize
+		chunk := p[n:]
+		if rest := img.clusterSize - inCluster; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if rest := img.Size() - pos; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if err := img.readCluster(chunk, pos/img.clusterSize, inCluster); err != nil {
+			return n, xerrors.Errorf("failed to read at %#x: %w", pos, err)
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// readCluster fills p from cluster at offset off in it.
+func (img *Image) readCluster(p []byte, cluster, off int64) error {
+	entry, err := img.l2Entry(cluster)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry&l2Compressed != 0:
+		data, err := img.decompress(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, data[off:])
+		return nil
+	case img.header.Version >= 3 && entry&l2Zero != 0:
+		zero(p)
+		return nil
+	case entry&l2OffsetMask == 0:
+		return img.readBacking(p, cluster*img.clusterSize+off)
+	}
+	_, err = img.r.ReadAt(p, int64(entry&l2OffsetMask)+off)
+	return err
+}
+
+// l2Entry returns the L2 entry of cluster, zero when its L2 table is not
+// allocated.
+func (img *Image) l2Entry(cluster int64) (uint64, error) {
+	l1Index := cluster / img.l2Entries
+	if l1Index >= int64(len(img.l1)) {
+		return 0, xerrors.Errorf("cluster %d is past the L1 table", cluster)
+	}
+	tableOffset := img.l1[l1Index] & l1OffsetMask
+	if tableOffset == 0 {
+		return 0, nil
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	table, ok := img.l2[tableOffset]
+	if !ok {
+		b := make([]byte, img.clusterSize)
+		if _, err := img.r.ReadAt(b, int64(tableOffset)); err != nil {
+			return 0, xerrors.Errorf("failed to read L2 table at %#x: %w", tableOffset, err)
+		}
+		table = make([]uint64, img.l2Entries)
+		for i := range table {
+			table[i] = binary.BigEndian.Uint64(b[8*i:])
+		}
+		if len(img.l2) >= maxCachedTables {
+			img.l2 = map[uint64][]uint64{}
+		}
+		img.l2[tableOffset] = table
+	}
+	return table[cluster%img.l2Entries], nil
+}
+
+// decompress returns the content of the compressed cluster of entry. The
+// descriptor holds the host offset in its low bits and the number of
+// additional 512-byte sectors the compressed data spans above them.
+func (img *Image) decompress(entry uint64) ([]byte, error) {
+	offsetBits := 62 - (img.header.ClusterBits - 8)
+	offset := entry & (1<<offsetBits - 1)
+	sectors := (entry&(l2Compressed-1))>>offsetBits + 1
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.compressed != nil && img.compressedOffset == offset {
+		return img.compressed, nil
+	}
+
+	size := int64(sectors*compressedSectorSize - offset%compressedSectorSize)
+	b := make([]byte, size)
+	// The compressed data may end before the last sector does, at the end
+	// of the file.
+	n, err := img.r.ReadAt(b, int64(offset))
+	if err != nil && !(err == io.EOF && n > 0) {
+		return nil, xerrors.Errorf("failed to read compressed cluster at %#x: %w", offset, err)
+	}
+	data := make([]byte, img.clusterSize)
+	fr := flate.NewReader(bytes.NewReader(b[:n]))
+	defer fr.Close()
+	if _, err := io.ReadFull(fr, data); err != nil {
+		return nil, xerrors.Errorf("failed to decompress cluster at %#x: %w", offset, err)
+	}
+	img.compressedOffset = offset
+	img.compressed = data
+	return data, nil
+}
+
+// readBacking fills p from the backing file at off. The part of p past the
+// end of the backing file, or all of it without one, reads as zeros.
+func (img *Image) readBacking(p []byte, off int64) error {
+	if img.backing == nil {
+		zero(p)
+		return nil
+	}
+	n, err := img.backing.ReadAt(p, off)
+	if err == io.EOF {
+		zero(p[n:])
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to read backing file: %w", err)
+	}
+	return nil
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
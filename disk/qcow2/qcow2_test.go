@@ -0,0 +1,156 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	testClusterBits = 12
+	testClusterSize = 1 << testClusterBits
+	// testSize ends in the middle of the last cluster.
+	testSize = 8*testClusterSize - 1000
+)
+
+// Layout of the images built by buildImage:
+//
+//	cluster 0  header and backing file name
+//	cluster 1  L1 table
+//	cluster 2  L2 table
+//	cluster 3  data of virtual cluster 0
+//	cluster 4  garbage behind the zero cluster 1 (version 3)
+//	cluster 5  compressed data of virtual cluster 2, unaligned
+//	           virtual cluster 3 and up are unallocated
+func buildImage(t *testing.T, version uint32, backing string) (image, want []byte) {
+	t.Helper()
+	image = make([]byte, 6*testClusterSize)
+	want = make([]byte, testSize)
+
+	h := rawHeader{
+		Magic:         magic,
+		Version:       version,
+		ClusterBits:   testClusterBits,
+		Size:          testSize,
+		L1Size:        1,
+		L1TableOffset: testClusterSize,
+		RefcountOrder: 4,
+		HeaderLength:  compressionTypeOffset,
+	}
+	if backing != "" {
+		h.BackingFileOffset = 512
+		h.BackingFileSize = uint32(len(backing))
+		copy(image[512:], backing)
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, h)
+	copy(image, buf.Bytes())
+	binary.BigEndian.PutUint64(image[testClusterSize:], 2*testClusterSize|1<<63)
+	l2 := image[2*testClusterSize:]
+
+	data := bytes.Repeat([]byte("data"), testClusterSize/4)
+	copy(image[3*testClusterSize:], data)
+	binary.BigEndian.PutUint64(l2, 3*testClusterSize|1<<63)
+	copy(want, data)
+
+	if version >= 3 {
+		copy(image[4*testClusterSize:], bytes.Repeat([]byte{0xff}, testClusterSize))
+		binary.BigEndian.PutUint64(l2[8:], 4*testClusterSize|l2Zero)
+	}
+
+	compressed := bytes.Repeat([]byte("compressed"), testClusterSize/10+1)[:testClusterSize]
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fw.Write(compressed)
+	fw.Close()
+	off := uint64(5*testClusterSize + 100)
+	copy(image[off:], deflated.Bytes())
+	sectors := (off%compressedSectorSize + uint64(deflated.Len()) + compressedSectorSize - 1) / compressedSectorSize
+	offsetBits := 62 - (testClusterBits - 8)
+	binary.BigEndian.PutUint64(l2[16:], l2Compressed|(sectors-1)<<offsetBits|off)
+	copy(want[2*testClusterSize:], compressed)
+	return image, want
+}
+
+func TestImage(t *testing.T) {
+	for _, version := range []uint32{2, 3} {
+		image, want := buildImage(t, version, "")
+		img, err := Open(bytes.NewReader(image))
+		if err != nil {
+			t.Fatalf("Open() of version %d error: %v", version, err)
+		}
+		if img.Size() != testSize {
+			t.Errorf("Size() = %d, want %d", img.Size(), testSize)
+		}
+		got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+		if err != nil {
+			t.Fatalf("ReadAll() of version %d error: %v", version, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("content of version %d differs", version)
+		}
+
+		// A read across clusters, stopping at the end of the disk.
+		p := make([]byte, 2*testClusterSize)
+		n, err := img.ReadAt(p, testSize-testClusterSize)
+		if n != testClusterSize || err != io.EOF {
+			t.Errorf("ReadAt() at the end = %d, %v, want %d, EOF", n, err, testClusterSize)
+		}
+	}
+}
+
+func TestReadHeaderBackingFileBounds(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset uint64
+		size   uint32
+	}{
+		{name: "offset past the first cluster", offset: testClusterSize + 1, size: 4},
+		{name: "name too long", offset: 512, size: maxBackingFileSize + 1},
+		{name: "name past the first cluster", offset: testClusterSize - 8, size: 9},
+		{name: "huge name", offset: 512, size: 0xFFFFFFFF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, _ := buildImage(t, 3, "base.qcow2")
+			binary.BigEndian.PutUint64(image[8:], tt.offset)
+			binary.BigEndian.PutUint32(image[16:], tt.size)
+			if _, err := ReadHeader(bytes.NewReader(image)); err == nil {
+				t.Error("ReadHeader() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestImageBackingFile(t *testing.T) {
+	image, want := buildImage(t, 3, "base.qcow2")
+	if _, err := Open(bytes.NewReader(image)); !xerrors.Is(err, ErrBackingFileRequired) {
+		t.Fatalf("Open() without the backing file error = %v, want ErrBackingFileRequired", err)
+	}
+	h, err := ReadHeader(bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("ReadHeader() error: %v", err)
+	}
+	if h.BackingFile != "base.qcow2" {
+		t.Errorf("BackingFile = %q, want base.qcow2", h.BackingFile)
+	}
+
+	// The backing file is shorter than the image, the rest reads as zeros.
+	backing := bytes.Repeat([]byte{'b'}, 5*testClusterSize)
+	img, err := Open(bytes.NewReader(image), WithBackingFile(bytes.NewReader(backing)))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	copy(want[3*testClusterSize:], backing[3*testClusterSize:])
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatalf("ReadAll() error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("content with a backing file differs")
+	}
+}
@@ -0,0 +1,259 @@
+// Package simg reads Android sparse images, such as system and vendor
+// images of firmware packages, as the raw image they expand to. The chunk
+// list is indexed once when the image is opened; reads are served from the
+// chunks without expanding the image.
+package simg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+const magic = 0xed26ff3a
+
+const (
+	majorVersion = 1
+
+	fileHeaderSize  = 28
+	chunkHeaderSize = 12
+
+	// maxBlockSize is far above the 4KiB blocks real images use.
+	maxBlockSize = 64 << 20
+)
+
+// Chunk types.
+const (
+	ChunkRaw      = 0xcac1
+	ChunkFill     = 0xcac2
+	ChunkDontCare = 0xcac3
+	ChunkCRC32    = 0xcac4
+)
+
+// Header is the header of a sparse image.
+type Header struct {
+	MajorVersion uint16
+	MinorVersion uint16
+	// BlockSize is the size of the blocks chunks are made of.
+	BlockSize uint32
+	// TotalBlocks is the number of blocks of the expanded image.
+	TotalBlocks   uint32
+	TotalChunks   uint32
+	ImageChecksum uint32
+}
+
+type rawHeader struct {
+	Magic           uint32
+	MajorVersion    uint16
+	MinorVersion    uint16
+	FileHeaderSize  uint16
+	ChunkHeaderSize uint16
+	BlockSize       uint32
+	TotalBlocks     uint32
+	TotalChunks     uint32
+	ImageChecksum   uint32
+}
+
+type chunkHeader struct {
+	Type      uint16
+	_         uint16
+	Blocks    uint32
+	TotalSize uint32
+}
+
+// chunk is a chunk covering blocks of the expanded image, from byte offset
+// start.
+type chunk struct {
+	typ   uint16
+	start int64
+	size  int64
+	// offset is the offset of the data of raw chunks in the file.
+	offset int64
+	fill   [4]byte
+}
+
+// ReadHeader reads the header of the sparse image r.
+func ReadHeader(r io.ReaderAt) (*Header, error) {
+	raw, err := readRawHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return raw.header(), nil
+}
+
+func (h rawHeader) header() *Header {
+	return &Header{
+		MajorVersion:  h.MajorVersion,
+		MinorVersion:  h.MinorVersion,
+		BlockSize:     h.BlockSize,
+		TotalBlocks:   h.TotalBlocks,
+		TotalChunks:   h.TotalChunks,
+		ImageChecksum: h.ImageChecksum,
+	}
+}
+
+func readRawHeader(r io.ReaderAt) (rawHeader, error) {
+	var h rawHeader
+	b := make([]byte, fileHeaderSize)
+	if _, err := r.ReadAt(b, 0); err != nil {
+		return h, xerrors.Errorf("failed to read header: %w", err)
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return h, xerrors.Errorf("failed to parse header: %w", err)
+	}
+	if h.Magic != magic {
+		return h, xerrors.Errorf("invalid magic %#x", h.Magic)
+	}
+	if h.MajorVersion != majorVersion {
+		return h, xerrors.Errorf("unsupported version %d.%d", h.MajorVersion, h.MinorVersion)
+	}
+	if h.FileHeaderSize < fileHeaderSize || h.ChunkHeaderSize < chunkHeaderSize {
+		return h, xerrors.Errorf("invalid header sizes %d and %d", h.FileHeaderSize, h.ChunkHeaderSize)
+	}
+	if h.BlockSize == 0 || h.BlockSize%4 != 0 || h.BlockSize > maxBlockSize {
+		return h, xerrors.Errorf("invalid block size %d", h.BlockSize)
+	}
+	return h, nil
+}
+
+// Image is a sparse image read as the image it expands to. It implements
+// io.ReaderAt and is safe for concurrent use.
+type Image struct {
+	r      io.ReaderAt
+	header *Header
+	size   int64
+	chunks []chunk
+}
+
+// Open opens the sparse image r and indexes its chunks. Don't care chunks
+// read as zeros. The checksums of CRC32 chunks are not verified.
+func Open(r io.ReaderAt) (*Image, error) {
+	raw, err := readRawHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	h := raw.header()
+	img := &Image{r: r, header: h}
+
+	blockSize := int64(h.BlockSize)
+	off := int64(raw.FileHeaderSize)
+	var blocks int64
+	for i := uint32(0); i < h.TotalChunks; i++ {
+		var ch chunkHeader
+		b := make([]byte, chunkHeaderSize)
+		if _, err := r.ReadAt(b, off); err != nil {
+			return nil, xerrors.Errorf("failed to read chunk %d header at %#x: %w", i, off, err)
+		}
+		if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &ch); err != nil {
+			return nil, xerrors.Errorf("failed to parse chunk %d header: %w", i, err)
+		}
+		data := off + int64(raw.ChunkHeaderSize)
+		dataSize := int64(ch.TotalSize) - int64(raw.ChunkHeaderSize)
+
+		c := chunk{typ: ch.Type, start: blocks * blockSize, size: int64(ch.Blocks) * blockSize, offset: data}
+		switch ch.Type {
+		case ChunkRaw:
+			if dataSize != c.size {
+				return nil, xerrors.Errorf("raw chunk %d of %d blocks has %d bytes of data", i, ch.Blocks, dataSize)
+			}
+		case ChunkFill:
+			if dataSize != 4 {
+				return nil, xerrors.Errorf("fill chunk %d has %d bytes of data", i, dataSize)
+			}
+			if _, err := r.ReadAt(c.fill[:], data); err != nil {
+				return nil, xerrors.Errorf("failed to read fill chunk %d: %w", i, err)
+			}
+		case ChunkDontCare:
+			if dataSize != 0 {
+				return nil, xerrors.Errorf("don't care chunk %d has %d bytes of data", i, dataSize)
+			}
+		case ChunkCRC32:
+			if dataSize != 4 || ch.Blocks != 0 {
+				return nil, xerrors.Errorf("invalid CRC32 chunk %d", i)
+			}
+		default:
+			return nil, xerrors.Errorf("chunk %d: unknown type %#x", i, ch.Type)
+		}
+		if c.size > 0 {
+			img.chunks = append(img.chunks, c)
+		}
+		blocks += int64(ch.Blocks)
+		if blocks > int64(h.TotalBlocks) {
+			return nil, xerrors.Errorf("chunk %d ends past the %d blocks of the image", i, h.TotalBlocks)
+		}
+		off = data + dataSize
+	}
+	if blocks != int64(h.TotalBlocks) {
+		return nil, xerrors.Errorf("chunks cover %d blocks of %d", blocks, h.TotalBlocks)
+	}
+	img.size = blocks * blockSize
+	return img, nil
+}
+
+// Header returns the header of the image.
+func (img *Image) Header() Header {
+	return *img.header
+}
+
+// Size returns the size of the expanded image.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// ReadAt reads the expanded image at off.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, xerrors.Errorf("negative offset %d", off)
+	}
+	if off >= img.size {
+		return 0, io.EOF
+	}
+	// The chunk holding off is the last one starting at or before it.
+	i := sort.Search(len(img.chunks), func(i int) bool {
+		return img.chunks[i].start > off
+	}) - 1
+	var n int
+	for ; i < len(img.chunks) && n < len(p); i++ {
+		c := img.chunks[i]
+		pos := off + int64(n)
+		buf := p[n:]
+		if rest := c.start + c.size - pos; int64(len(buf)) > rest {
+			buf = buf[:rest]
+		}
+		if err := c.readAt(img.r, buf, pos); err != nil {
+			return n, xerrors.Errorf("failed to read at %#x: %w", pos, err)
+		}
+		n += len(buf)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readAt fills p from byte offset off of the expanded image, within c.
+func (c chunk) readAt(r io.ReaderAt, p []byte, off int64) error {
+	switch c.typ {
+	case ChunkRaw:
+		_, err := r.ReadAt(p, c.offset+off-c.start)
+		return err
+	case ChunkFill:
+		// Chunks start at a multiple of the block size, itself a multiple
+		// of the size of the fill value.
+		for i := range p {
+			p[i] = c.fill[(off+int64(i))%4]
+		}
+	default:
+		zero(p)
+	}
+	return nil
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
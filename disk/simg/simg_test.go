@@ -0,0 +1,112 @@
+package simg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+const testBlockSize = 4096
+
+// buildImage builds a sparse image, with a file header of headerSize
+// bytes, of the chunks:
+//
+//	blocks 0 and 1  raw
+//	block 2         filled with 0xdeadbeef
+//	blocks 3 to 5   don't care
+//	                CRC32
+//	block 6         raw
+func buildImage(headerSize uint16) (image, want []byte) {
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, rawHeader{
+		Magic:           magic,
+		MajorVersion:    majorVersion,
+		FileHeaderSize:  headerSize,
+		ChunkHeaderSize: chunkHeaderSize,
+		BlockSize:       testBlockSize,
+		TotalBlocks:     7,
+		TotalChunks:     5,
+	})
+	out.Write(make([]byte, headerSize-fileHeaderSize))
+	writeChunk := func(typ uint16, blocks uint32, data []byte) {
+		binary.Write(&out, binary.LittleEndian, chunkHeader{
+			Type:      typ,
+			Blocks:    blocks,
+			TotalSize: uint32(chunkHeaderSize + len(data)),
+		})
+		out.Write(data)
+	}
+
+	raw := make([]byte, 2*testBlockSize)
+	for i := range raw {
+		raw[i] = byte(i / 100)
+	}
+	writeChunk(ChunkRaw, 2, raw)
+	want = append(want, raw...)
+	writeChunk(ChunkFill, 1, []byte{0xef, 0xbe, 0xad, 0xde})
+	want = append(want, bytes.Repeat([]byte{0xef, 0xbe, 0xad, 0xde}, testBlockSize/4)...)
+	writeChunk(ChunkDontCare, 3, nil)
+	want = append(want, make([]byte, 3*testBlockSize)...)
+	writeChunk(ChunkCRC32, 0, []byte{1, 2, 3, 4})
+	last := bytes.Repeat([]byte{'z'}, testBlockSize)
+	writeChunk(ChunkRaw, 1, last)
+	want = append(want, last...)
+	return out.Bytes(), want
+}
+
+func TestOpen(t *testing.T) {
+	for _, headerSize := range []uint16{fileHeaderSize, fileHeaderSize + 4} {
+		image, want := buildImage(headerSize)
+		img, err := Open(bytes.NewReader(image))
+		if err != nil {
+			t.Fatalf("Open() error: %v", err)
+		}
+		if h := img.Header(); h.BlockSize != testBlockSize || h.TotalChunks != 5 {
+			t.Errorf("Header() = %+v", h)
+		}
+		if img.Size() != int64(len(want)) {
+			t.Errorf("Size() = %d, want %d", img.Size(), len(want))
+		}
+		got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+		if err != nil {
+			t.Fatalf("ReadAll() error: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("header of %d bytes: content differs", headerSize)
+		}
+
+		// Reads across chunks, from an offset unaligned to the fill value.
+		for _, off := range []int64{2*testBlockSize - 3, 3*testBlockSize - 1, 6*testBlockSize - 10} {
+			p := make([]byte, 20)
+			if _, err := img.ReadAt(p, off); err != nil {
+				t.Fatalf("ReadAt(%d) error: %v", off, err)
+			}
+			if !bytes.Equal(p, want[off:off+20]) {
+				t.Errorf("ReadAt(%d) = %x, want %x", off, p, want[off:off+20])
+			}
+		}
+		if n, err := img.ReadAt(make([]byte, 20), img.Size()-10); n != 10 || err != io.EOF {
+			t.Errorf("ReadAt() at the end = %d, %v, want 10, EOF", n, err)
+		}
+		if _, err := img.ReadAt(make([]byte, 1), img.Size()); err != io.EOF {
+			t.Errorf("ReadAt() past the end error = %v, want EOF", err)
+		}
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	image, _ := buildImage(fileHeaderSize)
+	for name, corrupt := range map[string]func(b []byte){
+		"magic":        func(b []byte) { b[0] = 0 },
+		"total blocks": func(b []byte) { binary.LittleEndian.PutUint32(b[16:], 8) },
+		"chunk type":   func(b []byte) { binary.LittleEndian.PutUint16(b[fileHeaderSize:], 0xcaff) },
+		"raw size":     func(b []byte) { binary.LittleEndian.PutUint32(b[fileHeaderSize+8:], chunkHeaderSize+testBlockSize) },
+	} {
+		b := append([]byte(nil), image...)
+		corrupt(b)
+		if _, err := Open(bytes.NewReader(b)); err == nil {
+			t.Errorf("%s: Open() succeeded", name)
+		}
+	}
+}
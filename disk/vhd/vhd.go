@@ -0,0 +1,491 @@
+// Package vhd reads Hyper-V virtual disks, VHD and VHDX, as the raw disk
+// they hold. Fixed, dynamic and differencing disks are supported; the
+// parent of a differencing disk is opened by the caller.
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"unicode/utf16"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrParentRequired is returned by Open when the disk is a differencing
+// disk and its parent was not supplied with WithParent.
+var ErrParentRequired = xerrors.New("parent disk required")
+
+// Format is the format of a virtual disk file.
+type Format string
+
+const (
+	FormatVHD  Format = "vhd"
+	FormatVHDX Format = "vhdx"
+)
+
+// Type is the type of a virtual disk.
+type Type int
+
+const (
+	TypeFixed Type = iota + 1
+	TypeDynamic
+	TypeDifferencing
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeFixed:
+		return "fixed"
+	case TypeDynamic:
+		return "dynamic"
+	case TypeDifferencing:
+		return "differencing"
+	}
+	return "unknown"
+}
+
+// Info describes a virtual disk.
+type Info struct {
+	Format Format
+	Type   Type
+	// Size is the size of the virtual disk in bytes.
+	Size int64
+	// ParentPaths are the paths of the parent of a differencing disk
+	// recorded in the file, most specific first: relative paths, then
+	// absolute ones.
+	ParentPaths []string
+}
+
+// format reads the content of a disk.
+type format interface {
+	info() *Info
+	// readAt fills p from off, within the size of the disk. Ranges stored
+	// in the parent are read from parent.
+	readAt(p []byte, off int64, parent io.ReaderAt) error
+}
+
+// Option configures an Image opened by Open.
+type Option func(*Image)
+
+// WithParent supplies the parent of a differencing disk, itself possibly
+// an *Image.
+func WithParent(r io.ReaderAt) Option {
+	return func(img *Image) {
+		img.parent = r
+	}
+}
+
+// Image is a VHD or VHDX disk. It implements io.ReaderAt and is safe for
+// concurrent use.
+type Image struct {
+	format
+	parent io.ReaderAt
+}
+
+// ReadInfo reads the description of the VHD or VHDX disk r of size bytes,
+// to find its parent before opening it.
+func ReadInfo(r io.ReaderAt, size int64) (*Info, error) {
+	f, err := openFormat(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return f.info(), nil
+}
+
+// Open opens the VHD or VHDX disk r of size bytes. The log of a VHDX disk
+// is replayed in memory; the file is not modified.
+func Open(r io.ReaderAt, size int64, opts ...Option) (*Image, error) {
+	f, err := openFormat(r, size)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{format: f}
+	for _, opt := range opts {
+		opt(img)
+	}
+	if info := f.info(); info.Type == TypeDifferencing && img.parent == nil {
+		name := ""
+		if len(info.ParentPaths) > 0 {
+			name = info.ParentPaths[0]
+		}
+		return nil, xerrors.Errorf("%w: %s", ErrParentRequired, name)
+	}
+	return img, nil
+}
+
+func openFormat(r io.ReaderAt, size int64) (format, error) {
+	sig := make([]byte, len(vhdxSignature))
+	if _, err := r.ReadAt(sig, 0); err != nil && err != io.EOF {
+		return nil, xerrors.Errorf("failed to read signature: %w", err)
+	}
+	if string(sig) == vhdxSignature {
+		return openVHDX(r)
+	}
+	return openVHD(r, size)
+}
+
+// Info returns the description of the disk.
+func (img *Image) Info() Info {
+	return *img.info()
+}
+
+// Size returns the size of the disk.
+func (img *Image) Size() int64 {
+	return img.info().Size
+}
+
+// ReadAt reads the disk at off.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, xerrors.Errorf("negative offset %d", off)
+	}
+	if off >= img.Size() {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if rest := img.Size() - off; int64(n) > rest {
+		n = int(rest)
+	}
+	if err := img.readAt(p[:n], off, img.parent); err != nil {
+		return 0, xerrors.Errorf("failed to read at %#x: %w", off, err)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+const (
+	sectorSize      = 512
+	footerSize      = 512
+	footerCookie    = "conectix"
+	dynamicCookie   = "cxsparse"
+	unusedBATEntry  = 0xffffffff
+	vhdDiskFixed    = 2
+	vhdDiskDynamic  = 3
+	vhdDiskDiff     = 4
+	maxVHDBlockSize = 256 << 20
+	// maxCachedBitmaps bounds the number of sector bitmaps kept in memory.
+	maxCachedBitmaps = 64
+)
+
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      uint32
+	OriginalSize       uint64
+	CurrentSize        uint64
+	DiskGeometry       uint32
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	_                  [427]byte
+}
+
+type vhdParentLocator struct {
+	PlatformCode       [4]byte
+	PlatformDataSpace  uint32
+	PlatformDataLength uint32
+	_                  uint32
+	PlatformDataOffset uint64
+}
+
+type vhdDynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueID    [16]byte
+	ParentTimeStamp   uint32
+	_                 uint32
+	ParentUnicodeName [256]uint16
+	ParentLocators    [8]vhdParentLocator
+	_                 [256]byte
+}
+
+// vhdChecksum returns the one's complement of the sum of the bytes of a
+// structure, without its checksum field at checksumOffset.
+func vhdChecksum(b []byte, checksumOffset int) uint32 {
+	var sum uint32
+	for i, c := range b {
+		if i >= checksumOffset && i < checksumOffset+4 {
+			continue
+		}
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+// vhd is a VHD disk. Fixed disks are their data followed by the footer;
+// dynamic and differencing disks have a copy of the footer at the start,
+// then a header and a block allocation table locating the blocks, each a
+// bitmap of the sectors present followed by the sectors.
+type vhd struct {
+	r      io.ReaderAt
+	footer vhdFooter
+	header vhdDynamicHeader
+	desc   Info
+
+	bat        []uint32
+	blockSize  int64
+	bitmapSize int64
+
+	mu      sync.Mutex
+	bitmaps map[uint32][]byte
+}
+
+func readVHDFooter(r io.ReaderAt, off int64) (vhdFooter, error) {
+	var f vhdFooter
+	b := make([]byte, footerSize)
+	if _, err := r.ReadAt(b, off); err != nil {
+		return f, xerrors.Errorf("failed to read footer at %#x: %w", off, err)
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &f); err != nil {
+		return f, xerrors.Errorf("failed to parse footer: %w", err)
+	}
+	if string(f.Cookie[:]) != footerCookie {
+		return f, xerrors.Errorf("invalid footer cookie %q at %#x", f.Cookie[:], off)
+	}
+	if sum := vhdChecksum(b, 64); sum != f.Checksum {
+		return f, xerrors.Errorf("footer at %#x: checksum %#x, want %#x", off, sum, f.Checksum)
+	}
+	return f, nil
+}
+
+func openVHD(r io.ReaderAt, size int64) (*vhd, error) {
+	footer, err := readVHDFooter(r, size-footerSize)
+	if err != nil {
+		// Dynamic disks have a copy of the footer at the start.
+		copyFooter, copyErr := readVHDFooter(r, 0)
+		if copyErr != nil {
+			return nil, err
+		}
+		footer = copyFooter
+	}
+	v := &vhd{r: r, footer: footer, bitmaps: map[uint32][]byte{}}
+	v.desc = Info{Format: FormatVHD, Size: int64(footer.CurrentSize)}
+	if v.desc.Size <= 0 {
+		return nil, xerrors.Errorf("invalid disk size %d", footer.CurrentSize)
+	}
+
+	switch footer.DiskType {
+	case vhdDiskFixed:
+		v.desc.Type = TypeFixed
+		if v.desc.Size > size-footerSize {
+			return nil, xerrors.Errorf("fixed disk of %d bytes in a file of %d bytes", v.desc.Size, size)
+		}
+		return v, nil
+	case vhdDiskDynamic:
+		v.desc.Type = TypeDynamic
+	case vhdDiskDiff:
+		v.desc.Type = TypeDifferencing
+	default:
+		return nil, xerrors.Errorf("unsupported disk type %d", footer.DiskType)
+	}
+
+	b := make([]byte, binary.Size(vhdDynamicHeader{}))
+	if _, err := r.ReadAt(b, int64(footer.DataOffset)); err != nil {
+		return nil, xerrors.Errorf("failed to read dynamic disk header: %w", err)
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.BigEndian, &v.header); err != nil {
+		return nil, xerrors.Errorf("failed to parse dynamic disk header: %w", err)
+	}
+	h := v.header
+	if string(h.Cookie[:]) != dynamicCookie {
+		return nil, xerrors.Errorf("invalid dynamic disk header cookie %q", h.Cookie[:])
+	}
+	if sum := vhdChecksum(b, 36); sum != h.Checksum {
+		return nil, xerrors.Errorf("dynamic disk header: checksum %#x, want %#x", sum, h.Checksum)
+	}
+	if h.BlockSize == 0 || h.BlockSize%sectorSize != 0 || h.BlockSize > maxVHDBlockSize {
+		return nil, xerrors.Errorf("invalid block size %d", h.BlockSize)
+	}
+	v.blockSize = int64(h.BlockSize)
+	sectors := v.blockSize / sectorSize
+	v.bitmapSize = (sectors/8 + sectorSize - 1) / sectorSize * sectorSize
+	if blocks := (v.desc.Size + v.blockSize - 1) / v.blockSize; int64(h.MaxTableEntries) < blocks {
+		return nil, xerrors.Errorf("block allocation table of %d entries is too small for %d blocks", h.MaxTableEntries, blocks)
+	}
+	if int64(h.MaxTableEntries)*4 > size {
+		return nil, xerrors.Errorf("block allocation table of %d entries is larger than the file", h.MaxTableEntries)
+	}
+
+	bat := make([]byte, 4*int64(h.MaxTableEntries))
+	if _, err := r.ReadAt(bat, int64(h.TableOffset)); err != nil {
+		return nil, xerrors.Errorf("failed to read block allocation table: %w", err)
+	}
+	v.bat = make([]uint32, h.MaxTableEntries)
+	for i := range v.bat {
+		v.bat[i] = binary.BigEndian.Uint32(bat[4*i:])
+	}
+
+	if v.desc.Type == TypeDifferencing {
+		v.desc.ParentPaths = v.parentPaths()
+	}
+	return v, nil
+}
+
+// parentPaths returns the relative, then the absolute paths of the parent
+// locators, then the parent name of the header.
+func (v *vhd) parentPaths() []string {
+	var relative, absolute []string
+	for _, l := range v.header.ParentLocators {
+		code := string(l.PlatformCode[:])
+		if code != "W2ru" && code != "W2ku" || l.PlatformDataLength == 0 || l.PlatformDataLength > 64<<10 {
+			continue
+		}
+		b := make([]byte, l.PlatformDataLength)
+		if _, err := v.r.ReadAt(b, int64(l.PlatformDataOffset)); err != nil {
+			continue
+		}
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(b[2*i:])
+		}
+		if code == "W2ru" {
+			relative = append(relative, utf16String(u))
+		} else {
+			absolute = append(absolute, utf16String(u))
+		}
+	}
+	paths := append(relative, absolute...)
+	if name := utf16String(v.header.ParentUnicodeName[:]); name != "" {
+		paths = append(paths, name)
+	}
+	return paths
+}
+
+func (v *vhd) info() *Info {
+	return &v.desc
+}
+
+func (v *vhd) readAt(p []byte, off int64, parent io.ReaderAt) error {
+	if v.desc.Type == TypeFixed {
+		_, err := v.r.ReadAt(p, off)
+		return err
+	}
+	for len(p) > 0 {
+		inBlock := off % v.blockSize
+		chunk := p
+		if rest := v.blockSize - inBlock; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if err := v.readBlock(chunk, off/v.blockSize, inBlock, off, parent); err != nil {
+			return err
+		}
+		p = p[len(chunk):]
+		off += int64(len(chunk))
+	}
+	return nil
+}
+
+// readBlock fills p from block at offset off in it, which is at offset
+// diskOff of the disk. Differencing disks read the sectors their bitmap
+// marks absent from the parent.
+func (v *vhd) readBlock(p []byte, block, off, diskOff int64, parent io.ReaderAt) error {
+	entry := v.bat[block]
+	if entry == unusedBATEntry {
+		if v.desc.Type == TypeDifferencing {
+			return readParent(parent, p, diskOff)
+		}
+		zero(p)
+		return nil
+	}
+	data := int64(entry)*sectorSize + v.bitmapSize
+	if v.desc.Type != TypeDifferencing {
+		_, err := v.r.ReadAt(p, data+off)
+		return err
+	}
+
+	bitmap, err := v.bitmap(entry)
+	if err != nil {
+		return err
+	}
+	present := func(pos int64) bool {
+		sector := pos / sectorSize
+		return bitmap[sector/8]&(0x80>>(sector%8)) != 0
+	}
+	// Read the runs of sectors present or absent at once.
+	for len(p) > 0 {
+		state := present(off)
+		end := (off/sectorSize + 1) * sectorSize
+		for end < off+int64(len(p)) && present(end) == state {
+			end += sectorSize
+		}
+		chunk := p
+		if n := end - off; int64(len(chunk)) > n {
+			chunk = chunk[:n]
+		}
+		if state {
+			if _, err := v.r.ReadAt(chunk, data+off); err != nil {
+				return err
+			}
+		} else if err := readParent(parent, chunk, diskOff); err != nil {
+			return err
+		}
+		p = p[len(chunk):]
+		off += int64(len(chunk))
+		diskOff += int64(len(chunk))
+	}
+	return nil
+}
+
+// bitmap returns the sector bitmap of the block at sector entry.
+func (v *vhd) bitmap(entry uint32) ([]byte, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if b, ok := v.bitmaps[entry]; ok {
+		return b, nil
+	}
+	b := make([]byte, v.bitmapSize)
+	if _, err := v.r.ReadAt(b, int64(entry)*sectorSize); err != nil {
+		return nil, xerrors.Errorf("failed to read sector bitmap at sector %d: %w", entry, err)
+	}
+	if len(v.bitmaps) >= maxCachedBitmaps {
+		v.bitmaps = map[uint32][]byte{}
+	}
+	v.bitmaps[entry] = b
+	return b, nil
+}
+
+// readParent fills p from the parent at off. The part of p past the end of
+// the parent reads as zeros.
+func readParent(parent io.ReaderAt, p []byte, off int64) error {
+	n, err := parent.ReadAt(p, off)
+	if err == io.EOF {
+		zero(p[n:])
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("failed to read parent: %w", err)
+	}
+	return nil
+}
+
+// utf16String decodes a NUL terminated UTF-16 string.
+func utf16String(u []uint16) string {
+	for i, c := range u {
+		if c == 0 {
+			u = u[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
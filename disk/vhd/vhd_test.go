@@ -0,0 +1,243 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"golang.org/x/xerrors"
+
+	"github.com/masahiro331/go-ext4-filesystem/disk"
+)
+
+const (
+	testBlockSize = 4096
+	// testSize ends in the middle of block 4.
+	testSize = 4*testBlockSize + 1024
+)
+
+func encode(order binary.ByteOrder, v interface{}) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, order, v)
+	return b.Bytes()
+}
+
+func buildFooter(diskType uint32, dataOffset uint64) []byte {
+	f := vhdFooter{
+		FileFormatVersion: 0x00010000,
+		DataOffset:        dataOffset,
+		OriginalSize:      testSize,
+		CurrentSize:       testSize,
+		DiskType:          diskType,
+	}
+	copy(f.Cookie[:], footerCookie)
+	f.Checksum = vhdChecksum(encode(binary.BigEndian, f), 64)
+	return encode(binary.BigEndian, f)
+}
+
+func buildFixed(content []byte) []byte {
+	return append(append([]byte(nil), content...), buildFooter(vhdDiskFixed, ^uint64(0))...)
+}
+
+// testBlock is an allocated block: its sector bitmap, most significant bit
+// first, and its data.
+type testBlock struct {
+	bitmap byte
+	data   []byte
+}
+
+// buildDynamic builds a dynamic or differencing disk of testSize bytes:
+// the footer copy, the header, the block allocation table, the parent
+// locator data, the blocks and the footer.
+func buildDynamic(diskType uint32, blocks map[int]testBlock) []byte {
+	const (
+		headerOffset  = footerSize
+		tableOffset   = headerOffset + 1024
+		locatorOffset = tableOffset + 512
+		blocksOffset  = locatorOffset + 512
+		entries       = (testSize + testBlockSize - 1) / testBlockSize
+	)
+	out := make([]byte, blocksOffset)
+	copy(out, buildFooter(diskType, headerOffset))
+
+	h := vhdDynamicHeader{
+		DataOffset:      ^uint64(0),
+		TableOffset:     tableOffset,
+		HeaderVersion:   0x00010000,
+		MaxTableEntries: entries,
+		BlockSize:       testBlockSize,
+	}
+	copy(h.Cookie[:], dynamicCookie)
+	if diskType == vhdDiskDiff {
+		copy(h.ParentUnicodeName[:], utf16.Encode([]rune("parent.vhd")))
+		var locator bytes.Buffer
+		binary.Write(&locator, binary.LittleEndian, utf16.Encode([]rune(`.\parent.vhd`)))
+		copy(out[locatorOffset:], locator.Bytes())
+		h.ParentLocators[0] = vhdParentLocator{
+			PlatformDataSpace:  512,
+			PlatformDataLength: uint32(locator.Len()),
+			PlatformDataOffset: locatorOffset,
+		}
+		copy(h.ParentLocators[0].PlatformCode[:], "W2ru")
+	}
+	h.Checksum = vhdChecksum(encode(binary.BigEndian, h), 36)
+	copy(out[headerOffset:], encode(binary.BigEndian, h))
+
+	for i := 0; i < entries; i++ {
+		entry := uint32(unusedBATEntry)
+		if b, ok := blocks[i]; ok {
+			entry = uint32(len(out) / sectorSize)
+			bitmap := make([]byte, sectorSize)
+			bitmap[0] = b.bitmap
+			out = append(out, bitmap...)
+			out = append(out, b.data...)
+		}
+		binary.BigEndian.PutUint32(out[tableOffset+4*i:], entry)
+	}
+	return append(out, buildFooter(diskType, headerOffset)...)
+}
+
+func readAll(t *testing.T, img *Image) []byte {
+	t.Helper()
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatalf("ReadAll() error: %v", err)
+	}
+	return got
+}
+
+func TestOpenFixed(t *testing.T) {
+	content := make([]byte, testSize)
+	for i := range content {
+		content[i] = byte(i / sectorSize)
+	}
+	image := buildFixed(content)
+	img, err := Open(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if info := img.Info(); info.Format != FormatVHD || info.Type != TypeFixed || info.Size != testSize {
+		t.Errorf("Info() = %+v", info)
+	}
+	if got := readAll(t, img); !bytes.Equal(got, content) {
+		t.Error("content differs")
+	}
+	if n, err := img.ReadAt(make([]byte, 10), testSize-4); n != 4 || err != io.EOF {
+		t.Errorf("ReadAt() at the end = %d, %v, want 4, EOF", n, err)
+	}
+}
+
+func TestOpenDynamic(t *testing.T) {
+	want := make([]byte, testSize)
+	blocks := map[int]testBlock{}
+	for _, i := range []int{0, 2, 4} {
+		data := bytes.Repeat([]byte{byte('a' + i)}, testBlockSize)
+		blocks[i] = testBlock{bitmap: 0xff, data: data}
+		copy(want[i*testBlockSize:], data)
+	}
+	image := buildDynamic(vhdDiskDynamic, blocks)
+	img, err := Open(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if info := img.Info(); info.Type != TypeDynamic || info.Size != testSize {
+		t.Errorf("Info() = %+v", info)
+	}
+	if got := readAll(t, img); !bytes.Equal(got, want) {
+		t.Error("content differs")
+	}
+}
+
+func TestOpenDifferencing(t *testing.T) {
+	parentContent := bytes.Repeat([]byte{'p'}, testSize)
+	parent, err := Open(bytes.NewReader(buildFixed(parentContent)), testSize+footerSize)
+	if err != nil {
+		t.Fatalf("Open() of the parent error: %v", err)
+	}
+
+	// Block 0 has its first 4 sectors, block 3 all of them.
+	want := append([]byte(nil), parentContent...)
+	blocks := map[int]testBlock{
+		0: {bitmap: 0xf0, data: bytes.Repeat([]byte{'x'}, testBlockSize)},
+		3: {bitmap: 0xff, data: bytes.Repeat([]byte{'y'}, testBlockSize)},
+	}
+	copy(want, blocks[0].data[:4*sectorSize])
+	copy(want[3*testBlockSize:], blocks[3].data)
+	image := buildDynamic(vhdDiskDiff, blocks)
+
+	info, err := ReadInfo(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatalf("ReadInfo() error: %v", err)
+	}
+	if want := []string{`.\parent.vhd`, "parent.vhd"}; !reflect.DeepEqual(info.ParentPaths, want) {
+		t.Errorf("ParentPaths = %q, want %q", info.ParentPaths, want)
+	}
+	if _, err := Open(bytes.NewReader(image), int64(len(image))); !xerrors.Is(err, ErrParentRequired) {
+		t.Errorf("Open() without parent error = %v, want ErrParentRequired", err)
+	}
+
+	img, err := Open(bytes.NewReader(image), int64(len(image)), WithParent(parent))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if got := readAll(t, img); !bytes.Equal(got, want) {
+		t.Error("content differs")
+	}
+	// A read across the sectors of block 0 and its parent.
+	p := make([]byte, 1024)
+	if _, err := img.ReadAt(p, 4*sectorSize-512); err != nil {
+		t.Fatalf("ReadAt() error: %v", err)
+	}
+	if !bytes.Equal(p, want[4*sectorSize-512:4*sectorSize+512]) {
+		t.Error("ReadAt() across the bitmap differs")
+	}
+}
+
+func TestOpenInvalidSize(t *testing.T) {
+	for _, size := range []uint64{0, 1 << 63} {
+		image := buildFixed(make([]byte, testSize))
+		footer := image[testSize:]
+		binary.BigEndian.PutUint64(footer[48:], size)
+		binary.BigEndian.PutUint32(footer[64:], vhdChecksum(footer, 64))
+		if _, err := Open(bytes.NewReader(image), int64(len(image))); err == nil {
+			t.Errorf("Open() of a disk of %d bytes succeeded", size)
+		}
+	}
+}
+
+// TestOpenPartitioned reads the partition table of a dynamic disk with
+// disk.Open.
+func TestOpenPartitioned(t *testing.T) {
+	block0 := make([]byte, testBlockSize)
+	// One Linux partition of 16 sectors at sector 2.
+	entry := block0[446:]
+	entry[4] = 0x83
+	binary.LittleEndian.PutUint32(entry[8:], 2)
+	binary.LittleEndian.PutUint32(entry[12:], 16)
+	binary.LittleEndian.PutUint16(block0[510:], 0xaa55)
+	copy(block0[2*sectorSize:], "partition")
+	image := buildDynamic(vhdDiskDynamic, map[int]testBlock{0: {bitmap: 0xff, data: block0}})
+
+	img, err := Open(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	d, err := disk.Open(img, img.Size())
+	if err != nil {
+		t.Fatalf("disk.Open() error: %v", err)
+	}
+	if len(d.Partitions) != 1 {
+		t.Fatalf("got %d partitions, want 1", len(d.Partitions))
+	}
+	p := d.Partitions[0]
+	if p.Offset != 2*sectorSize || p.Size != 16*sectorSize {
+		t.Errorf("partition at %d of %d bytes, want %d of %d", p.Offset, p.Size, 2*sectorSize, 16*sectorSize)
+	}
+	b := make([]byte, len("partition"))
+	if _, err := p.SectionReader().ReadAt(b, 0); err != nil || string(b) != "partition" {
+		t.Errorf("partition content = %q, %v", b, err)
+	}
+}
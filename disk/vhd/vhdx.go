@@ -0,0 +1,531 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"golang.org/x/xerrors"
+
+	"github.com/masahiro331/go-ext4-filesystem/disk"
+)
+
+const (
+	vhdxSignature = "vhdxfile"
+
+	vhdxHeaderSignature   = 0x64616568 // "head"
+	vhdxRegionSignature   = 0x69676572 // "regi"
+	vhdxMetadataSignature = "metadata"
+
+	vhdxHeaderSize        = 4 << 10
+	vhdxRegionTableSize   = 64 << 10
+	vhdxMaxRegionEntries  = 2047
+	vhdxMaxMetadataItems  = 2047
+	vhdxMetadataTableSize = 64 << 10
+	vhdxMB                = 1 << 20
+
+	// sectorsPerBitmap is the number of sectors a sector bitmap block
+	// covers.
+	sectorsPerBitmap = 1 << 23
+
+	maxVHDXBlockSize = 256 << 20
+	// maxVHDXSize is the largest virtual disk size the format allows.
+	maxVHDXSize = 64 << 40
+	// maxBATSize bounds the memory taken by the block allocation table.
+	maxBATSize = 256 << 20
+)
+
+// The header copies and region table copies, at fixed offsets.
+var (
+	vhdxHeaderOffsets      = []int64{64 << 10, 128 << 10}
+	vhdxRegionTableOffsets = []int64{192 << 10, 256 << 10}
+)
+
+// Regions and metadata items.
+var (
+	regionBAT               = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	regionMetadata          = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	metadataFileParameters  = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	metadataVirtualDiskSize = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	metadataLogicalSector   = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	metadataParentLocator   = mustParseGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+	metadataVirtualDiskID   = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	metadataPhysicalSector  = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+)
+
+// Payload and sector bitmap block states of BAT entries.
+const (
+	payloadNotPresent       = 0
+	payloadUndefined        = 1
+	payloadZero             = 2
+	payloadUnmapped         = 3
+	payloadFullyPresent     = 6
+	payloadPartiallyPresent = 7
+	bitmapPresent           = 6
+	batStateMask            = 7
+	batOffsetShift          = 20
+)
+
+const (
+	fileParametersHasParent = 1 << 1
+	metadataIsRequired      = 1 << 2
+)
+
+func mustParseGUID(s string) disk.GUID {
+	g, err := disk.ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// vhdxChecksum returns the CRC-32C of b with its checksum field at
+// offset 4 zeroed.
+func vhdxChecksum(b []byte) uint32 {
+	c := append([]byte(nil), b...)
+	binary.LittleEndian.PutUint32(c[4:], 0)
+	return crc32.Checksum(c, castagnoli)
+}
+
+type vhdxHeader struct {
+	Signature      uint32
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  disk.GUID
+	DataWriteGUID  disk.GUID
+	LogGUID        disk.GUID
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type vhdxRegionTableHeader struct {
+	Signature  uint32
+	Checksum   uint32
+	EntryCount uint32
+	_          uint32
+}
+
+type vhdxRegionEntry struct {
+	GUID       disk.GUID
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetadataTableHeader struct {
+	Signature  [8]byte
+	_          uint16
+	EntryCount uint16
+	_          [20]byte
+}
+
+type vhdxMetadataEntry struct {
+	ItemID disk.GUID
+	Offset uint32
+	Length uint32
+	Flags  uint32
+	_      uint32
+}
+
+// vhdx is a VHDX disk. Its blocks are located by the block allocation
+// table, which interleaves a sector bitmap entry after every chunk of
+// payload block entries.
+type vhdx struct {
+	r    io.ReaderAt
+	desc Info
+
+	blockSize         int64
+	logicalSectorSize int64
+	chunkRatio        int64
+	bat               []uint64
+
+	mu      sync.Mutex
+	bitmaps map[uint64][]byte
+}
+
+func openVHDX(file io.ReaderAt) (*vhdx, error) {
+	h, err := readVHDXHeader(file)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version != 1 {
+		return nil, xerrors.Errorf("unsupported version %d", h.Version)
+	}
+
+	// Replay the log over the file, in memory.
+	r := file
+	if !h.LogGUID.IsZero() {
+		if h.LogVersion != 0 {
+			return nil, xerrors.Errorf("unsupported log version %d", h.LogVersion)
+		}
+		if r, err = replayLog(file, h); err != nil {
+			return nil, xerrors.Errorf("failed to replay log: %w", err)
+		}
+	}
+
+	regions, err := readRegionTable(r)
+	if err != nil {
+		return nil, err
+	}
+	bat, ok := regions[regionBAT]
+	if !ok {
+		return nil, xerrors.New("no block allocation table region")
+	}
+	meta, ok := regions[regionMetadata]
+	if !ok {
+		return nil, xerrors.New("no metadata region")
+	}
+
+	v := &vhdx{r: r, desc: Info{Format: FormatVHDX}, bitmaps: map[uint64][]byte{}}
+	if err := v.readMetadata(meta); err != nil {
+		return nil, xerrors.Errorf("failed to read metadata: %w", err)
+	}
+	if err := v.readBAT(bat); err != nil {
+		return nil, xerrors.Errorf("failed to read block allocation table: %w", err)
+	}
+	return v, nil
+}
+
+// readVHDXHeader returns the valid header copy with the highest sequence
+// number.
+func readVHDXHeader(r io.ReaderAt) (vhdxHeader, error) {
+	var current vhdxHeader
+	var found bool
+	var lastErr error
+	for _, off := range vhdxHeaderOffsets {
+		b := make([]byte, vhdxHeaderSize)
+		if _, err := r.ReadAt(b, off); err != nil {
+			lastErr = xerrors.Errorf("failed to read header at %#x: %w", off, err)
+			continue
+		}
+		var h vhdxHeader
+		if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+			lastErr = xerrors.Errorf("failed to parse header at %#x: %w", off, err)
+			continue
+		}
+		if h.Signature != vhdxHeaderSignature {
+			lastErr = xerrors.Errorf("invalid header signature %#x at %#x", h.Signature, off)
+			continue
+		}
+		if sum := vhdxChecksum(b); sum != h.Checksum {
+			lastErr = xerrors.Errorf("header at %#x: checksum %#x, want %#x", off, sum, h.Checksum)
+			continue
+		}
+		if !found || h.SequenceNumber > current.SequenceNumber {
+			current, found = h, true
+		}
+	}
+	if !found {
+		return current, lastErr
+	}
+	return current, nil
+}
+
+// readRegionTable returns the regions of the first valid region table
+// copy, by GUID.
+func readRegionTable(r io.ReaderAt) (map[disk.GUID]vhdxRegionEntry, error) {
+	var lastErr error
+	for _, off := range vhdxRegionTableOffsets {
+		regions, err := readRegionTableAt(r, off)
+		if err == nil {
+			return regions, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func readRegionTableAt(r io.ReaderAt, off int64) (map[disk.GUID]vhdxRegionEntry, error) {
+	b := make([]byte, vhdxRegionTableSize)
+	if _, err := r.ReadAt(b, off); err != nil {
+		return nil, xerrors.Errorf("failed to read region table at %#x: %w", off, err)
+	}
+	br := bytes.NewReader(b)
+	var h vhdxRegionTableHeader
+	if err := binary.Read(br, binary.LittleEndian, &h); err != nil {
+		return nil, xerrors.Errorf("failed to parse region table at %#x: %w", off, err)
+	}
+	if h.Signature != vhdxRegionSignature {
+		return nil, xerrors.Errorf("invalid region table signature %#x at %#x", h.Signature, off)
+	}
+	if sum := vhdxChecksum(b); sum != h.Checksum {
+		return nil, xerrors.Errorf("region table at %#x: checksum %#x, want %#x", off, sum, h.Checksum)
+	}
+	if h.EntryCount > vhdxMaxRegionEntries {
+		return nil, xerrors.Errorf("region table at %#x: %d entries are too many", off, h.EntryCount)
+	}
+	entries := make([]vhdxRegionEntry, h.EntryCount)
+	if err := binary.Read(br, binary.LittleEndian, entries); err != nil {
+		return nil, xerrors.Errorf("failed to parse region table entries at %#x: %w", off, err)
+	}
+	regions := map[disk.GUID]vhdxRegionEntry{}
+	for _, e := range entries {
+		if e.GUID != regionBAT && e.GUID != regionMetadata && e.Required&1 != 0 {
+			return nil, xerrors.Errorf("unsupported required region %s", e.GUID)
+		}
+		regions[e.GUID] = e
+	}
+	return regions, nil
+}
+
+// readMetadata reads the block size, disk size, sector size and parent
+// locator from the metadata region.
+func (v *vhdx) readMetadata(region vhdxRegionEntry) error {
+	if region.Length < vhdxMetadataTableSize {
+		return xerrors.Errorf("metadata region of %d bytes is too small", region.Length)
+	}
+	b := make([]byte, region.Length)
+	if _, err := v.r.ReadAt(b, int64(region.FileOffset)); err != nil {
+		return xerrors.Errorf("failed to read metadata region: %w", err)
+	}
+	br := bytes.NewReader(b)
+	var h vhdxMetadataTableHeader
+	if err := binary.Read(br, binary.LittleEndian, &h); err != nil {
+		return xerrors.Errorf("failed to parse metadata table: %w", err)
+	}
+	if string(h.Signature[:]) != vhdxMetadataSignature {
+		return xerrors.Errorf("invalid metadata table signature %q", h.Signature[:])
+	}
+	if h.EntryCount > vhdxMaxMetadataItems {
+		return xerrors.Errorf("%d metadata items are too many", h.EntryCount)
+	}
+	entries := make([]vhdxMetadataEntry, h.EntryCount)
+	if err := binary.Read(br, binary.LittleEndian, entries); err != nil {
+		return xerrors.Errorf("failed to parse metadata entries: %w", err)
+	}
+
+	items := map[disk.GUID][]byte{}
+	for _, e := range entries {
+		if int64(e.Offset)+int64(e.Length) > int64(len(b)) {
+			return xerrors.Errorf("metadata item %s is past the region", e.ItemID)
+		}
+		switch e.ItemID {
+		case metadataFileParameters, metadataVirtualDiskSize, metadataLogicalSector, metadataParentLocator:
+			items[e.ItemID] = b[e.Offset : e.Offset+e.Length]
+		case metadataVirtualDiskID, metadataPhysicalSector:
+			// Required items that do not affect reading.
+		default:
+			if e.Flags&metadataIsRequired != 0 {
+				return xerrors.Errorf("unsupported required metadata item %s", e.ItemID)
+			}
+		}
+	}
+	for _, id := range []disk.GUID{metadataFileParameters, metadataVirtualDiskSize, metadataLogicalSector} {
+		if len(items[id]) < 4 {
+			return xerrors.Errorf("metadata item %s is missing", id)
+		}
+	}
+	if len(items[metadataFileParameters]) < 8 || len(items[metadataVirtualDiskSize]) < 8 {
+		return xerrors.New("metadata items are truncated")
+	}
+
+	params := items[metadataFileParameters]
+	v.blockSize = int64(binary.LittleEndian.Uint32(params))
+	if v.blockSize < vhdxMB || v.blockSize > maxVHDXBlockSize || v.blockSize&(v.blockSize-1) != 0 {
+		return xerrors.Errorf("invalid block size %d", v.blockSize)
+	}
+	v.desc.Size = int64(binary.LittleEndian.Uint64(items[metadataVirtualDiskSize]))
+	if v.desc.Size <= 0 || v.desc.Size > maxVHDXSize {
+		return xerrors.Errorf("invalid virtual disk size %d", v.desc.Size)
+	}
+	v.logicalSectorSize = int64(binary.LittleEndian.Uint32(items[metadataLogicalSector]))
+	if v.logicalSectorSize != 512 && v.logicalSectorSize != 4096 {
+		return xerrors.Errorf("invalid logical sector size %d", v.logicalSectorSize)
+	}
+	v.chunkRatio = sectorsPerBitmap * v.logicalSectorSize / v.blockSize
+
+	v.desc.Type = TypeDynamic
+	if binary.LittleEndian.Uint32(params[4:])&fileParametersHasParent != 0 {
+		v.desc.Type = TypeDifferencing
+		locator, ok := items[metadataParentLocator]
+		if !ok {
+			return xerrors.New("differencing disk without parent locator")
+		}
+		paths, err := parseParentLocator(locator)
+		if err != nil {
+			return xerrors.Errorf("failed to parse parent locator: %w", err)
+		}
+		v.desc.ParentPaths = paths
+	}
+	return nil
+}
+
+// parseParentLocator returns the relative, absolute and volume paths of a
+// parent locator, a list of UTF-16 keys and values.
+func parseParentLocator(b []byte) ([]string, error) {
+	const headerSize, entrySize = 20, 12
+	if len(b) < headerSize {
+		return nil, xerrors.New("truncated header")
+	}
+	count := int(binary.LittleEndian.Uint16(b[18:]))
+	if headerSize+count*entrySize > len(b) {
+		return nil, xerrors.Errorf("%d entries are past the item", count)
+	}
+	str := func(off uint32, length uint16) (string, error) {
+		if int64(off)+int64(length) > int64(len(b)) {
+			return "", xerrors.Errorf("string at %d is past the item", off)
+		}
+		u := make([]uint16, length/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(b[int(off)+2*i:])
+		}
+		return utf16String(u), nil
+	}
+	values := map[string]string{}
+	for i := 0; i < count; i++ {
+		e := b[headerSize+i*entrySize:]
+		key, err := str(binary.LittleEndian.Uint32(e), binary.LittleEndian.Uint16(e[8:]))
+		if err != nil {
+			return nil, err
+		}
+		value, err := str(binary.LittleEndian.Uint32(e[4:]), binary.LittleEndian.Uint16(e[10:]))
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	var paths []string
+	for _, key := range []string{"relative_path", "absolute_win32_path", "volume_path"} {
+		if p := values[key]; p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// readBAT reads the block allocation table of the disk size and block size
+// validated by readMetadata.
+func (v *vhdx) readBAT(region vhdxRegionEntry) error {
+	blocks := (v.desc.Size + v.blockSize - 1) / v.blockSize
+	chunks := (blocks + v.chunkRatio - 1) / v.chunkRatio
+	// Every chunk but the last may be followed by its sector bitmap
+	// entry; differencing disks have the last one too.
+	entries := blocks + (blocks-1)/v.chunkRatio
+	if v.desc.Type == TypeDifferencing {
+		entries = chunks * (v.chunkRatio + 1)
+	}
+	if 8*entries > maxBATSize || 8*entries > int64(region.Length) {
+		return xerrors.Errorf("%d entries do not fit in a region of %d bytes", entries, region.Length)
+	}
+	b := make([]byte, 8*entries)
+	if _, err := v.r.ReadAt(b, int64(region.FileOffset)); err != nil {
+		return err
+	}
+	v.bat = make([]uint64, entries)
+	for i := range v.bat {
+		v.bat[i] = binary.LittleEndian.Uint64(b[8*i:])
+	}
+	return nil
+}
+
+func (v *vhdx) info() *Info {
+	return &v.desc
+}
+
+func (v *vhdx) readAt(p []byte, off int64, parent io.ReaderAt) error {
+	for len(p) > 0 {
+		inBlock := off % v.blockSize
+		chunk := p
+		if rest := v.blockSize - inBlock; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if err := v.readBlock(chunk, off/v.blockSize, inBlock, off, parent); err != nil {
+			return err
+		}
+		p = p[len(chunk):]
+		off += int64(len(chunk))
+	}
+	return nil
+}
+
+// readBlock fills p from block at offset off in it, which is at offset
+// diskOff of the disk.
+func (v *vhdx) readBlock(p []byte, block, off, diskOff int64, parent io.ReaderAt) error {
+	entry := v.bat[block+block/v.chunkRatio]
+	data := int64(entry>>batOffsetShift) * vhdxMB
+	switch entry & batStateMask {
+	case payloadFullyPresent:
+		_, err := v.r.ReadAt(p, data+off)
+		return err
+	case payloadNotPresent:
+		if v.desc.Type == TypeDifferencing {
+			return readParent(parent, p, diskOff)
+		}
+		zero(p)
+		return nil
+	case payloadUndefined, payloadZero, payloadUnmapped:
+		zero(p)
+		return nil
+	case payloadPartiallyPresent:
+		if v.desc.Type != TypeDifferencing {
+			return xerrors.Errorf("block %d is partially present in a disk without parent", block)
+		}
+	default:
+		return xerrors.Errorf("block %d: invalid state %d", block, entry&batStateMask)
+	}
+
+	// The sector bitmap tells which sectors are in this file, one bit per
+	// sector of the chunk, least significant bit first.
+	chunk := block / v.chunkRatio
+	bitmap, err := v.bitmap(chunk)
+	if err != nil {
+		return err
+	}
+	first := (block % v.chunkRatio) * (v.blockSize / v.logicalSectorSize)
+	present := func(pos int64) bool {
+		sector := first + pos/v.logicalSectorSize
+		return bitmap[sector/8]&(1<<(sector%8)) != 0
+	}
+	for len(p) > 0 {
+		state := present(off)
+		end := (off/v.logicalSectorSize + 1) * v.logicalSectorSize
+		for end < off+int64(len(p)) && present(end) == state {
+			end += v.logicalSectorSize
+		}
+		run := p
+		if n := end - off; int64(len(run)) > n {
+			run = run[:n]
+		}
+		if state {
+			if _, err := v.r.ReadAt(run, data+off); err != nil {
+				return err
+			}
+		} else if err := readParent(parent, run, diskOff); err != nil {
+			return err
+		}
+		p = p[len(run):]
+		off += int64(len(run))
+		diskOff += int64(len(run))
+	}
+	return nil
+}
+
+// bitmap returns the sector bitmap block of chunk.
+func (v *vhdx) bitmap(chunk int64) ([]byte, error) {
+	entry := v.bat[chunk*(v.chunkRatio+1)+v.chunkRatio]
+	if entry&batStateMask != bitmapPresent {
+		return nil, xerrors.Errorf("sector bitmap of chunk %d is not present", chunk)
+	}
+	off := entry >> batOffsetShift * vhdxMB
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if b, ok := v.bitmaps[off]; ok {
+		return b, nil
+	}
+	b := make([]byte, vhdxMB)
+	if _, err := v.r.ReadAt(b, int64(off)); err != nil {
+		return nil, xerrors.Errorf("failed to read sector bitmap of chunk %d: %w", chunk, err)
+	}
+	if len(v.bitmaps) >= maxCachedBitmaps {
+		v.bitmaps = map[uint64][]byte{}
+	}
+	v.bitmaps[off] = b
+	return b, nil
+}
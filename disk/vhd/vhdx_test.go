@@ -0,0 +1,279 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/masahiro331/go-ext4-filesystem/disk"
+)
+
+const (
+	testVHDXSize   = 3*vhdxMB - 1024
+	testLogOffset  = 1 * vhdxMB
+	testMetaOffset = 2 * vhdxMB
+	testBATOffset  = 3 * vhdxMB
+	// testChunkRatio is the chunk ratio of 1MiB blocks and 512 byte
+	// sectors.
+	testChunkRatio = 4096
+)
+
+var testLogGUID = mustParseGUID("0CCD6B84-7F1A-4E0B-8E1D-2C3B4A5F6E7D")
+
+func encodeLE(v interface{}) []byte {
+	return encode(binary.LittleEndian, v)
+}
+
+func batEntry(state, offset uint64) uint64 {
+	return offset/vhdxMB<<batOffsetShift | state
+}
+
+func utf16LE(s string) []byte {
+	return encodeLE(utf16.Encode([]rune(s)))
+}
+
+// buildParentLocator builds a parent locator of key and value pairs.
+func buildParentLocator(pairs ...string) []byte {
+	n := len(pairs) / 2
+	var entries, strs bytes.Buffer
+	strOffset := 20 + 12*n
+	for i := 0; i < n; i++ {
+		key, value := utf16LE(pairs[2*i]), utf16LE(pairs[2*i+1])
+		binary.Write(&entries, binary.LittleEndian, uint32(strOffset+strs.Len()))
+		binary.Write(&entries, binary.LittleEndian, uint32(strOffset+strs.Len()+len(key)))
+		binary.Write(&entries, binary.LittleEndian, uint16(len(key)))
+		binary.Write(&entries, binary.LittleEndian, uint16(len(value)))
+		strs.Write(key)
+		strs.Write(value)
+	}
+	b := make([]byte, 18)
+	b = append(b, encodeLE(uint16(n))...)
+	b = append(b, entries.Bytes()...)
+	return append(b, strs.Bytes()...)
+}
+
+// buildVHDX builds a VHDX disk of testVHDXSize bytes and 1MiB blocks with
+// its log, metadata and block allocation table in the regions at 1, 2 and
+// 3MiB, and data at its offset in the file.
+func buildVHDX(bat []uint64, hasParent bool, logGUID disk.GUID, data map[int64][]byte) []byte {
+	size := int64(4 * vhdxMB)
+	for off, b := range data {
+		if end := off + int64(len(b)); end > size {
+			size = end
+		}
+	}
+	image := make([]byte, size)
+	copy(image, vhdxSignature)
+
+	for i, off := range vhdxHeaderOffsets {
+		b := make([]byte, vhdxHeaderSize)
+		copy(b, encodeLE(vhdxHeader{
+			Signature:      vhdxHeaderSignature,
+			SequenceNumber: uint64(i + 1),
+			LogGUID:        logGUID,
+			Version:        1,
+			LogLength:      vhdxMB,
+			LogOffset:      testLogOffset,
+		}))
+		binary.LittleEndian.PutUint32(b[4:], vhdxChecksum(b))
+		copy(image[off:], b)
+	}
+
+	regions := make([]byte, vhdxRegionTableSize)
+	copy(regions, encodeLE(vhdxRegionTableHeader{Signature: vhdxRegionSignature, EntryCount: 2}))
+	copy(regions[16:], encodeLE([]vhdxRegionEntry{
+		{GUID: regionBAT, FileOffset: testBATOffset, Length: vhdxMB, Required: 1},
+		{GUID: regionMetadata, FileOffset: testMetaOffset, Length: vhdxMB, Required: 1},
+	}))
+	binary.LittleEndian.PutUint32(regions[4:], vhdxChecksum(regions))
+	for _, off := range vhdxRegionTableOffsets {
+		copy(image[off:], regions)
+	}
+
+	var flags uint32
+	if hasParent {
+		flags = fileParametersHasParent
+	}
+	ids := []disk.GUID{
+		metadataFileParameters, metadataVirtualDiskSize, metadataVirtualDiskID,
+		metadataLogicalSector, metadataPhysicalSector,
+	}
+	items := [][]byte{
+		encodeLE([]uint32{vhdxMB, flags}),
+		encodeLE(uint64(testVHDXSize)),
+		encodeLE(mustParseGUID("6B3A2D5E-1C4F-4E8A-9B7D-0F1E2D3C4B5A")),
+		encodeLE(uint32(512)),
+		encodeLE(uint32(4096)),
+	}
+	if hasParent {
+		ids = append(ids, metadataParentLocator)
+		items = append(items, buildParentLocator("relative_path", `..\parent.vhdx`, "absolute_win32_path", `C:\parent.vhdx`))
+	}
+	header := vhdxMetadataTableHeader{EntryCount: uint16(len(items))}
+	copy(header.Signature[:], vhdxMetadataSignature)
+	table := encodeLE(header)
+	for i, item := range items {
+		// Items are in the 4KiB after the table, one each.
+		off := vhdxMetadataTableSize + i*4096
+		table = append(table, encodeLE(vhdxMetadataEntry{
+			ItemID: ids[i],
+			Offset: uint32(off),
+			Length: uint32(len(item)),
+			Flags:  metadataIsRequired,
+		})...)
+		copy(image[testMetaOffset+off:], item)
+	}
+	copy(image[testMetaOffset:], table)
+
+	copy(image[testBATOffset:], encodeLE(bat))
+	for off, b := range data {
+		copy(image[off:], b)
+	}
+	return image
+}
+
+func TestOpenVHDX(t *testing.T) {
+	block0 := bytes.Repeat([]byte{'a'}, vhdxMB)
+	bat := []uint64{
+		batEntry(payloadFullyPresent, 4*vhdxMB),
+		batEntry(payloadNotPresent, 0),
+		batEntry(payloadZero, 0),
+	}
+	image := buildVHDX(bat, false, disk.GUID{}, map[int64][]byte{4 * vhdxMB: block0})
+	img, err := Open(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if info := img.Info(); info.Format != FormatVHDX || info.Type != TypeDynamic || info.Size != testVHDXSize {
+		t.Errorf("Info() = %+v", info)
+	}
+	want := make([]byte, testVHDXSize)
+	copy(want, block0)
+	if got := readAll(t, img); !bytes.Equal(got, want) {
+		t.Error("content differs")
+	}
+}
+
+func TestOpenVHDXInvalidSize(t *testing.T) {
+	for _, size := range []uint64{0, 1 << 63, maxVHDXSize + vhdxMB} {
+		image := buildVHDX(nil, false, disk.GUID{}, nil)
+		// The virtual disk size is the second metadata item.
+		binary.LittleEndian.PutUint64(image[testMetaOffset+vhdxMetadataTableSize+4096:], size)
+		if _, err := Open(bytes.NewReader(image), int64(len(image))); err == nil {
+			t.Errorf("Open() of a disk of %d bytes succeeded", size)
+		}
+	}
+}
+
+func TestOpenVHDXDifferencing(t *testing.T) {
+	parentContent := bytes.Repeat([]byte{'p'}, testVHDXSize)
+	block0 := bytes.Repeat([]byte{'x'}, vhdxMB)
+	block1 := bytes.Repeat([]byte{'y'}, vhdxMB)
+	// Sectors 0, 1 and 9 of block 0 are present.
+	bitmap := make([]byte, vhdxMB)
+	bitmap[0], bitmap[1] = 0x03, 0x02
+
+	bat := make([]uint64, testChunkRatio+1)
+	bat[0] = batEntry(payloadPartiallyPresent, 4*vhdxMB)
+	bat[1] = batEntry(payloadFullyPresent, 5*vhdxMB)
+	bat[2] = batEntry(payloadNotPresent, 0)
+	bat[testChunkRatio] = batEntry(bitmapPresent, 6*vhdxMB)
+	image := buildVHDX(bat, true, disk.GUID{}, map[int64][]byte{
+		4 * vhdxMB: block0,
+		5 * vhdxMB: block1,
+		6 * vhdxMB: bitmap,
+	})
+
+	info, err := ReadInfo(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatalf("ReadInfo() error: %v", err)
+	}
+	if want := []string{`..\parent.vhdx`, `C:\parent.vhdx`}; info.Type != TypeDifferencing || !reflect.DeepEqual(info.ParentPaths, want) {
+		t.Errorf("Info() = %+v, want parents %q", info, want)
+	}
+
+	img, err := Open(bytes.NewReader(image), int64(len(image)), WithParent(bytes.NewReader(parentContent)))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	want := append([]byte(nil), parentContent...)
+	copy(want, block0[:1024])
+	copy(want[9*512:], block0[9*512:10*512])
+	copy(want[vhdxMB:], block1)
+	if got := readAll(t, img); !bytes.Equal(got, want) {
+		t.Error("content differs")
+	}
+}
+
+// buildLogEntry builds a log entry at the tail of the log writing page at
+// file offset dataOffset and zeroing zeroLength bytes at zeroOffset.
+func buildLogEntry(guid disk.GUID, seq uint64, dataOffset int64, page []byte, zeroOffset, zeroLength int64) []byte {
+	entry := make([]byte, 2*logSectorSize)
+	h := logEntryHeader{
+		Signature:       logEntrySignature,
+		EntryLength:     uint32(len(entry)),
+		SequenceNumber:  seq,
+		DescriptorCount: 2,
+		LogGUID:         guid,
+		LastFileOffset:  uint64(dataOffset + logSectorSize),
+	}
+	copy(entry, encodeLE(h))
+
+	data := logDescriptor{Signature: logDataDescSignature, FileOffset: uint64(dataOffset), SequenceNumber: seq}
+	copy(data.LeadingBytes[:], page)
+	copy(data.TrailingBytes[:], page[logSectorSize-logTrailingBytes:])
+	zero := logDescriptor{Signature: logZeroDescSignature, FileOffset: uint64(zeroOffset), SequenceNumber: seq}
+	binary.LittleEndian.PutUint64(zero.LeadingBytes[:], uint64(zeroLength))
+	copy(entry[logEntryHeaderSize:], encodeLE([]logDescriptor{data, zero}))
+
+	sector := entry[logSectorSize:]
+	binary.LittleEndian.PutUint32(sector, logDataSectorSignature)
+	binary.LittleEndian.PutUint32(sector[4:], uint32(seq>>32))
+	copy(sector[logLeadingBytes:], page[logLeadingBytes:logSectorSize-logTrailingBytes])
+	binary.LittleEndian.PutUint32(sector[logSectorSize-4:], uint32(seq))
+
+	binary.LittleEndian.PutUint32(entry[4:], crc32.Checksum(entry, castagnoli))
+	return entry
+}
+
+func TestOpenVHDXLog(t *testing.T) {
+	block0 := bytes.Repeat([]byte{'a'}, vhdxMB)
+	page := bytes.Repeat([]byte{'L'}, logSectorSize)
+	page[0], page[logSectorSize-1] = 'B', 'E'
+	bat := []uint64{
+		batEntry(payloadFullyPresent, 4*vhdxMB),
+		batEntry(payloadNotPresent, 0),
+		batEntry(payloadNotPresent, 0),
+	}
+	build := func(entryGUID disk.GUID) []byte {
+		return buildVHDX(bat, false, testLogGUID, map[int64][]byte{
+			4 * vhdxMB:    block0,
+			testLogOffset: buildLogEntry(entryGUID, 7, 4*vhdxMB+8192, page, 4*vhdxMB+16384, 8192),
+		})
+	}
+
+	image := build(testLogGUID)
+	img, err := Open(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	want := make([]byte, testVHDXSize)
+	copy(want, block0)
+	copy(want[8192:], page)
+	copy(want[16384:], make([]byte, 8192))
+	if got := readAll(t, img); !bytes.Equal(got, want) {
+		t.Error("content differs")
+	}
+	if !bytes.Equal(image[4*vhdxMB:5*vhdxMB], block0) {
+		t.Error("the file was modified")
+	}
+
+	// Entries of another log are not replayed.
+	image = build(mustParseGUID("11111111-2222-3333-4444-555555555555"))
+	if _, err := Open(bytes.NewReader(image), int64(len(image))); err == nil {
+		t.Error("Open() without a valid log sequence succeeded")
+	}
+}
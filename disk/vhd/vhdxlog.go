@@ -0,0 +1,278 @@
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+
+	"golang.org/x/xerrors"
+
+	"github.com/masahiro331/go-ext4-filesystem/disk"
+)
+
+const (
+	logEntrySignature      = 0x65676f6c // "loge"
+	logDataDescSignature   = 0x63736564 // "desc"
+	logZeroDescSignature   = 0x6f72657a // "zero"
+	logDataSectorSignature = 0x61746164 // "data"
+
+	logSectorSize         = 4 << 10
+	logEntryHeaderSize    = 64
+	logDescriptorSize     = 32
+	logLeadingBytes       = 8
+	logTrailingBytes      = 4
+	logDataSectorDataSize = logSectorSize - logLeadingBytes - logTrailingBytes
+
+	maxLogSize = 64 << 20
+	// maxLogZeroPages bounds the pages zeroed by the log, kept in memory.
+	maxLogZeroPages = 1 << 18
+)
+
+type logEntryHeader struct {
+	Signature         uint32
+	Checksum          uint32
+	EntryLength       uint32
+	Tail              uint32
+	SequenceNumber    uint64
+	DescriptorCount   uint32
+	_                 uint32
+	LogGUID           disk.GUID
+	FlushedFileOffset uint64
+	LastFileOffset    uint64
+}
+
+// logDescriptor is a data or zero descriptor. Data descriptors hold the
+// leading and trailing bytes of the page their data sector completes.
+type logDescriptor struct {
+	Signature      uint32
+	TrailingBytes  [logTrailingBytes]byte
+	LeadingBytes   [logLeadingBytes]byte
+	FileOffset     uint64
+	SequenceNumber uint64
+}
+
+// zeroLength returns the length of a zero descriptor, stored where data
+// descriptors have their leading bytes.
+func (d logDescriptor) zeroLength() uint64 {
+	return binary.LittleEndian.Uint64(d.LeadingBytes[:])
+}
+
+type logEntry struct {
+	offset int64
+	header logEntryHeader
+	// pages are the writes of the entry in order, nil for zeroed pages.
+	pages []logPage
+}
+
+type logPage struct {
+	offset int64
+	data   []byte
+}
+
+// circularLog is the log region, whose entries may wrap around its end.
+type circularLog []byte
+
+func (l circularLog) read(off, n int64) []byte {
+	b := make([]byte, n)
+	for i := int64(0); i < n; {
+		pos := (off + i) % int64(len(l))
+		i += int64(copy(b[i:], l[pos:]))
+	}
+	return b
+}
+
+// replayLog returns file with the writes of the active log sequence
+// applied, without modifying it.
+func replayLog(file io.ReaderAt, h vhdxHeader) (io.ReaderAt, error) {
+	if h.LogLength == 0 || h.LogLength%vhdxMB != 0 || h.LogLength > maxLogSize {
+		return nil, xerrors.Errorf("invalid log length %d", h.LogLength)
+	}
+	log := make(circularLog, h.LogLength)
+	if _, err := file.ReadAt(log, int64(h.LogOffset)); err != nil {
+		return nil, xerrors.Errorf("failed to read log: %w", err)
+	}
+
+	entries := map[int64]*logEntry{}
+	for off := int64(0); off < int64(len(log)); off += logSectorSize {
+		if e, err := parseLogEntry(log, off, h.LogGUID); err == nil {
+			entries[off] = e
+		}
+	}
+	sequence := activeSequence(log, entries)
+	if sequence == nil {
+		return nil, xerrors.New("no valid log sequence")
+	}
+
+	o := &overlay{r: file, pages: map[int64][]byte{}}
+	var zeroed int
+	for _, e := range sequence {
+		for _, p := range e.pages {
+			if p.data == nil {
+				if zeroed++; zeroed > maxLogZeroPages {
+					return nil, xerrors.New("log zeroes too many pages")
+				}
+			}
+			o.pages[p.offset] = p.data
+			if end := p.offset + logSectorSize; end > o.size {
+				o.size = end
+			}
+		}
+		if end := int64(e.header.LastFileOffset); end > o.size {
+			o.size = end
+		}
+	}
+	return o, nil
+}
+
+// activeSequence returns the entries to replay: those from the tail of the
+// valid sequence with the highest sequence number to its head. A sequence
+// is a run of entries with consecutive sequence numbers whose head, the
+// last entry, has its tail in the run.
+func activeSequence(log circularLog, entries map[int64]*logEntry) []*logEntry {
+	var active []*logEntry
+	for _, start := range entries {
+		run := []*logEntry{start}
+		for len(run) <= len(entries) {
+			last := run[len(run)-1]
+			next, ok := entries[(last.offset+int64(last.header.EntryLength))%int64(len(log))]
+			if !ok || next.header.SequenceNumber != last.header.SequenceNumber+1 {
+				break
+			}
+			run = append(run, next)
+		}
+		head := run[len(run)-1]
+		if active != nil && head.header.SequenceNumber <= active[len(active)-1].header.SequenceNumber {
+			continue
+		}
+		for i, e := range run {
+			if e.offset == int64(head.header.Tail) {
+				active = run[i:]
+				break
+			}
+		}
+	}
+	return active
+}
+
+// parseLogEntry parses and validates the log entry at off of the log.
+func parseLogEntry(log circularLog, off int64, guid disk.GUID) (*logEntry, error) {
+	e := &logEntry{offset: off}
+	if err := binary.Read(bytes.NewReader(log.read(off, logEntryHeaderSize)), binary.LittleEndian, &e.header); err != nil {
+		return nil, err
+	}
+	h := e.header
+	if h.Signature != logEntrySignature {
+		return nil, xerrors.Errorf("invalid log entry signature %#x", h.Signature)
+	}
+	if h.EntryLength == 0 || h.EntryLength%logSectorSize != 0 || int64(h.EntryLength) > int64(len(log)) {
+		return nil, xerrors.Errorf("invalid log entry length %d", h.EntryLength)
+	}
+	if h.Tail%logSectorSize != 0 || int64(h.Tail) >= int64(len(log)) {
+		return nil, xerrors.Errorf("invalid log entry tail %d", h.Tail)
+	}
+	if h.LogGUID != guid {
+		return nil, xerrors.Errorf("log entry of log %s", h.LogGUID)
+	}
+	b := log.read(off, int64(h.EntryLength))
+	sum := binary.LittleEndian.Uint32(b[4:])
+	binary.LittleEndian.PutUint32(b[4:], 0)
+	if crc32.Checksum(b, castagnoli) != sum {
+		return nil, xerrors.New("log entry checksum mismatch")
+	}
+
+	descriptorsEnd := logEntryHeaderSize + int64(h.DescriptorCount)*logDescriptorSize
+	if descriptorsEnd > int64(len(b)) {
+		return nil, xerrors.Errorf("%d log descriptors are past the entry", h.DescriptorCount)
+	}
+	descriptors := make([]logDescriptor, h.DescriptorCount)
+	if err := binary.Read(bytes.NewReader(b[logEntryHeaderSize:descriptorsEnd]), binary.LittleEndian, descriptors); err != nil {
+		return nil, err
+	}
+	// Data sectors follow the sectors of the descriptors, in their order.
+	sector := (descriptorsEnd + logSectorSize - 1) / logSectorSize * logSectorSize
+	for _, d := range descriptors {
+		if d.SequenceNumber != h.SequenceNumber {
+			return nil, xerrors.Errorf("log descriptor of sequence %d", d.SequenceNumber)
+		}
+		if d.FileOffset%logSectorSize != 0 {
+			return nil, xerrors.Errorf("unaligned log descriptor offset %d", d.FileOffset)
+		}
+		switch d.Signature {
+		case logZeroDescSignature:
+			length := d.zeroLength()
+			if length%logSectorSize != 0 || length/logSectorSize > maxLogZeroPages {
+				return nil, xerrors.Errorf("invalid zero descriptor length %d", length)
+			}
+			for i := uint64(0); i < length; i += logSectorSize {
+				e.pages = append(e.pages, logPage{offset: int64(d.FileOffset + i)})
+			}
+		case logDataDescSignature:
+			if sector+logSectorSize > int64(len(b)) {
+				return nil, xerrors.New("log data sector past the entry")
+			}
+			s := b[sector : sector+logSectorSize]
+			sector += logSectorSize
+			if binary.LittleEndian.Uint32(s) != logDataSectorSignature {
+				return nil, xerrors.New("invalid log data sector signature")
+			}
+			seq := uint64(binary.LittleEndian.Uint32(s[4:]))<<32 | uint64(binary.LittleEndian.Uint32(s[logSectorSize-4:]))
+			if seq != h.SequenceNumber {
+				return nil, xerrors.Errorf("log data sector of sequence %d", seq)
+			}
+			data := make([]byte, 0, logSectorSize)
+			data = append(data, d.LeadingBytes[:]...)
+			data = append(data, s[logLeadingBytes:logLeadingBytes+logDataSectorDataSize]...)
+			data = append(data, d.TrailingBytes[:]...)
+			e.pages = append(e.pages, logPage{offset: int64(d.FileOffset), data: data})
+		default:
+			return nil, xerrors.Errorf("invalid log descriptor signature %#x", d.Signature)
+		}
+	}
+	return e, nil
+}
+
+// overlay reads r with pages replaced, nil pages reading as zeros. Pages
+// may extend r up to size.
+type overlay struct {
+	r     io.ReaderAt
+	pages map[int64][]byte
+	size  int64
+}
+
+func (o *overlay) ReadAt(p []byte, off int64) (int, error) {
+	n, err := o.r.ReadAt(p, off)
+	if err == io.EOF && off+int64(len(p)) <= o.size {
+		zero(p[n:])
+		n, err = len(p), nil
+	}
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	for page := off / logSectorSize * logSectorSize; page < off+int64(len(p)); page += logSectorSize {
+		data, ok := o.pages[page]
+		if !ok {
+			continue
+		}
+		dst := p
+		src := int64(0)
+		if page >= off {
+			dst = p[page-off:]
+		} else {
+			src = off - page
+		}
+		if data == nil {
+			zero(dst[:min64(int64(len(dst)), logSectorSize-src)])
+		} else {
+			copy(dst, data[src:])
+		}
+	}
+	return n, err
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,118 @@
+package vmdk
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// maxDescriptorSize bounds the size of a descriptor file; real ones are a
+// few hundred bytes.
+const maxDescriptorSize = 1 << 20
+
+// Extent types of the descriptor.
+const (
+	ExtentFlat   = "FLAT"
+	ExtentSparse = "SPARSE"
+	ExtentZero   = "ZERO"
+	ExtentVMFS   = "VMFS"
+)
+
+// ExtentDescriptor is an extent line of a descriptor, such as
+//
+//	RW 4192256 FLAT "disk-f001.vmdk" 0
+type ExtentDescriptor struct {
+	Access  string
+	Sectors int64
+	Type    string
+	File    string
+	// Offset is the sector of the extent file where a flat extent starts.
+	Offset int64
+}
+
+// Descriptor is the text descriptor of a VMDK disk.
+type Descriptor struct {
+	// Fields are the "key = value" lines, such as "createType" or
+	// "parentCID", with the quotes of the values removed.
+	Fields  map[string]string
+	Extents []ExtentDescriptor
+}
+
+// CreateType returns the type of the disk, such as "monolithicSparse".
+func (d *Descriptor) CreateType() string {
+	return d.Fields["createType"]
+}
+
+// ParseDescriptor parses the text descriptor b, either a descriptor file
+// or the one embedded in a sparse extent.
+func ParseDescriptor(b []byte) (*Descriptor, error) {
+	// The embedded descriptor is padded with zeros.
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	d := &Descriptor{Fields: map[string]string{}}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		switch strings.Fields(text)[0] {
+		case "RW", "RDONLY", "NOACCESS":
+			e, err := parseExtentLine(text)
+			if err != nil {
+				return nil, xerrors.Errorf("line %d: %w", line, err)
+			}
+			d.Extents = append(d.Extents, e)
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, xerrors.Errorf("line %d: invalid line %q", line, text)
+		}
+		d.Fields[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	if err := s.Err(); err != nil {
+		return nil, xerrors.Errorf("failed to read descriptor: %w", err)
+	}
+	return d, nil
+}
+
+// parseExtentLine parses an extent line: the access, the size in sectors,
+// the type, and for all but ZERO extents the quoted file name and, for
+// flat extents, the offset.
+func parseExtentLine(text string) (ExtentDescriptor, error) {
+	var e ExtentDescriptor
+	fields := strings.Fields(text)
+	if len(fields) < 3 {
+		return e, xerrors.Errorf("invalid extent %q", text)
+	}
+	sectors, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || sectors < 0 {
+		return e, xerrors.Errorf("invalid extent size %q", fields[1])
+	}
+	e.Access, e.Sectors, e.Type = fields[0], sectors, fields[2]
+	if e.Type == ExtentZero {
+		return e, nil
+	}
+
+	// The file name is quoted and may contain spaces.
+	rest := strings.TrimSpace(strings.SplitN(text, e.Type, 2)[1])
+	if !strings.HasPrefix(rest, `"`) {
+		return e, xerrors.Errorf("extent %q has no file name", text)
+	}
+	end := strings.Index(rest[1:], `"`)
+	if end < 0 {
+		return e, xerrors.Errorf("extent %q has an unterminated file name", text)
+	}
+	e.File = rest[1 : end+1]
+	if offset := strings.TrimSpace(rest[end+2:]); offset != "" {
+		if e.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil || e.Offset < 0 {
+			return e, xerrors.Errorf("invalid extent offset %q", offset)
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,290 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	sparseMagic = 0x564d444b // "KDMV"
+	// gdAtEnd is the grain directory offset of streamOptimized headers;
+	// the footer near the end of the file has the real one.
+	gdAtEnd = 0xffffffffffffffff
+	// footerOffset is the offset of the footer from the end of the file,
+	// followed by the end-of-stream marker.
+	footerOffset = 2 * sectorSize
+
+	flagCompressed     = 1 << 16
+	compressionDeflate = 1
+
+	// zeroGrain is the grain table entry of a grain reading as zeros.
+	zeroGrain = 1
+	// grainMarkerSize is the size of the header of a compressed grain: its
+	// sector and the size of its data.
+	grainMarkerSize = 12
+
+	maxGrainSectors = 1 << 16
+	maxGTEsPerGT    = 1 << 16
+	// maxGrainDirectorySize is 16M grain tables, 512TiB with the usual 512
+	// entries of 64KiB grains.
+	maxGrainDirectorySize = 64 << 20
+	// maxCachedTables bounds the number of grain tables kept in memory.
+	maxCachedTables = 64
+)
+
+type sparseHeader struct {
+	Magic              uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  uint8
+	NonEndLineChar     uint8
+	DoubleEndLineChar1 uint8
+	DoubleEndLineChar2 uint8
+	CompressAlgorithm  uint16
+	_                  [433]byte
+}
+
+func isSparseExtent(head []byte) bool {
+	return len(head) >= 4 && binary.LittleEndian.Uint32(head) == sparseMagic
+}
+
+func readSparseHeader(r io.ReaderAt, off int64) (sparseHeader, error) {
+	var h sparseHeader
+	b := make([]byte, sectorSize)
+	if _, err := r.ReadAt(b, off); err != nil {
+		return h, xerrors.Errorf("failed to read sparse header at %#x: %w", off, err)
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &h); err != nil {
+		return h, xerrors.Errorf("failed to parse sparse header: %w", err)
+	}
+	if h.Magic != sparseMagic {
+		return h, xerrors.Errorf("invalid sparse header magic %#x at %#x", h.Magic, off)
+	}
+	return h, nil
+}
+
+// sparseExtent is a hosted sparse extent, whose grains are found through a
+// grain directory of grain tables.
+type sparseExtent struct {
+	r           io.ReaderAt
+	h           sparseHeader
+	grainBytes  int64
+	compressed  bool
+	directory   []uint32
+	gtCoverage  int64
+	tableLength int64
+
+	mu sync.Mutex
+	// tables caches the grain tables by sector.
+	tables map[uint32][]uint32
+	// grainSector and grain cache the last decompressed grain.
+	grainSector uint32
+	grain       []byte
+}
+
+// openSparseExtent opens the sparse extent r of size bytes. The header of
+// streamOptimized extents is replaced by their footer.
+func openSparseExtent(r io.ReaderAt, size int64) (*sparseExtent, error) {
+	h, err := readSparseHeader(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if h.GDOffset == gdAtEnd {
+		if h, err = readSparseHeader(r, size-footerOffset); err != nil {
+			return nil, xerrors.Errorf("failed to read footer: %w", err)
+		}
+	}
+	if h.Version < 1 || h.Version > 3 {
+		return nil, xerrors.Errorf("unsupported sparse extent version %d", h.Version)
+	}
+	if h.GrainSize == 0 || h.GrainSize > maxGrainSectors || h.GrainSize&(h.GrainSize-1) != 0 {
+		return nil, xerrors.Errorf("invalid grain size %d", h.GrainSize)
+	}
+	if h.NumGTEsPerGT == 0 || h.NumGTEsPerGT > maxGTEsPerGT {
+		return nil, xerrors.Errorf("invalid number of grain table entries %d", h.NumGTEsPerGT)
+	}
+	if h.Capacity > math.MaxInt64/sectorSize {
+		return nil, xerrors.Errorf("invalid capacity of %d sectors", h.Capacity)
+	}
+	if h.GDOffset > math.MaxInt64/sectorSize {
+		return nil, xerrors.Errorf("invalid grain directory sector %d", h.GDOffset)
+	}
+	e := &sparseExtent{
+		r:           r,
+		h:           h,
+		grainBytes:  int64(h.GrainSize) * sectorSize,
+		compressed:  h.Flags&flagCompressed != 0,
+		tableLength: int64(h.NumGTEsPerGT),
+		tables:      map[uint32][]uint32{},
+	}
+	if e.compressed && h.CompressAlgorithm != compressionDeflate {
+		return nil, xerrors.Errorf("unsupported compression algorithm %d", h.CompressAlgorithm)
+	}
+	e.gtCoverage = e.grainBytes * e.tableLength
+
+	tables := e.capacity() / e.gtCoverage
+	if e.capacity()%e.gtCoverage != 0 {
+		tables++
+	}
+	if tables > maxGrainDirectorySize/4 {
+		return nil, xerrors.Errorf("grain directory of %d entries is too large", tables)
+	}
+	b := make([]byte, 4*tables)
+	if _, err := r.ReadAt(b, int64(h.GDOffset)*sectorSize); err != nil {
+		return nil, xerrors.Errorf("failed to read grain directory: %w", err)
+	}
+	e.directory = make([]uint32, tables)
+	for i := range e.directory {
+		e.directory[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	return e, nil
+}
+
+func (e *sparseExtent) capacity() int64 {
+	return int64(e.h.Capacity) * sectorSize
+}
+
+// readDescriptor reads the embedded descriptor, empty when there is none.
+func (e *sparseExtent) readDescriptor() (*Descriptor, error) {
+	if e.h.DescriptorOffset == 0 || e.h.DescriptorSize == 0 {
+		return &Descriptor{Fields: map[string]string{}}, nil
+	}
+	if e.h.DescriptorSize > maxDescriptorSize/sectorSize || e.h.DescriptorOffset > math.MaxInt64/sectorSize {
+		return nil, xerrors.Errorf("embedded descriptor of %d sectors is too large", e.h.DescriptorSize)
+	}
+	b := make([]byte, e.h.DescriptorSize*sectorSize)
+	if _, err := e.r.ReadAt(b, int64(e.h.DescriptorOffset)*sectorSize); err != nil {
+		return nil, xerrors.Errorf("failed to read embedded descriptor: %w", err)
+	}
+	d, err := ParseDescriptor(b)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse embedded descriptor: %w", err)
+	}
+	return d, nil
+}
+
+func (e *sparseExtent) readAt(p []byte, off int64) error {
+	for len(p) > 0 {
+		inGrain := off % e.grainBytes
+		chunk := p
+		if rest := e.grainBytes - inGrain; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if err := e.readGrain(chunk, off/e.grainBytes, inGrain); err != nil {
+			return err
+		}
+		p = p[len(chunk):]
+		off += int64(len(chunk))
+	}
+	return nil
+}
+
+// readGrain fills p from grain at offset off in it.
+func (e *sparseExtent) readGrain(p []byte, grain, off int64) error {
+	entry, err := e.tableEntry(grain)
+	if err != nil {
+		return err
+	}
+	switch {
+	case entry == 0 || entry == zeroGrain:
+		zero(p)
+		return nil
+	case e.compressed:
+		data, err := e.decompress(entry)
+		if err != nil {
+			return err
+		}
+		copy(p, data[off:])
+		return nil
+	}
+	n, err := e.r.ReadAt(p, int64(entry)*sectorSize+off)
+	if err == io.EOF && n == len(p) {
+		return nil
+	}
+	return err
+}
+
+// tableEntry returns the grain table entry of grain, zero when its grain
+// table is not allocated.
+func (e *sparseExtent) tableEntry(grain int64) (uint32, error) {
+	index := grain / e.tableLength
+	if index >= int64(len(e.directory)) {
+		return 0, xerrors.Errorf("grain %d is past the grain directory", grain)
+	}
+	sector := e.directory[index]
+	if sector == 0 {
+		return 0, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	table, ok := e.tables[sector]
+	if !ok {
+		b := make([]byte, 4*e.tableLength)
+		if _, err := e.r.ReadAt(b, int64(sector)*sectorSize); err != nil {
+			return 0, xerrors.Errorf("failed to read grain table at sector %d: %w", sector, err)
+		}
+		table = make([]uint32, e.tableLength)
+		for i := range table {
+			table[i] = binary.LittleEndian.Uint32(b[4*i:])
+		}
+		if len(e.tables) >= maxCachedTables {
+			e.tables = map[uint32][]uint32{}
+		}
+		e.tables[sector] = table
+	}
+	return table[grain%e.tableLength], nil
+}
+
+// decompress returns the content of the compressed grain at sector. It
+// starts with a marker holding the size of the zlib stream that follows.
+func (e *sparseExtent) decompress(sector uint32) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.grain != nil && e.grainSector == sector {
+		return e.grain, nil
+	}
+
+	off := int64(sector) * sectorSize
+	marker := make([]byte, grainMarkerSize)
+	if _, err := e.r.ReadAt(marker, off); err != nil {
+		return nil, xerrors.Errorf("failed to read grain marker at sector %d: %w", sector, err)
+	}
+	size := int64(binary.LittleEndian.Uint32(marker[8:]))
+	// Deflate cannot expand data by more than a few bytes per block.
+	if size > 2*e.grainBytes {
+		return nil, xerrors.Errorf("compressed grain at sector %d: invalid size %d", sector, size)
+	}
+	b := make([]byte, size)
+	if _, err := e.r.ReadAt(b, off+grainMarkerSize); err != nil {
+		return nil, xerrors.Errorf("failed to read compressed grain at sector %d: %w", sector, err)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, xerrors.Errorf("compressed grain at sector %d: %w", sector, err)
+	}
+	defer zr.Close()
+	// The last grain may be shorter than the others.
+	data := make([]byte, e.grainBytes)
+	if _, err := io.ReadFull(zr, data); err != nil && err != io.ErrUnexpectedEOF {
+		return nil, xerrors.Errorf("failed to decompress grain at sector %d: %w", sector, err)
+	}
+	e.grainSector = sector
+	e.grain = data
+	return data, nil
+}
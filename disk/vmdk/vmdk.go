@@ -0,0 +1,198 @@
+// Package vmdk reads VMware virtual disks as the raw disk they hold:
+// monolithicSparse and streamOptimized disks, and descriptor files made of
+// flat, sparse and zero extents.
+package vmdk
+
+import (
+	"io"
+	"math"
+
+	"golang.org/x/xerrors"
+)
+
+const sectorSize = 512
+
+// ExtentOpener opens the extent file name of a descriptor, returning its
+// content and size.
+type ExtentOpener func(name string) (io.ReaderAt, int64, error)
+
+// Option configures an Image opened by Open.
+type Option func(*Image)
+
+// WithExtentOpener supplies the opener of the extent files a descriptor
+// file refers to.
+func WithExtentOpener(open ExtentOpener) Option {
+	return func(img *Image) {
+		img.open = open
+	}
+}
+
+// extent is a part of the disk.
+type extent interface {
+	// readAt fills p from byte offset off of the extent.
+	readAt(p []byte, off int64) error
+}
+
+// diskExtent is an extent at byte offset start of the disk.
+type diskExtent struct {
+	start int64
+	size  int64
+	extent
+}
+
+// Image is a VMDK disk. It implements io.ReaderAt and is safe for
+// concurrent use.
+type Image struct {
+	descriptor *Descriptor
+	extents    []diskExtent
+	size       int64
+	open       ExtentOpener
+}
+
+// Open opens the VMDK disk r of size bytes, either a sparse extent with its
+// embedded descriptor or a descriptor file, whose extent files are opened
+// with the opener supplied by WithExtentOpener. Grains not allocated in a
+// sparse extent read as zeros; the parents of delta disks are not read.
+func Open(r io.ReaderAt, size int64, opts ...Option) (*Image, error) {
+	img := &Image{}
+	for _, opt := range opts {
+		opt(img)
+	}
+
+	head := make([]byte, sectorSize)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, xerrors.Errorf("failed to read header: %w", err)
+	}
+	head = head[:n]
+
+	if isSparseExtent(head) {
+		e, err := openSparseExtent(r, size)
+		if err != nil {
+			return nil, err
+		}
+		if img.descriptor, err = e.readDescriptor(); err != nil {
+			return nil, err
+		}
+		img.add(e, e.capacity())
+		return img, nil
+	}
+
+	if size > maxDescriptorSize {
+		return nil, xerrors.Errorf("not a sparse extent, and too large for a descriptor")
+	}
+	b := make([]byte, size)
+	if _, err := r.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, xerrors.Errorf("failed to read descriptor: %w", err)
+	}
+	if img.descriptor, err = ParseDescriptor(b); err != nil {
+		return nil, xerrors.Errorf("failed to parse descriptor: %w", err)
+	}
+	for i, ed := range img.descriptor.Extents {
+		if ed.Sectors > (math.MaxInt64-img.size)/sectorSize {
+			return nil, xerrors.Errorf("extent %d: invalid size of %d sectors", i, ed.Sectors)
+		}
+		e, err := img.openExtent(ed)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to open extent %d: %w", i, err)
+		}
+		img.add(e, ed.Sectors*sectorSize)
+	}
+	return img, nil
+}
+
+func (img *Image) add(e extent, size int64) {
+	img.extents = append(img.extents, diskExtent{start: img.size, size: size, extent: e})
+	img.size += size
+}
+
+func (img *Image) openExtent(ed ExtentDescriptor) (extent, error) {
+	if ed.Type == ExtentZero {
+		return zeroExtent{}, nil
+	}
+	if img.open == nil {
+		return nil, xerrors.Errorf("extent file %q requires WithExtentOpener", ed.File)
+	}
+	r, size, err := img.open(ed.File)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open extent file %q: %w", ed.File, err)
+	}
+	switch ed.Type {
+	case ExtentFlat, ExtentVMFS:
+		return flatExtent{r: r, offset: ed.Offset * sectorSize}, nil
+	case ExtentSparse:
+		e, err := openSparseExtent(r, size)
+		if err != nil {
+			return nil, xerrors.Errorf("extent file %q: %w", ed.File, err)
+		}
+		return e, nil
+	}
+	return nil, xerrors.Errorf("unsupported extent type %s", ed.Type)
+}
+
+// Descriptor returns the descriptor of the disk.
+func (img *Image) Descriptor() *Descriptor {
+	return img.descriptor
+}
+
+// Size returns the size of the disk.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// ReadAt reads the disk at off.
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, xerrors.Errorf("negative offset %d", off)
+	}
+	var n int
+	for _, e := range img.extents {
+		if n == len(p) {
+			break
+		}
+		pos := off + int64(n)
+		if pos >= e.start+e.size {
+			continue
+		}
+		chunk := p[n:]
+		if rest := e.start + e.size - pos; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if err := e.readAt(chunk, pos-e.start); err != nil {
+			return n, xerrors.Errorf("failed to read at %#x: %w", pos, err)
+		}
+		n += len(chunk)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// flatExtent is an extent stored as is from byte offset offset of r.
+type flatExtent struct {
+	r      io.ReaderAt
+	offset int64
+}
+
+func (e flatExtent) readAt(p []byte, off int64) error {
+	n, err := e.r.ReadAt(p, e.offset+off)
+	if err == io.EOF && n == len(p) {
+		return nil
+	}
+	return err
+}
+
+// zeroExtent is an extent reading as zeros.
+type zeroExtent struct{}
+
+func (zeroExtent) readAt(p []byte, _ int64) error {
+	zero(p)
+	return nil
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
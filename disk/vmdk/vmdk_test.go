@@ -0,0 +1,242 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"testing"
+)
+
+const (
+	testGrainSectors = 8
+	testGrainSize    = testGrainSectors * sectorSize
+	testGTEsPerGT    = 4
+	// testCapacity ends in the middle of grain 10.
+	testCapacity = 10*testGrainSectors + 3
+)
+
+const testEmbeddedDescriptor = `# Disk DescriptorFile
+version=1
+CID=12345678
+parentCID=ffffffff
+createType="monolithicSparse"
+
+RW 83 SPARSE "test.vmdk"
+`
+
+// buildSparse builds a sparse extent of testCapacity sectors:
+//
+//	grains 0, 1 and 10  allocated, filled with 'a' + the grain number
+//	grain 2             zero grain
+//	grain 3, 8 and 9    not allocated
+//	grains 4 to 7       grain table not allocated
+//
+// Compressed extents have their grains compressed behind markers, and
+// streamOptimized ones their grain directory in the footer.
+func buildSparse(t *testing.T, compressed, streamOptimized bool) (image, want []byte) {
+	t.Helper()
+	want = make([]byte, testCapacity*sectorSize)
+	var out bytes.Buffer
+	sector := func() uint32 { return uint32(out.Len() / sectorSize) }
+	pad := func() {
+		out.Write(make([]byte, (sectorSize-out.Len()%sectorSize)%sectorSize))
+	}
+
+	h := sparseHeader{
+		Magic:            sparseMagic,
+		Version:          1,
+		Capacity:         testCapacity,
+		GrainSize:        testGrainSectors,
+		DescriptorOffset: 1,
+		DescriptorSize:   1,
+		NumGTEsPerGT:     testGTEsPerGT,
+		GDOffset:         2,
+	}
+	if compressed {
+		h.Version = 3
+		h.Flags |= flagCompressed
+		h.CompressAlgorithm = compressionDeflate
+	}
+	header := h
+	if streamOptimized {
+		header.GDOffset = gdAtEnd
+	}
+	binary.Write(&out, binary.LittleEndian, header)
+	out.WriteString(testEmbeddedDescriptor)
+	pad()
+
+	tables := [3][testGTEsPerGT]uint32{}
+	tables[0][2] = zeroGrain
+	var grainsStart uint32
+	if !streamOptimized {
+		// The grain directory and tables come first.
+		out.Write(make([]byte, 4*sectorSize))
+		grainsStart = sector()
+	}
+	for _, grain := range []int{0, 1, 10} {
+		data := bytes.Repeat([]byte{byte('a' + grain)}, testGrainSize)
+		copy(want[grain*testGrainSize:], data)
+		tables[grain/testGTEsPerGT][grain%testGTEsPerGT] = sector()
+		if !compressed {
+			out.Write(data)
+			continue
+		}
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(data)
+		zw.Close()
+		binary.Write(&out, binary.LittleEndian, uint64(grain*testGrainSectors))
+		binary.Write(&out, binary.LittleEndian, uint32(z.Len()))
+		out.Write(z.Bytes())
+		pad()
+	}
+
+	directory := [3]uint32{}
+	if streamOptimized {
+		for _, i := range []int{0, 2} {
+			directory[i] = sector()
+			binary.Write(&out, binary.LittleEndian, tables[i])
+			pad()
+		}
+		h.GDOffset = uint64(sector())
+		binary.Write(&out, binary.LittleEndian, directory)
+		pad()
+		// The footer marker, the footer and the end-of-stream marker.
+		out.Write(make([]byte, sectorSize))
+		binary.Write(&out, binary.LittleEndian, h)
+		out.Write(make([]byte, sectorSize))
+		return out.Bytes(), want
+	}
+
+	image = out.Bytes()
+	for _, i := range []int{0, 2} {
+		directory[i] = grainsStart - 3 + uint32(i)
+		b := &bytes.Buffer{}
+		binary.Write(b, binary.LittleEndian, tables[i])
+		copy(image[int(directory[i])*sectorSize:], b.Bytes())
+	}
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.LittleEndian, directory)
+	copy(image[2*sectorSize:], b.Bytes())
+	return image, want
+}
+
+func readAll(t *testing.T, img *Image) []byte {
+	t.Helper()
+	got, err := io.ReadAll(io.NewSectionReader(img, 0, img.Size()))
+	if err != nil {
+		t.Fatalf("ReadAll() error: %v", err)
+	}
+	return got
+}
+
+func TestOpenSparse(t *testing.T) {
+	for _, tt := range []struct {
+		name                        string
+		compressed, streamOptimized bool
+	}{
+		{"monolithicSparse", false, false},
+		{"compressed", true, false},
+		{"streamOptimized", true, true},
+	} {
+		image, want := buildSparse(t, tt.compressed, tt.streamOptimized)
+		img, err := Open(bytes.NewReader(image), int64(len(image)))
+		if err != nil {
+			t.Fatalf("%s: Open() error: %v", tt.name, err)
+		}
+		if img.Size() != testCapacity*sectorSize {
+			t.Errorf("%s: Size() = %d, want %d", tt.name, img.Size(), testCapacity*sectorSize)
+		}
+		if got := img.Descriptor().CreateType(); got != "monolithicSparse" {
+			t.Errorf("%s: CreateType() = %q", tt.name, got)
+		}
+		if got := readAll(t, img); !bytes.Equal(got, want) {
+			t.Errorf("%s: content differs", tt.name)
+		}
+	}
+}
+
+func TestOpenSparseInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		off   int
+		value uint64
+	}{
+		{"capacity overflowing bytes", 12, math.MaxInt64/sectorSize + 1},
+		{"negative capacity", 12, math.MaxUint64},
+		{"grain directory sector overflowing bytes", 56, math.MaxInt64/sectorSize + 1},
+	} {
+		image, _ := buildSparse(t, false, false)
+		binary.LittleEndian.PutUint64(image[tt.off:], tt.value)
+		if _, err := Open(bytes.NewReader(image), int64(len(image))); err == nil {
+			t.Errorf("%s: Open() succeeded", tt.name)
+		}
+	}
+
+	// Extents adding up past the largest int64.
+	descriptor := []byte(fmt.Sprintf("RW %d ZERO\nRW %d ZERO\n", math.MaxInt64/sectorSize, 1))
+	if _, err := Open(bytes.NewReader(descriptor), int64(len(descriptor))); err == nil {
+		t.Error("Open() of extents past the largest size succeeded")
+	}
+}
+
+func TestOpenDescriptor(t *testing.T) {
+	sparse, sparseContent := buildSparse(t, false, false)
+	files := map[string][]byte{
+		"disk f001.vmdk": bytes.Repeat([]byte{1}, 4*sectorSize),
+		"disk-f002.vmdk": append(bytes.Repeat([]byte{9}, sectorSize), bytes.Repeat([]byte{2}, 3*sectorSize)...),
+		"disk-s003.vmdk": sparse,
+	}
+	descriptor := []byte(`# Disk DescriptorFile
+version=1
+CID=fffffffe
+parentCID=ffffffff
+createType="twoGbMaxExtentFlat"
+
+# Extent description
+RW 4 FLAT "disk f001.vmdk" 0
+RW 2 ZERO
+RDONLY 3 FLAT "disk-f002.vmdk" 1
+RW 83 SPARSE "disk-s003.vmdk"
+
+ddb.adapterType = "lsilogic"
+`)
+	var want []byte
+	want = append(want, files["disk f001.vmdk"]...)
+	want = append(want, make([]byte, 2*sectorSize)...)
+	want = append(want, files["disk-f002.vmdk"][sectorSize:]...)
+	want = append(want, sparseContent...)
+
+	if _, err := Open(bytes.NewReader(descriptor), int64(len(descriptor))); err == nil {
+		t.Error("Open() of a descriptor without an extent opener succeeded")
+	}
+	img, err := Open(bytes.NewReader(descriptor), int64(len(descriptor)), WithExtentOpener(func(name string) (io.ReaderAt, int64, error) {
+		b, ok := files[name]
+		if !ok {
+			return nil, 0, os.ErrNotExist
+		}
+		return bytes.NewReader(b), int64(len(b)), nil
+	}))
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if got := img.Descriptor().Fields["ddb.adapterType"]; got != "lsilogic" {
+		t.Errorf("ddb.adapterType = %q, want lsilogic", got)
+	}
+	if got := readAll(t, img); !bytes.Equal(got, want) {
+		t.Error("content differs")
+	}
+
+	// A read spanning the flat and zero extents.
+	p := make([]byte, 2*sectorSize)
+	if _, err := img.ReadAt(p, 3*sectorSize+100); err != nil {
+		t.Fatalf("ReadAt() error: %v", err)
+	}
+	if !bytes.Equal(p, want[3*sectorSize+100:5*sectorSize+100]) {
+		t.Error("ReadAt() across extents differs")
+	}
+}
@@ -0,0 +1,363 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// backupBlockSizes are the block sizes tried when searching for a backup
+// superblock and no block size was given with WithBlockSize.
+var backupBlockSizes = []int64{1024, 2048, 4096, 8192, 16384, 32768, 65536}
+
+// SuperblockGroup returns the group whose copy of the superblock is in use.
+// It is 0 unless the primary superblock was damaged or a backup was chosen
+// with WithSuperblockBackup.
+func (ext4 *FileSystem) SuperblockGroup() int64 {
+	return ext4.sbGroup
+}
+
+// GroupDescriptorTableGroup returns the group whose copy of the group
+// descriptor table is in use.
+func (ext4 *FileSystem) GroupDescriptorTableGroup() int64 {
+	return ext4.gdtGroup
+}
+
+// readSuperblockAt reads and decodes the superblock at byte offset off.
+func readSuperblockAt(r io.ReaderAt, off int64) (Superblock, []byte, error) {
+	raw := make([]byte, SuperBlockSize)
+	if _, err := r.ReadAt(raw, off); err != nil {
+		return Superblock{}, nil, xerrors.Errorf("failed to read super block: %w", err)
+	}
+	var sb Superblock
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &sb); err != nil {
+		return Superblock{}, nil, xerrors.Errorf("failed to binary read super block: %w", err)
+	}
+	if sb.Magic != 0xEF53 {
+		return Superblock{}, nil, xerrors.New("unsupported block")
+	}
+	return sb, raw, nil
+}
+
+// validate checks that the fields used to locate the rest of the metadata
+// are consistent.
+func (sb *Superblock) validate() error {
+	switch {
+	case sb.LogBlockSize > 6:
+		return xerrors.Errorf("invalid block size: 1024 << %d", sb.LogBlockSize)
+	case sb.BlockPerGroup == 0 || int64(sb.BlockPerGroup) > 8*sb.GetBlockSize():
+		return xerrors.Errorf("invalid blocks per group: %d", sb.BlockPerGroup)
+	case sb.InodePerGroup == 0:
+		return xerrors.New("invalid inodes per group: 0")
+	case sb.RevLevel > 0 && (sb.InodeSize < 128 || int64(sb.InodeSize) > sb.GetBlockSize() || sb.InodeSize&(sb.InodeSize-1) != 0):
+		return xerrors.Errorf("invalid inode size: %d", sb.InodeSize)
+	case sb.FeatureInCompat64bit() && (sb.DescSize < 64 || sb.DescSize > 1024 || sb.DescSize&(sb.DescSize-1) != 0):
+		return xerrors.Errorf("invalid group descriptor size: %d", sb.DescSize)
+	case int64(sb.FirstDataBlock) >= sb.GetBlockCount():
+		return xerrors.Errorf("first data block %d is past the block count %d", sb.FirstDataBlock, sb.GetBlockCount())
+	}
+
+	numBlockGroups := int64(sb.GetGroupDescriptorTableCount())
+	numBlockGroups2 := (sb.InodeCount + sb.InodePerGroup - 1) / sb.InodePerGroup
+	if numBlockGroups != int64(numBlockGroups2) {
+		return xerrors.Errorf("Block/inode mismatch: %d %d %d", sb.GetBlockCount(), numBlockGroups, numBlockGroups2)
+	}
+	return nil
+}
+
+// groupFirstBlock returns the first block of group.
+func (sb *Superblock) groupFirstBlock(group int64) int64 {
+	return int64(sb.FirstDataBlock) + group*int64(sb.BlockPerGroup)
+}
+
+// loadSuperblock reads the superblock. The primary copy is used unless it
+// is damaged or a backup group was chosen with WithSuperblockBackup, in
+// which case the backup copies are searched.
+func (ext4 *FileSystem) loadSuperblock() error {
+	if ext4.forceGroup && ext4.sbGroup != 0 {
+		sb, err := ext4.findBackupSuperblock([]int64{ext4.sbGroup})
+		if err != nil {
+			return err
+		}
+		ext4.sb = sb
+		return nil
+	}
+
+	sb, raw, err := readSuperblockAt(ext4.r, GroupZeroPadding)
+	if err == nil {
+		err = ext4.checkSuperblock(&sb, raw, GroupZeroPadding)
+	}
+	if err == nil || ext4.forceGroup {
+		ext4.sb = sb
+		return err
+	}
+
+	groups := backupGroupCandidates(ext4.r.Size(), ext4.backupGeometries())
+	backup, backupErr := ext4.findBackupSuperblock(groups)
+	if backupErr != nil {
+		return xerrors.Errorf("no usable backup super block (%v): %w", backupErr, err)
+	}
+	ext4.tolerate(xerrors.Errorf("primary super block is damaged, using the backup in group %d: %w", ext4.sbGroup, err))
+	ext4.sb = backup
+	return nil
+}
+
+// checkSuperblock validates sb, and its checksum when checksum verification
+// is enabled. raw is the superblock as read at byte offset off.
+func (ext4 *FileSystem) checkSuperblock(sb *Superblock, raw []byte, off int64) error {
+	if err := sb.validate(); err != nil {
+		return err
+	}
+	if ext4.verifyChecksums {
+		return verifySuperblockChecksum(sb, raw, off/sb.GetBlockSize())
+	}
+	return nil
+}
+
+// backupGeometry is a block size and group size with which backup
+// superblocks are searched.
+type backupGeometry struct {
+	blockSize      int64
+	blocksPerGroup int64
+}
+
+// probe returns a superblock locating the groups of g.
+func (g backupGeometry) probe() Superblock {
+	probe := Superblock{BlockPerGroup: uint32(g.blocksPerGroup)}
+	if g.blockSize == 1024 {
+		probe.FirstDataBlock = 1
+	}
+	return probe
+}
+
+// backupGeometries returns the geometries tried when searching for a
+// backup superblock: the block size given with WithBlockSize or every
+// valid one, with the group size given with WithBlocksPerGroup or the
+// default of one bitmap block.
+func (ext4 *FileSystem) backupGeometries() []backupGeometry {
+	blockSizes := backupBlockSizes
+	if ext4.blockSize != 0 {
+		blockSizes = []int64{ext4.blockSize}
+	}
+	var geometries []backupGeometry
+	for _, blockSize := range blockSizes {
+		g := backupGeometry{blockSize: blockSize, blocksPerGroup: 8 * blockSize}
+		if ext4.blocksPerGroup != 0 {
+			g.blocksPerGroup = ext4.blocksPerGroup
+		}
+		geometries = append(geometries, g)
+	}
+	return geometries
+}
+
+// findBackupSuperblock returns the first valid backup superblock stored in
+// one of groups, trying every candidate geometry. ext4.sbGroup is set to
+// the group it was found in.
+func (ext4 *FileSystem) findBackupSuperblock(groups []int64) (Superblock, error) {
+	var lastErr error
+	for _, group := range groups {
+		for _, g := range ext4.backupGeometries() {
+			blockSize := g.blockSize
+			probe := g.probe()
+			off := probe.groupFirstBlock(group) * blockSize
+			if off+SuperBlockSize > ext4.r.Size() {
+				continue
+			}
+
+			sb, raw, err := readSuperblockAt(ext4.r, off)
+			if err == nil && (sb.GetBlockSize() != blockSize || sb.groupFirstBlock(group)*blockSize != off ||
+				int64(sb.BlockGroupNr) != group) {
+				err = xerrors.Errorf("super block at offset %d does not belong to group %d", off, group)
+			}
+			if err == nil {
+				err = ext4.checkSuperblock(&sb, raw, off)
+			}
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ext4.sbGroup = group
+			return sb, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = xerrors.Errorf("no backup super block in groups %v", groups)
+	}
+	return Superblock{}, lastErr
+}
+
+// backupGroupCandidates returns the groups of an image of size bytes that
+// may hold a backup superblock with one of geometries, in ascending order:
+// with sparse_super, 1 and the powers of 3, 5 and 7 up to the last group,
+// and with sparse_super2 also the last group of each geometry.
+func backupGroupCandidates(size int64, geometries []backupGeometry) []int64 {
+	var lasts []int64
+	var maxGroup int64
+	for _, g := range geometries {
+		blocks := size/g.blockSize - int64(g.probe().FirstDataBlock)
+		last := (blocks - 1) / g.blocksPerGroup
+		lasts = append(lasts, last)
+		if last > maxGroup {
+			maxGroup = last
+		}
+	}
+
+	groups := []int64{1}
+	for _, base := range []int64{3, 5, 7} {
+		for g := base; g <= maxGroup; g *= base {
+			groups = append(groups, g)
+		}
+	}
+	for _, last := range lasts {
+		if last > 1 {
+			groups = append(groups, last)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+
+	unique := groups[:1]
+	for _, g := range groups[1:] {
+		if g != unique[len(unique)-1] {
+			unique = append(unique, g)
+		}
+	}
+	return unique
+}
+
+// groupDescriptorBlock returns block i of the copy of the group descriptor
+// table stored with the superblock of group. With meta_bg, the blocks past
+// FirstMetaBg are stored in their own meta group instead: in its first group
+// for the primary copy and in its second group for the backups.
+func (sb *Superblock) groupDescriptorBlock(i, group int64) int64 {
+	if !sb.FeatureIncompatMetaBg() || i < int64(sb.FirstMetaBg) {
+		return sb.groupFirstBlock(group) + 1 + i
+	}
+	g := i * sb.GetBlockSize() / int64(sb.groupDescriptorSize())
+	if group != 0 {
+		g++
+	}
+	var hasSuper int64
+	if sb.GroupHasSuperblock(g) {
+		hasSuper = 1
+	}
+	return sb.groupFirstBlock(g) + hasSuper
+}
+
+// readGroupDescriptorTable reads the copy of the group descriptor table
+// stored with the superblock of group, returning the decoded descriptors
+// and the raw table.
+func (sb *Superblock) readGroupDescriptorTable(r io.ReaderAt, group int64) ([]GroupDescriptor, []byte, error) {
+	blockSize := sb.GetBlockSize()
+	raw := make([]byte, int64(sb.GetGroupDescriptorTableCount())*int64(sb.groupDescriptorSize()))
+	for i := int64(0); i*blockSize < int64(len(raw)); i++ {
+		block := sb.groupDescriptorBlock(i, group)
+		end := (i + 1) * blockSize
+		if end > int64(len(raw)) {
+			end = int64(len(raw))
+		}
+		if _, err := r.ReadAt(raw[i*blockSize:end], block*blockSize); err != nil {
+			return nil, nil, xerrors.Errorf("failed to read group descriptor block %d: %w", block, err)
+		}
+	}
+	gds, err := sb.parseGroupDescriptors(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, xerrors.Errorf("failed to parse group descriptors: %w", err)
+	}
+	return gds, raw, nil
+}
+
+// validateGroupDescriptors checks that the bitmaps and inode table of every
+// group lie within the filesystem.
+func (sb *Superblock) validateGroupDescriptors(gds []GroupDescriptor) error {
+	is64 := sb.FeatureInCompat64bit()
+	first, end := int64(sb.FirstDataBlock), sb.GetBlockCount()
+	for i, gd := range gds {
+		for _, block := range []int64{gd.GetBlockBitmapLoc(is64), gd.GetInodeBitmapLoc(is64), gd.GetInodeTableLoc(is64)} {
+			if block <= first || block >= end {
+				return xerrors.Errorf("group %d: metadata block %d is out of range", i, block)
+			}
+		}
+	}
+	return nil
+}
+
+// loadGroupDescriptors reads the group descriptor table stored with the
+// superblock in use. If that copy is damaged the other copies are tried,
+// unless a backup group was chosen with WithSuperblockBackup.
+func (ext4 *FileSystem) loadGroupDescriptors() error {
+	groups := []int64{ext4.sbGroup}
+	if !ext4.forceGroup {
+		for g := int64(0); g < int64(ext4.sb.GetGroupDescriptorTableCount()); g++ {
+			if g != ext4.sbGroup && ext4.sb.GroupHasSuperblock(g) {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	var firstErr error
+	var firstGds []GroupDescriptor
+	var firstGroup int64
+	for _, group := range groups {
+		gds, raw, err := ext4.sb.readGroupDescriptorTable(ext4.r, group)
+		if err == nil && firstGds == nil {
+			firstGds, firstGroup = gds, group
+		}
+		if err == nil {
+			err = ext4.sb.validateGroupDescriptors(gds)
+		}
+		if err == nil && ext4.verifyChecksums {
+			err = verifyGroupDescriptorChecksums(&ext4.sb, raw, ext4.sb.groupDescriptorBlock(0, group))
+		}
+		if err == nil {
+			if firstErr != nil {
+				ext4.tolerate(xerrors.Errorf("group descriptor table is damaged, using the backup in group %d: %w", group, firstErr))
+			}
+			ext4.setGroupDescriptors(gds, group)
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstGds != nil && ext4.tolerate(firstErr) {
+		ext4.setGroupDescriptors(firstGds, firstGroup)
+		return nil
+	}
+	return firstErr
+}
+
+// setGroupDescriptors uses gds, read from the copy stored in group. The
+// uninitialized flags and unused inode counts of a backup copy date from
+// mkfs or the last resize, so they are cleared as e2fsck does: every
+// bitmap and inode table is then read. The flags as stored are kept in
+// ext4.storedFlags.
+func (ext4 *FileSystem) setGroupDescriptors(gds []GroupDescriptor, group int64) {
+	ext4.storedFlags = nil
+	if group != 0 {
+		ext4.storedFlags = make([]uint16, len(gds))
+		for i := range gds {
+			ext4.storedFlags[i] = gds[i].Flags
+			gds[i].Flags &^= BG_INODE_UNINIT | BG_BLOCK_UNINIT
+			gds[i].ItableUnusedLo = 0
+			gds[i].ItableUnusedHi = 0
+		}
+	}
+	ext4.gds = gds
+	ext4.gdtGroup = group
+}
+
+// bitmapChecksummed reports whether the bitmap of group marked by flag has
+// a checksum. Uninitialized bitmaps have none, including those of a backup
+// copy of the group descriptors whose flags were cleared: their checksums
+// are as stale as the flags.
+func (ext4 *FileSystem) bitmapChecksummed(group int64, flag uint16) bool {
+	flags := ext4.gds[group].Flags
+	if ext4.storedFlags != nil {
+		flags = ext4.storedFlags[group]
+	}
+	return flags&flag == 0
+}
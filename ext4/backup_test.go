@@ -0,0 +1,223 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+// testBackupGroupStart is the first block of group 1 of a test image with
+// two groups, where the backup superblock and group descriptor table live.
+const testBackupGroupStart = 1 + 8192
+
+// backupImage serializes img as a filesystem of two groups whose second
+// group holds a backup of the superblock and the group descriptor table.
+func backupImage(img *testImage) []byte {
+	groupStart := 1 + int64(img.SB.BlockPerGroup)
+	img.SB.BlockCountLo = uint32(groupStart) + 16
+	img.SB.InodeCount = 2 * testInodesPerGroup
+	img.SB.FeatureRoCompat |= FEATURE_RO_COMPAT_SPARSE_SUPER
+
+	data := make([]byte, int64(img.SB.BlockCountLo)*testBlockSize)
+	copy(data, img.bytes())
+
+	// Group 1: backups, block bitmap, inode bitmap and inode table.
+	gd := GroupDescriptor32{
+		BlockBitmapLo: uint32(groupStart) + 2,
+		InodeBitmapLo: uint32(groupStart) + 3,
+		InodeTableLo:  uint32(groupStart) + 4,
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, gd)
+	copy(data[2*testBlockSize+32:], buf.Bytes())
+
+	backup := data[groupStart*testBlockSize:]
+	copy(backup, data[testBlockSize:3*testBlockSize])
+	binary.LittleEndian.PutUint16(backup[0x5A:], 1) // s_block_group_nr
+	return data
+}
+
+func TestSuperblockBackup(t *testing.T) {
+	zeroSuperblock := func(b []byte) { copy(b[GroupZeroPadding:], make([]byte, SuperBlockSize)) }
+	zeroGDT := func(b []byte) { copy(b[2*testBlockSize:], make([]byte, testBlockSize)) }
+
+	tests := []struct {
+		name           string
+		blocksPerGroup uint32
+		corrupt        func(b []byte)
+		opts           []Option
+		sbGroup        int64
+		gdtGroup       int64
+		wantErr        bool
+	}{
+		{
+			name: "primary",
+		},
+		{
+			name:     "damaged superblock",
+			corrupt:  zeroSuperblock,
+			sbGroup:  1,
+			gdtGroup: 1,
+		},
+		{
+			name:     "damaged group descriptors",
+			corrupt:  zeroGDT,
+			gdtGroup: 1,
+		},
+		{
+			name:     "explicit backup",
+			opts:     []Option{WithSuperblockBackup(1)},
+			sbGroup:  1,
+			gdtGroup: 1,
+		},
+		{
+			name:     "explicit backup and block size",
+			corrupt:  zeroSuperblock,
+			opts:     []Option{WithSuperblockBackup(1), WithBlockSize(1024)},
+			sbGroup:  1,
+			gdtGroup: 1,
+		},
+		{
+			name:    "explicit primary",
+			corrupt: zeroSuperblock,
+			opts:    []Option{WithSuperblockBackup(0)},
+			wantErr: true,
+		},
+		{
+			name:    "wrong block size",
+			corrupt: zeroSuperblock,
+			opts:    []Option{WithBlockSize(4096)},
+			wantErr: true,
+		},
+		{
+			name:           "explicit blocks per group",
+			blocksPerGroup: 4096,
+			corrupt:        zeroSuperblock,
+			opts:           []Option{WithBlocksPerGroup(4096)},
+			sbGroup:        1,
+			gdtGroup:       1,
+		},
+		{
+			name:           "non-default blocks per group",
+			blocksPerGroup: 4096,
+			corrupt:        zeroSuperblock,
+			wantErr:        true,
+		},
+		{
+			name:    "missing backup group",
+			opts:    []Option{WithSuperblockBackup(3)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := newTestImage(t)
+			img.AddFile(rootInodeNumber, "a.txt", []byte("hello"))
+			if tt.blocksPerGroup != 0 {
+				img.SB.BlockPerGroup = tt.blocksPerGroup
+				img.SB.ClusterPerGroup = tt.blocksPerGroup
+			}
+			b := backupImage(img)
+			if tt.corrupt != nil {
+				tt.corrupt(b)
+			}
+
+			fsys, err := NewFS(*io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), nil, tt.opts...)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewFS() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewFS() error: %v", err)
+			}
+			if got := fsys.SuperblockGroup(); got != tt.sbGroup {
+				t.Errorf("SuperblockGroup() = %d, want %d", got, tt.sbGroup)
+			}
+			if got := fsys.GroupDescriptorTableGroup(); got != tt.gdtGroup {
+				t.Errorf("GroupDescriptorTableGroup() = %d, want %d", got, tt.gdtGroup)
+			}
+			content, err := fs.ReadFile(fsys, "/a.txt")
+			if err != nil {
+				t.Fatalf("ReadFile() error: %v", err)
+			}
+			if string(content) != "hello" {
+				t.Errorf("ReadFile() = %q, want %q", content, "hello")
+			}
+		})
+	}
+}
+
+func TestBackupGroupCandidates(t *testing.T) {
+	fsys := &FileSystem{}
+	got := backupGroupCandidates(50*8192*1024, fsys.backupGeometries())
+	// 49, 12 and 3 are the last groups with 1KB, 2KB and 4KB blocks, and
+	// bound the powers of 3, 5 and 7.
+	want := []int64{1, 3, 5, 7, 9, 12, 25, 27, 49}
+	if len(got) != len(want) {
+		t.Fatalf("backupGroupCandidates() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("backupGroupCandidates() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBackupGroupDescriptorsUninit(t *testing.T) {
+	img := newTestImage(t)
+	img.AddFile(rootInodeNumber, "a.txt", []byte("hello"))
+	b := backupImage(img)
+
+	// The backup of group 0 still says its inodes are unused, as written
+	// by mkfs, while the primary table is damaged.
+	backupGD := b[(testBackupGroupStart+1)*testBlockSize:]
+	binary.LittleEndian.PutUint16(backupGD[0x12:], BG_INODE_UNINIT|BG_BLOCK_UNINIT)
+	binary.LittleEndian.PutUint16(backupGD[0x1C:], testInodesPerGroup)
+	copy(b[2*testBlockSize:], make([]byte, testBlockSize))
+
+	fsys, err := NewFS(*io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), nil)
+	if err != nil {
+		t.Fatalf("NewFS() error: %v", err)
+	}
+	for _, gd := range fsys.GroupDescriptors() {
+		if gd.Flags&(BG_INODE_UNINIT|BG_BLOCK_UNINIT) != 0 || gd.GetItableUnused(false) != 0 {
+			t.Errorf("group descriptor %+v keeps the backup's uninitialized state", gd)
+		}
+	}
+	if ok, err := fsys.IsInodeAllocated(rootInodeNumber); err != nil || !ok {
+		t.Errorf("IsInodeAllocated(%d) = %v, %v, want true", rootInodeNumber, ok, err)
+	}
+}
+
+func TestSuperblockBackupChecksums(t *testing.T) {
+	img, _ := newChecksumTestImage(t)
+	b := backupImage(img)
+	backup := b[(1+int64(img.SB.BlockPerGroup))*testBlockSize:]
+
+	// Group 1 was never used: its bitmaps are uninitialized and have no
+	// checksum.
+	for _, gdt := range [][]byte{b[2*testBlockSize:], backup[testBlockSize:]} {
+		gd := gdt[32:64]
+		binary.LittleEndian.PutUint16(gd[0x12:], BG_INODE_UNINIT|BG_BLOCK_UNINIT)
+		binary.LittleEndian.PutUint16(gd[0x1E:], 0)
+		csum, _ := img.SB.groupDescriptorChecksum(1, gd)
+		binary.LittleEndian.PutUint16(gd[0x1E:], csum)
+	}
+	binary.LittleEndian.PutUint32(backup[SuperBlockSize-4:], crc32c(^uint32(0), backup[:SuperBlockSize-4]))
+	copy(b[GroupZeroPadding:], make([]byte, SuperBlockSize))
+
+	fsys, err := NewFS(*io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), nil, WithChecksumVerification())
+	if err != nil {
+		t.Fatalf("NewFS() error: %v", err)
+	}
+	if got := fsys.SuperblockGroup(); got != 1 {
+		t.Errorf("SuperblockGroup() = %d, want 1", got)
+	}
+	if content, err := fs.ReadFile(fsys, "file.txt"); err != nil || string(content) != "checksummed" {
+		t.Errorf("ReadFile() = %q, %v, want %q", content, err, "checksummed")
+	}
+}
@@ -0,0 +1,214 @@
+package ext4
+
+import (
+	"golang.org/x/xerrors"
+)
+
+// BlockBitmap returns the raw block bitmap of group, verifying its checksum
+// when enabled.
+func (ext4 *FileSystem) BlockBitmap(group int64) ([]byte, error) {
+	if group < 0 || group >= int64(len(ext4.gds)) {
+		return nil, xerrors.Errorf("group %d is out of range", group)
+	}
+	gd := ext4.gds[group]
+	block := gd.GetBlockBitmapLoc(ext4.sb.FeatureInCompat64bit())
+	bitmap := make([]byte, ext4.sb.GetBlockSize())
+	if _, err := ext4.r.ReadAt(bitmap, block*ext4.sb.GetBlockSize()); err != nil {
+		return nil, xerrors.Errorf("failed to read block bitmap at block %d: %w", block, err)
+	}
+	if ext4.verifyChecksums && ext4.bitmapChecksummed(group, BG_BLOCK_UNINIT) {
+		size := int(ext4.sb.ClusterPerGroup / 8)
+		if err := verifyBitmapChecksum(&ext4.sb, ChecksumBlockBitmap, bitmap, size,
+			gd.BlockBitmapCsumLo, gd.BlockBitmapCsumHi, block, group); err != nil {
+			return nil, err
+		}
+	}
+	return bitmap, nil
+}
+
+// InodeBitmap returns the raw inode bitmap of group, verifying its checksum
+// when enabled.
+func (ext4 *FileSystem) InodeBitmap(group int64) ([]byte, error) {
+	if group < 0 || group >= int64(len(ext4.gds)) {
+		return nil, xerrors.Errorf("group %d is out of range", group)
+	}
+	gd := ext4.gds[group]
+	block := gd.GetInodeBitmapLoc(ext4.sb.FeatureInCompat64bit())
+	bitmap := make([]byte, ext4.sb.GetBlockSize())
+	if _, err := ext4.r.ReadAt(bitmap, block*ext4.sb.GetBlockSize()); err != nil {
+		return nil, xerrors.Errorf("failed to read inode bitmap at block %d: %w", block, err)
+	}
+	if ext4.verifyChecksums && ext4.bitmapChecksummed(group, BG_INODE_UNINIT) {
+		size := int(ext4.sb.InodePerGroup / 8)
+		if err := verifyBitmapChecksum(&ext4.sb, ChecksumInodeBitmap, bitmap, size,
+			gd.InodeBitmapCsumLo, gd.InodeBitmapCsumHi, block, group); err != nil {
+			return nil, err
+		}
+	}
+	return bitmap, nil
+}
+
+// IsInodeAllocated reports whether inode ino is in use according to the
+// inode bitmap. The inodes of groups with INODE_UNINIT are free.
+func (ext4 *FileSystem) IsInodeAllocated(ino int64) (bool, error) {
+	if ino < 1 || ino > int64(ext4.sb.InodeCount) {
+		return false, xerrors.Errorf("inode %d is out of range: %w", ino, ErrInodeNotFound)
+	}
+	group, index := (ino-1)/int64(ext4.sb.InodePerGroup), (ino-1)%int64(ext4.sb.InodePerGroup)
+	if group >= int64(len(ext4.gds)) {
+		return false, xerrors.Errorf("inode %d is out of range: %w", ino, ErrInodeNotFound)
+	}
+	if ext4.gds[group].Flags&BG_INODE_UNINIT != 0 {
+		return false, nil
+	}
+	bitmap, err := ext4.InodeBitmap(group)
+	if err != nil {
+		return false, err
+	}
+	return bitmap[index/8]&(1<<(index%8)) != 0, nil
+}
+
+// IsBlockAllocated reports whether block is in use according to the block
+// bitmap. In groups with BLOCK_UNINIT, only the metadata of the group is in
+// use.
+func (ext4 *FileSystem) IsBlockAllocated(block int64) (bool, error) {
+	return ext4.blockAllocated(block, map[int64][]byte{})
+}
+
+// blockAllocated is IsBlockAllocated with bitmaps caching the bitmaps read,
+// by group.
+func (ext4 *FileSystem) blockAllocated(block int64, bitmaps map[int64][]byte) (bool, error) {
+	if block < int64(ext4.sb.FirstDataBlock) || block >= ext4.sb.GetBlockCount() {
+		return false, xerrors.Errorf("block %d is out of range", block)
+	}
+	rel := block - int64(ext4.sb.FirstDataBlock)
+	group := rel / int64(ext4.sb.BlockPerGroup)
+	if group >= int64(len(ext4.gds)) {
+		return false, xerrors.Errorf("block %d is out of range", block)
+	}
+	bitmap, ok := bitmaps[group]
+	if !ok {
+		var err error
+		bitmap, err = ext4.groupBlockBitmap(group)
+		if err != nil {
+			return false, err
+		}
+		bitmaps[group] = bitmap
+	}
+	bit := (rel % int64(ext4.sb.BlockPerGroup)) / ext4.clusterRatio()
+	return bitmap[bit/8]&(1<<(bit%8)) != 0, nil
+}
+
+// clusterRatio returns the number of blocks a bit of the block bitmap
+// stands for, 1 unless bigalloc is enabled.
+func (ext4 *FileSystem) clusterRatio() int64 {
+	if ext4.sb.FeatureRoCompatBigalloc() && ext4.sb.ClusterPerGroup != 0 {
+		return int64(ext4.sb.BlockPerGroup / ext4.sb.ClusterPerGroup)
+	}
+	return 1
+}
+
+// groupBlockCount returns the number of blocks of group, which is smaller
+// than BlockPerGroup for the last group.
+func (ext4 *FileSystem) groupBlockCount(group int64) int64 {
+	n := ext4.sb.GetBlockCount() - ext4.sb.groupFirstBlock(group)
+	if n > int64(ext4.sb.BlockPerGroup) {
+		n = int64(ext4.sb.BlockPerGroup)
+	}
+	return n
+}
+
+// groupBlockBitmap returns the block bitmap of group. For groups with
+// BLOCK_UNINIT it is built as the kernel does on first use: only the
+// superblock and group descriptor copies, the bitmaps and the inode table
+// stored in the group are in use.
+func (ext4 *FileSystem) groupBlockBitmap(group int64) ([]byte, error) {
+	gd := ext4.gds[group]
+	if gd.Flags&BG_BLOCK_UNINIT == 0 {
+		return ext4.BlockBitmap(group)
+	}
+
+	bitmap := make([]byte, ext4.sb.GetBlockSize())
+	start := ext4.sb.groupFirstBlock(group)
+	count := ext4.groupBlockCount(group)
+	ratio := ext4.clusterRatio()
+	mark := func(block, n int64) {
+		for b := block; b < block+n; b++ {
+			if b >= start && b < start+count {
+				bit := (b - start) / ratio
+				bitmap[bit/8] |= 1 << (bit % 8)
+			}
+		}
+	}
+
+	layout := ext4.sb.GroupLayout(group)
+	mark(start, layout.DescriptorStart-start+layout.DescriptorBlocks)
+
+	is64bit := ext4.sb.FeatureInCompat64bit()
+	blockSize := ext4.sb.GetBlockSize()
+	inodeTableBlocks := (int64(ext4.sb.InodePerGroup)*int64(ext4.sb.InodeSize) + blockSize - 1) / blockSize
+	mark(gd.GetBlockBitmapLoc(is64bit), 1)
+	mark(gd.GetInodeBitmapLoc(is64bit), 1)
+	mark(gd.GetInodeTableLoc(is64bit), inodeTableBlocks)
+	return bitmap, nil
+}
+
+// BlockRange is a run of Len blocks starting at block Start.
+type BlockRange struct {
+	Start int64
+	Len   int64
+}
+
+// BlockRangeHandler is called by FreeBlockRanges and UsedBlockRanges for
+// every range. Returning an error stops the iteration.
+type BlockRangeHandler func(r BlockRange) error
+
+// FreeBlockRanges calls fn for every run of free blocks, in ascending
+// order. Runs spanning several groups are reported once. The error returned
+// by fn is returned as is.
+func (ext4 *FileSystem) FreeBlockRanges(fn BlockRangeHandler) error {
+	return ext4.blockRanges(false, fn)
+}
+
+// UsedBlockRanges calls fn for every run of blocks in use, in ascending
+// order, like FreeBlockRanges.
+func (ext4 *FileSystem) UsedBlockRanges(fn BlockRangeHandler) error {
+	return ext4.blockRanges(true, fn)
+}
+
+func (ext4 *FileSystem) blockRanges(used bool, fn BlockRangeHandler) error {
+	ratio := ext4.clusterRatio()
+	var current BlockRange
+	for group := int64(0); group < int64(len(ext4.gds)); group++ {
+		bitmap, err := ext4.groupBlockBitmap(group)
+		if err != nil {
+			return xerrors.Errorf("failed to read block bitmap of group %d: %w", group, err)
+		}
+		start := ext4.sb.groupFirstBlock(group)
+		count := ext4.groupBlockCount(group)
+		for rel := int64(0); rel < count; rel += ratio {
+			bit := rel / ratio
+			n := ratio
+			if rel+n > count {
+				n = count - rel
+			}
+			if (bitmap[bit/8]&(1<<(bit%8)) != 0) != used {
+				continue
+			}
+			if current.Len > 0 && current.Start+current.Len == start+rel {
+				current.Len += n
+				continue
+			}
+			if current.Len > 0 {
+				if err := fn(current); err != nil {
+					return err
+				}
+			}
+			current = BlockRange{Start: start + rel, Len: n}
+		}
+	}
+	if current.Len > 0 {
+		return fn(current)
+	}
+	return nil
+}
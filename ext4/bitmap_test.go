@@ -0,0 +1,76 @@
+package ext4
+
+import (
+	"reflect"
+	"testing"
+)
+
+func collectBlockRanges(t *testing.T, iterate func(BlockRangeHandler) error) []BlockRange {
+	t.Helper()
+	var ranges []BlockRange
+	if err := iterate(func(r BlockRange) error {
+		ranges = append(ranges, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("iteration error: %v", err)
+	}
+	return ranges
+}
+
+func TestBlockAllocation(t *testing.T) {
+	img := newTestImage(t)
+	f := img.AddFile(rootInodeNumber, "a.txt", make([]byte, 2*testBlockSize))
+	// A free block between two used ones.
+	img.Alloc(1)
+	hole := img.Alloc(1)
+	img.Alloc(1)
+	bit := hole - int64(img.SB.FirstDataBlock)
+	img.Data[testBlockBitmap*testBlockSize+bit/8] &^= 1 << (bit % 8)
+	fsys := img.fs()
+
+	for _, tt := range []struct {
+		block int64
+		want  bool
+	}{{1, true}, {testInodeTable, true}, {hole - 1, true}, {hole, false}, {hole + 2, false}, {testBlockCount - 1, false}} {
+		got, err := fsys.IsBlockAllocated(tt.block)
+		if err != nil || got != tt.want {
+			t.Errorf("IsBlockAllocated(%d) = %v, %v, want %v", tt.block, got, err, tt.want)
+		}
+	}
+	if _, err := fsys.IsBlockAllocated(testBlockCount); err == nil {
+		t.Error("IsBlockAllocated() past the end of the filesystem succeeded")
+	}
+	if got, err := fsys.IsInodeAllocated(int64(f)); err != nil || !got {
+		t.Errorf("IsInodeAllocated(%d) = %v, %v, want true", f, got, err)
+	}
+	if got, err := fsys.IsInodeAllocated(int64(f) + 1); err != nil || got {
+		t.Errorf("IsInodeAllocated(%d) = %v, %v, want false", f+1, got, err)
+	}
+
+	// The blocks past the end of the last group are marked in use in the
+	// bitmap but are not reported.
+	wantUsed := []BlockRange{{Start: 1, Len: hole - 1}, {Start: hole + 1, Len: 1}}
+	wantFree := []BlockRange{{Start: hole, Len: 1}, {Start: hole + 2, Len: testBlockCount - hole - 2}}
+	if got := collectBlockRanges(t, fsys.UsedBlockRanges); !reflect.DeepEqual(got, wantUsed) {
+		t.Errorf("UsedBlockRanges() = %v, want %v", got, wantUsed)
+	}
+	if got := collectBlockRanges(t, fsys.FreeBlockRanges); !reflect.DeepEqual(got, wantFree) {
+		t.Errorf("FreeBlockRanges() = %v, want %v", got, wantFree)
+	}
+}
+
+func TestBlockAllocationUninit(t *testing.T) {
+	img := newTestImage(t)
+	img.GD.Flags |= BG_BLOCK_UNINIT | BG_INODE_UNINIT
+	fsys := img.fs()
+
+	// Only the superblock, the group descriptor table, the bitmaps and the
+	// inode table are in use.
+	want := []BlockRange{{Start: 1, Len: testFirstDataBlock - 1}}
+	if got := collectBlockRanges(t, fsys.UsedBlockRanges); !reflect.DeepEqual(got, want) {
+		t.Errorf("UsedBlockRanges() = %v, want %v", got, want)
+	}
+	if got, err := fsys.IsInodeAllocated(rootInodeNumber); err != nil || got {
+		t.Errorf("IsInodeAllocated(%d) = %v, %v, want false", rootInodeNumber, got, err)
+	}
+}
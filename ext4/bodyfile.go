@@ -0,0 +1,194 @@
+package ext4
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// BodyfileOption configures WriteBodyfile.
+type BodyfileOption func(*bodyfileConfig)
+
+type bodyfileConfig struct {
+	deleted bool
+	orphans bool
+}
+
+// IncludeDeleted makes WriteBodyfile also write the deleted inodes, under
+// the names of the deleted entries referring to them in the rec_len slack of
+// directory blocks or as $OrphanFiles/OrphanFile-<ino>. Their names are
+// suffixed with " (deleted)", like fls does.
+func IncludeDeleted() BodyfileOption {
+	return func(c *bodyfileConfig) {
+		c.deleted = true
+	}
+}
+
+// IncludeOrphans makes WriteBodyfile also write the orphan inodes no longer
+// reachable from the root directory, as $OrphanFiles/OrphanFile-<ino>.
+func IncludeOrphans() BodyfileOption {
+	return func(c *bodyfileConfig) {
+		c.orphans = true
+	}
+}
+
+// WriteBodyfile writes a line in the Sleuth Kit bodyfile format for every
+// path of the filesystem, to build a timeline with mactime:
+//
+//	MD5|name|inode|mode|UID|GID|size|atime|mtime|ctime|crtime
+//
+// The MD5 field is always 0. Timestamps have nanoseconds when the inode
+// stores them, and crtime is 0 when the inode has no room for it.
+func (ext4 *FileSystem) WriteBodyfile(w io.Writer, opts ...BodyfileOption) error {
+	var c bodyfileConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	bw := bufio.NewWriter(w)
+
+	// The names of the deleted entries, by inode.
+	deletedNames := map[int64][]string{}
+	reachable := map[int64]bool{}
+	err := ext4.walkTree(func(name string, ino int64, fileType uint8) error {
+		reachable[ino] = true
+		inode, err := ext4.getInode(ino)
+		if err != nil {
+			err = xerrors.Errorf("failed to get inode(%d) of %s: %w", ino, name, err)
+			if ext4.tolerate(err) {
+				return nil
+			}
+			return err
+		}
+		if err := writeBodyfileLine(bw, name, ino, fileType, inode); err != nil {
+			return err
+		}
+		if !c.deleted || !inode.IsDir() {
+			return nil
+		}
+		deleted, err := ext4.deletedDirEntries(ino)
+		if err != nil {
+			err = xerrors.Errorf("failed to scan deleted entries of %s: %w", name, err)
+			if ext4.tolerate(err) {
+				return nil
+			}
+			return err
+		}
+		for _, e := range deleted {
+			if e.Inode != 0 {
+				deletedNames[int64(e.Inode)] = append(deletedNames[int64(e.Inode)], strings.TrimSuffix(name, "/")+"/"+e.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.orphans {
+		orphans, err := ext4.OrphanInodes()
+		if err != nil {
+			return xerrors.Errorf("failed to read orphan inodes: %w", err)
+		}
+		for _, o := range orphans {
+			if reachable[o.Ino] {
+				continue
+			}
+			if err := writeBodyfileLine(bw, orphanFileName(o.Ino), o.Ino, 0, o.Inode); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.deleted {
+		err := ext4.DeletedInodes(func(d *DeletedInode) error {
+			names := deletedNames[d.Ino]
+			if len(names) == 0 {
+				names = []string{orphanFileName(d.Ino)}
+			}
+			for _, name := range names {
+				if err := writeBodyfileLine(bw, name+" (deleted)", d.Ino, 0, d.Inode); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return xerrors.Errorf("failed to enumerate deleted inodes: %w", err)
+		}
+	}
+	return bw.Flush()
+}
+
+// orphanFileName is the name fls gives to inodes without a name.
+func orphanFileName(ino int64) string {
+	return fmt.Sprintf("/$OrphanFiles/OrphanFile-%d", ino)
+}
+
+func writeBodyfileLine(w io.Writer, name string, ino int64, fileType uint8, inode *Inode) error {
+	_, err := fmt.Fprintf(w, "0|%s|%d|%s|%d|%d|%d|%s|%s|%s|%s\n",
+		name, ino, bodyfileMode(fileType, inode.Mode), inode.GetUID(), inode.GetGID(), inode.GetSize(),
+		bodyfileTime(inode.AccessTime()), bodyfileTime(inode.ModificationTime()),
+		bodyfileTime(inode.ChangeTime()), bodyfileTime(inode.CreationTime()))
+	return err
+}
+
+// bodyfileTime formats t as seconds since the epoch, with nanoseconds when
+// it has any.
+func bodyfileTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	if t.Nanosecond() == 0 {
+		return fmt.Sprintf("%d", t.Unix())
+	}
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+// The type letters used by fls, by entry file type and by inode mode.
+var (
+	bodyfileNameTypes = map[uint8]byte{
+		direntRegular: 'r', direntDir: 'd', direntCharDevice: 'c', direntBlockDevice: 'b',
+		direntFifo: 'p', direntSocket: 's', direntSymlink: 'l',
+	}
+	bodyfileMetaTypes = map[uint16]byte{
+		FileTypeRegular: 'r', FileTypeDir: 'd', FileTypeCharDevice: 'c', FileTypeBlockDevice: 'b',
+		FileTypeFifo: 'p', FileTypeSocket: 's', FileTypeSymlink: 'l',
+	}
+)
+
+// bodyfileMode formats the type of the entry and the mode of the inode the
+// way fls does, e.g. "r/rrw-r--r--".
+func bodyfileMode(fileType uint8, mode uint16) string {
+	b := []byte("-/----------")
+	if t, ok := bodyfileNameTypes[fileType]; ok {
+		b[0] = t
+	}
+	if t, ok := bodyfileMetaTypes[mode&FileTypeMask]; ok {
+		b[2] = t
+	}
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		if mode&(1<<(8-i)) != 0 {
+			b[3+i] = rwx[i]
+		}
+	}
+	for _, special := range []struct {
+		bit   uint16
+		index int
+		set   byte
+	}{{0o4000, 5, 's'}, {0o2000, 8, 's'}, {0o1000, 11, 't'}} {
+		if mode&special.bit == 0 {
+			continue
+		}
+		if b[special.index] == '-' {
+			b[special.index] = special.set - 'a' + 'A'
+		} else {
+			b[special.index] = special.set
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,100 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWriteBodyfile(t *testing.T) {
+	img := newTestImage(t)
+	f := img.AddFile(rootInodeNumber, "f", []byte("hello"))
+	inode := img.Inodes[f]
+	inode.Mode = FileTypeRegular | 0o4755
+	inode.UID, inode.UIDHigh = 1, 1
+	inode.GID = 100
+	inode.Atime, inode.Mtime, inode.Ctime, inode.Crtime = 10, 20, 30, 40
+	inode.MtimeExtra = 500 << 2
+	inode.ExtraIsize = crtimeExtraEnd
+
+	gone := img.AddFile(rootInodeNumber, "gone", []byte("x"))
+	img.Dirs[rootInodeNumber].Entries = img.Dirs[rootInodeNumber].Entries[:3]
+	img.deleteInode(gone)
+
+	orphan := img.AddFile(rootInodeNumber, "orphan", nil)
+	img.Dirs[rootInodeNumber].Entries = img.Dirs[rootInodeNumber].Entries[:3]
+	img.Inodes[orphan].LinksCount = 0
+	img.SB.LastOrphan = orphan
+	fsys := img.fs()
+
+	var buf bytes.Buffer
+	if err := fsys.WriteBodyfile(&buf); err != nil {
+		t.Fatalf("WriteBodyfile() error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "0|/|2|d/drwxr-xr-x|") {
+		t.Fatalf("WriteBodyfile() = %q, want the root directory and f", lines)
+	}
+	want := "0|/f|11|r/rrwsr-xr-x|65537|100|5|10|20.000000500|30|40"
+	if lines[1] != want {
+		t.Errorf("line = %q, want %q", lines[1], want)
+	}
+
+	buf.Reset()
+	if err := fsys.WriteBodyfile(&buf, IncludeDeleted(), IncludeOrphans()); err != nil {
+		t.Fatalf("WriteBodyfile() error: %v", err)
+	}
+	for _, name := range []string{"|/$OrphanFiles/OrphanFile-13|13|", "|/$OrphanFiles/OrphanFile-12 (deleted)|12|"} {
+		if !strings.Contains(buf.String(), name) {
+			t.Errorf("bodyfile does not contain %q:\n%s", name, buf.String())
+		}
+	}
+}
+
+func TestWriteBodyfileSlackName(t *testing.T) {
+	img := newTestImage(t)
+	img.AddFile(rootInodeNumber, "a.txt", []byte("a"))
+	gone := img.AddFile(rootInodeNumber, "gone.txt", []byte("gone"))
+	img.AddFile(rootInodeNumber, "b.txt", []byte("b"))
+
+	// Unlinking gone.txt grew the rec_len of a.txt over it and freed its
+	// inode.
+	entries := img.Dirs[rootInodeNumber].Entries
+	n := len(entries)
+	prev, deleted := entries[n-3], entries[n-2]
+	binary.LittleEndian.PutUint16(prev[4:], uint16(len(prev)+len(deleted)))
+	img.deleteInode(gone)
+	fsys := img.fs()
+
+	var buf bytes.Buffer
+	if err := fsys.WriteBodyfile(&buf, IncludeDeleted()); err != nil {
+		t.Fatalf("WriteBodyfile() error: %v", err)
+	}
+	want := fmt.Sprintf("0|/gone.txt (deleted)|%d|", gone)
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("bodyfile does not contain %q:\n%s", want, buf.String())
+	}
+	if strings.Contains(buf.String(), "OrphanFile-"+strconv.Itoa(int(gone))) {
+		t.Errorf("the inode of gone.txt is listed as an orphan file:\n%s", buf.String())
+	}
+}
+
+func TestBodyfileMode(t *testing.T) {
+	for _, tt := range []struct {
+		fileType uint8
+		mode     uint16
+		want     string
+	}{
+		{direntRegular, FileTypeRegular | 0o644, "r/rrw-r--r--"},
+		{direntDir, FileTypeDir | 0o1777, "d/drwxrwxrwt"},
+		{direntSymlink, FileTypeSymlink | 0o777, "l/lrwxrwxrwx"},
+		{0, FileTypeRegular | 0o2640, "-/rrw-r-S---"},
+	} {
+		if got := bodyfileMode(tt.fileType, tt.mode); got != tt.want {
+			t.Errorf("bodyfileMode(%d, %o) = %q, want %q", tt.fileType, tt.mode, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+// Package check reports inconsistencies in an ext4 filesystem without
+// modifying it, similar to e2fsck -n. It is meant to tell a damaged image
+// apart from a bug in the ext4 package.
+package check
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"golang.org/x/xerrors"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4"
+)
+
+// Kind identifies the type of an inconsistency.
+type Kind string
+
+const (
+	// KindLinkCount is an inode whose link count does not match the number
+	// of directory entries referring to it.
+	KindLinkCount Kind = "link count"
+	// KindDuplicateBlock is a block claimed by two inodes, or by an inode
+	// and filesystem metadata.
+	KindDuplicateBlock Kind = "duplicate block"
+	// KindBlockOutOfRange is a block mapped past the end of the filesystem.
+	KindBlockOutOfRange Kind = "block out of range"
+	// KindBlockBitmap is a block whose allocation bitmap bit does not match
+	// its actual use.
+	KindBlockBitmap Kind = "block bitmap"
+	// KindInodeBitmap is an inode whose allocation bitmap bit does not match
+	// its actual use.
+	KindInodeBitmap Kind = "inode bitmap"
+	// KindDtime is a reachable inode with its deletion time set.
+	KindDtime Kind = "dtime"
+	// KindHTreeOrder is an htree leaf holding names outside its hash range.
+	KindHTreeOrder Kind = "htree order"
+	// KindUnreadable is a structure that could not be read or parsed.
+	KindUnreadable Kind = "unreadable"
+)
+
+// Finding is a single inconsistency. Inode and Block are 0 when the finding
+// does not relate to an inode or a block.
+type Finding struct {
+	Kind    Kind
+	Inode   int64
+	Block   int64
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s (inode: %d, block: %d): %s", f.Kind, f.Inode, f.Block, f.Message)
+}
+
+// linkMax is the link count above which dir_nlink directories report 1.
+const linkMax = 65000
+
+// claim is a run of blocks used by an inode or, when ino is 0, by the
+// filesystem metadata.
+type claim struct {
+	start int64
+	count int64
+	ino   int64
+	// xattr blocks may be shared between inodes.
+	xattr bool
+}
+
+type checker struct {
+	fs  *ext4.FileSystem
+	sb  ext4.Superblock
+	gds []ext4.GroupDescriptor
+
+	findings []Finding
+
+	inodes    map[int64]*ext4.Inode
+	refs      map[int64]int
+	subdirs   map[int64]int
+	reachable map[int64]bool
+	orphans   map[int64]bool
+	bitmap    map[int64]bool
+	claims    []claim
+}
+
+// Run checks fsys and returns the inconsistencies found. An error is
+// returned only when the filesystem cannot be checked at all.
+func Run(fsys *ext4.FileSystem) ([]Finding, error) {
+	c := &checker{
+		fs:        fsys,
+		sb:        fsys.GetSuperBlock(),
+		gds:       fsys.GroupDescriptors(),
+		inodes:    map[int64]*ext4.Inode{},
+		refs:      map[int64]int{},
+		subdirs:   map[int64]int{},
+		reachable: map[int64]bool{},
+		orphans:   map[int64]bool{},
+		bitmap:    map[int64]bool{},
+	}
+	if err := c.walkDirectories(); err != nil {
+		return nil, err
+	}
+	c.readInodeBitmaps()
+	c.readOrphans()
+	c.claimMetadata()
+	c.claimInodeBlocks()
+	c.checkDuplicateBlocks()
+	c.checkBlockBitmaps()
+	c.checkInodes()
+	return c.findings, nil
+}
+
+func (c *checker) report(kind Kind, ino, block int64, format string, args ...interface{}) {
+	c.findings = append(c.findings, Finding{
+		Kind:    kind,
+		Inode:   ino,
+		Block:   block,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// inode returns inode ino, reporting it when it cannot be read.
+func (c *checker) inode(ino int64) (*ext4.Inode, bool) {
+	if inode, ok := c.inodes[ino]; ok {
+		return inode, inode != nil
+	}
+	if ino < 1 || ino > int64(c.sb.InodeCount) {
+		c.inodes[ino] = nil
+		c.report(KindUnreadable, ino, 0, "inode number out of range (inode count %d)", c.sb.InodeCount)
+		return nil, false
+	}
+	inode, err := c.fs.GetInode(ino)
+	if err != nil {
+		c.inodes[ino] = nil
+		c.report(KindUnreadable, ino, 0, "failed to read inode: %v", err)
+		return nil, false
+	}
+	c.inodes[ino] = inode
+	return inode, true
+}
+
+func (c *checker) isSystemInode(ino int64) bool {
+	if ino < int64(c.sb.FirstIno) && ino != 2 {
+		return true
+	}
+	for _, sys := range []uint32{c.sb.JournalInum, c.sb.UsrQuotaInum, c.sb.GrpQuotaInum, c.sb.PrjQuotaInum, c.sb.SnapshotInum, c.sb.OrphanFileInum} {
+		if sys != 0 && int64(sys) == ino {
+			return true
+		}
+	}
+	return false
+}
+
+// walkDirectories walks the tree from the root, counting references to
+// every inode and checking htree order and dtime of reachable inodes.
+func (c *checker) walkDirectories() error {
+	const root = 2
+	if _, ok := c.inode(root); !ok {
+		return xerrors.New("failed to read the root inode")
+	}
+	c.reachable[root] = true
+	queue := []int64{root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		dirInode := c.inodes[dir]
+		if dirInode.UsesDirectoryHashTree() {
+			c.checkHTree(dir)
+		}
+		entries, err := c.fs.DirEntries(dir)
+		if err != nil {
+			c.report(KindUnreadable, dir, 0, "failed to read directory: %v", err)
+			continue
+		}
+		for _, e := range entries {
+			if e.Deleted {
+				continue
+			}
+			ino := int64(e.Inode)
+			c.refs[ino]++
+			inode, ok := c.inode(ino)
+			if !ok || c.reachable[ino] {
+				continue
+			}
+			c.reachable[ino] = true
+			if inode.Dtime != 0 {
+				c.report(KindDtime, ino, 0, "reachable inode %q has dtime %d", e.Name, inode.Dtime)
+			}
+			if inode.IsDir() {
+				c.subdirs[dir]++
+				queue = append(queue, ino)
+			}
+		}
+	}
+	return nil
+}
+
+// checkHTree verifies that every leaf holds only names within the hash
+// range assigned to it by the index.
+func (c *checker) checkHTree(dir int64) {
+	tree, err := c.fs.HTreeLeaves(dir)
+	if err != nil {
+		c.report(KindUnreadable, dir, 0, "failed to read htree: %v", err)
+		return
+	}
+	for i, leaf := range tree.Leaves {
+		low := leaf.Hash &^ 1
+		var high uint32
+		hasHigh, collision := false, false
+		if i+1 < len(tree.Leaves) {
+			next := tree.Leaves[i+1].Hash
+			high, hasHigh, collision = next&^1, true, next&1 != 0
+		}
+		if hasHigh && high < low {
+			c.report(KindHTreeOrder, dir, leaf.Block, "index hash %#x is lower than the previous %#x", high, low)
+			continue
+		}
+		for _, e := range leaf.Entries {
+			hash, err := c.fs.DirHash(e.Name, tree.HashVersion)
+			if err != nil {
+				c.report(KindUnreadable, dir, leaf.Block, "failed to hash %q: %v", e.Name, err)
+				return
+			}
+			inRange := hash >= low && (!hasHigh || hash < high || (collision && hash == high))
+			if !inRange {
+				c.report(KindHTreeOrder, dir, leaf.Block, "name %q hash %#x is outside leaf range [%#x, %#x)", e.Name, hash, low, high)
+			}
+		}
+	}
+}
+
+func (c *checker) readInodeBitmaps() {
+	perGroup := int64(c.sb.InodePerGroup)
+	for g, gd := range c.gds {
+		if gd.Flags&ext4.BG_INODE_UNINIT != 0 {
+			continue
+		}
+		bitmap, err := c.fs.InodeBitmap(int64(g))
+		if err != nil {
+			c.report(KindUnreadable, 0, gd.GetInodeBitmapLoc(c.sb.FeatureInCompat64bit()), "failed to read inode bitmap of group %d: %v", g, err)
+			continue
+		}
+		for i := int64(0); i < perGroup; i++ {
+			if bitmap[i/8]&(1<<(i%8)) != 0 {
+				c.bitmap[int64(g)*perGroup+i+1] = true
+			}
+		}
+	}
+}
+
+// readOrphans follows the orphan inode list, whose links are kept in dtime.
+func (c *checker) readOrphans() {
+	for ino := int64(c.sb.LastOrphan); ino != 0 && !c.orphans[ino]; {
+		inode, ok := c.inode(ino)
+		if !ok {
+			return
+		}
+		c.orphans[ino] = true
+		ino = int64(inode.Dtime)
+	}
+}
+
+// claimMetadata claims the superblocks, group descriptor tables, bitmaps
+// and inode tables.
+func (c *checker) claimMetadata() {
+	is64 := c.sb.FeatureInCompat64bit()
+	blockSize := c.sb.GetBlockSize()
+	inodeTableBlocks := (int64(c.sb.InodePerGroup)*int64(c.sb.InodeSize) + blockSize - 1) / blockSize
+
+	for g, gd := range c.gds {
+		group := int64(g)
+		start := int64(c.sb.FirstDataBlock) + group*int64(c.sb.BlockPerGroup)
+		layout := c.sb.GroupLayout(group)
+		if n := layout.DescriptorStart - start + layout.DescriptorBlocks; n != 0 {
+			c.claimBlocks(claim{start: start, count: n})
+		}
+		c.claimBlocks(claim{start: gd.GetBlockBitmapLoc(is64), count: 1})
+		c.claimBlocks(claim{start: gd.GetInodeBitmapLoc(is64), count: 1})
+		c.claimBlocks(claim{start: gd.GetInodeTableLoc(is64), count: inodeTableBlocks})
+	}
+	if c.sb.FeatureIncompatMmp() && c.sb.MmpBlock != 0 {
+		c.claimBlocks(claim{start: int64(c.sb.MmpBlock), count: 1})
+	}
+}
+
+// inUse reports whether inode ino is allocated: reachable, on the orphan
+// list, a system inode or marked in the bitmap with a non-zero link count.
+func (c *checker) inUse(ino int64, inode *ext4.Inode) bool {
+	if c.reachable[ino] || c.orphans[ino] {
+		return true
+	}
+	if c.isSystemInode(ino) {
+		return inode.Mode != 0 || inode.BlocksLo != 0
+	}
+	return c.bitmap[ino] && inode.LinksCount > 0
+}
+
+func (c *checker) candidateInodes() []int64 {
+	seen := map[int64]bool{}
+	var inos []int64
+	add := func(ino int64) {
+		if !seen[ino] {
+			seen[ino] = true
+			inos = append(inos, ino)
+		}
+	}
+	for ino := range c.reachable {
+		add(ino)
+	}
+	for ino := range c.orphans {
+		add(ino)
+	}
+	for ino := range c.bitmap {
+		add(ino)
+	}
+	for ino := int64(1); ino < int64(c.sb.FirstIno); ino++ {
+		add(ino)
+	}
+	sort.Slice(inos, func(i, j int) bool { return inos[i] < inos[j] })
+	return inos
+}
+
+// claimInodeBlocks claims the data, mapping and xattr blocks of every inode
+// in use.
+func (c *checker) claimInodeBlocks() {
+	for _, ino := range c.candidateInodes() {
+		inode, ok := c.inode(ino)
+		if !ok || !c.inUse(ino, inode) {
+			continue
+		}
+
+		if acl := int64(inode.FileACLHigh)<<32 | int64(inode.FileACLLo); acl != 0 {
+			c.claimBlocks(claim{start: acl, count: 1, ino: ino, xattr: true})
+		}
+
+		// The reserved GDT blocks of the resize inode are claimed with the
+		// group metadata; only its double indirect block is its own.
+		if ino == ext4.ResizeInodeNumber {
+			var addressing ext4.BlockAddressing
+			if err := binary.Read(bytes.NewReader(inode.BlockOrExtents[:]), binary.LittleEndian, &addressing); err == nil && addressing.DoubleIndirectBlock != 0 {
+				c.claimBlocks(claim{start: int64(addressing.DoubleIndirectBlock), count: 1, ino: ino})
+			}
+			continue
+		}
+
+		if !inode.HasBlocks() {
+			continue
+		}
+		meta, err := c.fs.MetadataBlocks(inode)
+		if err != nil {
+			c.report(KindUnreadable, ino, 0, "failed to read block map: %v", err)
+			continue
+		}
+		for _, b := range meta {
+			c.claimBlocks(claim{start: b, count: 1, ino: ino})
+		}
+
+		if inode.UsesExtents() {
+			extents, err := c.fs.Extents(inode)
+			if err != nil {
+				c.report(KindUnreadable, ino, 0, "failed to read extents: %v", err)
+				continue
+			}
+			for _, e := range extents {
+				start := int64(e.StartHi)<<32 | int64(e.StartLo)
+				c.claimBlocks(claim{start: start, count: int64(e.GetLen()), ino: ino})
+			}
+			continue
+		}
+		addrs, err := inode.GetBlockAddresses(c.fs)
+		if err != nil {
+			c.report(KindUnreadable, ino, 0, "failed to read block addresses: %v", err)
+			continue
+		}
+		for _, a := range addrs {
+			if a != 0 {
+				c.claimBlocks(claim{start: int64(a), count: 1, ino: ino})
+			}
+		}
+	}
+}
+
+// claimBlocks records cl, reporting the part past the end of the filesystem.
+func (c *checker) claimBlocks(cl claim) {
+	blockCount := c.sb.GetBlockCount()
+	if cl.start < int64(c.sb.FirstDataBlock) || cl.start+cl.count > blockCount {
+		c.report(KindBlockOutOfRange, cl.ino, cl.start, "%d blocks at %d extend past the end of the filesystem (%d blocks)", cl.count, cl.start, blockCount)
+		if cl.start >= blockCount || cl.start < int64(c.sb.FirstDataBlock) {
+			return
+		}
+		cl.count = blockCount - cl.start
+	}
+	c.claims = append(c.claims, cl)
+}
+
+func owner(ino int64) string {
+	if ino == 0 {
+		return "filesystem metadata"
+	}
+	return fmt.Sprintf("inode %d", ino)
+}
+
+// checkDuplicateBlocks reports blocks claimed more than once.
+func (c *checker) checkDuplicateBlocks() {
+	claims := make([]claim, len(c.claims))
+	copy(claims, c.claims)
+	sort.SliceStable(claims, func(i, j int) bool { return claims[i].start < claims[j].start })
+
+	var last claim // the claim reaching furthest so far
+	for i, cl := range claims {
+		if i > 0 && cl.start < last.start+last.count && !(cl.xattr && last.xattr) {
+			end := cl.start + cl.count
+			if lastEnd := last.start + last.count; lastEnd < end {
+				end = lastEnd
+			}
+			c.report(KindDuplicateBlock, cl.ino, cl.start, "%d blocks at %d are also claimed by %s", end-cl.start, cl.start, owner(last.ino))
+		}
+		if i == 0 || cl.start+cl.count > last.start+last.count {
+			last = cl
+		}
+	}
+}
+
+// checkBlockBitmaps compares the block bitmaps with the claimed blocks.
+// Groups with BLOCK_UNINIT have no bitmap on disk and are skipped.
+func (c *checker) checkBlockBitmaps() {
+	ratio := int64(1)
+	if c.sb.FeatureRoCompatBigalloc() {
+		ratio = 1 << (c.sb.LogClusterSize - c.sb.LogBlockSize)
+	}
+	firstData := int64(c.sb.FirstDataBlock)
+	clusters := (c.sb.GetBlockCount() - firstData + ratio - 1) / ratio
+	claimed := make([]bool, clusters)
+	for _, cl := range c.claims {
+		for b := cl.start; b < cl.start+cl.count; b++ {
+			claimed[(b-firstData)/ratio] = true
+		}
+	}
+
+	perGroup := int64(c.sb.ClusterPerGroup)
+	for g, gd := range c.gds {
+		if gd.Flags&ext4.BG_BLOCK_UNINIT != 0 {
+			continue
+		}
+		bitmap, err := c.fs.BlockBitmap(int64(g))
+		if err != nil {
+			c.report(KindUnreadable, 0, gd.GetBlockBitmapLoc(c.sb.FeatureInCompat64bit()), "failed to read block bitmap of group %d: %v", g, err)
+			continue
+		}
+		first := int64(g) * perGroup
+		n := perGroup
+		if first+n > clusters {
+			n = clusters - first
+		}
+
+		// Mismatches are reported as runs to keep a damaged group from
+		// producing one finding per block.
+		runStart, runUsed := int64(-1), false
+		flush := func(end int64) {
+			if runStart < 0 {
+				return
+			}
+			block := firstData + (first+runStart)*ratio
+			count := (end - runStart) * ratio
+			if runUsed {
+				c.report(KindBlockBitmap, 0, block, "%d blocks at %d are marked in use but not claimed", count, block)
+			} else {
+				c.report(KindBlockBitmap, 0, block, "%d blocks at %d are claimed but marked free", count, block)
+			}
+			runStart = -1
+		}
+		for i := int64(0); i < n; i++ {
+			used := bitmap[i/8]&(1<<(i%8)) != 0
+			if used == claimed[first+i] {
+				flush(i)
+				continue
+			}
+			if runStart >= 0 && runUsed != used {
+				flush(i)
+			}
+			if runStart < 0 {
+				runStart, runUsed = i, used
+			}
+		}
+		flush(n)
+	}
+}
+
+// checkInodes compares link counts with directory references and the inode
+// bitmaps with the inodes in use.
+func (c *checker) checkInodes() {
+	perGroup := int64(c.sb.InodePerGroup)
+	for _, ino := range c.candidateInodes() {
+		inode, ok := c.inode(ino)
+		if !ok {
+			continue
+		}
+		group := (ino - 1) / perGroup
+		uninit := group < int64(len(c.gds)) && c.gds[group].Flags&ext4.BG_INODE_UNINIT != 0
+		used := c.inUse(ino, inode)
+		inBitmap := c.bitmap[ino]
+
+		switch {
+		case used && !inBitmap && !uninit && !c.isSystemInode(ino):
+			c.report(KindInodeBitmap, ino, 0, "inode is in use but marked free")
+		case used && uninit:
+			c.report(KindInodeBitmap, ino, 0, "inode is in use but its group has INODE_UNINIT")
+		case !used && inBitmap && !c.isSystemInode(ino):
+			c.report(KindInodeBitmap, ino, 0, "inode is marked in use but has no links")
+		}
+
+		if !used || c.isSystemInode(ino) || c.orphans[ino] {
+			continue
+		}
+		expected := c.refs[ino]
+		if inode.IsDir() {
+			// "." and the ".." of every subdirectory, plus ".." for the root.
+			expected += 1 + c.subdirs[ino]
+			if ino == 2 {
+				expected++
+			}
+			if inode.LinksCount == 1 && expected >= linkMax && c.sb.FeatureRoCompatDirNlink() {
+				continue
+			}
+		}
+		if int(inode.LinksCount) != expected {
+			if c.refs[ino] == 0 && ino != 2 {
+				c.report(KindLinkCount, ino, 0, "inode has link count %d but no directory refers to it", inode.LinksCount)
+			} else {
+				c.report(KindLinkCount, ino, 0, "link count is %d, should be %d", inode.LinksCount, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package check
+
+import (
+	"encoding/binary"
+	"sort"
+	"testing"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4"
+	"github.com/masahiro331/go-ext4-filesystem/ext4/internal/testimage"
+)
+
+func run(t *testing.T, img *testImage) []Finding {
+	t.Helper()
+	findings, err := Run(img.fs())
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	return findings
+}
+
+func TestRunClean(t *testing.T) {
+	img := newTestImage(t)
+	img.addFile(testRootInode, "a.txt")
+	dir := img.AddDir(testRootInode, "dir")
+	img.addFile(dir, "b.txt")
+
+	if findings := run(t, img); len(findings) != 0 {
+		t.Errorf("unexpected findings on a clean image: %v", findings)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(img *testImage, file, dir uint32)
+		kind    Kind
+		inode   func(file, dir uint32) int64
+		block   int64
+	}{
+		{
+			name: "link count",
+			corrupt: func(img *testImage, file, dir uint32) {
+				img.Inodes[file].LinksCount = 3
+			},
+			kind:  KindLinkCount,
+			inode: func(file, dir uint32) int64 { return int64(file) },
+		},
+		{
+			name: "directory link count",
+			corrupt: func(img *testImage, file, dir uint32) {
+				img.Inodes[dir].LinksCount = 5
+			},
+			kind:  KindLinkCount,
+			inode: func(file, dir uint32) int64 { return int64(dir) },
+		},
+		{
+			name: "duplicate block",
+			corrupt: func(img *testImage, file, dir uint32) {
+				img.Inodes[file].BlockOrExtents = testimage.ExtentRoot(ext4.Extent{Len: 1, StartLo: uint32(img.Dirs[dir].Block)})
+			},
+			kind:  KindDuplicateBlock,
+			block: testFirstDataBlock + 2,
+		},
+		{
+			name: "extent past end",
+			corrupt: func(img *testImage, file, dir uint32) {
+				img.Inodes[file].BlockOrExtents = testimage.ExtentRoot(ext4.Extent{Len: 4, StartLo: testBlockCount - 2})
+			},
+			kind:  KindBlockOutOfRange,
+			inode: func(file, dir uint32) int64 { return int64(file) },
+			block: testBlockCount - 2,
+		},
+		{
+			name: "block marked free",
+			corrupt: func(img *testImage, file, dir uint32) {
+				img.UnmarkBlock(testFirstDataBlock + 1)
+			},
+			kind:  KindBlockBitmap,
+			block: testFirstDataBlock + 1,
+		},
+		{
+			name: "inode marked free",
+			corrupt: func(img *testImage, file, dir uint32) {
+				img.UnmarkInode(file)
+			},
+			kind:  KindInodeBitmap,
+			inode: func(file, dir uint32) int64 { return int64(file) },
+		},
+		{
+			name: "dtime on reachable inode",
+			corrupt: func(img *testImage, file, dir uint32) {
+				img.Inodes[file].Dtime = 1700000000
+			},
+			kind:  KindDtime,
+			inode: func(file, dir uint32) int64 { return int64(file) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := newTestImage(t)
+			file := img.addFile(testRootInode, "a.txt")
+			dir := img.AddDir(testRootInode, "dir")
+			tt.corrupt(img, file, dir)
+
+			findings := run(t, img)
+			var found bool
+			for _, f := range findings {
+				if f.Kind != tt.kind {
+					continue
+				}
+				found = true
+				if tt.inode != nil && f.Inode != tt.inode(file, dir) {
+					t.Errorf("Inode = %d, want %d", f.Inode, tt.inode(file, dir))
+				}
+				if tt.block != 0 && f.Block != tt.block {
+					t.Errorf("Block = %d, want %d", f.Block, tt.block)
+				}
+			}
+			if !found {
+				t.Errorf("no %q finding in %v", tt.kind, findings)
+			}
+		})
+	}
+}
+
+func TestRunHTreeOrder(t *testing.T) {
+	names := []string{"alpha", "bravo", "charlie", "delta", "echo", "foxtrot"}
+	fsys := newTestImage(t).fs()
+	hashes := map[string]uint32{}
+	for _, name := range names {
+		h, err := fsys.DirHash(name, ext4.DX_HASH_TEA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[name] = h
+	}
+	sort.Slice(names, func(i, j int) bool { return hashes[names[i]] < hashes[names[j]] })
+	low, high := names[:3], names[3:]
+	bound := []uint32{hashes[high[0]]}
+
+	t.Run("ordered", func(t *testing.T) {
+		img := newTestImage(t)
+		img.addHTreeDir(testRootInode, "htree", [][]string{low, high}, bound)
+		if findings := run(t, img); len(findings) != 0 {
+			t.Errorf("unexpected findings: %v", findings)
+		}
+	})
+
+	t.Run("misplaced", func(t *testing.T) {
+		img := newTestImage(t)
+		// Move the lowest name into the upper leaf.
+		misplaced := [][]string{low[1:], append([]string{low[0]}, high...)}
+		dir := img.addHTreeDir(testRootInode, "htree", misplaced, bound)
+
+		findings := run(t, img)
+		if len(findings) != 1 {
+			t.Fatalf("got %d findings, want 1: %v", len(findings), findings)
+		}
+		if f := findings[0]; f.Kind != KindHTreeOrder || f.Inode != int64(dir) {
+			t.Errorf("got %v, want %q finding for inode %d", f, KindHTreeOrder, dir)
+		}
+	})
+}
+
+func TestRunOrphanFile(t *testing.T) {
+	img := newTestImage(t)
+	// The orphan file is referenced from the superblock only.
+	orphanFile := img.addFile(testRootInode, "orphan_file")
+	root := img.Dirs[testRootInode]
+	root.Entries = root.Entries[:len(root.Entries)-1]
+	img.SB.FeatureCompat |= ext4.FEATURE_COMPAT_ORPHAN_FILE
+	img.SB.OrphanFileInum = orphanFile
+
+	if findings := run(t, img); len(findings) != 0 {
+		t.Errorf("unexpected findings: %v", findings)
+	}
+}
+
+func TestRunDeletedEntries(t *testing.T) {
+	img := newTestImage(t)
+	img.addFile(testRootInode, "a.txt")
+	gone := img.addFile(testRootInode, "gone.txt")
+	img.addFile(testRootInode, "b.txt")
+
+	// Unlinking gone.txt grew the rec_len of a.txt over it and freed its
+	// inode and block.
+	entries := img.Dirs[testRootInode].Entries
+	n := len(entries)
+	prev, deleted := entries[n-3], entries[n-2]
+	binary.LittleEndian.PutUint16(prev[4:], uint16(len(prev)+len(deleted)))
+	img.Inodes[gone].LinksCount = 0
+	img.Inodes[gone].Dtime = 1700000000
+	img.UnmarkInode(gone)
+	img.UnmarkBlock(int64(binary.LittleEndian.Uint32(img.Inodes[gone].BlockOrExtents[12+8:])))
+
+	findings, err := Run(img.fs(ext4.WithDeletedEntries()))
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("unexpected findings: %v", findings)
+	}
+}
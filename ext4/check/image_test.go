@@ -0,0 +1,85 @@
+package check
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4"
+	"github.com/masahiro331/go-ext4-filesystem/ext4/internal/testimage"
+)
+
+const (
+	testBlockSize      = testimage.BlockSize
+	testBlockCount     = testimage.BlockCount
+	testFirstDataBlock = testimage.FirstDataBlock
+	testRootInode      = testimage.RootInode
+)
+
+type testImage struct {
+	*testimage.Image[ext4.Superblock, ext4.GroupDescriptor, ext4.Inode]
+}
+
+func newTestImage(t *testing.T) *testImage {
+	t.Helper()
+	img := &testImage{testimage.New[ext4.Superblock, ext4.GroupDescriptor, ext4.Inode](t)}
+	img.SB.DefHashVersion = ext4.DX_HASH_TEA
+	return img
+}
+
+// addFile creates a one block regular file holding its name in directory
+// parent.
+func (img *testImage) addFile(parent uint32, name string) uint32 {
+	return img.AddFile(parent, name, []byte(name))
+}
+
+// addHTreeDir creates an htree indexed directory in parent whose leaves
+// hold files with the given names. hashes holds the lower hash bound of
+// every leaf but the first.
+func (img *testImage) addHTreeDir(parent uint32, name string, leaves [][]string, hashes []uint32) uint32 {
+	ino := img.NextIno
+	img.NextIno++
+	n := int64(1 + len(leaves))
+	start := img.Alloc(n)
+	inode := img.NewInode(ext4.FileTypeDir|0o755, 2, n*testBlockSize, testimage.ExtentRoot(ext4.Extent{Len: uint16(n), StartLo: uint32(start)}))
+	inode.Flags |= ext4.INDEX_FL
+	img.SetInode(ino, inode)
+	img.AddEntry(parent, ino, name, 2)
+	img.Link(parent)
+
+	root := make([]byte, testBlockSize)
+	copy(root, testimage.DirEntry(ino, ".", 2))
+	dotdot := testimage.DirEntry(parent, "..", 2)
+	binary.LittleEndian.PutUint16(dotdot[4:], testBlockSize-12)
+	copy(root[12:], dotdot)
+	root[0x18+4] = ext4.DX_HASH_TEA // hash_version
+	root[0x18+5] = 8                // info_length
+	binary.LittleEndian.PutUint16(root[0x20:], uint16((testBlockSize-0x20)/8))
+	binary.LittleEndian.PutUint16(root[0x22:], uint16(len(leaves)))
+	binary.LittleEndian.PutUint32(root[0x24:], 1)
+	for i, h := range hashes {
+		binary.LittleEndian.PutUint32(root[0x28+i*8:], h)
+		binary.LittleEndian.PutUint32(root[0x2C+i*8:], uint32(i+2))
+	}
+	img.WriteBlock(start, root)
+
+	for i, names := range leaves {
+		img.NewDirBlock(ino, start+1+int64(i))
+		for _, name := range names {
+			img.addFile(ino, name)
+		}
+	}
+	delete(img.Dirs, ino)
+	return ino
+}
+
+func (img *testImage) fs(opts ...ext4.Option) *ext4.FileSystem {
+	img.T.Helper()
+	b := img.Bytes()
+	fsys, err := ext4.NewFS(*io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), nil, opts...)
+	if err != nil {
+		img.T.Fatalf("NewFS() error: %v", err)
+	}
+	return fsys
+}
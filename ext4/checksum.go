@@ -0,0 +1,389 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"golang.org/x/xerrors"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Structure names reported by ChecksumError.
+const (
+	ChecksumSuperblock      = "superblock"
+	ChecksumGroupDescriptor = "group descriptor"
+	ChecksumInode           = "inode"
+	ChecksumExtentBlock     = "extent block"
+	ChecksumDirectoryBlock  = "directory block"
+	ChecksumDxNode          = "dx node"
+	ChecksumBlockBitmap     = "block bitmap"
+	ChecksumInodeBitmap     = "inode bitmap"
+	ChecksumOrphanBlock     = "orphan file block"
+)
+
+// ChecksumError is returned when an on-disk structure fails verification.
+type ChecksumError struct {
+	// Structure names the kind of metadata, e.g. ChecksumInode.
+	Structure string
+	// Block is the physical block holding the structure.
+	Block int64
+	// Index is the inode number or group number, when applicable.
+	Index int64
+	// Stored is the checksum recorded on disk and Computed the one
+	// calculated from the structure's contents.
+	Stored   uint32
+	Computed uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch (block: %d, index: %d): stored %#x, computed %#x",
+		e.Structure, e.Block, e.Index, e.Stored, e.Computed)
+}
+
+// crc32c computes the raw crc32c used by ext4, without the pre- and
+// post-inversion applied by hash/crc32.
+func crc32c(seed uint32, b []byte) uint32 {
+	return ^crc32.Update(^seed, crc32cTable, b)
+}
+
+func crc32cUint32(seed uint32, v uint32) uint32 {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return crc32c(seed, b[:])
+}
+
+// crc16 is the CRC16 (polynomial 0x8005, reflected) used by gdt_csum.
+func crc16(crc uint16, b []byte) uint16 {
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// checksumSeed returns the filesystem wide metadata_csum seed.
+func (sb *Superblock) checksumSeed() uint32 {
+	if sb.FeatureIncompatCsumSeed() {
+		return sb.ChecksumSeed
+	}
+	return crc32c(^uint32(0), sb.UUID[:])
+}
+
+// hasMetadataChecksums reports whether structures carry crc32c checksums.
+func (sb *Superblock) hasMetadataChecksums() bool {
+	return sb.FeatureRoCompatMetadataCsum()
+}
+
+// groupDescriptorSize returns the on-disk size of one group descriptor:
+// s_desc_size with 64bit, as EXT4_DESC_SIZE.
+func (sb *Superblock) groupDescriptorSize() int {
+	if sb.FeatureInCompat64bit() {
+		return int(sb.DescSize)
+	}
+	return 32
+}
+
+// verifySuperblockChecksum verifies the crc32c over the raw superblock read
+// from block.
+func verifySuperblockChecksum(sb *Superblock, raw []byte, block int64) error {
+	if !sb.hasMetadataChecksums() {
+		return nil
+	}
+	actual := crc32c(^uint32(0), raw[:SuperBlockSize-4])
+	if actual != sb.Checksum {
+		return &ChecksumError{
+			Structure: ChecksumSuperblock,
+			Block:     block,
+			Stored:    sb.Checksum,
+			Computed:  actual,
+		}
+	}
+	return nil
+}
+
+// groupDescriptorChecksum computes the checksum of a raw group descriptor
+// using metadata_csum or gdt_csum. ok is false when neither is enabled.
+func (sb *Superblock) groupDescriptorChecksum(group uint32, raw []byte) (csum uint16, ok bool) {
+	const checksumOffset = 0x1E
+	switch {
+	case sb.hasMetadataChecksums():
+		c := crc32cUint32(sb.checksumSeed(), group)
+		c = crc32c(c, raw[:checksumOffset])
+		c = crc32c(c, []byte{0, 0})
+		c = crc32c(c, raw[checksumOffset+2:])
+		return uint16(c), true
+	case sb.FeatureRoCompatGdtCsum():
+		var g [4]byte
+		binary.LittleEndian.PutUint32(g[:], group)
+		c := crc16(0xFFFF, sb.UUID[:])
+		c = crc16(c, g[:])
+		c = crc16(c, raw[:checksumOffset])
+		c = crc16(c, raw[checksumOffset+2:])
+		return c, true
+	}
+	return 0, false
+}
+
+// verifyGroupDescriptorChecksums verifies every descriptor of the raw group
+// descriptor table starting at block.
+func verifyGroupDescriptorChecksums(sb *Superblock, raw []byte, block int64) error {
+	size := sb.groupDescriptorSize()
+	for i := uint32(0); i < sb.GetGroupDescriptorTableCount(); i++ {
+		off := int(i) * size
+		if off+size > len(raw) {
+			break
+		}
+		desc := raw[off : off+size]
+		expected, ok := sb.groupDescriptorChecksum(i, desc)
+		if !ok {
+			return nil
+		}
+		actual := binary.LittleEndian.Uint16(desc[0x1E:])
+		if actual != expected {
+			return &ChecksumError{
+				Structure: ChecksumGroupDescriptor,
+				Block:     block + int64(off)/sb.GetBlockSize(),
+				Index:     int64(i),
+				Stored:    uint32(actual),
+				Computed:  uint32(expected),
+			}
+		}
+	}
+	return nil
+}
+
+// csumSeed is the per-inode seed used to verify extent, directory and dx
+// blocks. The zero value disables verification.
+type csumSeed struct {
+	seed uint32
+	ino  int64
+}
+
+func (s csumSeed) enabled() bool {
+	return s.ino != 0
+}
+
+// inodeCsumSeed returns the seed for verifying the blocks of inode ino, or
+// the zero csumSeed when verification is disabled.
+func (ext4 *FileSystem) inodeCsumSeed(ino int64, inode *Inode) csumSeed {
+	if !ext4.verifyChecksums || !ext4.sb.hasMetadataChecksums() {
+		return csumSeed{}
+	}
+	return csumSeed{seed: ext4.sb.inodeChecksumSeed(ino, inode.Generation), ino: ino}
+}
+
+// inodeChecksumSeed returns the per-inode seed used by inode, extent and
+// directory block checksums.
+func (sb *Superblock) inodeChecksumSeed(ino int64, generation uint32) uint32 {
+	c := crc32cUint32(sb.checksumSeed(), uint32(ino))
+	return crc32cUint32(c, generation)
+}
+
+const (
+	inodeChecksumLoOffset = 0x7C
+	inodeExtraIsizeOffset = 0x80
+	inodeChecksumHiOffset = 0x82
+)
+
+// inodeChecksum computes the checksum of a raw on-disk inode. hasHi reports
+// whether the inode is large enough to store the upper 16 bits.
+func (sb *Superblock) inodeChecksum(ino int64, raw []byte) (csum uint32, hasHi bool) {
+	generation := binary.LittleEndian.Uint32(raw[0x64:])
+	hasHi = len(raw) > 128 && int(binary.LittleEndian.Uint16(raw[inodeExtraIsizeOffset:]))+128 >= inodeChecksumHiOffset+2
+
+	c := sb.inodeChecksumSeed(ino, generation)
+	c = crc32c(c, raw[:inodeChecksumLoOffset])
+	c = crc32c(c, []byte{0, 0})
+	c = crc32c(c, raw[inodeChecksumLoOffset+2:128])
+	if len(raw) > 128 {
+		c = crc32c(c, raw[128:inodeChecksumHiOffset])
+		if hasHi {
+			c = crc32c(c, []byte{0, 0})
+		} else {
+			c = crc32c(c, raw[inodeChecksumHiOffset:inodeChecksumHiOffset+2])
+		}
+		c = crc32c(c, raw[inodeChecksumHiOffset+2:])
+	}
+	if !hasHi {
+		c &= 0xFFFF
+	}
+	return c, hasHi
+}
+
+// verifyInodeChecksum verifies the checksum of a raw on-disk inode.
+func verifyInodeChecksum(sb *Superblock, ino int64, raw []byte, block int64) error {
+	if !sb.hasMetadataChecksums() || len(raw) < 128 {
+		return nil
+	}
+	actual, hasHi := sb.inodeChecksum(ino, raw)
+	expected := uint32(binary.LittleEndian.Uint16(raw[inodeChecksumLoOffset:]))
+	if hasHi {
+		expected |= uint32(binary.LittleEndian.Uint16(raw[inodeChecksumHiOffset:])) << 16
+	}
+	if actual != expected {
+		return &ChecksumError{
+			Structure: ChecksumInode,
+			Block:     block,
+			Index:     ino,
+			Stored:    expected,
+			Computed:  actual,
+		}
+	}
+	return nil
+}
+
+// verifyExtentBlockChecksum verifies the tail of an extent tree block.
+// The tail follows the eh_max extent entries.
+func verifyExtentBlockChecksum(seed csumSeed, b []byte, block int64) error {
+	if !seed.enabled() || len(b) < 12 {
+		return nil
+	}
+	max := int(binary.LittleEndian.Uint16(b[4:]))
+	size := 12 + 12*max
+	if size+4 > len(b) {
+		return nil
+	}
+	expected := binary.LittleEndian.Uint32(b[size:])
+	actual := crc32c(seed.seed, b[:size])
+	if actual != expected {
+		return &ChecksumError{
+			Structure: ChecksumExtentBlock,
+			Block:     block,
+			Index:     seed.ino,
+			Stored:    expected,
+			Computed:  actual,
+		}
+	}
+	return nil
+}
+
+// directoryTailSize is the size of the fake dirent holding a leaf checksum.
+const directoryTailSize = 12
+
+// hasDirectoryTail reports whether a directory leaf block ends with a
+// checksum tail (inode 0, rec_len 12, name_len 0, file_type 0xDE).
+func hasDirectoryTail(b []byte) bool {
+	if len(b) < directoryTailSize {
+		return false
+	}
+	t := b[len(b)-directoryTailSize:]
+	return binary.LittleEndian.Uint32(t[0:]) == 0 &&
+		binary.LittleEndian.Uint16(t[4:]) == directoryTailSize &&
+		t[6] == 0 && t[7] == 0xDE
+}
+
+// verifyDirectoryBlockChecksum verifies the checksum tail of a directory
+// leaf block. Blocks without a tail are not verified.
+func verifyDirectoryBlockChecksum(seed csumSeed, b []byte, block int64) error {
+	if !seed.enabled() || !hasDirectoryTail(b) {
+		return nil
+	}
+	size := len(b) - directoryTailSize
+	expected := binary.LittleEndian.Uint32(b[size+8:])
+	actual := crc32c(seed.seed, b[:size])
+	if actual != expected {
+		return &ChecksumError{
+			Structure: ChecksumDirectoryBlock,
+			Block:     block,
+			Index:     seed.ino,
+			Stored:    expected,
+			Computed:  actual,
+		}
+	}
+	return nil
+}
+
+// verifyDxNodeChecksum verifies the dx_tail of an htree root or internal
+// node. countOffset is the offset of the dx_countlimit in the block.
+func verifyDxNodeChecksum(seed csumSeed, b []byte, countOffset int, block int64) error {
+	if !seed.enabled() || countOffset+4 > len(b) {
+		return nil
+	}
+	limit := int(binary.LittleEndian.Uint16(b[countOffset:]))
+	count := int(binary.LittleEndian.Uint16(b[countOffset+2:]))
+	tailOffset := countOffset + limit*8
+	if tailOffset+8 > len(b) || count > limit {
+		return nil
+	}
+	c := crc32c(seed.seed, b[:countOffset+count*8])
+	c = crc32c(c, b[tailOffset:tailOffset+4])
+	c = crc32c(c, []byte{0, 0, 0, 0})
+	expected := binary.LittleEndian.Uint32(b[tailOffset+4:])
+	if c != expected {
+		return &ChecksumError{
+			Structure: ChecksumDxNode,
+			Block:     block,
+			Index:     seed.ino,
+			Stored:    expected,
+			Computed:  c,
+		}
+	}
+	return nil
+}
+
+// verifyBitmapChecksum verifies a block or inode bitmap against the
+// checksum halves stored in its group descriptor.
+func verifyBitmapChecksum(sb *Superblock, structure string, bitmap []byte, size int, lo, hi uint16, block int64, group int64) error {
+	if !sb.hasMetadataChecksums() {
+		return nil
+	}
+	c := crc32c(sb.checksumSeed(), bitmap[:size])
+	expected := uint32(lo)
+	actual := c & 0xFFFF
+	if sb.FeatureInCompat64bit() {
+		expected |= uint32(hi) << 16
+		actual = c
+	}
+	if actual != expected {
+		return &ChecksumError{
+			Structure: structure,
+			Block:     block,
+			Index:     group,
+			Stored:    expected,
+			Computed:  actual,
+		}
+	}
+	return nil
+}
+
+// verifyStaticChecksums verifies the structures read when the filesystem is
+// opened: the superblock, the group descriptors and the allocation bitmaps.
+func (ext4 *FileSystem) verifyStaticChecksums() error {
+	off := int64(GroupZeroPadding)
+	if ext4.sbGroup != 0 {
+		off = ext4.sb.groupFirstBlock(ext4.sbGroup) * ext4.sb.GetBlockSize()
+	}
+	_, raw, err := readSuperblockAt(ext4.r, off)
+	if err != nil {
+		return err
+	}
+	if err := verifySuperblockChecksum(&ext4.sb, raw, off/ext4.sb.GetBlockSize()); err != nil {
+		return err
+	}
+
+	_, raw, err = ext4.sb.readGroupDescriptorTable(ext4.r, ext4.gdtGroup)
+	if err != nil {
+		return xerrors.Errorf("failed to read group descriptors: %w", err)
+	}
+	if err := verifyGroupDescriptorChecksums(&ext4.sb, raw, ext4.sb.groupDescriptorBlock(0, ext4.gdtGroup)); err != nil {
+		return err
+	}
+
+	for group := range ext4.gds {
+		if _, err := ext4.BlockBitmap(int64(group)); err != nil {
+			return err
+		}
+		if _, err := ext4.InodeBitmap(int64(group)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// inodeDtimeOffset is the offset of i_dtime in the raw inode.
+const inodeDtimeOffset = 0x14
+
+// DeletedInode is an inode that is free in the inode bitmap but still
+// records a deletion time, with the metadata it kept.
+type DeletedInode struct {
+	Ino          int64
+	Inode        *Inode
+	DeletionTime time.Time
+}
+
+// DeletedInodeHandler is called by DeletedInodes for every deleted inode.
+// Returning an error stops the enumeration.
+type DeletedInodeHandler func(d *DeletedInode) error
+
+// DeletedInodes calls fn for every deleted inode in inode number order.
+// Inode table entries that were never used are skipped. The error returned
+// by fn is returned as is.
+func (ext4 *FileSystem) DeletedInodes(fn DeletedInodeHandler) error {
+	firstIno := int64(ext4.sb.FirstIno)
+	if ext4.sb.RevLevel == 0 {
+		firstIno = 11
+	}
+	return ext4.walkInodeTables(func(ino int64, raw []byte, allocated bool) error {
+		if ino < firstIno || allocated {
+			return nil
+		}
+		dtime := binary.LittleEndian.Uint32(raw[inodeDtimeOffset:])
+		if dtime == 0 {
+			return nil
+		}
+		inode, err := parseInode(raw)
+		if err != nil {
+			return xerrors.Errorf("failed to parse inode %d: %w", ino, err)
+		}
+		return fn(&DeletedInode{Ino: ino, Inode: inode, DeletionTime: time.Unix(int64(dtime), 0)})
+	})
+}
+
+// ReallocatedRange is a run of blocks of a deleted file that are in use
+// again, so they likely hold data of another file.
+type ReallocatedRange struct {
+	LogicalBlock int64
+	Block        int64
+	Len          int64
+}
+
+// DeletedFile is the best-effort content of a deleted inode. Holes and
+// blocks that could not be mapped read as zeros.
+type DeletedFile struct {
+	*io.SectionReader
+	// Inode is the inode the blocks were mapped from: the deleted inode
+	// itself or, when the deletion cleared its block map, its latest copy
+	// in the journal that still maps blocks.
+	Inode *Inode
+	// Sequence is the journal transaction of Inode, zero for the inode
+	// on disk.
+	Sequence uint32
+	// Reallocated lists the blocks of the content that are in use again,
+	// in logical block order.
+	Reallocated []ReallocatedRange
+}
+
+// OpenDeleted opens the content of the deleted inode ino.
+func (ext4 *FileSystem) OpenDeleted(ino int64) (*DeletedFile, error) {
+	allocated, err := ext4.IsInodeAllocated(ino)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read inode bitmap: %w", err)
+	}
+	if allocated {
+		return nil, xerrors.Errorf("inode %d is in use", ino)
+	}
+	off, err := ext4.inodeOffset(ino)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, ext4.sb.InodeSize)
+	if _, err := ext4.r.ReadAt(raw, off); err != nil {
+		return nil, xerrors.Errorf("failed to read inode: %w", err)
+	}
+	inode, err := parseInode(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// Recent kernels clear the block map on deletion, older copies of the
+	// inode in the journal may still have it. The journal is optional.
+	candidates := []InodeVersion{{Inode: inode}}
+	if versions, err := ext4.InodeHistory(ino); err == nil {
+		for i := len(versions) - 1; i >= 0; i-- {
+			candidates = append(candidates, versions[i])
+		}
+	}
+	for _, c := range candidates {
+		if c.Inode.Flags&INLINE_DATA_FL != 0 {
+			continue
+		}
+		dt, err := ext4.dataTable(0, c.Inode)
+		if err != nil || len(dt) == 0 {
+			continue
+		}
+		return ext4.newDeletedFile(c, dt), nil
+	}
+	return nil, xerrors.Errorf("no block map of deleted inode %d survives", ino)
+}
+
+// newDeletedFile builds the DeletedFile of the blocks dt mapped by v,
+// flagging the ones in use again.
+func (ext4 *FileSystem) newDeletedFile(v InodeVersion, dt dataTable) *DeletedFile {
+	blockSize := ext4.sb.GetBlockSize()
+	logical := make([]int64, 0, len(dt))
+	for l := range dt {
+		logical = append(logical, l)
+	}
+	sort.Slice(logical, func(i, j int) bool { return logical[i] < logical[j] })
+
+	f := &DeletedFile{Inode: v.Inode, Sequence: v.Sequence}
+	bitmaps := map[int64][]byte{}
+	for _, l := range logical {
+		block := dt[l] / blockSize
+		if block >= ext4.sb.GetBlockCount() {
+			// A stale map may point past the end of the filesystem.
+			delete(dt, l)
+			continue
+		}
+		if allocated, err := ext4.blockAllocated(block, bitmaps); err != nil || !allocated {
+			continue
+		}
+		if n := len(f.Reallocated); n > 0 {
+			last := &f.Reallocated[n-1]
+			if last.LogicalBlock+last.Len == l && last.Block+last.Len == block {
+				last.Len++
+				continue
+			}
+		}
+		f.Reallocated = append(f.Reallocated, ReallocatedRange{LogicalBlock: l, Block: block, Len: 1})
+	}
+
+	size := v.Inode.GetSize()
+	if size == 0 && len(logical) > 0 {
+		size = (logical[len(logical)-1] + 1) * blockSize
+	}
+	f.SectionReader = io.NewSectionReader(&inodeReader{
+		r:         ext4.r,
+		table:     dt,
+		blockSize: blockSize,
+		size:      size,
+	}, 0, size)
+	return f
+}
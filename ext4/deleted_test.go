@@ -0,0 +1,103 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+const testDtime = 1700000000
+
+// deleteInode frees inode ino and the blocks of its extents, as unlinking
+// the last link does, leaving the inode otherwise intact.
+func (img *testImage) deleteInode(ino uint32) {
+	inode := img.Inodes[ino]
+	inode.LinksCount = 0
+	inode.Dtime = testDtime
+	bit := ino - 1
+	img.Data[testInodeBitmap*testBlockSize+bit/8] &^= 1 << (bit % 8)
+
+	entries := binary.LittleEndian.Uint16(inode.BlockOrExtents[2:])
+	for i := 0; i < int(entries); i++ {
+		var e Extent
+		binary.Read(bytes.NewReader(inode.BlockOrExtents[12+12*i:]), binary.LittleEndian, &e)
+		for b := e.offset(); b < e.offset()+int64(e.GetLen()); b++ {
+			bit := b - int64(img.SB.FirstDataBlock)
+			img.Data[testBlockBitmap*testBlockSize+bit/8] &^= 1 << (bit % 8)
+		}
+	}
+}
+
+func TestDeletedInodes(t *testing.T) {
+	img := newTestImage(t)
+	img.AddFile(rootInodeNumber, "keep.txt", []byte("keep"))
+	gone := img.AddFile(rootInodeNumber, "gone.txt", append(bytes.Repeat([]byte{'g'}, testBlockSize), "tail"...))
+	cleared := img.AddFile(rootInodeNumber, "cleared.txt", []byte("journal copy"))
+	// The journal holds the inode before its deletion.
+	before := img.bytes()
+	inodeBlock := img.InodeOffset(cleared) / testBlockSize
+	img.addJournal(testTransaction{blocks: map[int64][]byte{
+		inodeBlock: before[inodeBlock*testBlockSize : (inodeBlock+1)*testBlockSize],
+	}})
+
+	img.deleteInode(gone)
+	// The second block of gone.txt has been allocated again.
+	goneStart := int64(binary.LittleEndian.Uint32(img.Inodes[gone].BlockOrExtents[12+8:]))
+	img.MarkBlock(goneStart + 1)
+	// Like recent kernels, the deletion cleared the size and extents.
+	img.deleteInode(cleared)
+	img.Inodes[cleared].SizeLo = 0
+	img.Inodes[cleared].BlockOrExtents = testExtentRoot()
+	fsys := img.fs()
+
+	var deleted []int64
+	err := fsys.DeletedInodes(func(d *DeletedInode) error {
+		if d.DeletionTime.Unix() != testDtime || d.Inode.LinksCount != 0 {
+			t.Errorf("inode %d: deletion time %v, links %d", d.Ino, d.DeletionTime, d.Inode.LinksCount)
+		}
+		deleted = append(deleted, d.Ino)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("DeletedInodes() error: %v", err)
+	}
+	if len(deleted) != 2 || deleted[0] != int64(gone) || deleted[1] != int64(cleared) {
+		t.Errorf("DeletedInodes() = %v, want [%d %d]", deleted, gone, cleared)
+	}
+
+	read := func(ino uint32) *DeletedFile {
+		t.Helper()
+		f, err := fsys.OpenDeleted(int64(ino))
+		if err != nil {
+			t.Fatalf("OpenDeleted(%d) error: %v", ino, err)
+		}
+		return f
+	}
+
+	f := read(gone)
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll() error: %v", err)
+	}
+	if len(content) != testBlockSize+4 || content[0] != 'g' || f.Sequence != 0 {
+		t.Errorf("gone.txt: %d bytes from transaction %d", len(content), f.Sequence)
+	}
+	want := []ReallocatedRange{{LogicalBlock: 1, Block: goneStart + 1, Len: 1}}
+	if len(f.Reallocated) != 1 || f.Reallocated[0] != want[0] {
+		t.Errorf("Reallocated = %+v, want %+v", f.Reallocated, want)
+	}
+
+	f = read(cleared)
+	content, err = io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll() error: %v", err)
+	}
+	if string(content) != "journal copy" || f.Sequence != 5 || len(f.Reallocated) != 0 {
+		t.Errorf("cleared.txt = %q from transaction %d, reallocated %v", content, f.Sequence, f.Reallocated)
+	}
+
+	if _, err := fsys.OpenDeleted(rootInodeNumber); err == nil {
+		t.Error("OpenDeleted() of an inode in use succeeded")
+	}
+}
@@ -0,0 +1,121 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+const direntHeaderSize = 8
+
+// deletedDirEntries returns the deleted entries found in the blocks of
+// directory ino, in block order.
+func (ext4 *FileSystem) deletedDirEntries(ino int64) ([]DirectoryEntry2, error) {
+	inode, err := ext4.getInode(ino)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get inode(%d): %w", ino, err)
+	}
+	if inode.Flags&INLINE_DATA_FL != 0 {
+		return nil, nil
+	}
+	blockMap, err := ext4.buildDirectoryBlockMap(ino, inode, csumSeed{})
+	if err != nil {
+		return nil, err
+	}
+	logical := make([]uint32, 0, len(blockMap))
+	for l := range blockMap {
+		logical = append(logical, l)
+	}
+	sort.Slice(logical, func(i, j int) bool { return logical[i] < logical[j] })
+
+	var entries []DirectoryEntry2
+	for _, l := range logical {
+		b, err := ext4.readLogicalBlock(blockMap, l)
+		if err != nil {
+			if ext4.tolerate(xerrors.Errorf("inode %d: %w", ino, err)) {
+				continue
+			}
+			return nil, err
+		}
+		entries = append(entries, scanDeletedEntries(b, ext4.sb.InodeCount)...)
+	}
+	return entries, nil
+}
+
+// scanDeletedEntries follows the live entries of directory block b and
+// returns the deleted ones still found in it: the entries hidden in the
+// rec_len slack after a live entry, which swallowed them on deletion, and
+// the unused entries that kept their name. The latter lost their inode
+// number. Only entries that look plausible are returned.
+func scanDeletedEntries(b []byte, inodeCount uint32) []DirectoryEntry2 {
+	var deleted []DirectoryEntry2
+	for off := 0; off+direntHeaderSize <= len(b); {
+		recLen := int(binary.LittleEndian.Uint16(b[off+4:]))
+		if recLen < direntHeaderSize || recLen%4 != 0 || off+recLen > len(b) {
+			break
+		}
+		inode := binary.LittleEndian.Uint32(b[off:])
+		nameLen := int(b[off+6])
+
+		slack := off + direntHeaderSize
+		if inode != 0 || nameLen > 0 {
+			slack += direntAlign(nameLen)
+		}
+		if inode == 0 && nameLen > 0 {
+			if e, ok := plausibleDirEntry(b[off:], len(b)-off, inodeCount, true); ok {
+				deleted = append(deleted, e)
+			}
+		}
+		for p := slack; p+direntHeaderSize <= off+recLen; {
+			e, ok := plausibleDirEntry(b[p:off+recLen], len(b)-p, inodeCount, false)
+			if !ok {
+				p += 4
+				continue
+			}
+			deleted = append(deleted, e)
+			p += direntHeaderSize + direntAlign(int(e.NameLen))
+		}
+		off += recLen
+	}
+	return deleted
+}
+
+// plausibleDirEntry decodes the entry at the start of b, whose rec_len may
+// extend up to limit bytes. unused accepts an entry without an inode number.
+func plausibleDirEntry(b []byte, limit int, inodeCount uint32, unused bool) (DirectoryEntry2, bool) {
+	if len(b) < direntHeaderSize {
+		return DirectoryEntry2{}, false
+	}
+	e := DirectoryEntry2{
+		Inode:   binary.LittleEndian.Uint32(b),
+		RecLen:  binary.LittleEndian.Uint16(b[4:]),
+		NameLen: b[6],
+		Flags:   b[7],
+		Deleted: true,
+	}
+	if (e.Inode == 0) != unused || e.Inode > inodeCount {
+		return DirectoryEntry2{}, false
+	}
+	if e.NameLen == 0 || direntHeaderSize+int(e.NameLen) > len(b) || e.Flags > direntSymlink {
+		return DirectoryEntry2{}, false
+	}
+	if int(e.RecLen) < direntHeaderSize+int(e.NameLen) || e.RecLen%4 != 0 || int(e.RecLen) > limit {
+		return DirectoryEntry2{}, false
+	}
+	name := b[direntHeaderSize : direntHeaderSize+int(e.NameLen)]
+	if bytes.IndexByte(name, 0) >= 0 || bytes.IndexByte(name, '/') >= 0 {
+		return DirectoryEntry2{}, false
+	}
+	e.Name = string(name)
+	if e.Name == "." || e.Name == ".." {
+		return DirectoryEntry2{}, false
+	}
+	return e, true
+}
+
+// direntAlign returns the size of a name padded to 4 bytes.
+func direntAlign(nameLen int) int {
+	return (nameLen + 3) &^ 3
+}
@@ -0,0 +1,73 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"testing"
+)
+
+func TestDeletedDirEntries(t *testing.T) {
+	img := newTestImage(t)
+	img.AddFile(rootInodeNumber, "a.txt", []byte("a"))
+	gone := img.AddFile(rootInodeNumber, "gone.txt", []byte("gone"))
+	img.AddFile(rootInodeNumber, "b.txt", []byte("b"))
+
+	// Unlinking gone.txt grew the rec_len of a.txt over it.
+	entries := img.Dirs[rootInodeNumber].Entries
+	n := len(entries)
+	prev, deleted := entries[n-3], entries[n-2]
+	binary.LittleEndian.PutUint16(prev[4:], uint16(len(prev)+len(deleted)))
+
+	for _, e := range mustDirEntries(t, img.fs(), rootInodeNumber) {
+		if e.Name == "gone.txt" {
+			t.Errorf("DirEntries() without WithDeletedEntries returned %+v", e)
+		}
+	}
+
+	fsys := img.fs(WithDeletedEntries())
+	var found []DirectoryEntry2
+	for _, e := range mustDirEntries(t, fsys, rootInodeNumber) {
+		if e.Deleted {
+			found = append(found, e)
+		}
+	}
+	if len(found) != 1 || found[0].Name != "gone.txt" || found[0].Inode != gone || found[0].Flags != 1 {
+		t.Fatalf("deleted entries = %+v, want gone.txt with inode %d", found, gone)
+	}
+
+	dirEntries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatalf("ReadDir() error: %v", err)
+	}
+	for _, e := range dirEntries {
+		if e.Name() == "gone.txt" {
+			t.Error("ReadDir() returned a deleted entry")
+		}
+	}
+}
+
+func TestScanDeletedEntries(t *testing.T) {
+	block := make([]byte, 64)
+	// The first entry of a block keeps its name when deleted.
+	first := buildDirEntry(0, "first", 1)
+	copy(block, first)
+	live := buildDirEntry(12, "live", 1)
+	binary.LittleEndian.PutUint16(live[4:], uint16(len(block)-len(first)))
+	copy(block[len(first):], live)
+	// Garbage in the slack after the live entry is not an entry.
+	copy(block[len(first)+len(live):], []byte{0xff, 0xff, 0xff, 0xff, 8, 0, 1, 1, 'x'})
+
+	got := scanDeletedEntries(block, 32)
+	if len(got) != 1 || got[0].Name != "first" || got[0].Inode != 0 || !got[0].Deleted {
+		t.Errorf("scanDeletedEntries() = %+v, want only the unused first entry", got)
+	}
+}
+
+func mustDirEntries(t *testing.T, fsys *FileSystem, ino int64) []DirectoryEntry2 {
+	t.Helper()
+	entries, err := fsys.DirEntries(ino)
+	if err != nil {
+		t.Fatalf("DirEntries() error: %v", err)
+	}
+	return entries
+}
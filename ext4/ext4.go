@@ -38,10 +38,20 @@ func Check(r io.Reader) bool {
 }
 
 func (ext4 *FileSystem) Extents(inode *Inode) ([]Extent, error) {
-	extents, err := ext4.extents(inode.BlockOrExtents[:], nil, extentDepthRoot)
+	return ext4.inodeExtents(0, inode, csumSeed{})
+}
+
+// inodeExtents returns the sorted extents of inode ino, verifying extent
+// block checksums with seed. The block ranges of replayed fast commits are
+// applied on top of the extent tree; an ino of 0 skips them.
+func (ext4 *FileSystem) inodeExtents(ino int64, inode *Inode, seed csumSeed) ([]Extent, error) {
+	extents, err := ext4.extents(inode.BlockOrExtents[:], nil, extentDepthRoot, seed)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to get extents: %w", err)
 	}
+	if ranges := ext4.fcRanges[ino]; len(ranges) > 0 {
+		extents = applyFastCommitRanges(extents, ranges)
+	}
 	sort.Slice(extents, func(i, j int) bool {
 		return extents[i].Block < extents[j].Block
 	})
@@ -49,34 +59,30 @@ func (ext4 *FileSystem) Extents(inode *Inode) ([]Extent, error) {
 }
 
 func (sb Superblock) getGroupDescriptor(r io.SectionReader) ([]GroupDescriptor, error) {
-	_, err := r.Seek(int64(sb.FirstDataBlock+1)*sb.GetBlockSize(), 0)
+	gds, _, err := sb.readGroupDescriptorTable(&r, 0)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to seek Group Descriptor offset: %w", err)
-	}
-
-	GroupDescriptorSize := int(sb.GetGroupDescriptorTableCount()) * 32
-	if sb.FeatureInCompat64bit() {
-		GroupDescriptorSize = int(sb.GetGroupDescriptorTableCount()) * 64
+		return nil, err
 	}
+	return gds, nil
+}
 
-	count := divWithRoundUp(GroupDescriptorSize, SectorSize)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to div: %w", err)
-	}
-	buf, err := readBlock(&r, int64(count)*SectorSize)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to read group descriptor: %w", err)
-	}
+// parseGroupDescriptors decodes the group descriptor table from buf.
+func (sb Superblock) parseGroupDescriptors(buf io.Reader) ([]GroupDescriptor, error) {
 	var gds []GroupDescriptor
+	// Descriptors larger than GroupDescriptor are padded.
+	raw := make([]byte, sb.groupDescriptorSize())
 	for i := uint32(0); i < sb.GetGroupDescriptorTableCount(); i++ {
 		var gd GroupDescriptor
+		if _, err := io.ReadFull(buf, raw); err != nil {
+			return nil, xerrors.Errorf("failed to read group descriptor: %w", err)
+		}
 		if sb.FeatureInCompat64bit() {
-			err = binary.Read(buf, binary.LittleEndian, &gd)
+			err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &gd)
 			if err != nil {
 				return nil, xerrors.Errorf("failed to parse 64 bit group descriptor: %w", err)
 			}
 		} else {
-			err = binary.Read(buf, binary.LittleEndian, &gd.GroupDescriptor32)
+			err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &gd.GroupDescriptor32)
 			if err != nil {
 				return nil, xerrors.Errorf("failed to parse 32 bit group descriptor: %w", err)
 			}
@@ -96,60 +102,153 @@ func (ext4 *FileSystem) getInode(inodeAddress int64) (*Inode, error) {
 		}
 	}
 
+	physicalOffset, err := ext4.inodeOffset(inodeAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, ext4.sb.InodeSize)
+	_, err = ext4.r.ReadAt(buf, physicalOffset)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read inode: %w", err)
+	}
+	if ext4.verifyChecksums {
+		if err := verifyInodeChecksum(&ext4.sb, inodeAddress, buf, physicalOffset/ext4.sb.GetBlockSize()); err != nil {
+			return nil, err
+		}
+	}
+
+	inode, err := parseInode(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	ext4.cache.Add(inodeCacheKey(inodeAddress), *inode)
+	return inode, nil
+}
+
+// inodeOffset returns the byte offset of inode inodeAddress in the inode
+// table.
+func (ext4 *FileSystem) inodeOffset(inodeAddress int64) (int64, error) {
+	if inodeAddress < 1 {
+		return 0, xerrors.Errorf("inode %d is out of range: %w", inodeAddress, ErrInodeNotFound)
+	}
 	bgdIndex := (inodeAddress - 1) / int64(ext4.sb.InodePerGroup)
 	if bgdIndex >= int64(len(ext4.gds)) {
 		log.Logger.Debugf("inodeAddress: %d, InodePerGroup: %d, bgdIndex: %d", inodeAddress, ext4.sb.InodePerGroup, bgdIndex)
-		return nil, xerrors.Errorf("failed to get inode: bgdIndex is out of range bgdIndex: %d len(ext4.gds): %d", bgdIndex, len(ext4.gds))
+		return 0, xerrors.Errorf("failed to get inode: bgdIndex is out of range bgdIndex: %d len(ext4.gds): %d", bgdIndex, len(ext4.gds))
 	}
 	bgd := ext4.gds[bgdIndex]
 	index := (inodeAddress - 1) % int64(ext4.sb.InodePerGroup)
-	physicalOffset := bgd.GetInodeTableLoc(ext4.sb.FeatureInCompat64bit())*ext4.sb.GetBlockSize() + index*int64(ext4.sb.InodeSize)
+	return bgd.GetInodeTableLoc(ext4.sb.FeatureInCompat64bit())*ext4.sb.GetBlockSize() + index*int64(ext4.sb.InodeSize), nil
+}
 
-	inodeStructSize := int64(binary.Size(Inode{}))
-	buf := make([]byte, inodeStructSize)
+// walkInodeTables calls fn with every raw inode of the inode tables, in
+// inode number order, and whether the inode bitmap marks it in use. Groups
+// with INODE_UNINIT and the inode table entries that were never used are
+// skipped. The error returned by fn is returned as is.
+func (ext4 *FileSystem) walkInodeTables(fn func(ino int64, raw []byte, allocated bool) error) error {
+	is64bit := ext4.sb.FeatureInCompat64bit()
+	inodeSize := int64(ext4.sb.InodeSize)
 
-	// Read only the on-disk inode size; for ext2/ext3 (InodeSize=128)
-	// the remaining bytes stay zero, giving safe defaults for extended fields.
-	readSize := inodeStructSize
-	if int64(ext4.sb.InodeSize) < readSize {
-		readSize = int64(ext4.sb.InodeSize)
-	}
-	_, err := ext4.r.ReadAt(buf[:readSize], physicalOffset)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to read inode: %w", err)
+	for group := range ext4.gds {
+		gd := ext4.gds[group]
+		if gd.Flags&BG_INODE_UNINIT != 0 {
+			continue
+		}
+		used := int64(ext4.sb.InodePerGroup)
+		if ext4.sb.FeatureRoCompatGdtCsum() || ext4.sb.FeatureRoCompatMetadataCsum() {
+			used -= gd.GetItableUnused(is64bit)
+		}
+		if used <= 0 {
+			continue
+		}
+
+		bitmap, err := ext4.InodeBitmap(int64(group))
+		if err != nil {
+			err = xerrors.Errorf("failed to read inode bitmap of group %d: %w", group, err)
+			if ext4.tolerate(err) {
+				continue
+			}
+			return err
+		}
+		table := make([]byte, used*inodeSize)
+		if _, err := ext4.r.ReadAt(table, gd.GetInodeTableLoc(is64bit)*ext4.sb.GetBlockSize()); err != nil {
+			err = xerrors.Errorf("failed to read inode table of group %d: %w", group, err)
+			if ext4.tolerate(err) {
+				continue
+			}
+			return err
+		}
+
+		for index := int64(0); index < used; index++ {
+			ino := int64(group)*int64(ext4.sb.InodePerGroup) + index + 1
+			allocated := bitmap[index/8]&(1<<(index%8)) != 0
+			if err := fn(ino, table[index*inodeSize:(index+1)*inodeSize], allocated); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
+
+// parseInode decodes an on-disk inode. Only the bytes present in b are used;
+// for ext2/ext3 (InodeSize=128) the remaining fields stay zero, giving safe
+// defaults for extended fields.
+func parseInode(b []byte) (*Inode, error) {
+	buf := make([]byte, binary.Size(Inode{}))
+	copy(buf, b)
 
 	inode := Inode{}
 	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &inode); err != nil {
 		return nil, xerrors.Errorf("failed to read binary: %w", err)
 	}
-
-	ext4.cache.Add(inodeCacheKey(inodeAddress), inode)
 	return &inode, nil
 }
 
-func (ext4 *FileSystem) extents(b []byte, extents []Extent, expectedDepth int) ([]Extent, error) {
-	extentReader := bytes.NewReader(b)
-	extentHeader := &ExtentHeader{}
-	err := binary.Read(extentReader, binary.LittleEndian, extentHeader)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to parse extent header: %w", err)
+// extentNodeEntrySize is the size of the header of an extent tree node and
+// of each of its entries.
+const extentNodeEntrySize = 12
+
+// maxExtentDepth is the maximum depth of an extent tree.
+const maxExtentDepth = 5
+
+// parseExtentHeader parses and validates the header of the extent tree node
+// b, whose depth must be expectedDepth unless it is extentDepthRoot. The
+// returned reader is positioned at the first entry.
+func parseExtentHeader(b []byte, expectedDepth int) (*ExtentHeader, *bytes.Reader, error) {
+	r := bytes.NewReader(b)
+	header := &ExtentHeader{}
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return nil, nil, xerrors.Errorf("failed to parse extent header: %w", err)
+	}
+
+	if header.Magic != 0xF30A {
+		return nil, nil, xerrors.Errorf("invalid extent header magic: %#x", header.Magic)
 	}
 
-	if extentHeader.Magic != 0xF30A {
-		return nil, xerrors.Errorf("invalid extent header magic: %#x", extentHeader.Magic)
+	if header.Depth > maxExtentDepth {
+		return nil, nil, xerrors.Errorf("extent tree depth %d exceeds maximum of %d", header.Depth, maxExtentDepth)
 	}
 
-	if extentHeader.Depth > 5 {
-		return nil, xerrors.Errorf("extent tree depth %d exceeds maximum of 5", extentHeader.Depth)
+	if expectedDepth >= 0 && int(header.Depth) != expectedDepth {
+		return nil, nil, xerrors.Errorf("extent tree depth %d does not match expected %d", header.Depth, expectedDepth)
 	}
 
-	if expectedDepth >= 0 && int(extentHeader.Depth) != expectedDepth {
-		return nil, xerrors.Errorf("extent tree depth %d does not match expected %d", extentHeader.Depth, expectedDepth)
+	if header.Entries > header.Max {
+		return nil, nil, xerrors.Errorf("extent header entries (%d) exceeds max (%d)", header.Entries, header.Max)
 	}
 
-	if extentHeader.Entries > extentHeader.Max {
-		return nil, xerrors.Errorf("extent header entries (%d) exceeds max (%d)", extentHeader.Entries, extentHeader.Max)
+	if size := extentNodeEntrySize * (int(header.Entries) + 1); size > len(b) {
+		return nil, nil, xerrors.Errorf("%d extent entries do not fit in a node of %d bytes", header.Entries, len(b))
+	}
+	return header, r, nil
+}
+
+func (ext4 *FileSystem) extents(b []byte, extents []Extent, expectedDepth int, seed csumSeed) ([]Extent, error) {
+	extentHeader, extentReader, err := parseExtentHeader(b, expectedDepth)
+	if err != nil {
+		return nil, err
 	}
 
 	if extentHeader.Depth == 0 {
@@ -159,6 +258,11 @@ func (ext4 *FileSystem) extents(b []byte, extents []Extent, expectedDepth int) (
 			if err != nil {
 				return nil, xerrors.Errorf("failed to read leaf node extent: %w", err)
 			}
+			if ext4.lenient && extent.offset()+int64(extent.GetLen()) > ext4.sb.GetBlockCount() {
+				ext4.tolerate(xerrors.Errorf("extent at logical block %d maps blocks %d-%d past the end of the filesystem",
+					extent.Block, extent.offset(), extent.offset()+int64(extent.GetLen())-1))
+				continue
+			}
 			extents = append(extents, extent)
 		}
 	} else {
@@ -172,13 +276,30 @@ func (ext4 *FileSystem) extents(b []byte, extents []Extent, expectedDepth int) (
 			physBlock := int64(extent.LeafHigh)<<32 | int64(extent.LeafLow)
 			_, err = ext4.r.ReadAt(b, physBlock*ext4.sb.GetBlockSize())
 			if err != nil {
-				return nil, xerrors.Errorf("failed to read leaf node extent: %w", err)
+				err = xerrors.Errorf("failed to read leaf node extent: %w", err)
+				if ext4.tolerate(err) {
+					continue
+				}
+				return nil, err
+			}
+			if err := verifyExtentBlockChecksum(seed, b, physBlock); err != nil {
+				if ext4.tolerate(err) {
+					continue
+				}
+				return nil, err
 			}
 
-			extents, err = ext4.extents(b, extents, int(extentHeader.Depth)-1)
+			// A damaged subtree is dropped as a whole in lenient mode so
+			// that it cannot contribute half of its extents.
+			subtree, err := ext4.extents(b, nil, int(extentHeader.Depth)-1, seed)
 			if err != nil {
-				return nil, xerrors.Errorf("failed to get extents: %w", err)
+				err = xerrors.Errorf("failed to get extents: %w", err)
+				if ext4.tolerate(xerrors.Errorf("extent tree block %d: %w", physBlock, err)) {
+					continue
+				}
+				return nil, err
 			}
+			extents = append(extents, subtree...)
 		}
 	}
 	return extents, nil
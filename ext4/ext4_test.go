@@ -63,7 +63,7 @@ func TestExtents_InternalNodeUsesFullBlockSize(t *testing.T) {
 		LeafLow: leafBlock,
 	})
 
-	extents, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot)
+	extents, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot, csumSeed{})
 	if err != nil {
 		t.Fatalf("extents() error: %v", err)
 	}
@@ -86,7 +86,7 @@ func TestExtents_EntriesExceedsMax(t *testing.T) {
 	fs := &FileSystem{
 		sb: Superblock{LogBlockSize: 2},
 	}
-	_, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot)
+	_, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot, csumSeed{})
 	if err == nil {
 		t.Fatal("extents() should return error when Entries > Max")
 	}
@@ -129,7 +129,7 @@ func TestExtents_DepthMismatch(t *testing.T) {
 		LeafLow: 1, // points to block 1
 	})
 
-	_, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot)
+	_, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot, csumSeed{})
 	if err == nil {
 		t.Fatal("extents() should return error when child depth does not match expected")
 	}
@@ -149,7 +149,7 @@ func TestExtents_InvalidMagic(t *testing.T) {
 	fs := &FileSystem{
 		sb: Superblock{LogBlockSize: 2},
 	}
-	_, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot)
+	_, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot, csumSeed{})
 	if err == nil {
 		t.Fatal("extents() should return error for invalid magic")
 	}
@@ -169,7 +169,7 @@ func TestExtents_DepthExceedsMax(t *testing.T) {
 	fs := &FileSystem{
 		sb: Superblock{LogBlockSize: 2},
 	}
-	_, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot)
+	_, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot, csumSeed{})
 	if err == nil {
 		t.Fatal("extents() should return error for depth > 5")
 	}
@@ -231,7 +231,7 @@ func TestExtents_InternalNodeLeafHighAddress(t *testing.T) {
 		LeafHigh: leafHigh,
 	})
 
-	extents, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot)
+	extents, err := fs.extents(rootBuf.Bytes(), nil, extentDepthRoot, csumSeed{})
 	if err != nil {
 		t.Fatalf("extents() error: %v", err)
 	}
@@ -385,3 +385,41 @@ func TestGetInode_SmallInodeSizeExtendedFieldsZero(t *testing.T) {
 		t.Errorf("CtimeExtra = %#x, want 0", inode.CtimeExtra)
 	}
 }
+
+// TestMetadataBlocks_IndexLoop verifies that MetadataBlocks rejects an
+// extent index block pointing to itself instead of recursing forever.
+func TestMetadataBlocks_IndexLoop(t *testing.T) {
+	const blockSize = 4096
+
+	index := &bytes.Buffer{}
+	binary.Write(index, binary.LittleEndian, ExtentHeader{Magic: 0xF30A, Entries: 1, Max: 340, Depth: 1})
+	binary.Write(index, binary.LittleEndian, ExtentInternal{LeafLow: 1}) // itself
+	image := make([]byte, blockSize*2)
+	copy(image[blockSize:], index.Bytes())
+
+	fs := &FileSystem{
+		r:  io.NewSectionReader(bytes.NewReader(image), 0, int64(len(image))),
+		sb: Superblock{LogBlockSize: 2},
+	}
+	root := &bytes.Buffer{}
+	binary.Write(root, binary.LittleEndian, ExtentHeader{Magic: 0xF30A, Entries: 1, Max: 4, Depth: 2})
+	binary.Write(root, binary.LittleEndian, ExtentInternal{LeafLow: 1})
+	inode := &Inode{Flags: EXTENTS_FL}
+	copy(inode.BlockOrExtents[:], root.Bytes())
+
+	if _, err := fs.MetadataBlocks(inode); err == nil {
+		t.Fatal("MetadataBlocks() should return error for an index block pointing to itself")
+	}
+}
+
+// TestParseExtentHeader_EntriesPastNode verifies that an extent header
+// whose entries do not fit in its node is rejected.
+func TestParseExtentHeader_EntriesPastNode(t *testing.T) {
+	root := &bytes.Buffer{}
+	binary.Write(root, binary.LittleEndian, ExtentHeader{Magic: 0xF30A, Entries: 5, Max: 5})
+	b := make([]byte, 60)
+	copy(b, root.Bytes())
+	if _, _, err := parseExtentHeader(b, extentDepthRoot); err == nil {
+		t.Fatal("parseExtentHeader() should return error when entries do not fit in the node")
+	}
+}
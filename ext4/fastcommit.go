@@ -0,0 +1,211 @@
+package ext4
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4/journal"
+)
+
+// Raw inode layout used when replaying fast commit inodes.
+const (
+	inodeFlagsOffset      = 0x20
+	inodeBlockOffset      = 0x28
+	inodeGenerationOffset = 0x64
+)
+
+// Directory entry file types.
+const (
+	direntRegular     = 1
+	direntDir         = 2
+	direntCharDevice  = 3
+	direntBlockDevice = 4
+	direntFifo        = 5
+	direntSocket      = 6
+	direntSymlink     = 7
+)
+
+// replayFastCommits applies the fast commits of j on top of the replayed
+// transactions. Inodes are patched in overlay the way the kernel does;
+// block ranges and directory entries are recorded and applied when extents
+// and directories are read. Allocation bitmaps are left as they are.
+func (ext4 *FileSystem) replayFastCommits(j *journal.Journal, overlay *overlayReader) error {
+	fcs, err := j.FastCommits(int(ext4.sb.InodeSize))
+	if err != nil {
+		return xerrors.Errorf("failed to read fast commits: %w", err)
+	}
+	ext4.fcRanges = map[int64][]journal.FastCommitRecord{}
+	ext4.fcDentries = map[int64][]journal.FastCommitRecord{}
+	for _, fc := range fcs {
+		for _, rec := range fc.Records {
+			switch rec.Tag {
+			case journal.FC_TAG_INODE:
+				if err := ext4.replayFastCommitInode(overlay, int64(rec.Ino), rec.Inode); err != nil {
+					return xerrors.Errorf("failed to replay inode %d: %w", rec.Ino, err)
+				}
+			case journal.FC_TAG_ADD_RANGE, journal.FC_TAG_DEL_RANGE:
+				ext4.fcRanges[int64(rec.Ino)] = append(ext4.fcRanges[int64(rec.Ino)], rec)
+			case journal.FC_TAG_CREAT, journal.FC_TAG_LINK, journal.FC_TAG_UNLINK:
+				ext4.fcDentries[int64(rec.Parent)] = append(ext4.fcDentries[int64(rec.Parent)], rec)
+			}
+		}
+	}
+	return nil
+}
+
+// replayFastCommitInode writes the inode logged by a fast commit over inode
+// ino. As in the kernel, the block map of the on-disk inode is kept, since
+// it is rebuilt from the block range records, except for inline data.
+func (ext4 *FileSystem) replayFastCommitInode(overlay *overlayReader, ino int64, logged []byte) error {
+	off, err := ext4.inodeOffset(ino)
+	if err != nil {
+		return err
+	}
+	raw := make([]byte, ext4.sb.InodeSize)
+	if _, err := ext4.r.ReadAt(raw, off); err != nil {
+		return xerrors.Errorf("failed to read inode: %w", err)
+	}
+	if len(logged) > len(raw) {
+		logged = logged[:len(raw)]
+	}
+	if len(logged) < inodeGenerationOffset {
+		return xerrors.Errorf("logged inode is too short: %d bytes", len(logged))
+	}
+
+	copy(raw[:inodeBlockOffset], logged)
+	copy(raw[inodeGenerationOffset:], logged[inodeGenerationOffset:])
+	flags := binary.LittleEndian.Uint32(raw[inodeFlagsOffset:])
+	switch {
+	case flags&EXTENTS_FL != 0:
+		if binary.LittleEndian.Uint16(raw[inodeBlockOffset:]) != 0xF30A {
+			// An inode created by the fast commit starts with an
+			// empty extent tree.
+			header := raw[inodeBlockOffset : inodeBlockOffset+12]
+			for i := range header {
+				header[i] = 0
+			}
+			binary.LittleEndian.PutUint16(header, 0xF30A)
+			binary.LittleEndian.PutUint16(header[4:], (inodeGenerationOffset-inodeBlockOffset-12)/12)
+		}
+	case flags&INLINE_DATA_FL != 0:
+		copy(raw[inodeBlockOffset:inodeGenerationOffset], logged[inodeBlockOffset:])
+	}
+
+	if ext4.sb.hasMetadataChecksums() && len(raw) >= 128 {
+		csum, hasHi := ext4.sb.inodeChecksum(ino, raw)
+		binary.LittleEndian.PutUint16(raw[inodeChecksumLoOffset:], uint16(csum))
+		if hasHi {
+			binary.LittleEndian.PutUint16(raw[inodeChecksumHiOffset:], uint16(csum>>16))
+		}
+	}
+	return overlay.writeAt(raw, off)
+}
+
+// applyFastCommitRanges maps and unmaps the block ranges of fast commit
+// records, in order, over extents.
+func applyFastCommitRanges(extents []Extent, ranges []journal.FastCommitRecord) []Extent {
+	for _, r := range ranges {
+		extents = unmapExtents(extents, uint64(r.LogicalBlock), uint64(r.Len))
+		if r.Tag == journal.FC_TAG_ADD_RANGE {
+			extents = append(extents, newExtent(r.LogicalBlock, uint16(r.Len), int64(r.Start), r.Uninitialized))
+		}
+	}
+	return extents
+}
+
+// unmapExtents removes logical blocks [block, block+n) from extents,
+// splitting the extents that partially overlap.
+func unmapExtents(extents []Extent, block, n uint64) []Extent {
+	end := block + n
+	var kept []Extent
+	for _, e := range extents {
+		start, last := uint64(e.Block), uint64(e.Block)+uint64(e.GetLen())
+		if last <= block || start >= end {
+			kept = append(kept, e)
+			continue
+		}
+		if start < block {
+			kept = append(kept, newExtent(e.Block, uint16(block-start), e.offset(), e.IsUninitialized()))
+		}
+		if last > end {
+			kept = append(kept, newExtent(uint32(end), uint16(last-end), e.offset()+int64(end-start), e.IsUninitialized()))
+		}
+	}
+	return kept
+}
+
+func newExtent(block uint32, n uint16, start int64, uninitialized bool) Extent {
+	e := Extent{
+		Block:   block,
+		Len:     n,
+		StartHi: uint16(start >> 32),
+		StartLo: uint32(start),
+	}
+	if uninitialized {
+		e.Len |= 0x8000
+	}
+	return e
+}
+
+// applyFastCommitDentries creates and removes directory entries as the
+// records of fast commits, in order, did. Like the kernel, a link to a name
+// that already exists is ignored, and an unlink only removes the name when
+// it refers to the inode of the record.
+func (ext4 *FileSystem) applyFastCommitDentries(entries []DirectoryEntry2, dentries []journal.FastCommitRecord) []DirectoryEntry2 {
+	for _, d := range dentries {
+		i := 0
+		for ; i < len(entries); i++ {
+			if entries[i].Inode != 0 && entries[i].Name == d.Name &&
+				(d.Tag != journal.FC_TAG_UNLINK || entries[i].Inode == d.Ino) {
+				break
+			}
+		}
+		if d.Tag == journal.FC_TAG_UNLINK {
+			if i < len(entries) {
+				entries = append(entries[:i:i], entries[i+1:]...)
+			}
+			continue
+		}
+		if i < len(entries) {
+			continue
+		}
+		entries = append(entries, DirectoryEntry2{
+			Inode:   d.Ino,
+			RecLen:  uint16(8+len(d.Name)+3) &^ 3,
+			NameLen: uint8(len(d.Name)),
+			Flags:   ext4.direntFileType(int64(d.Ino)),
+			Name:    d.Name,
+		})
+	}
+	return entries
+}
+
+// direntFileType returns the directory entry file type of inode ino, or 0
+// when the filesystem does not record file types in directory entries.
+func (ext4 *FileSystem) direntFileType(ino int64) uint8 {
+	if !ext4.sb.FeatureIncompatFiletype() {
+		return 0
+	}
+	inode, err := ext4.getInode(ino)
+	if err != nil {
+		return 0
+	}
+	switch inode.Mode & FileTypeMask {
+	case FileTypeRegular:
+		return direntRegular
+	case FileTypeDir:
+		return direntDir
+	case FileTypeCharDevice:
+		return direntCharDevice
+	case FileTypeBlockDevice:
+		return direntBlockDevice
+	case FileTypeFifo:
+		return direntFifo
+	case FileTypeSocket:
+		return direntSocket
+	case FileTypeSymlink:
+		return direntSymlink
+	}
+	return 0
+}
@@ -0,0 +1,147 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4/journal"
+)
+
+const testFcBlocks = 4
+
+// fcRecord encodes a fast commit record with the given value fields.
+func fcRecord(tag uint16, fields ...any) []byte {
+	value := &bytes.Buffer{}
+	for _, f := range fields {
+		binary.Write(value, binary.LittleEndian, f)
+	}
+	b := make([]byte, 4, 4+value.Len())
+	binary.LittleEndian.PutUint16(b, tag)
+	binary.LittleEndian.PutUint16(b[2:], uint16(value.Len()))
+	return append(b, value.Bytes()...)
+}
+
+// addFastCommits enables fast commits in the journal added by addJournal
+// and writes records as one fast commit following up transaction tid.
+func (img *testImage) addFastCommits(tid uint32, records ...[]byte) {
+	start := int64(binary.LittleEndian.Uint32(img.Inodes[testJournalInode].BlockOrExtents[12+8:]))
+	dev := img.Data[start*testBlockSize : (start+testJournalBlocks)*testBlockSize]
+	incompat := binary.BigEndian.Uint32(dev[0x28:])
+	binary.BigEndian.PutUint32(dev[0x28:], incompat|journal.FEATURE_INCOMPAT_FAST_COMMIT)
+	binary.BigEndian.PutUint32(dev[0x54:], testFcBlocks)
+
+	area := dev[(testJournalBlocks-testFcBlocks+1)*testBlockSize:]
+	head := fcRecord(journal.FC_TAG_HEAD, uint32(0), tid)
+	off := copy(area, head)
+	for _, r := range records {
+		off += copy(area[off:], r)
+	}
+	crc := crc32c(0, area[:off])
+	tail := area[off:testBlockSize]
+	binary.LittleEndian.PutUint16(tail, journal.FC_TAG_TAIL)
+	binary.LittleEndian.PutUint16(tail[2:], uint16(len(tail)-4))
+	binary.LittleEndian.PutUint32(tail[4:], tid)
+	binary.LittleEndian.PutUint32(tail[8:], crc32c(crc, tail[:8]))
+}
+
+func TestFastCommitReplay(t *testing.T) {
+	img := newTestImage(t)
+	a := img.AddFile(rootInodeNumber, "a.txt", bytes.Repeat([]byte{'a'}, 3*testBlockSize))
+	b := img.AddFile(rootInodeNumber, "b.txt", []byte("old b"))
+	blockA := int64(binary.LittleEndian.Uint32(img.Inodes[a].BlockOrExtents[12+8:]))
+	newA := img.Alloc(1)
+	img.WriteBlock(newA, bytes.Repeat([]byte{'f'}, testBlockSize))
+	blockC := img.Alloc(1)
+	img.WriteBlock(blockC, []byte("fast c"))
+
+	// c.txt only exists in the fast commit.
+	c := img.NextIno
+	img.NextIno++
+	inodeC := &bytes.Buffer{}
+	binary.Write(inodeC, binary.LittleEndian, Inode{
+		Mode:       FileTypeRegular | 0o644,
+		LinksCount: 1,
+		SizeLo:     6,
+		BlocksLo:   testBlockSize / SectorSize,
+		Flags:      EXTENTS_FL,
+	})
+
+	header := make([]byte, testBlockSize)
+	copy(header, "new header")
+	img.addJournal(testTransaction{blocks: map[int64][]byte{blockA: header}})
+	img.addFastCommits(6,
+		// The middle block of a.txt is remapped.
+		fcRecord(journal.FC_TAG_DEL_RANGE, a, uint32(1), uint32(1)),
+		fcRecord(journal.FC_TAG_ADD_RANGE, a, uint32(1), uint16(1), uint16(0), uint32(newA)),
+		fcRecord(journal.FC_TAG_INODE, c, inodeC.Bytes()[:testInodeSize]),
+		fcRecord(journal.FC_TAG_ADD_RANGE, c, uint32(0), uint16(1), uint16(0), uint32(blockC)),
+		fcRecord(journal.FC_TAG_CREAT, uint32(rootInodeNumber), c, []byte("c.txt")),
+		fcRecord(journal.FC_TAG_UNLINK, uint32(rootInodeNumber), b, []byte("b.txt")),
+	)
+
+	fsys := img.fs(WithJournalReplay())
+	content, err := fs.ReadFile(fsys, "/a.txt")
+	if err != nil {
+		t.Fatalf("ReadFile(a.txt) error: %v", err)
+	}
+	want := append(append(append([]byte(nil), header...), bytes.Repeat([]byte{'f'}, testBlockSize)...), bytes.Repeat([]byte{'a'}, testBlockSize)...)
+	if !bytes.Equal(content, want) {
+		t.Errorf("a.txt does not hold the transaction and fast commit updates")
+	}
+	if content, err := fs.ReadFile(fsys, "/c.txt"); err != nil || string(content) != "fast c" {
+		t.Errorf("ReadFile(c.txt) = %q, %v, want %q", content, err, "fast c")
+	}
+	if _, err := fs.Stat(fsys, "/b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(b.txt) error = %v, want fs.ErrNotExist", err)
+	}
+
+	// Without replay the fast commits are ignored along with the
+	// transactions.
+	fsys = img.fs()
+	if _, err := fs.Stat(fsys, "/c.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("without replay Stat(c.txt) error = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestFastCommitUnlinkInode(t *testing.T) {
+	img := newTestImage(t)
+	img.AddFile(rootInodeNumber, "a.txt", []byte("a"))
+	b := img.AddFile(rootInodeNumber, "b.txt", []byte("b"))
+	img.addJournal(testTransaction{})
+	img.addFastCommits(6,
+		// An unlink of a name that refers to another inode is ignored.
+		fcRecord(journal.FC_TAG_UNLINK, uint32(rootInodeNumber), b, []byte("a.txt")),
+		fcRecord(journal.FC_TAG_UNLINK, uint32(rootInodeNumber), b, []byte("b.txt")),
+	)
+
+	fsys := img.fs(WithJournalReplay())
+	if content, err := fs.ReadFile(fsys, "/a.txt"); err != nil || string(content) != "a" {
+		t.Errorf("ReadFile(a.txt) = %q, %v, want %q", content, err, "a")
+	}
+	if _, err := fs.Stat(fsys, "/b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(b.txt) error = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestUnmapExtents(t *testing.T) {
+	extents := []Extent{
+		newExtent(0, 10, 100, false),
+		newExtent(20, 5, 200, true),
+	}
+	got := unmapExtents(extents, 4, 18)
+	want := []Extent{
+		newExtent(0, 4, 100, false),
+		newExtent(22, 3, 202, true),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unmapExtents() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("extent %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
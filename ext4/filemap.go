@@ -0,0 +1,156 @@
+package ext4
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// FileExtentFlags describe a FileExtent. The values match the FIEMAP
+// extent flags, except for FileExtentHole which FIEMAP does not report.
+type FileExtentFlags uint32
+
+const (
+	// FileExtentLast marks the last mapping of the file.
+	FileExtentLast FileExtentFlags = 0x1
+	// FileExtentInline marks data stored in the inode itself. Physical is
+	// the byte offset of the data in the inode table.
+	FileExtentInline FileExtentFlags = 0x200
+	// FileExtentUnwritten marks allocated blocks that read as zeros.
+	FileExtentUnwritten FileExtentFlags = 0x800
+	// FileExtentMerged marks a run of blocks of an indirect-mapped file,
+	// which has no extents of its own.
+	FileExtentMerged FileExtentFlags = 0x1000
+	// FileExtentHole marks a range without blocks. Physical is zero.
+	FileExtentHole FileExtentFlags = 0x10000
+)
+
+// FileExtent maps Length bytes of a file at byte offset Logical to the
+// device at byte offset Physical.
+type FileExtent struct {
+	Logical  int64
+	Physical int64
+	Length   int64
+	Flags    FileExtentFlags
+}
+
+// FileMap returns the mapping of the content of name to the device, in
+// logical order, covering the file up to its last block. Symbolic links are
+// not followed. Device, fifo and socket files have no mapping.
+func (ext4 *FileSystem) FileMap(name string) ([]FileExtent, error) {
+	const op = "filemap"
+
+	ino, inode, err := ext4.lookup(name)
+	if err != nil {
+		return nil, ext4.wrapError(op, name, err)
+	}
+	m, err := ext4.fileMap(ino, inode)
+	if err != nil {
+		return nil, ext4.wrapError(op, name, err)
+	}
+	return m, nil
+}
+
+// lookup returns the inode of name, without following symbolic links.
+func (ext4 *FileSystem) lookup(name string) (int64, *Inode, error) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		inode, err := ext4.getInode(rootInodeNumber)
+		if err != nil {
+			return 0, nil, xerrors.Errorf("failed to get root inode: %w", err)
+		}
+		return rootInodeNumber, inode, nil
+	}
+	info, err := ext4.ReadDirInfo(name)
+	if err != nil {
+		return 0, nil, err
+	}
+	fi, ok := info.(FileInfo)
+	if !ok {
+		return 0, nil, xerrors.Errorf("unspecified error, entry is not file info %+v", info)
+	}
+	return fi.ino, fi.inode, nil
+}
+
+func (ext4 *FileSystem) fileMap(ino int64, inode *Inode) ([]FileExtent, error) {
+	blockSize := ext4.sb.GetBlockSize()
+	size := inode.GetSize()
+
+	if inode.Flags&INLINE_DATA_FL != 0 || (inode.IsSymlink() && !inode.HasBlocks()) {
+		if size == 0 {
+			return nil, nil
+		}
+		off, err := ext4.inodeOffset(ino)
+		if err != nil {
+			return nil, err
+		}
+		return []FileExtent{{
+			Physical: off + inodeBlockOffset,
+			Length:   size,
+			Flags:    FileExtentInline | FileExtentLast,
+		}}, nil
+	}
+	if !inode.HasBlocks() {
+		return nil, nil
+	}
+
+	var mapped []FileExtent
+	if inode.UsesExtents() {
+		extents, err := ext4.inodeExtents(ino, inode, ext4.inodeCsumSeed(ino, inode))
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(extents, func(i, j int) bool { return extents[i].Block < extents[j].Block })
+		for _, e := range extents {
+			fe := FileExtent{
+				Logical:  int64(e.Block) * blockSize,
+				Physical: e.offset() * blockSize,
+				Length:   int64(e.GetLen()) * blockSize,
+			}
+			if e.IsUninitialized() {
+				fe.Flags = FileExtentUnwritten
+			}
+			mapped = append(mapped, fe)
+		}
+	} else {
+		dt, err := ext4.blockDataTable(inode)
+		if err != nil {
+			return nil, err
+		}
+		logical := make([]int64, 0, len(dt))
+		for l := range dt {
+			logical = append(logical, l)
+		}
+		sort.Slice(logical, func(i, j int) bool { return logical[i] < logical[j] })
+		for _, l := range logical {
+			if n := len(mapped); n > 0 {
+				last := &mapped[n-1]
+				if last.Logical+last.Length == l*blockSize && last.Physical+last.Length == dt[l] {
+					last.Length += blockSize
+					continue
+				}
+			}
+			mapped = append(mapped, FileExtent{Logical: l * blockSize, Physical: dt[l], Length: blockSize, Flags: FileExtentMerged})
+		}
+	}
+
+	// Fill in the holes, up to the block holding the end of the file.
+	var m []FileExtent
+	var next int64
+	for _, fe := range mapped {
+		if fe.Logical > next {
+			m = append(m, FileExtent{Logical: next, Length: fe.Logical - next, Flags: FileExtentHole})
+		}
+		m = append(m, fe)
+		next = fe.Logical + fe.Length
+	}
+	if end := (size + blockSize - 1) / blockSize * blockSize; end > next {
+		m = append(m, FileExtent{Logical: next, Length: end - next, Flags: FileExtentHole})
+	}
+	if len(m) > 0 {
+		m[len(m)-1].Flags |= FileExtentLast
+	}
+	return m, nil
+}
@@ -0,0 +1,67 @@
+package ext4
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFileMap(t *testing.T) {
+	img := newTestImage(t)
+	data := img.Alloc(2)
+	unwritten := img.Alloc(1)
+	sparse := img.AddFile(rootInodeNumber, "sparse", nil)
+	img.Inodes[sparse].SizeLo = 7*testBlockSize - 100
+	img.Inodes[sparse].BlockOrExtents = testExtentRoot(
+		Extent{Block: 1, Len: 2, StartLo: uint32(data)},
+		Extent{Block: 4, Len: 0x8000 | 1, StartLo: uint32(unwritten)},
+	)
+
+	direct := img.Alloc(3)
+	indirect := img.AddFile(rootInodeNumber, "indirect", nil)
+	img.Inodes[indirect] = buildBlockAddressingInode([12]uint32{uint32(direct), uint32(direct + 1), 0, uint32(direct + 2)}, 0, 0, 0, 4*testBlockSize)
+
+	link := img.AddFile(rootInodeNumber, "link", nil)
+	img.Inodes[link].Mode = FileTypeSymlink | 0o777
+	img.Inodes[link].Flags = 0
+	img.Inodes[link].SizeLo = 6
+	copy(img.Inodes[link].BlockOrExtents[:], "target")
+	fsys := img.fs()
+
+	const bs = testBlockSize
+	for _, tt := range []struct {
+		name string
+		want []FileExtent
+	}{
+		{"sparse", []FileExtent{
+			{Logical: 0, Length: bs, Flags: FileExtentHole},
+			{Logical: bs, Physical: data * bs, Length: 2 * bs},
+			{Logical: 3 * bs, Length: bs, Flags: FileExtentHole},
+			{Logical: 4 * bs, Physical: unwritten * bs, Length: bs, Flags: FileExtentUnwritten},
+			{Logical: 5 * bs, Length: 2 * bs, Flags: FileExtentHole | FileExtentLast},
+		}},
+		{"/indirect", []FileExtent{
+			{Logical: 0, Physical: direct * bs, Length: 2 * bs, Flags: FileExtentMerged},
+			{Logical: 2 * bs, Length: bs, Flags: FileExtentHole},
+			{Logical: 3 * bs, Physical: (direct + 2) * bs, Length: bs, Flags: FileExtentMerged | FileExtentLast},
+		}},
+		{"link", []FileExtent{
+			{Physical: img.InodeOffset(link) + inodeBlockOffset, Length: 6, Flags: FileExtentInline | FileExtentLast},
+		}},
+		{"/", []FileExtent{
+			{Physical: img.Dirs[rootInodeNumber].Block * bs, Length: bs, Flags: FileExtentLast},
+		}},
+	} {
+		got, err := fsys.FileMap(tt.name)
+		if err != nil {
+			t.Errorf("FileMap(%q) error: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FileMap(%q) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := fsys.FileMap("missing"); err == nil {
+		t.Error("FileMap() of a missing file succeeded")
+	}
+}
@@ -8,9 +8,12 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/lunixbochs/struc"
 	"golang.org/x/xerrors"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4/journal"
 )
 
 var (
@@ -27,6 +30,37 @@ type FileSystem struct {
 	gds []GroupDescriptor
 
 	cache Cache[string, any]
+
+	verifyChecksums bool
+	replay          bool
+	journalDev      io.ReaderAt
+	deletedEntries  bool
+
+	// sbGroup and gdtGroup are the groups whose copies of the superblock
+	// and group descriptor table are in use.
+	sbGroup        int64
+	gdtGroup       int64
+	storedFlags    []uint16
+	forceGroup     bool
+	blockSize      int64
+	blocksPerGroup int64
+
+	// fcRanges and fcDentries are the block range and directory entry
+	// records of replayed fast commits in log order, keyed by the inode
+	// and the directory they change.
+	fcRanges   map[int64][]journal.FastCommitRecord
+	fcDentries map[int64][]journal.FastCommitRecord
+
+	lenient  bool
+	errsMu   sync.Mutex
+	errs     []error
+	errsSeen map[string]bool
+
+	// paths is the index of the paths of every inode reachable from the
+	// root directory, built on first use by pathIndex.
+	pathsOnce sync.Once
+	paths     map[int64][]string
+	pathsErr  error
 }
 
 func readPadding(r io.Reader) error {
@@ -57,32 +91,35 @@ func parseSuperBlock(r io.Reader) (Superblock, error) {
 }
 
 // NewFS is created io/fs.FS for ext4 filesystem
-func NewFS(r io.SectionReader, cache Cache[string, any]) (*FileSystem, error) {
-	sb, err := parseSuperBlock(&r)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to parse super block: %w", err)
-	}
-
-	numBlockGroups := int64(sb.GetGroupDescriptorTableCount())
-	numBlockGroups2 := (sb.InodeCount + sb.InodePerGroup - 1) / sb.InodePerGroup
-	if numBlockGroups != int64(numBlockGroups2) {
-		return nil, xerrors.Errorf("Block/inode mismatch: %d %d %d", sb.GetBlockCount(), numBlockGroups, numBlockGroups2)
-	}
-
-	gds, err := sb.getGroupDescriptor(r)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to get group Descriptor: %w", err)
-	}
-
+func NewFS(r io.SectionReader, cache Cache[string, any], opts ...Option) (*FileSystem, error) {
 	if cache == nil {
 		cache = &mockCache[string, any]{}
 	}
 	fs := &FileSystem{
 		r:     &r,
-		sb:    sb,
-		gds:   gds,
 		cache: cache,
 	}
+	for _, opt := range opts {
+		opt(fs)
+	}
+
+	if err := fs.loadSuperblock(); err != nil {
+		return nil, xerrors.Errorf("failed to parse super block: %w", err)
+	}
+	if err := fs.loadGroupDescriptors(); err != nil {
+		return nil, xerrors.Errorf("failed to get group Descriptor: %w", err)
+	}
+	if fs.replay {
+		if err := fs.replayJournal(); err != nil {
+			return nil, err
+		}
+	}
+
+	if fs.verifyChecksums {
+		if err := fs.verifyStaticChecksums(); err != nil && !fs.tolerate(err) {
+			return nil, xerrors.Errorf("failed to verify checksums: %w", err)
+		}
+	}
 	return fs, nil
 }
 
@@ -159,14 +196,22 @@ func (ext4 *FileSystem) readDirEntry(name string) ([]fs.DirEntry, error) {
 func (ext4 *FileSystem) listFileInfo(ino int64) ([]FileInfo, error) {
 	entries, err := ext4.listEntries(ino)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to get directory entries: %w", err)
+		err = xerrors.Errorf("failed to get directory entries: %w", err)
+		if ext4.tolerate(xerrors.Errorf("directory inode %d: %w", ino, err)) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
 	var fileInfos []FileInfo
 	for _, entry := range entries {
 		inode, err := ext4.getInode(int64(entry.Inode))
 		if err != nil {
-			return nil, xerrors.Errorf("failed to get inode(%d): %w", entry.Inode, err)
+			err = xerrors.Errorf("failed to get inode(%d) of %q in directory inode %d: %w", entry.Inode, entry.Name, ino, err)
+			if ext4.tolerate(err) {
+				continue
+			}
+			return nil, err
 		}
 		fileInfos = append(fileInfos,
 			FileInfo{
@@ -180,9 +225,28 @@ func (ext4 *FileSystem) listFileInfo(ino int64) ([]FileInfo, error) {
 }
 
 func extractDirectoryEntries(directoryReader *bytes.Buffer) ([]DirectoryEntry2, error) {
+	dirEntries, err := scanDirectoryEntries(directoryReader)
+	if xerrors.Is(err, errMalformedDirectoryEntry) {
+		return dirEntries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dirEntries, nil
+}
+
+// errMalformedDirectoryEntry marks a directory entry whose rec_len cannot be
+// followed. Parsing stops there; the entries before it are still valid.
+var errMalformedDirectoryEntry = xerrors.New("malformed directory entry")
+
+// scanDirectoryEntries parses directory entries like extractDirectoryEntries
+// but returns the entries parsed so far along with any error.
+func scanDirectoryEntries(directoryReader *bytes.Buffer) ([]DirectoryEntry2, error) {
 	var dirEntries []DirectoryEntry2
 
+	size := directoryReader.Len()
 	for {
+		offset := size - directoryReader.Len()
 		dirEntry := DirectoryEntry2{}
 
 		err := struc.Unpack(directoryReader, &dirEntry)
@@ -190,7 +254,7 @@ func extractDirectoryEntries(directoryReader *bytes.Buffer) ([]DirectoryEntry2,
 			if err == io.EOF {
 				break
 			}
-			return nil, xerrors.Errorf("failed to parse directory entry: %w", err)
+			return dirEntries, xerrors.Errorf("failed to parse directory entry at offset %d: %w", offset, err)
 		}
 
 		if dirEntry.RecLen == 0 {
@@ -199,15 +263,15 @@ func extractDirectoryEntries(directoryReader *bytes.Buffer) ([]DirectoryEntry2,
 
 		nameAndHeader := uint16(dirEntry.NameLen) + 8
 		if dirEntry.RecLen < nameAndHeader {
-			break
+			return dirEntries, xerrors.Errorf("%w at offset %d: rec_len %d is shorter than the name", errMalformedDirectoryEntry, offset, dirEntry.RecLen)
 		}
 		align := dirEntry.RecLen - nameAndHeader
 		if int(align) > directoryReader.Len() {
-			break
+			return dirEntries, xerrors.Errorf("%w at offset %d: rec_len %d exceeds the block", errMalformedDirectoryEntry, offset, dirEntry.RecLen)
 		}
 		_, err = directoryReader.Read(make([]byte, align))
 		if err != nil {
-			return nil, xerrors.Errorf("failed to read align: %w", err)
+			return dirEntries, xerrors.Errorf("failed to read align: %w", err)
 		}
 
 		// inode == 0 means the entry is unused (deleted or padding such as checksum tail).
@@ -224,14 +288,29 @@ func extractDirectoryEntries(directoryReader *bytes.Buffer) ([]DirectoryEntry2,
 	return dirEntries, nil
 }
 
+// directoryBlockEntries parses the directory entries of block. In lenient
+// mode the entries before a damaged one are returned and the damage is
+// recorded.
+func (ext4 *FileSystem) directoryBlockEntries(b []byte, block int64) ([]DirectoryEntry2, error) {
+	entries, err := scanDirectoryEntries(bytes.NewBuffer(b))
+	if err == nil {
+		return entries, nil
+	}
+	err = xerrors.Errorf("directory block %d: %w", block, err)
+	if ext4.tolerate(err) || xerrors.Is(err, errMalformedDirectoryEntry) {
+		return entries, nil
+	}
+	return nil, xerrors.Errorf("failed to extract directory entries: %w", err)
+}
+
 // buildDirectoryBlockMap builds a mapping from logical directory block numbers
 // to physical byte offsets for the given inode.
-func (ext4 *FileSystem) buildDirectoryBlockMap(inode *Inode) (map[uint32]int64, error) {
+func (ext4 *FileSystem) buildDirectoryBlockMap(ino int64, inode *Inode, seed csumSeed) (map[uint32]int64, error) {
 	blockSize := ext4.sb.GetBlockSize()
 	m := make(map[uint32]int64)
 
 	if inode.UsesExtents() {
-		extents, err := ext4.Extents(inode)
+		extents, err := ext4.inodeExtents(ino, inode, seed)
 		if err != nil {
 			return nil, xerrors.Errorf("failed to get extents: %w", err)
 		}
@@ -274,20 +353,38 @@ func (ext4 *FileSystem) readLogicalBlock(blockMap map[uint32]int64, logicalBlock
 	return buf, nil
 }
 
+// dxEntry is a dx_entry of an htree node. The hash of the first entry in
+// each node is implicit and reported as the node's lower bound.
+type dxEntry struct {
+	hash  uint32
+	block uint32
+}
+
 // parseDxBlockNumbers extracts logical block numbers from dx_entry data.
 // data starts right after the DxCountLimit (at the block field of the header entry).
 func parseDxBlockNumbers(data []byte, count uint16) []uint32 {
-	blocks := make([]uint32, 0, count)
+	entries := parseDxEntries(data, count, 0)
+	blocks := make([]uint32, 0, len(entries))
+	for _, e := range entries {
+		blocks = append(blocks, e.block)
+	}
+	return blocks
+}
+
+// parseDxEntries extracts dx_entries from dx_entry data. The header entry
+// has no hash of its own and inherits lowerBound.
+func parseDxEntries(data []byte, count uint16, lowerBound uint32) []dxEntry {
+	entries := make([]dxEntry, 0, count)
 
 	if count == 0 {
-		return blocks
+		return entries
 	}
 
 	// Header entry: only the block field (4 bytes, no hash)
 	if len(data) < 4 {
-		return blocks
+		return entries
 	}
-	blocks = append(blocks, binary.LittleEndian.Uint32(data[:4]))
+	entries = append(entries, dxEntry{hash: lowerBound, block: binary.LittleEndian.Uint32(data[:4])})
 
 	// Remaining entries: each 8 bytes (hash:4 + block:4)
 	for i := uint16(1); i < count; i++ {
@@ -295,24 +392,27 @@ func parseDxBlockNumbers(data []byte, count uint16) []uint32 {
 		if off+8 > len(data) {
 			break
 		}
-		blocks = append(blocks, binary.LittleEndian.Uint32(data[off+4:off+8]))
+		entries = append(entries, dxEntry{
+			hash:  binary.LittleEndian.Uint32(data[off : off+4]),
+			block: binary.LittleEndian.Uint32(data[off+4 : off+8]),
+		})
 	}
 
-	return blocks
+	return entries
 }
 
 // collectLeafBlocks recursively traverses HTree internal nodes to collect
-// all leaf block numbers.
-func (ext4 *FileSystem) collectLeafBlocks(blockMap map[uint32]int64, nodeBlocks []uint32, remainingDepth uint8) ([]uint32, error) {
+// all leaf blocks, in hash order.
+func (ext4 *FileSystem) collectLeafBlocks(blockMap map[uint32]int64, nodes []dxEntry, remainingDepth uint8, seed csumSeed) ([]dxEntry, error) {
 	if remainingDepth == 0 {
-		return nodeBlocks, nil
+		return nodes, nil
 	}
 
-	var leafBlocks []uint32
-	for _, nodeBlock := range nodeBlocks {
-		data, err := ext4.readLogicalBlock(blockMap, nodeBlock)
+	var leaves []dxEntry
+	for _, node := range nodes {
+		data, err := ext4.readLogicalBlock(blockMap, node.block)
 		if err != nil {
-			return nil, xerrors.Errorf("failed to read internal node block %d: %w", nodeBlock, err)
+			return nil, xerrors.Errorf("failed to read internal node block %d: %w", node.block, err)
 		}
 
 		// Internal node layout:
@@ -322,6 +422,9 @@ func (ext4 *FileSystem) collectLeafBlocks(blockMap map[uint32]int64, nodeBlocks
 		if len(data) < 0x0C {
 			return nil, xerrors.New("htree internal node block too small")
 		}
+		if err := verifyDxNodeChecksum(seed, data, 0x08, blockMap[node.block]/ext4.sb.GetBlockSize()); err != nil {
+			return nil, err
+		}
 
 		var cl DxCountLimit
 		if err := binary.Read(bytes.NewReader(data[0x08:0x0C]), binary.LittleEndian, &cl); err != nil {
@@ -331,22 +434,64 @@ func (ext4 *FileSystem) collectLeafBlocks(blockMap map[uint32]int64, nodeBlocks
 			return nil, xerrors.Errorf("htree internal node: count (%d) exceeds limit (%d)", cl.Count, cl.Limit)
 		}
 
-		childBlocks := parseDxBlockNumbers(data[0x0C:], cl.Count)
+		children := parseDxEntries(data[0x0C:], cl.Count, node.hash)
 
-		leaves, err := ext4.collectLeafBlocks(blockMap, childBlocks, remainingDepth-1)
+		l, err := ext4.collectLeafBlocks(blockMap, children, remainingDepth-1, seed)
 		if err != nil {
 			return nil, err
 		}
-		leafBlocks = append(leafBlocks, leaves...)
+		leaves = append(leaves, l...)
 	}
 
-	return leafBlocks, nil
+	return leaves, nil
+}
+
+// HTree is the leaf level of an htree indexed directory.
+type HTree struct {
+	// HashVersion is the hash version recorded in the dx_root.
+	HashVersion uint8
+	Leaves      []HTreeLeaf
+}
+
+// HTreeLeaf is a leaf block of an htree indexed directory.
+type HTreeLeaf struct {
+	LogicalBlock uint32
+	Block        int64
+	// Hash is the lower hash bound of the leaf recorded in the index. The
+	// lowest bit is set when the leaf continues a run of colliding hashes.
+	Hash    uint32
+	Entries []DirectoryEntry2
+}
+
+// HTreeLeaves returns the leaf blocks of the htree indexed directory ino in
+// hash order.
+func (ext4 *FileSystem) HTreeLeaves(ino int64) (*HTree, error) {
+	inode, err := ext4.getInode(ino)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get inode(%d): %w", ino, err)
+	}
+	if !inode.UsesDirectoryHashTree() {
+		return nil, xerrors.Errorf("inode %d is not an htree directory", ino)
+	}
+	return ext4.htree(ino, inode, ext4.inodeCsumSeed(ino, inode))
 }
 
 // listEntriesHTree reads all directory entries from an HTree-indexed directory
 // by traversing the hash tree structure and reading only leaf blocks.
-func (ext4 *FileSystem) listEntriesHTree(inode *Inode) ([]DirectoryEntry2, error) {
-	blockMap, err := ext4.buildDirectoryBlockMap(inode)
+func (ext4 *FileSystem) listEntriesHTree(ino int64, inode *Inode, seed csumSeed) ([]DirectoryEntry2, error) {
+	tree, err := ext4.htree(ino, inode, seed)
+	if err != nil {
+		return nil, err
+	}
+	var entries []DirectoryEntry2
+	for _, leaf := range tree.Leaves {
+		entries = append(entries, leaf.Entries...)
+	}
+	return entries, nil
+}
+
+func (ext4 *FileSystem) htree(ino int64, inode *Inode, seed csumSeed) (*HTree, error) {
+	blockMap, err := ext4.buildDirectoryBlockMap(ino, inode, seed)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to build block map: %w", err)
 	}
@@ -366,6 +511,9 @@ func (ext4 *FileSystem) listEntriesHTree(inode *Inode) ([]DirectoryEntry2, error
 	if len(rootData) < 0x24 {
 		return nil, xerrors.New("htree root block too small")
 	}
+	if err := verifyDxNodeChecksum(seed, rootData, 0x20, blockMap[0]/ext4.sb.GetBlockSize()); err != nil {
+		return nil, err
+	}
 
 	var rootInfo DxRootInfo
 	if err := binary.Read(bytes.NewReader(rootData[0x18:0x20]), binary.LittleEndian, &rootInfo); err != nil {
@@ -388,40 +536,71 @@ func (ext4 *FileSystem) listEntriesHTree(inode *Inode) ([]DirectoryEntry2, error
 	}
 
 	// Collect block numbers from root dx_entries
-	rootBlocks := parseDxBlockNumbers(rootData[0x24:], cl.Count)
+	rootEntries := parseDxEntries(rootData[0x24:], cl.Count, 0)
 
 	// Traverse tree to collect all leaf block numbers
-	leafBlocks, err := ext4.collectLeafBlocks(blockMap, rootBlocks, rootInfo.IndirectLevels)
+	leafEntries, err := ext4.collectLeafBlocks(blockMap, rootEntries, rootInfo.IndirectLevels, seed)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to collect htree leaf blocks: %w", err)
 	}
 
 	// Read directory entries from each leaf block
-	var entries []DirectoryEntry2
-	for _, logBlock := range leafBlocks {
-		data, err := ext4.readLogicalBlock(blockMap, logBlock)
+	tree := &HTree{HashVersion: rootInfo.HashVersion}
+	for _, leaf := range leafEntries {
+		data, err := ext4.readLogicalBlock(blockMap, leaf.block)
 		if err != nil {
-			return nil, xerrors.Errorf("failed to read leaf block %d: %w", logBlock, err)
+			return nil, xerrors.Errorf("failed to read leaf block %d: %w", leaf.block, err)
+		}
+		block := blockMap[leaf.block] / ext4.sb.GetBlockSize()
+		if err := verifyDirectoryBlockChecksum(seed, data, block); err != nil {
+			return nil, err
 		}
 
-		dirEntries, err := extractDirectoryEntries(bytes.NewBuffer(data))
+		dirEntries, err := ext4.directoryBlockEntries(data, block)
 		if err != nil {
-			return nil, xerrors.Errorf("failed to extract directory entries from leaf block %d: %w", logBlock, err)
+			return nil, xerrors.Errorf("failed to extract directory entries from leaf block %d: %w", leaf.block, err)
 		}
-		entries = append(entries, dirEntries...)
+		tree.Leaves = append(tree.Leaves, HTreeLeaf{
+			LogicalBlock: leaf.block,
+			Block:        block,
+			Hash:         leaf.hash,
+			Entries:      dirEntries,
+		})
 	}
 
-	return entries, nil
+	return tree, nil
 }
 
+// listEntries returns the entries of directory ino, with the entries
+// created and removed by replayed fast commits applied.
 func (ext4 *FileSystem) listEntries(ino int64) ([]DirectoryEntry2, error) {
+	entries, err := ext4.directoryEntries(ino)
+	if err != nil {
+		return nil, err
+	}
+	if dentries := ext4.fcDentries[ino]; len(dentries) > 0 {
+		entries = ext4.applyFastCommitDentries(entries, dentries)
+	}
+	return entries, nil
+}
+
+// directoryEntries returns the entries stored in the blocks of directory
+// ino.
+func (ext4 *FileSystem) directoryEntries(ino int64) ([]DirectoryEntry2, error) {
 	inode, err := ext4.getInode(ino)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to get inode(%d): %w", ino, err)
 	}
 
+	seed := ext4.inodeCsumSeed(ino, inode)
 	if inode.UsesDirectoryHashTree() {
-		return ext4.listEntriesHTree(inode)
+		entries, err := ext4.listEntriesHTree(ino, inode, seed)
+		if err == nil || !ext4.tolerate(xerrors.Errorf("inode %d: %w", ino, err)) {
+			return entries, err
+		}
+		// Leaf blocks are ordinary directory blocks and the index blocks
+		// look like empty ones, so a damaged index can be bypassed by a
+		// linear scan.
 	}
 
 	if !inode.UsesExtents() {
@@ -432,52 +611,64 @@ func (ext4 *FileSystem) listEntries(ino int64) ([]DirectoryEntry2, error) {
 			return nil, xerrors.Errorf("failed to get block address: %w", err)
 		}
 
-		blockSize := ext4.sb.GetBlockSize()
 		for _, blockAddress := range blockAddresses {
 			if blockAddress == 0 {
 				continue
 			}
-
-			buf := make([]byte, blockSize)
-			_, err = ext4.r.ReadAt(buf, int64(blockAddress)*blockSize)
+			extracted, err := ext4.readDirectoryBlock(seed, int64(blockAddress))
 			if err != nil {
-				return nil, xerrors.Errorf("failed to read directory block at %#x: %w", blockAddress, err)
-			}
-
-			extracted, err := extractDirectoryEntries(bytes.NewBuffer(buf))
-			if err != nil {
-				return nil, xerrors.Errorf("failed to extract directory entries: %w", err)
+				return nil, err
 			}
 			dirEntries = append(dirEntries, extracted...)
 		}
 		return dirEntries, nil
 	}
 
-	extents, err := ext4.Extents(inode)
+	extents, err := ext4.inodeExtents(ino, inode, seed)
 	if err != nil {
 		return nil, xerrors.Errorf("failed to get extents: %w", err)
 	}
 
-	blockSize := ext4.sb.GetBlockSize()
 	var entries []DirectoryEntry2
 	for _, e := range extents {
 		if e.IsUninitialized() {
-			return nil, xerrors.Errorf("failed to list directory entries: uninitialized extent at logical block %d", e.Block)
+			err := xerrors.Errorf("failed to list directory entries: uninitialized extent at logical block %d", e.Block)
+			if ext4.tolerate(xerrors.Errorf("inode %d: %w", ino, err)) {
+				continue
+			}
+			return nil, err
 		}
-		size := blockSize * int64(e.GetLen())
-		buf := make([]byte, size)
-		_, err := ext4.r.ReadAt(buf, e.offset()*blockSize)
-		if err != nil {
-			return nil, xerrors.Errorf("failed to read directory blocks at offset %#x: %w", e.offset()*blockSize, err)
+		for i := int64(0); i < int64(e.GetLen()); i++ {
+			dirEntries, err := ext4.readDirectoryBlock(seed, e.offset()+i)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, dirEntries...)
 		}
+	}
+	return entries, nil
+}
 
-		dirEntries, err := extractDirectoryEntries(bytes.NewBuffer(buf))
-		if err != nil {
-			return nil, xerrors.Errorf("failed to extract directory entries: %w", err)
+// readDirectoryBlock reads and parses the directory leaf block at block. In
+// lenient mode an unreadable block is recorded and yields no entries.
+func (ext4 *FileSystem) readDirectoryBlock(seed csumSeed, block int64) ([]DirectoryEntry2, error) {
+	blockSize := ext4.sb.GetBlockSize()
+	buf := make([]byte, blockSize)
+	_, err := ext4.r.ReadAt(buf, block*blockSize)
+	if err != nil {
+		err = xerrors.Errorf("failed to read directory block at %#x: %w", block, err)
+		if ext4.tolerate(err) {
+			return nil, nil
 		}
-		entries = append(entries, dirEntries...)
+		return nil, err
 	}
-	return entries, nil
+	if err := verifyDirectoryBlockChecksum(seed, buf, block); err != nil {
+		if ext4.tolerate(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ext4.directoryBlockEntries(buf, block)
 }
 
 func (ext4 *FileSystem) Stat(name string) (fs.FileInfo, error) {
@@ -506,6 +697,7 @@ func (ext4 *FileSystem) ReadDirInfo(name string) (fs.FileInfo, error) {
 		}
 		return FileInfo{
 			name:  "/",
+			ino:   rootInodeNumber,
 			inode: inode,
 		}, nil
 	}
@@ -614,19 +806,22 @@ func (ext4 *FileSystem) Lstat(name string) (fs.FileInfo, error) {
 }
 
 func (ext4 *FileSystem) fileFromBlock(fi FileInfo, filePath string) (*File, error) {
-	blockAddresses, err := fi.inode.GetBlockAddresses(ext4)
+	dt, err := ext4.blockDataTable(fi.inode)
 	if err != nil {
-		return nil, xerrors.Errorf("failed to get block addresses: %w", err)
+		return nil, err
 	}
+	return ext4.newFile(fi, filePath, dt), nil
+}
 
-	dt := make(dataTable)
-	for i, blockAddress := range blockAddresses {
-		if blockAddress == 0 {
-			continue
-		}
-		dt[int64(i)] = int64(blockAddress) * ext4.sb.GetBlockSize()
+func (ext4 *FileSystem) file(fi FileInfo, filePath string) (*File, error) {
+	dt, err := ext4.extentDataTable(fi.ino, fi.inode)
+	if err != nil {
+		return nil, err
 	}
+	return ext4.newFile(fi, filePath, dt), nil
+}
 
+func (ext4 *FileSystem) newFile(fi FileInfo, filePath string, dt dataTable) *File {
 	return &File{
 		fs:           ext4,
 		FileInfo:     fi,
@@ -636,11 +831,35 @@ func (ext4 *FileSystem) fileFromBlock(fi FileInfo, filePath string) (*File, erro
 		blockSize:    ext4.sb.GetBlockSize(),
 		table:        dt,
 		size:         fi.Size(),
-	}, nil
+	}
 }
 
-func (ext4 *FileSystem) file(fi FileInfo, filePath string) (*File, error) {
-	extents, err := ext4.Extents(fi.inode)
+// dataTable maps the logical blocks of inode ino to their byte offsets.
+func (ext4 *FileSystem) dataTable(ino int64, inode *Inode) (dataTable, error) {
+	if inode.UsesExtents() {
+		return ext4.extentDataTable(ino, inode)
+	}
+	return ext4.blockDataTable(inode)
+}
+
+func (ext4 *FileSystem) blockDataTable(inode *Inode) (dataTable, error) {
+	blockAddresses, err := inode.GetBlockAddresses(ext4)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get block addresses: %w", err)
+	}
+
+	dt := make(dataTable)
+	for i, blockAddress := range blockAddresses {
+		if blockAddress == 0 {
+			continue
+		}
+		dt[int64(i)] = int64(blockAddress) * ext4.sb.GetBlockSize()
+	}
+	return dt, nil
+}
+
+func (ext4 *FileSystem) extentDataTable(ino int64, inode *Inode) (dataTable, error) {
+	extents, err := ext4.inodeExtents(ino, inode, ext4.inodeCsumSeed(ino, inode))
 	if err != nil {
 		return nil, err
 	}
@@ -657,17 +876,7 @@ func (ext4 *FileSystem) file(fi FileInfo, filePath string) (*File, error) {
 			dt[int64(e.Block)+i] = offset + i*ext4.sb.GetBlockSize()
 		}
 	}
-
-	return &File{
-		fs:           ext4,
-		FileInfo:     fi,
-		currentBlock: -1,
-		buffer:       bytes.NewBuffer(nil),
-		filePath:     filePath,
-		blockSize:    ext4.sb.GetBlockSize(),
-		table:        dt,
-		size:         fi.Size(),
-	}, nil
+	return dt, nil
 }
 
 func (ext4 *FileSystem) wrapError(op, path string, err error) error {
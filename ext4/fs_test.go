@@ -292,7 +292,7 @@ func TestListEntriesHTreeDirect(t *testing.T) {
 		cache: &mockCache[string, any]{},
 	}
 
-	entries, err := ext4fs.listEntriesHTree(rootInode)
+	entries, err := ext4fs.listEntriesHTree(rootInodeNumber, rootInode, csumSeed{})
 	if err != nil {
 		t.Fatalf("listEntriesHTree failed: %v", err)
 	}
@@ -374,7 +374,7 @@ func TestListEntriesHTreeWithInternalNodes(t *testing.T) {
 		cache: &mockCache[string, any]{},
 	}
 
-	entries, err := ext4fs.listEntriesHTree(rootInode)
+	entries, err := ext4fs.listEntriesHTree(rootInodeNumber, rootInode, csumSeed{})
 	if err != nil {
 		t.Fatalf("listEntriesHTree failed: %v", err)
 	}
@@ -432,7 +432,7 @@ func TestListEntriesHTreeBlockAddressing(t *testing.T) {
 		cache: &mockCache[string, any]{},
 	}
 
-	entries, err := ext4fs.listEntriesHTree(rootInode)
+	entries, err := ext4fs.listEntriesHTree(rootInodeNumber, rootInode, csumSeed{})
 	if err != nil {
 		t.Fatalf("listEntriesHTree failed: %v", err)
 	}
@@ -469,7 +469,7 @@ func TestListEntriesHTreeRootBlockReadFailure(t *testing.T) {
 	})
 	copy(rootInode.BlockOrExtents[:], extBuf.Bytes())
 
-	_, err := ext4fs.listEntriesHTree(rootInode)
+	_, err := ext4fs.listEntriesHTree(rootInodeNumber, rootInode, csumSeed{})
 	if err == nil {
 		t.Fatal("expected error for root block read failure, got nil")
 	}
@@ -509,7 +509,7 @@ func TestCollectLeafBlocksInternalNodeCountZero(t *testing.T) {
 	})
 	copy(rootInode.BlockOrExtents[:], extBuf.Bytes())
 
-	entries, err := ext4fs.listEntriesHTree(rootInode)
+	entries, err := ext4fs.listEntriesHTree(rootInodeNumber, rootInode, csumSeed{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -630,7 +630,7 @@ func TestListEntriesHTreeCountExceedsLimit(t *testing.T) {
 		cache: &mockCache[string, any]{},
 	}
 
-	_, err := ext4fs.listEntriesHTree(rootInode)
+	_, err := ext4fs.listEntriesHTree(rootInodeNumber, rootInode, csumSeed{})
 	if err == nil {
 		t.Fatal("expected error for count > limit, got nil")
 	}
@@ -663,7 +663,7 @@ func TestListEntriesHTreeInternalNodeCountExceedsLimit(t *testing.T) {
 	sr := io.NewSectionReader(bytes.NewReader(image), 0, int64(totalSize))
 	ext4fs := &FileSystem{r: sr, sb: Superblock{LogBlockSize: 2}, cache: &mockCache[string, any]{}}
 
-	_, err := ext4fs.listEntriesHTree(rootInode)
+	_, err := ext4fs.listEntriesHTree(rootInodeNumber, rootInode, csumSeed{})
 	if err == nil {
 		t.Fatal("expected error for internal node count > limit, got nil")
 	}
@@ -687,7 +687,7 @@ func TestListEntriesHTreeIndirectLevelsTooHigh(t *testing.T) {
 		sr := io.NewSectionReader(bytes.NewReader(image), 0, int64(totalSize))
 		ext4fs := &FileSystem{r: sr, sb: Superblock{LogBlockSize: 2}, cache: &mockCache[string, any]{}}
 
-		_, err := ext4fs.listEntriesHTree(rootInode)
+		_, err := ext4fs.listEntriesHTree(rootInodeNumber, rootInode, csumSeed{})
 		if err == nil {
 			t.Fatal("expected error for indirect_levels=3 without LARGEDIR")
 		}
@@ -709,7 +709,7 @@ func TestListEntriesHTreeIndirectLevelsTooHigh(t *testing.T) {
 		sb := Superblock{LogBlockSize: 2, FeatureIncompat: FEATURE_INCOMPAT_LARGEDIR}
 		ext4fs := &FileSystem{r: sr, sb: sb, cache: &mockCache[string, any]{}}
 
-		_, err := ext4fs.listEntriesHTree(rootInode)
+		_, err := ext4fs.listEntriesHTree(rootInodeNumber, rootInode, csumSeed{})
 		if err == nil {
 			t.Fatal("expected error for indirect_levels=4 with LARGEDIR")
 		}
@@ -973,7 +973,7 @@ func TestBuildDirectoryBlockMapSkipsZero(t *testing.T) {
 	sr := io.NewSectionReader(bytes.NewReader(image), 0, int64(len(image)))
 	ext4fs := &FileSystem{r: sr, sb: Superblock{LogBlockSize: 2}, cache: &mockCache[string, any]{}}
 
-	m, err := ext4fs.buildDirectoryBlockMap(inode)
+	m, err := ext4fs.buildDirectoryBlockMap(0, inode, csumSeed{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -1019,7 +1019,7 @@ func TestBuildDirectoryBlockMapExtents(t *testing.T) {
 	sr := io.NewSectionReader(bytes.NewReader(image), 0, int64(len(image)))
 	ext4fs := &FileSystem{r: sr, sb: Superblock{LogBlockSize: 2}, cache: &mockCache[string, any]{}}
 
-	m, err := ext4fs.buildDirectoryBlockMap(inode)
+	m, err := ext4fs.buildDirectoryBlockMap(0, inode, csumSeed{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -1068,7 +1068,7 @@ func TestBuildDirectoryBlockMapRejectsUninitializedExtent(t *testing.T) {
 	sr := io.NewSectionReader(bytes.NewReader(image), 0, int64(len(image)))
 	ext4fs := &FileSystem{r: sr, sb: Superblock{LogBlockSize: 2}, cache: &mockCache[string, any]{}}
 
-	_, err := ext4fs.buildDirectoryBlockMap(inode)
+	_, err := ext4fs.buildDirectoryBlockMap(0, inode, csumSeed{})
 	if err == nil {
 		t.Fatal("expected error for uninitialized extent in directory, got nil")
 	}
@@ -55,3 +55,12 @@ func (gd *GroupDescriptor) GetBlockBitmapLoc(featureInCompat64bit bool) int64 {
 	}
 	return int64(gd.BlockBitmapLo)
 }
+
+// GetItableUnused returns the number of inodes at the end of the inode
+// table that have never been used.
+func (gd *GroupDescriptor) GetItableUnused(featureInCompat64bit bool) int64 {
+	if featureInCompat64bit {
+		return (int64(gd.ItableUnusedHi) << 16) | int64(gd.ItableUnusedLo)
+	}
+	return int64(gd.ItableUnusedLo)
+}
@@ -0,0 +1,174 @@
+package ext4
+
+import (
+	"math/bits"
+
+	"golang.org/x/xerrors"
+)
+
+// DirHash computes the htree hash of name using hashVersion, as stored in a
+// directory's dx_root_info. The signedness of the legacy, half_md4 and tea
+// hashes is taken from the superblock flags.
+func (ext4 *FileSystem) DirHash(name string, hashVersion uint8) (uint32, error) {
+	if hashVersion <= DX_HASH_TEA && ext4.sb.Flags&FLAGS_UNSIGNED_HASH != 0 {
+		hashVersion += DX_HASH_LEGACY_UNSIGNED
+	}
+	return dirHash([]byte(name), hashVersion, ext4.sb.HashSeed)
+}
+
+func dirHash(name []byte, hashVersion uint8, seed [4]uint32) (uint32, error) {
+	buf := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	if seed != [4]uint32{} {
+		buf = seed
+	}
+
+	var hash uint32
+	switch hashVersion {
+	case DX_HASH_LEGACY:
+		hash = dxHackHash(name, true)
+	case DX_HASH_LEGACY_UNSIGNED:
+		hash = dxHackHash(name, false)
+	case DX_HASH_HALF_MD4, DX_HASH_HALF_MD4_UNSIGNED:
+		signed := hashVersion == DX_HASH_HALF_MD4
+		var in [8]uint32
+		for p := name; len(p) > 0; p = p[hashChunk(p, 32):] {
+			str2hashbuf(p, in[:], signed)
+			halfMD4Transform(&buf, &in)
+		}
+		hash = buf[1]
+	case DX_HASH_TEA, DX_HASH_TEA_UNSIGNED:
+		signed := hashVersion == DX_HASH_TEA
+		var in [4]uint32
+		for p := name; len(p) > 0; p = p[hashChunk(p, 16):] {
+			str2hashbuf(p, in[:], signed)
+			teaTransform(&buf, &in)
+		}
+		hash = buf[0]
+	default:
+		return 0, xerrors.Errorf("unsupported directory hash version %d", hashVersion)
+	}
+
+	hash &^= 1
+	if hash == 0x7fffffff<<1 {
+		hash = (0x7fffffff - 1) << 1
+	}
+	return hash, nil
+}
+
+// hashChar widens a name byte the way the kernel does for the signed and
+// unsigned hash variants.
+func hashChar(c byte, signed bool) uint32 {
+	if signed {
+		return uint32(int32(int8(c)))
+	}
+	return uint32(c)
+}
+
+func dxHackHash(name []byte, signed bool) uint32 {
+	hash0, hash1 := uint32(0x12a3fe2d), uint32(0x37abe8f9)
+	for _, c := range name {
+		hash := hash1 + (hash0 ^ hashChar(c, signed)*7152373)
+		if hash&0x80000000 != 0 {
+			hash -= 0x7fffffff
+		}
+		hash1 = hash0
+		hash0 = hash
+	}
+	return hash0 << 1
+}
+
+func hashChunk(p []byte, size int) int {
+	if len(p) < size {
+		return len(p)
+	}
+	return size
+}
+
+// str2hashbuf packs msg into buf, padding with the length of msg.
+func str2hashbuf(msg []byte, buf []uint32, signed bool) {
+	pad := uint32(len(msg)) | uint32(len(msg))<<8
+	pad |= pad << 16
+
+	if len(msg) > len(buf)*4 {
+		msg = msg[:len(buf)*4]
+	}
+	val := pad
+	i := 0
+	for j, c := range msg {
+		val = hashChar(c, signed) + val<<8
+		if j%4 == 3 {
+			buf[i] = val
+			i++
+			val = pad
+		}
+	}
+	if i < len(buf) {
+		buf[i] = val
+		i++
+	}
+	for ; i < len(buf); i++ {
+		buf[i] = pad
+	}
+}
+
+func teaTransform(buf *[4]uint32, in *[4]uint32) {
+	const delta = 0x9E3779B9
+	var sum uint32
+	b0, b1 := buf[0], buf[1]
+	a, b, c, d := in[0], in[1], in[2], in[3]
+	for n := 0; n < 16; n++ {
+		sum += delta
+		b0 += ((b1 << 4) + a) ^ (b1 + sum) ^ ((b1 >> 5) + b)
+		b1 += ((b0 << 4) + c) ^ (b0 + sum) ^ ((b0 >> 5) + d)
+	}
+	buf[0] += b0
+	buf[1] += b1
+}
+
+func halfMD4Transform(buf *[4]uint32, in *[8]uint32) {
+	const (
+		k1 = 0
+		k2 = 013240474631
+		k3 = 015666365641
+	)
+	f := func(x, y, z uint32) uint32 { return z ^ (x & (y ^ z)) }
+	g := func(x, y, z uint32) uint32 { return (x & y) + ((x ^ y) & z) }
+	h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+	round := func(fn func(x, y, z uint32) uint32, a *uint32, b, c, d, x uint32, s int) {
+		*a = bits.RotateLeft32(*a+fn(b, c, d)+x, s)
+	}
+
+	a, b, c, d := buf[0], buf[1], buf[2], buf[3]
+
+	round(f, &a, b, c, d, in[0]+k1, 3)
+	round(f, &d, a, b, c, in[1]+k1, 7)
+	round(f, &c, d, a, b, in[2]+k1, 11)
+	round(f, &b, c, d, a, in[3]+k1, 19)
+	round(f, &a, b, c, d, in[4]+k1, 3)
+	round(f, &d, a, b, c, in[5]+k1, 7)
+	round(f, &c, d, a, b, in[6]+k1, 11)
+	round(f, &b, c, d, a, in[7]+k1, 19)
+
+	round(g, &a, b, c, d, in[1]+k2, 3)
+	round(g, &d, a, b, c, in[3]+k2, 5)
+	round(g, &c, d, a, b, in[5]+k2, 9)
+	round(g, &b, c, d, a, in[7]+k2, 13)
+	round(g, &a, b, c, d, in[0]+k2, 3)
+	round(g, &d, a, b, c, in[2]+k2, 5)
+	round(g, &c, d, a, b, in[4]+k2, 9)
+	round(g, &b, c, d, a, in[6]+k2, 13)
+
+	round(h, &a, b, c, d, in[3]+k3, 3)
+	round(h, &d, a, b, c, in[7]+k3, 9)
+	round(h, &c, d, a, b, in[2]+k3, 11)
+	round(h, &b, c, d, a, in[6]+k3, 15)
+	round(h, &a, b, c, d, in[1]+k3, 3)
+	round(h, &d, a, b, c, in[5]+k3, 9)
+	round(h, &c, d, a, b, in[0]+k3, 11)
+	round(h, &b, c, d, a, in[4]+k3, 15)
+
+	buf[0] += a
+	buf[1] += b
+	buf[2] += c
+	buf[3] += d
+}
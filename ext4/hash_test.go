@@ -0,0 +1,35 @@
+package ext4
+
+import "testing"
+
+func TestDirHash(t *testing.T) {
+	// Expected values were produced by debugfs dx_hash.
+	long := "hello_world_this_is_a_long_filename_more_than_32_bytes"
+	seed := [4]uint32{0x04030201, 0x08070605, 0x0c0b0a09, 0x100f0e0d}
+	tests := []struct {
+		name    string
+		version uint8
+		seed    [4]uint32
+		want    uint32
+	}{
+		{name: long, version: DX_HASH_LEGACY, want: 0x14e55422},
+		{name: long, version: DX_HASH_HALF_MD4, want: 0xde4c5882},
+		{name: long, version: DX_HASH_TEA, want: 0x77a15c4c},
+		{name: "fooé", version: DX_HASH_LEGACY, seed: seed, want: 0x219c4fec},
+		{name: "fooé", version: DX_HASH_HALF_MD4, seed: seed, want: 0xcd2740f6},
+		{name: "fooé", version: DX_HASH_TEA, seed: seed, want: 0xf4b86612},
+	}
+	for _, tt := range tests {
+		got, err := dirHash([]byte(tt.name), tt.version, tt.seed)
+		if err != nil {
+			t.Fatalf("dirHash(%q, %d) error: %v", tt.name, tt.version, err)
+		}
+		if got != tt.want {
+			t.Errorf("dirHash(%q, %d) = %#x, want %#x", tt.name, tt.version, got, tt.want)
+		}
+	}
+
+	if _, err := dirHash([]byte("x"), DX_HASH_SIPHASH, seed); err == nil {
+		t.Errorf("dirHash() with siphash succeeded, want error")
+	}
+}
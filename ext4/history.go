@@ -0,0 +1,161 @@
+package ext4
+
+import (
+	"bytes"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4/journal"
+)
+
+// InodeVersion is a copy of an inode found in the journal.
+type InodeVersion struct {
+	// Sequence is the transaction that logged the copy and CommitTime the
+	// time it was committed, zero when unknown.
+	Sequence   uint32
+	CommitTime time.Time
+	// Committed reports whether the commit block of the transaction is
+	// still in the journal.
+	Committed bool
+	Inode     *Inode
+}
+
+// DirectoryBlockVersion is a copy of a directory block found in the
+// journal.
+type DirectoryBlockVersion struct {
+	Sequence   uint32
+	CommitTime time.Time
+	Committed  bool
+	// Block is the filesystem block the copy belongs to.
+	Block   int64
+	Entries []DirectoryEntry2
+}
+
+// journalCopy is a filesystem block logged in the journal.
+type journalCopy struct {
+	tx     journal.Transaction
+	target int64
+	data   []byte
+}
+
+// journalCopies returns the copies of the filesystem blocks accepted by
+// want found in the journal, oldest first. Copies failing checksum
+// verification are skipped.
+func (ext4 *FileSystem) journalCopies(want func(block int64) bool) ([]journalCopy, error) {
+	j, err := ext4.Journal()
+	if err != nil {
+		return nil, err
+	}
+	txs, err := j.History()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read journal history: %w", err)
+	}
+
+	var copies []journalCopy
+	for _, tx := range txs {
+		for _, b := range tx.Blocks {
+			if !want(int64(b.Target)) {
+				continue
+			}
+			data, err := j.ReadBlock(b)
+			if err != nil {
+				var csumErr *journal.ChecksumError
+				if xerrors.As(err, &csumErr) {
+					continue
+				}
+				return nil, err
+			}
+			copies = append(copies, journalCopy{tx: tx, target: int64(b.Target), data: data})
+		}
+	}
+	return copies, nil
+}
+
+// InodeHistory returns the copies of inode ino found in the journal, oldest
+// first. They include the ones of transactions already checkpointed, which
+// show earlier sizes, timestamps and links of the inode.
+func (ext4 *FileSystem) InodeHistory(ino int64) ([]InodeVersion, error) {
+	off, err := ext4.inodeOffset(ino)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := ext4.sb.GetBlockSize()
+	block, inBlock := off/blockSize, off%blockSize
+
+	copies, err := ext4.journalCopies(func(b int64) bool { return b == block })
+	if err != nil {
+		return nil, err
+	}
+	var versions []InodeVersion
+	for _, c := range copies {
+		inode, err := parseInode(c.data[inBlock : inBlock+int64(ext4.sb.InodeSize)])
+		if err != nil {
+			return nil, xerrors.Errorf("failed to parse inode %d of transaction %d: %w", ino, c.tx.Sequence, err)
+		}
+		versions = append(versions, InodeVersion{
+			Sequence:   c.tx.Sequence,
+			CommitTime: c.tx.CommitTime,
+			Committed:  c.tx.CommitBlock != 0,
+			Inode:      inode,
+		})
+	}
+	return versions, nil
+}
+
+// DirectoryHistory returns the copies of the blocks of directory ino found
+// in the journal, oldest first, with their entries. The blocks are the ones
+// mapped by the inode and by its copies in the journal, so the earlier
+// names of renamed and deleted entries show up. Copies whose entries cannot
+// be parsed, typically blocks since reused, are left out and recorded in
+// Errors.
+func (ext4 *FileSystem) DirectoryHistory(ino int64) ([]DirectoryBlockVersion, error) {
+	versions, err := ext4.InodeHistory(ino)
+	if err != nil {
+		return nil, err
+	}
+	inodes := make([]*Inode, 0, len(versions)+1)
+	if inode, err := ext4.getInode(ino); err == nil {
+		inodes = append(inodes, inode)
+	}
+	for _, v := range versions {
+		inodes = append(inodes, v.Inode)
+	}
+
+	blockSize := ext4.sb.GetBlockSize()
+	blocks := map[int64]bool{}
+	for _, inode := range inodes {
+		if !inode.IsDir() || inode.Flags&INLINE_DATA_FL != 0 {
+			continue
+		}
+		// The mapping of an old copy may no longer be readable.
+		m, err := ext4.buildDirectoryBlockMap(0, inode, csumSeed{})
+		if err != nil {
+			continue
+		}
+		for _, offset := range m {
+			blocks[offset/blockSize] = true
+		}
+	}
+
+	copies, err := ext4.journalCopies(func(b int64) bool { return blocks[b] })
+	if err != nil {
+		return nil, err
+	}
+	var dirVersions []DirectoryBlockVersion
+	for _, c := range copies {
+		entries, err := extractDirectoryEntries(bytes.NewBuffer(c.data))
+		if err != nil {
+			ext4.record(xerrors.Errorf("failed to extract directory entries of block %d in transaction %d: %w", c.target, c.tx.Sequence, err))
+			continue
+		}
+		dirVersions = append(dirVersions, DirectoryBlockVersion{
+			Sequence:   c.tx.Sequence,
+			CommitTime: c.tx.CommitTime,
+			Committed:  c.tx.CommitBlock != 0,
+			Block:      c.target,
+			Entries:    entries,
+		})
+	}
+	return dirVersions, nil
+}
@@ -0,0 +1,99 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	img := newTestImage(t)
+	d := img.AddDir(rootInodeNumber, "d")
+	f := img.AddFile(d, "new.txt", []byte("hello"))
+
+	current := img.bytes()
+	dirBlock := img.Dirs[d].Block
+	inodeBlock := img.InodeOffset(f) / testBlockSize
+	block := func(b int64) []byte {
+		return append([]byte(nil), current[b*testBlockSize:(b+1)*testBlockSize]...)
+	}
+
+	// Before being renamed and rewritten, the file was "old.txt" of 3
+	// bytes.
+	oldDir := bytes.Replace(block(dirBlock), []byte("new.txt"), []byte("old.txt"), 1)
+	oldInodes := block(inodeBlock)
+	binary.LittleEndian.PutUint32(oldInodes[img.InodeOffset(f)%testBlockSize+4:], 3)
+	img.addJournal(
+		testTransaction{blocks: map[int64][]byte{inodeBlock: oldInodes, dirBlock: oldDir}},
+		testTransaction{blocks: map[int64][]byte{inodeBlock: block(inodeBlock)}},
+	)
+	fsys := img.fs()
+
+	inodes, err := fsys.InodeHistory(int64(f))
+	if err != nil {
+		t.Fatalf("InodeHistory() error: %v", err)
+	}
+	if len(inodes) != 2 {
+		t.Fatalf("got %d inode versions, want 2", len(inodes))
+	}
+	for i, want := range []struct {
+		seq  uint32
+		size int64
+	}{{5, 3}, {6, 5}} {
+		v := inodes[i]
+		if v.Sequence != want.seq || v.Inode.GetSize() != want.size || !v.Committed {
+			t.Errorf("version %d = transaction %d, size %d, want transaction %d, size %d", i, v.Sequence, v.Inode.GetSize(), want.seq, want.size)
+		}
+	}
+
+	dirs, err := fsys.DirectoryHistory(int64(d))
+	if err != nil {
+		t.Fatalf("DirectoryHistory() error: %v", err)
+	}
+	if len(dirs) != 1 || dirs[0].Sequence != 5 || dirs[0].Block != dirBlock {
+		t.Fatalf("DirectoryHistory() = %+v, want block %d of transaction 5", dirs, dirBlock)
+	}
+	var names []string
+	for _, e := range dirs[0].Entries {
+		names = append(names, e.Name)
+	}
+	if len(names) != 1 || names[0] != "old.txt" {
+		t.Errorf("entries = %v, want the old name", names)
+	}
+}
+
+func TestDirectoryHistoryBadCopy(t *testing.T) {
+	img := newTestImage(t)
+	d := img.AddDir(rootInodeNumber, "d")
+	img.AddFile(d, "file.txt", []byte("hello"))
+
+	current := img.bytes()
+	dirBlock := img.Dirs[d].Block
+	good := append([]byte(nil), current[dirBlock*testBlockSize:(dirBlock+1)*testBlockSize]...)
+
+	// The block was reused for something else before: its last entry
+	// runs past the end of the block.
+	bad := make([]byte, testBlockSize)
+	copy(bad, buildDirEntry(uint32(d), "x", 2))
+	binary.LittleEndian.PutUint16(bad[4:], testBlockSize-12)
+	last := bad[testBlockSize-12:]
+	binary.LittleEndian.PutUint32(last, 13)
+	binary.LittleEndian.PutUint16(last[4:], 12)
+	last[6] = 10 // name_len
+	img.addJournal(
+		testTransaction{blocks: map[int64][]byte{dirBlock: bad}},
+		testTransaction{blocks: map[int64][]byte{dirBlock: good}},
+	)
+	fsys := img.fs()
+
+	dirs, err := fsys.DirectoryHistory(int64(d))
+	if err != nil {
+		t.Fatalf("DirectoryHistory() error: %v", err)
+	}
+	if len(dirs) != 1 || dirs[0].Sequence != 6 {
+		t.Fatalf("DirectoryHistory() = %+v, want only the copy of transaction 6", dirs)
+	}
+	if errs := fsys.Errors(); len(errs) != 1 {
+		t.Errorf("Errors() = %v, want the copy of transaction 5", errs)
+	}
+}
@@ -0,0 +1,112 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4/internal/testimage"
+)
+
+// The layout of the images built by testImage is that of package testimage.
+const (
+	testBlockSize      = testimage.BlockSize
+	testBlockCount     = testimage.BlockCount
+	testInodesPerGroup = testimage.InodesPerGroup
+	testInodeSize      = testimage.InodeSize
+	testBlockBitmap    = testimage.BlockBitmap
+	testInodeBitmap    = testimage.InodeBitmap
+	testInodeTable     = testimage.InodeTable
+	testFirstDataBlock = testimage.FirstDataBlock
+	testFirstInode     = testimage.FirstInode
+)
+
+type testImage struct {
+	*testimage.Image[Superblock, GroupDescriptor, Inode]
+}
+
+// newTestImage builds an empty filesystem holding only the root directory.
+func newTestImage(t *testing.T) *testImage {
+	t.Helper()
+	return &testImage{testimage.New[Superblock, GroupDescriptor, Inode](t)}
+}
+
+// testExtentRoot encodes a depth 0 extent tree root for an inode's i_block.
+func testExtentRoot(extents ...Extent) [60]byte {
+	return testimage.ExtentRoot(extents...)
+}
+
+// bytes serializes the image, writing out directories, inodes, the group
+// descriptor and the superblock, with the free counts and checksums.
+func (img *testImage) bytes() []byte {
+	img.WriteTables()
+
+	var freeBlocks, freeInodes uint32
+	for b := int64(1); b < testBlockCount; b++ {
+		bit := b - 1
+		if img.Data[testBlockBitmap*testBlockSize+bit/8]&(1<<(bit%8)) == 0 {
+			freeBlocks++
+		}
+	}
+	for ino := uint32(1); ino <= testInodesPerGroup; ino++ {
+		bit := ino - 1
+		if img.Data[testInodeBitmap*testBlockSize+bit/8]&(1<<(bit%8)) == 0 {
+			freeInodes++
+		}
+	}
+	img.GD.FreeBlocksCountLo = uint16(freeBlocks)
+	img.GD.FreeInodesCountLo = uint16(freeInodes)
+	img.SB.FreeBlockCountLo = freeBlocks
+	img.SB.FreeInodeCount = freeInodes
+
+	if img.SB.hasMetadataChecksums() {
+		img.writeChecksums()
+	}
+
+	img.WriteBlock(2, testimage.Encode(img.GD.GroupDescriptor32))
+	raw := testimage.Encode(img.SB)
+	if img.SB.hasMetadataChecksums() {
+		binary.LittleEndian.PutUint32(raw[SuperBlockSize-4:], crc32c(^uint32(0), raw[:SuperBlockSize-4]))
+	}
+	img.WriteBlock(1, raw)
+	return img.Copy()
+}
+
+// writeChecksums fills in the metadata_csum checksums of the inodes, the
+// bitmaps and the group descriptor. It relies on the functions under test,
+// which TestChecksumVectors checks against checksums written by e2fsprogs.
+func (img *testImage) writeChecksums() {
+	for ino := range img.Inodes {
+		raw := img.Data[img.InodeOffset(ino) : img.InodeOffset(ino)+testInodeSize]
+		binary.LittleEndian.PutUint16(raw[inodeChecksumLoOffset:], 0)
+		binary.LittleEndian.PutUint16(raw[inodeChecksumHiOffset:], 0)
+		c, hasHi := img.SB.inodeChecksum(int64(ino), raw)
+		binary.LittleEndian.PutUint16(raw[inodeChecksumLoOffset:], uint16(c))
+		if hasHi {
+			binary.LittleEndian.PutUint16(raw[inodeChecksumHiOffset:], uint16(c>>16))
+		}
+	}
+
+	seed := img.SB.checksumSeed()
+	c := crc32c(seed, img.Data[testBlockBitmap*testBlockSize:][:img.SB.ClusterPerGroup/8])
+	img.GD.BlockBitmapCsumLo = uint16(c)
+	c = crc32c(seed, img.Data[testInodeBitmap*testBlockSize:][:img.SB.InodePerGroup/8])
+	img.GD.InodeBitmapCsumLo = uint16(c)
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, img.GD.GroupDescriptor32)
+	csum, _ := img.SB.groupDescriptorChecksum(0, buf.Bytes())
+	img.GD.Checksum = csum
+}
+
+// fs opens the serialized image with NewFS.
+func (img *testImage) fs(opts ...Option) *FileSystem {
+	img.T.Helper()
+	b := img.bytes()
+	fsys, err := NewFS(*io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), nil, opts...)
+	if err != nil {
+		img.T.Fatalf("NewFS() error: %v", err)
+	}
+	return fsys
+}
@@ -3,6 +3,7 @@ package ext4
 import (
 	"bytes"
 	"encoding/binary"
+	"time"
 
 	"golang.org/x/xerrors"
 )
@@ -43,6 +44,10 @@ type DirectoryEntry2 struct {
 	NameLen uint8  `struc:"uint8,sizeof=Name"`
 	Flags   uint8  `struc:"uint8"`
 	Name    string `struc:"[]byte"`
+
+	// Deleted is set on the entries recovered from the slack of directory
+	// blocks. See WithDeletedEntries.
+	Deleted bool `struc:"skip"`
 }
 
 // Inode is index-node
@@ -135,23 +140,83 @@ func (i *Inode) GetSize() int64 {
 	return (int64(i.SizeHigh) << 32) | int64(i.SizeLo)
 }
 
+// GetUID returns the owner of the inode, with the upper 16 bits.
+func (i *Inode) GetUID() uint32 {
+	return uint32(i.UIDHigh)<<16 | uint32(i.UID)
+}
+
+// GetGID returns the group of the inode, with the upper 16 bits.
+func (i *Inode) GetGID() uint32 {
+	return uint32(i.GIDHigh)<<16 | uint32(i.GID)
+}
+
+// End of the extra timestamp fields, relative to ExtraIsize.
+const (
+	ctimeExtraEnd  = 0x08
+	mtimeExtraEnd  = 0x0C
+	atimeExtraEnd  = 0x10
+	crtimeEnd      = 0x14
+	crtimeExtraEnd = 0x18
+)
+
+// AccessTime returns the last access time. Like the other timestamps, it
+// has nanoseconds and extends past 2038 when the inode has extra fields.
+func (i *Inode) AccessTime() time.Time {
+	return i.timestamp(i.Atime, i.AtimeExtra, atimeExtraEnd)
+}
+
+// ModificationTime returns the last modification time of the content.
+func (i *Inode) ModificationTime() time.Time {
+	return i.timestamp(i.Mtime, i.MtimeExtra, mtimeExtraEnd)
+}
+
+// ChangeTime returns the last change time of the inode.
+func (i *Inode) ChangeTime() time.Time {
+	return i.timestamp(i.Ctime, i.CtimeExtra, ctimeExtraEnd)
+}
+
+// CreationTime returns the creation time, the zero Time when the inode has
+// no room for it.
+func (i *Inode) CreationTime() time.Time {
+	if i.ExtraIsize < crtimeEnd {
+		return time.Time{}
+	}
+	return i.timestamp(i.Crtime, i.CrtimeExtra, crtimeExtraEnd)
+}
+
+// timestamp decodes seconds and, when the extra fields reach end, the
+// extra field holding the epoch bits and nanoseconds.
+func (i *Inode) timestamp(seconds, extra uint32, end uint16) time.Time {
+	sec := int64(int32(seconds))
+	if i.ExtraIsize < end {
+		return time.Unix(sec, 0)
+	}
+	sec += int64(extra&3) << 32
+	return time.Unix(sec, int64(extra>>2))
+}
+
 // readIndirectBlockPointers reads all block pointers from an indirect block
 // using ReadAt. Returns up to entriesPerBlock (blockSize/4) entries including
 // zeros (sparse holes).
 func readIndirectBlockPointers(ext4 *FileSystem, blockAddr uint32, remaining int64) ([]uint32, error) {
 	blockSize := ext4.sb.GetBlockSize()
 	buf := make([]byte, blockSize)
-	_, err := ext4.r.ReadAt(buf, int64(blockAddr)*blockSize)
-	if err != nil {
-		return nil, xerrors.Errorf("failed to read indirect block at %#x: %w", blockAddr, err)
-	}
-
 	entriesPerBlock := blockSize / 4
 	count := remaining
 	if count > entriesPerBlock {
 		count = entriesPerBlock
 	}
 
+	_, err := ext4.r.ReadAt(buf, int64(blockAddr)*blockSize)
+	if err != nil {
+		err = xerrors.Errorf("failed to read indirect block at %#x: %w", blockAddr, err)
+		if ext4.tolerate(err) {
+			// The blocks it maps read back as a hole.
+			return make([]uint32, count), nil
+		}
+		return nil, err
+	}
+
 	addrs := make([]uint32, count)
 	for j := int64(0); j < count; j++ {
 		addrs[j] = binary.LittleEndian.Uint32(buf[j*4 : j*4+4])
@@ -1,6 +1,9 @@
 package ext4
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestInodeFileType(t *testing.T) {
 	tests := []struct {
@@ -152,3 +155,40 @@ func TestInodeFileTypeMutualExclusion(t *testing.T) {
 		})
 	}
 }
+
+func TestInodeTimestamps(t *testing.T) {
+	inode := &Inode{
+		Atime:       0x80000000,
+		AtimeExtra:  1<<2 | 1,
+		Mtime:       1700000000,
+		MtimeExtra:  123456789 << 2,
+		Ctime:       1700000001,
+		Crtime:      1600000000,
+		CrtimeExtra: 5 << 2,
+		ExtraIsize:  crtimeExtraEnd,
+	}
+	for _, tt := range []struct {
+		name string
+		got  time.Time
+		want time.Time
+	}{
+		// The epoch bits extend the signed seconds past 2038.
+		{"atime", inode.AccessTime(), time.Unix(-0x80000000+1<<32, 1)},
+		{"mtime", inode.ModificationTime(), time.Unix(1700000000, 123456789)},
+		{"ctime", inode.ChangeTime(), time.Unix(1700000001, 0)},
+		{"crtime", inode.CreationTime(), time.Unix(1600000000, 5)},
+	} {
+		if !tt.got.Equal(tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// Without extra fields, only the seconds are used.
+	inode.ExtraIsize = 0
+	if got := inode.ModificationTime(); !got.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("mtime without extra fields = %v", got)
+	}
+	if got := inode.CreationTime(); !got.IsZero() {
+		t.Errorf("crtime without extra fields = %v, want zero", got)
+	}
+}
@@ -0,0 +1,213 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+var _ fs.ReadDirFile = &Dir{}
+
+// Dir is a directory opened by OpenInode. It implements the io/fs
+// ReadDirFile interface.
+type Dir struct {
+	FileInfo
+	fs      *FileSystem
+	listed  bool
+	entries []fs.DirEntry
+}
+
+func (d *Dir) Stat() (fs.FileInfo, error) {
+	return d.FileInfo, nil
+}
+
+func (d *Dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: xerrors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries of the directory, or all the remaining
+// ones when n <= 0, in directory order. "." and ".." are not returned.
+func (d *Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		infos, err := d.fs.listFileInfo(d.ino)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: err}
+		}
+		for _, fi := range infos {
+			d.entries = append(d.entries, dirEntry{fi})
+		}
+		d.listed = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *Dir) Close() error {
+	return nil
+}
+
+// OpenInode opens inode ino without going through a path: directories are
+// opened as a *Dir and other inodes as a *File. Symbolic links are not
+// followed and files with inline data are not supported. The handle is
+// named after the inode in the notation of debugfs, "<ino>"; use PathsOf to
+// find its names.
+func (ext4 *FileSystem) OpenInode(ino int64) (fs.File, error) {
+	const op = "open inode"
+
+	name := inodeName(ino)
+	inode, err := ext4.getInode(ino)
+	if err != nil {
+		return nil, ext4.wrapError(op, name, xerrors.Errorf("failed to get inode(%d): %w", ino, err))
+	}
+	if inode.IsDir() {
+		return &Dir{FileInfo: FileInfo{name: name, ino: ino, inode: inode}, fs: ext4}, nil
+	}
+	f, err := ext4.inodeFile(ino, inode)
+	if err != nil {
+		return nil, ext4.wrapError(op, name, err)
+	}
+	return f, nil
+}
+
+// inodeFile opens the content of inode ino under the name "<ino>".
+func (ext4 *FileSystem) inodeFile(ino int64, inode *Inode) (*File, error) {
+	if inode.Flags&INLINE_DATA_FL != 0 {
+		return nil, xerrors.Errorf("inode %d has inline data", ino)
+	}
+	dt, err := ext4.dataTable(ino, inode)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get file(inode: %d): %w", ino, err)
+	}
+	name := inodeName(ino)
+	return ext4.newFile(FileInfo{name: name, ino: ino, inode: inode}, name, dt), nil
+}
+
+// inodeName is the name debugfs gives to inode ino.
+func inodeName(ino int64) string {
+	return fmt.Sprintf("<%d>", ino)
+}
+
+// PathsOf returns every path referring to inode ino, none when it is not
+// reachable from the root directory. The path of a directory is found by
+// following the ".." entries up to the root directory. The paths of other
+// inodes, which can have several hard links, come from an index of the
+// whole tree built by the first call.
+func (ext4 *FileSystem) PathsOf(ino int64) ([]string, error) {
+	if ino < 1 || ino > int64(ext4.sb.InodeCount) {
+		return nil, xerrors.Errorf("inode %d is out of range: %w", ino, ErrInodeNotFound)
+	}
+	if ino == rootInodeNumber {
+		return []string{"/"}, nil
+	}
+	inode, err := ext4.getInode(ino)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get inode(%d): %w", ino, err)
+	}
+	if inode.IsDir() {
+		// A damaged or unlinked directory may not be found in its parent,
+		// the index tells whether it is reachable another way.
+		if p, err := ext4.dirPath(ino); err == nil {
+			return []string{p}, nil
+		}
+	}
+
+	index, err := ext4.pathIndex()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to index paths: %w", err)
+	}
+	return append([]string(nil), index[ino]...), nil
+}
+
+// dirPath returns the path of directory ino by looking up the name of each
+// directory in the one its ".." entry refers to.
+func (ext4 *FileSystem) dirPath(ino int64) (string, error) {
+	var names []string
+	seen := map[int64]bool{}
+	for ino != rootInodeNumber {
+		if seen[ino] {
+			return "", xerrors.Errorf("directory inode %d is its own ancestor", ino)
+		}
+		seen[ino] = true
+
+		parent, err := ext4.parentDirectory(ino)
+		if err != nil {
+			return "", err
+		}
+		entries, err := ext4.listEntries(parent)
+		if err != nil {
+			return "", xerrors.Errorf("failed to list directory inode %d: %w", parent, err)
+		}
+		name := ""
+		for _, e := range entries {
+			if int64(e.Inode) == ino {
+				name = e.Name
+				break
+			}
+		}
+		if name == "" {
+			return "", xerrors.Errorf("directory inode %d is not in its parent inode %d", ino, parent)
+		}
+		names = append(names, name)
+		ino = parent
+	}
+
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return "/" + strings.Join(names, "/"), nil
+}
+
+// parentDirectory returns the inode the ".." entry of directory ino refers
+// to. It is the second entry of the first block, after ".", also in hash
+// tree directories.
+func (ext4 *FileSystem) parentDirectory(ino int64) (int64, error) {
+	inode, err := ext4.getInode(ino)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to get inode(%d): %w", ino, err)
+	}
+	if !inode.IsDir() {
+		return 0, xerrors.Errorf("inode %d is not a directory", ino)
+	}
+	if inode.Flags&INLINE_DATA_FL != 0 {
+		// Inline directories store the parent in place of "." and "..".
+		return int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[:4])), nil
+	}
+	dt, err := ext4.dataTable(ino, inode)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to map directory inode %d: %w", ino, err)
+	}
+	offset, ok := dt[0]
+	if !ok {
+		return 0, xerrors.Errorf("directory inode %d has no first block", ino)
+	}
+	b := make([]byte, ext4.sb.GetBlockSize())
+	if _, err := ext4.r.ReadAt(b, offset); err != nil {
+		return 0, xerrors.Errorf("failed to read directory block at %#x: %w", offset, err)
+	}
+
+	dotLen := int(binary.LittleEndian.Uint16(b[4:]))
+	if dotLen < direntHeaderSize || dotLen+direntHeaderSize+2 > len(b) {
+		return 0, xerrors.Errorf("directory inode %d: %w: rec_len %d of \".\"", ino, errMalformedDirectoryEntry, dotLen)
+	}
+	e := b[dotLen:]
+	if e[6] != 2 || string(e[direntHeaderSize:direntHeaderSize+2]) != ".." {
+		return 0, xerrors.Errorf("directory inode %d has no \"..\" entry", ino)
+	}
+	return int64(binary.LittleEndian.Uint32(e)), nil
+}
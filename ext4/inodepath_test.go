@@ -0,0 +1,96 @@
+package ext4
+
+import (
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+func TestOpenInode(t *testing.T) {
+	img := newTestImage(t)
+	d := img.AddDir(rootInodeNumber, "d")
+	f := img.AddFile(d, "f", []byte("hello"))
+	img.AddFile(d, "g", nil)
+	fsys := img.fs()
+
+	file, err := fsys.OpenInode(int64(f))
+	if err != nil {
+		t.Fatalf("OpenInode(%d) error: %v", f, err)
+	}
+	got, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("ReadAll() error: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("content = %q, want %q", got, "hello")
+	}
+
+	dir, err := fsys.OpenInode(int64(d))
+	if err != nil {
+		t.Fatalf("OpenInode(%d) error: %v", d, err)
+	}
+	rd, ok := dir.(fs.ReadDirFile)
+	if !ok {
+		t.Fatalf("OpenInode(%d) = %T, want a fs.ReadDirFile", d, dir)
+	}
+	var names []string
+	for {
+		entries, err := rd.ReadDir(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadDir() error: %v", err)
+		}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+	}
+	if want := []string{"f", "g"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir() names = %v, want %v", names, want)
+	}
+	if _, err := dir.Read(make([]byte, 1)); err == nil {
+		t.Error("Read() of a directory succeeded")
+	}
+
+	if _, err := fsys.OpenInode(1 << 20); err == nil {
+		t.Error("OpenInode() of an out of range inode succeeded")
+	}
+}
+
+func TestPathsOf(t *testing.T) {
+	img := newTestImage(t)
+	a := img.AddDir(rootInodeNumber, "a")
+	b := img.AddDir(a, "b")
+	f := img.AddFile(b, "f", []byte("x"))
+	img.AddEntry(rootInodeNumber, f, "link", 1)
+	img.Inodes[f].LinksCount++
+	unlinked := img.AddFile(rootInodeNumber, "unlinked", nil)
+	img.Dirs[rootInodeNumber].Entries = img.Dirs[rootInodeNumber].Entries[:len(img.Dirs[rootInodeNumber].Entries)-1]
+	fsys := img.fs()
+
+	for _, tt := range []struct {
+		ino  uint32
+		want []string
+	}{
+		{rootInodeNumber, []string{"/"}},
+		{a, []string{"/a"}},
+		{b, []string{"/a/b"}},
+		{f, []string{"/link", "/a/b/f"}},
+		{unlinked, nil},
+	} {
+		got, err := fsys.PathsOf(int64(tt.ino))
+		if err != nil {
+			t.Errorf("PathsOf(%d) error: %v", tt.ino, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PathsOf(%d) = %q, want %q", tt.ino, got, tt.want)
+		}
+	}
+
+	if _, err := fsys.PathsOf(0); err == nil {
+		t.Error("PathsOf(0) succeeded")
+	}
+}
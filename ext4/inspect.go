@@ -0,0 +1,117 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+// GetInode returns inode ino.
+func (ext4 *FileSystem) GetInode(ino int64) (*Inode, error) {
+	return ext4.getInode(ino)
+}
+
+// GroupDescriptors returns the group descriptors of the filesystem.
+func (ext4 *FileSystem) GroupDescriptors() []GroupDescriptor {
+	gds := make([]GroupDescriptor, len(ext4.gds))
+	copy(gds, ext4.gds)
+	return gds
+}
+
+// DirEntries returns the entries of directory ino, excluding "." and "..".
+// With WithDeletedEntries, the deleted entries found in the directory blocks
+// follow the live ones.
+func (ext4 *FileSystem) DirEntries(ino int64) ([]DirectoryEntry2, error) {
+	entries, err := ext4.listEntries(ino)
+	if err != nil || !ext4.deletedEntries {
+		return entries, err
+	}
+	deleted, err := ext4.deletedDirEntries(ino)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to scan deleted entries: %w", err)
+	}
+	return append(entries, deleted...), nil
+}
+
+// MetadataBlocks returns the blocks used to map the data of inode: the
+// extent tree index and leaf blocks, or the indirect blocks.
+func (ext4 *FileSystem) MetadataBlocks(inode *Inode) ([]int64, error) {
+	if inode.Flags&INLINE_DATA_FL != 0 {
+		return nil, nil
+	}
+	if inode.UsesExtents() {
+		return ext4.extentTreeBlocks(inode.BlockOrExtents[:], extentDepthRoot, nil)
+	}
+	if inode.IsSymlink() && inode.GetSize() < int64(len(inode.BlockOrExtents)) {
+		return nil, nil
+	}
+
+	addresses := BlockAddressing{}
+	if err := binary.Read(bytes.NewReader(inode.BlockOrExtents[:]), binary.LittleEndian, &addresses); err != nil {
+		return nil, xerrors.Errorf("failed to read block addressing: %w", err)
+	}
+	var blocks []int64
+	for depth, addr := range []uint32{addresses.SingleIndirectBlock, addresses.DoubleIndirectBlock, addresses.TripleIndirectBlock} {
+		var err error
+		blocks, err = ext4.indirectBlocks(addr, depth, blocks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// extentTreeBlocks appends the blocks of the extent tree nodes below the
+// node b to blocks. The depth of each child must be one less than the
+// depth of its parent, which also bounds the recursion on looping trees.
+func (ext4 *FileSystem) extentTreeBlocks(b []byte, expectedDepth int, blocks []int64) ([]int64, error) {
+	header, r, err := parseExtentHeader(b, expectedDepth)
+	if err != nil {
+		return nil, err
+	}
+	if header.Depth == 0 {
+		return blocks, nil
+	}
+	for i := uint16(0); i < header.Entries; i++ {
+		var index ExtentInternal
+		if err := binary.Read(r, binary.LittleEndian, &index); err != nil {
+			return nil, xerrors.Errorf("failed to read internal extent: %w", err)
+		}
+		block := int64(index.LeafHigh)<<32 | int64(index.LeafLow)
+		blocks = append(blocks, block)
+
+		child := make([]byte, ext4.sb.GetBlockSize())
+		if _, err := ext4.r.ReadAt(child, block*ext4.sb.GetBlockSize()); err != nil {
+			return nil, xerrors.Errorf("failed to read extent tree block %d: %w", block, err)
+		}
+		blocks, err = ext4.extentTreeBlocks(child, int(header.Depth)-1, blocks)
+		if err != nil {
+			return nil, xerrors.Errorf("extent tree block %d: %w", block, err)
+		}
+	}
+	return blocks, nil
+}
+
+// indirectBlocks appends addr and, for double and triple indirect blocks
+// (depth 1 and 2), the indirect blocks it points to.
+func (ext4 *FileSystem) indirectBlocks(addr uint32, depth int, blocks []int64) ([]int64, error) {
+	if addr == 0 {
+		return blocks, nil
+	}
+	blocks = append(blocks, int64(addr))
+	if depth == 0 {
+		return blocks, nil
+	}
+	pointers, err := readIndirectBlockPointers(ext4, addr, ext4.sb.GetBlockSize()/4)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pointers {
+		blocks, err = ext4.indirectBlocks(p, depth-1, blocks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
@@ -0,0 +1,341 @@
+// Package testimage builds small ext4 images for the tests of package ext4
+// and the packages built on it.
+//
+// The images are assembled from raw on-disk structures and decoded into the
+// superblock, group descriptor and inode types given as type parameters, so
+// that this package does not import ext4: the tests of ext4 itself use it.
+package testimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Layout of the images (1KB blocks, one group):
+//
+//	block 0      boot block
+//	block 1      superblock
+//	block 2      group descriptor table
+//	block 3      block bitmap
+//	block 4      inode bitmap
+//	block 5..12  inode table (32 inodes * 256 bytes)
+//	block 13..   data blocks
+const (
+	BlockSize      = 1024
+	BlockCount     = 256
+	BlocksPerGroup = 8192
+	InodesPerGroup = 32
+	InodeSize      = 256
+	BlockBitmap    = 3
+	InodeBitmap    = 4
+	InodeTable     = 5
+	FirstDataBlock = 13
+	FirstInode     = 11
+	RootInode      = 2
+
+	// DescSize is the size of the 32-bit group descriptors written.
+	DescSize = 32
+)
+
+const (
+	modeRegular = 0x8000 | 0o644
+	modeDir     = 0x4000 | 0o755
+	extentsFl   = 0x80000
+	sectorSize  = 512
+
+	// Offsets of the inode fields set by the builder.
+	inodeSize       = 0x04
+	inodeLinksCount = 0x1A
+	inodeBlocks     = 0x1C
+	inodeFlags      = 0x20
+	inodeBlock      = 0x28
+)
+
+// Image is an image being built. S, G and I are the superblock, group
+// descriptor and inode types, decoded from and encoded to their on-disk
+// layout with encoding/binary.
+type Image[S, G, I any] struct {
+	T    *testing.T
+	Data []byte
+	SB   S
+	GD   G
+	// Inodes are written to the inode table by Bytes.
+	Inodes map[uint32]*I
+	// Dirs holds the block receiving the entries added to each directory.
+	Dirs      map[uint32]*Dir
+	NextBlock int64
+	NextIno   uint32
+
+	// dirBlocks holds every directory block, in the order created.
+	dirBlocks []*Dir
+}
+
+// Dir is a directory block and its entries. The last entry is stretched to
+// the end of the block.
+type Dir struct {
+	Block   int64
+	Entries [][]byte
+}
+
+// New builds an empty filesystem holding only the root directory.
+func New[S, G, I any](t *testing.T) *Image[S, G, I] {
+	t.Helper()
+	img := &Image[S, G, I]{
+		T:         t,
+		Data:      make([]byte, BlockCount*BlockSize),
+		Inodes:    map[uint32]*I{},
+		Dirs:      map[uint32]*Dir{},
+		NextBlock: FirstDataBlock,
+		NextIno:   FirstInode,
+	}
+
+	sb := make([]byte, 1024)
+	le := binary.LittleEndian
+	le.PutUint32(sb[0x00:], InodesPerGroup) // s_inodes_count
+	le.PutUint32(sb[0x04:], BlockCount)     // s_blocks_count_lo
+	le.PutUint32(sb[0x14:], 1)              // s_first_data_block
+	le.PutUint32(sb[0x20:], BlocksPerGroup) // s_blocks_per_group
+	le.PutUint32(sb[0x24:], BlocksPerGroup) // s_clusters_per_group
+	le.PutUint32(sb[0x28:], InodesPerGroup) // s_inodes_per_group
+	le.PutUint16(sb[0x38:], 0xEF53)         // s_magic
+	le.PutUint32(sb[0x4C:], 1)              // s_rev_level
+	le.PutUint32(sb[0x54:], FirstInode)     // s_first_ino
+	le.PutUint16(sb[0x58:], InodeSize)      // s_inode_size
+	le.PutUint32(sb[0x60:], 0x0002|0x0040)  // s_feature_incompat: filetype, extents
+	copy(sb[0x68:], []byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12})
+	img.decode(sb, &img.SB)
+
+	gd := make([]byte, DescSize)
+	le.PutUint32(gd[0x00:], BlockBitmap)
+	le.PutUint32(gd[0x04:], InodeBitmap)
+	le.PutUint32(gd[0x08:], InodeTable)
+	img.decode(gd, &img.GD)
+
+	for ino := uint32(1); ino < FirstInode; ino++ {
+		img.MarkInode(ino)
+	}
+	for b := int64(1); b < FirstDataBlock; b++ {
+		img.MarkBlock(b)
+	}
+	// Blocks past the end of the filesystem are marked in use, as mke2fs does.
+	for b := int64(BlockCount); b <= BlocksPerGroup; b++ {
+		img.MarkBlock(b)
+	}
+
+	block := img.Alloc(1)
+	img.NewDirBlock(RootInode, block)
+	img.SetInode(RootInode, img.NewInode(modeDir, 2, BlockSize, ExtentRoot(Extent{Len: 1, Start: uint32(block)})))
+	img.AddEntry(RootInode, RootInode, ".", 2)
+	img.AddEntry(RootInode, RootInode, "..", 2)
+	return img
+}
+
+// decode decodes raw, zero padded to the size of v, into v.
+func (img *Image[S, G, I]) decode(raw []byte, v interface{}) {
+	b := make([]byte, binary.Size(v))
+	copy(b, raw)
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, v); err != nil {
+		img.T.Fatalf("failed to decode %T: %v", v, err)
+	}
+}
+
+// Encode returns the on-disk layout of v.
+func Encode(v interface{}) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, v)
+	return buf.Bytes()
+}
+
+// Extent is an extent of Len blocks from Start mapping logical block Block.
+type Extent struct {
+	Block   uint32
+	Len     uint16
+	StartHi uint16
+	Start   uint32
+}
+
+// ExtentRoot encodes a depth 0 extent tree root for an inode's i_block.
+// E is an extent type with the on-disk layout, such as Extent.
+func ExtentRoot[E any](extents ...E) [60]byte {
+	var root [60]byte
+	binary.LittleEndian.PutUint16(root[0:], 0xF30A)
+	binary.LittleEndian.PutUint16(root[2:], uint16(len(extents)))
+	binary.LittleEndian.PutUint16(root[4:], 4)
+	for i, e := range extents {
+		copy(root[12+12*i:], Encode(e))
+	}
+	return root
+}
+
+// DirEntry encodes a directory entry of the smallest record length.
+func DirEntry(ino uint32, name string, fileType uint8) []byte {
+	recLen := (8 + len(name) + 3) &^ 3
+	b := make([]byte, recLen)
+	binary.LittleEndian.PutUint32(b[0:], ino)
+	binary.LittleEndian.PutUint16(b[4:], uint16(recLen))
+	b[6] = uint8(len(name))
+	b[7] = fileType
+	copy(b[8:], name)
+	return b
+}
+
+// NewInode returns an inode of mode using extents with the given link
+// count, size and i_block. Its block count is that of the extents in
+// i_block.
+func (img *Image[S, G, I]) NewInode(mode uint16, links uint16, size int64, iblock [60]byte) *I {
+	raw := make([]byte, InodeSize)
+	le := binary.LittleEndian
+	le.PutUint16(raw[0:], mode)
+	le.PutUint32(raw[inodeSize:], uint32(size))
+	le.PutUint16(raw[inodeLinksCount:], links)
+	var blocks uint32
+	for i := 0; i < int(le.Uint16(iblock[2:])); i++ {
+		blocks += uint32(le.Uint16(iblock[12+12*i+4:]))
+	}
+	le.PutUint32(raw[inodeBlocks:], blocks*BlockSize/sectorSize)
+	le.PutUint32(raw[inodeFlags:], extentsFl)
+	copy(raw[inodeBlock:], iblock[:])
+	inode := new(I)
+	img.decode(raw, inode)
+	return inode
+}
+
+// Link adds one to the link count of inode ino.
+func (img *Image[S, G, I]) Link(ino uint32) {
+	raw := Encode(img.Inodes[ino])
+	binary.LittleEndian.PutUint16(raw[inodeLinksCount:], binary.LittleEndian.Uint16(raw[inodeLinksCount:])+1)
+	img.decode(raw, img.Inodes[ino])
+}
+
+// Alloc allocates n consecutive blocks.
+func (img *Image[S, G, I]) Alloc(n int64) int64 {
+	start := img.NextBlock
+	if start+n > BlockCount {
+		img.T.Fatalf("test image is full")
+	}
+	for b := start; b < start+n; b++ {
+		img.MarkBlock(b)
+	}
+	img.NextBlock += n
+	return start
+}
+
+func (img *Image[S, G, I]) MarkBlock(b int64) {
+	setBit(img.Data[BlockBitmap*BlockSize:], b-1, true)
+}
+
+func (img *Image[S, G, I]) UnmarkBlock(b int64) {
+	setBit(img.Data[BlockBitmap*BlockSize:], b-1, false)
+}
+
+func (img *Image[S, G, I]) MarkInode(ino uint32) {
+	setBit(img.Data[InodeBitmap*BlockSize:], int64(ino-1), true)
+}
+
+func (img *Image[S, G, I]) UnmarkInode(ino uint32) {
+	setBit(img.Data[InodeBitmap*BlockSize:], int64(ino-1), false)
+}
+
+func setBit(b []byte, bit int64, set bool) {
+	if set {
+		b[bit/8] |= 1 << (bit % 8)
+	} else {
+		b[bit/8] &^= 1 << (bit % 8)
+	}
+}
+
+// InodeOffset returns the byte offset of inode ino.
+func (img *Image[S, G, I]) InodeOffset(ino uint32) int64 {
+	return InodeTable*BlockSize + int64(ino-1)*InodeSize
+}
+
+// SetInode writes inode ino into the inode table and marks it in use.
+func (img *Image[S, G, I]) SetInode(ino uint32, inode *I) {
+	img.Inodes[ino] = inode
+	img.MarkInode(ino)
+}
+
+func (img *Image[S, G, I]) WriteBlock(b int64, data []byte) {
+	copy(img.Data[b*BlockSize:(b+1)*BlockSize], data)
+}
+
+// NewDirBlock makes block the directory block receiving the entries added
+// to directory dir.
+func (img *Image[S, G, I]) NewDirBlock(dir uint32, block int64) {
+	d := &Dir{Block: block}
+	img.Dirs[dir] = d
+	img.dirBlocks = append(img.dirBlocks, d)
+}
+
+func (img *Image[S, G, I]) AddEntry(dir, ino uint32, name string, fileType uint8) {
+	d, ok := img.Dirs[dir]
+	if !ok {
+		img.T.Fatalf("inode %d is not a test directory", dir)
+	}
+	d.Entries = append(d.Entries, DirEntry(ino, name, fileType))
+}
+
+// AddFile creates a regular file with the given content in directory parent.
+func (img *Image[S, G, I]) AddFile(parent uint32, name string, content []byte) uint32 {
+	ino := img.NextIno
+	img.NextIno++
+
+	iblock := ExtentRoot[Extent]()
+	if n := (int64(len(content)) + BlockSize - 1) / BlockSize; n > 0 {
+		start := img.Alloc(n)
+		copy(img.Data[start*BlockSize:], content)
+		iblock = ExtentRoot(Extent{Len: uint16(n), Start: uint32(start)})
+	}
+	img.SetInode(ino, img.NewInode(modeRegular, 1, int64(len(content)), iblock))
+	img.AddEntry(parent, ino, name, 1)
+	return ino
+}
+
+// AddDir creates an empty directory in directory parent.
+func (img *Image[S, G, I]) AddDir(parent uint32, name string) uint32 {
+	ino := img.NextIno
+	img.NextIno++
+
+	block := img.Alloc(1)
+	img.NewDirBlock(ino, block)
+	img.SetInode(ino, img.NewInode(modeDir, 2, BlockSize, ExtentRoot(Extent{Len: 1, Start: uint32(block)})))
+	img.AddEntry(ino, ino, ".", 2)
+	img.AddEntry(ino, parent, "..", 2)
+	img.AddEntry(parent, ino, name, 2)
+	img.Link(parent)
+	return ino
+}
+
+// WriteTables writes out the directory blocks and the inode table.
+func (img *Image[S, G, I]) WriteTables() {
+	for _, d := range img.dirBlocks {
+		block := make([]byte, BlockSize)
+		off := 0
+		for i, e := range d.Entries {
+			copy(block[off:], e)
+			if i == len(d.Entries)-1 {
+				binary.LittleEndian.PutUint16(block[off+4:], uint16(BlockSize-off))
+			}
+			off += len(e)
+		}
+		img.WriteBlock(d.Block, block)
+	}
+	for ino, inode := range img.Inodes {
+		copy(img.Data[img.InodeOffset(ino):], Encode(inode)[:InodeSize])
+	}
+}
+
+// Bytes serializes the image, writing out directories, inodes, the group
+// descriptor and the superblock.
+func (img *Image[S, G, I]) Bytes() []byte {
+	img.WriteTables()
+	img.WriteBlock(2, Encode(img.GD)[:DescSize])
+	img.WriteBlock(1, Encode(img.SB))
+	return img.Copy()
+}
+
+// Copy returns a copy of the image as it is.
+func (img *Image[S, G, I]) Copy() []byte {
+	return append([]byte(nil), img.Data...)
+}
@@ -0,0 +1,127 @@
+package ext4
+
+import (
+	"io"
+
+	"golang.org/x/xerrors"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4/journal"
+)
+
+var (
+	ErrNoJournal = xerrors.New("filesystem has no journal")
+)
+
+// Journal opens the journal of the filesystem: the journal inode, or the
+// external journal device given with WithExternalJournal.
+func (ext4 *FileSystem) Journal() (*journal.Journal, error) {
+	if !ext4.sb.FeatureCompatHas_journal() {
+		return nil, ErrNoJournal
+	}
+	if ext4.journalDev != nil {
+		return ext4.externalJournal()
+	}
+	if ext4.sb.JournalInum == 0 {
+		return nil, xerrors.Errorf("the journal is on an external device (UUID: %x): %w", ext4.sb.JournalUUID, ErrNoJournal)
+	}
+	r, err := ext4.inodeReaderAt(int64(ext4.sb.JournalInum))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read journal inode: %w", err)
+	}
+	j, err := journal.Open(r)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open journal: %w", err)
+	}
+	return j, nil
+}
+
+// externalJournal opens the journal on the external journal device. The
+// device must be a journal device whose UUID matches the one recorded in
+// the superblock and whose users include this filesystem.
+func (ext4 *FileSystem) externalJournal() (*journal.Journal, error) {
+	sb, _, err := readSuperblockAt(ext4.journalDev, GroupZeroPadding)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read journal device super block: %w", err)
+	}
+	if !sb.FeatureIncompatJournalDev() {
+		return nil, xerrors.New("external journal is not a journal device")
+	}
+	if sb.UUID != ext4.sb.JournalUUID {
+		return nil, xerrors.Errorf("journal device UUID %x does not match the filesystem journal UUID %x", sb.UUID, ext4.sb.JournalUUID)
+	}
+
+	// The journal superblock follows the superblock of the device.
+	blockSize := sb.GetBlockSize()
+	block := int64(GroupZeroPadding+SuperBlockSize+blockSize-1) / blockSize
+	j, err := journal.OpenAt(ext4.journalDev, block*blockSize)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open external journal: %w", err)
+	}
+	jsb := j.Superblock()
+	for _, uuid := range jsb.UserUUIDs() {
+		if uuid == ext4.sb.UUID {
+			return j, nil
+		}
+	}
+	return nil, xerrors.Errorf("filesystem %x is not a user of the external journal", ext4.sb.UUID)
+}
+
+// inodeReaderAt returns an io.ReaderAt over the data of inode ino.
+func (ext4 *FileSystem) inodeReaderAt(ino int64) (*inodeReader, error) {
+	inode, err := ext4.getInode(ino)
+	if err != nil {
+		return nil, err
+	}
+	dt, err := ext4.dataTable(ino, inode)
+	if err != nil {
+		return nil, err
+	}
+	return &inodeReader{
+		r:         ext4.r,
+		table:     dt,
+		blockSize: ext4.sb.GetBlockSize(),
+		size:      inode.GetSize(),
+	}, nil
+}
+
+// inodeReader reads the data of an inode through its data table. Holes
+// read as zeros.
+type inodeReader struct {
+	r         io.ReaderAt
+	table     dataTable
+	blockSize int64
+	size      int64
+}
+
+func (ir *inodeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= ir.size {
+		return 0, io.EOF
+	}
+	var n int
+	for n < len(p) && off < ir.size {
+		block, inBlock := off/ir.blockSize, off%ir.blockSize
+		chunk := ir.blockSize - inBlock
+		if remaining := ir.size - off; chunk > remaining {
+			chunk = remaining
+		}
+		if chunk > int64(len(p)-n) {
+			chunk = int64(len(p) - n)
+		}
+		dst := p[n : n+int(chunk)]
+		if offset, ok := ir.table[block]; ok {
+			if _, err := ir.r.ReadAt(dst, offset+inBlock); err != nil {
+				return n, xerrors.Errorf("failed to read block %d: %w", block, err)
+			}
+		} else {
+			for i := range dst {
+				dst[i] = 0
+			}
+		}
+		n += int(chunk)
+		off += chunk
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
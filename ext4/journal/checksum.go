@@ -0,0 +1,101 @@
+package journal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Structure names reported by ChecksumError.
+const (
+	ChecksumSuperblock = "journal superblock"
+	ChecksumDescriptor = "descriptor block"
+	ChecksumCommit     = "commit block"
+	ChecksumRevoke     = "revoke block"
+	ChecksumData       = "data block"
+)
+
+// ChecksumError is returned when a journal structure fails verification.
+type ChecksumError struct {
+	// Structure names the kind of block, e.g. ChecksumCommit.
+	Structure string
+	// Block is the journal block holding the structure.
+	Block int64
+	// Stored is the checksum recorded in the journal and Computed the one
+	// calculated from the block's contents.
+	Stored   uint32
+	Computed uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch (block: %d): stored %#x, computed %#x",
+		e.Structure, e.Block, e.Stored, e.Computed)
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c computes the raw crc32c used by jbd2, without the pre- and
+// post-inversion applied by hash/crc32.
+func crc32c(seed uint32, b []byte) uint32 {
+	return ^crc32.Update(^seed, crc32cTable, b)
+}
+
+func crc32cUint32(seed uint32, v uint32) uint32 {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return crc32c(seed, b[:])
+}
+
+// verifyTail verifies the checksum in the tail of a descriptor or revoke
+// block.
+func (j *Journal) verifyTail(structure string, block uint32, buf []byte) error {
+	if !j.sb.hasChecksums() {
+		return nil
+	}
+	tail := len(buf) - 4
+	expected := binary.BigEndian.Uint32(buf[tail:])
+	binary.BigEndian.PutUint32(buf[tail:], 0)
+	actual := crc32c(j.csumSeed, buf)
+	binary.BigEndian.PutUint32(buf[tail:], expected)
+	if actual != expected {
+		return &ChecksumError{Structure: structure, Block: int64(block), Stored: expected, Computed: actual}
+	}
+	return nil
+}
+
+// verifyCommit verifies the checksum of a commit block.
+func (j *Journal) verifyCommit(block uint32, buf []byte) error {
+	if !j.sb.hasChecksums() {
+		return nil
+	}
+	expected := binary.BigEndian.Uint32(buf[commitChecksumOffset:])
+	binary.BigEndian.PutUint32(buf[commitChecksumOffset:], 0)
+	actual := crc32c(j.csumSeed, buf)
+	binary.BigEndian.PutUint32(buf[commitChecksumOffset:], expected)
+	if actual != expected {
+		return &ChecksumError{Structure: ChecksumCommit, Block: int64(block), Stored: expected, Computed: actual}
+	}
+	return nil
+}
+
+// dataChecksum computes the checksum of a logged block stored in its tag.
+// csum v2 tags only hold the low 16 bits.
+func (j *Journal) dataChecksum(sequence uint32, data []byte) uint32 {
+	csum := crc32c(crc32cUint32(j.csumSeed, sequence), data)
+	if !j.sb.FeatureCsumV3() {
+		csum &= 0xFFFF
+	}
+	return csum
+}
+
+// verifyData verifies the checksum of logged block b read from the journal,
+// before it is unescaped.
+func (j *Journal) verifyData(b Block, data []byte) error {
+	if !j.sb.hasChecksums() {
+		return nil
+	}
+	if actual := j.dataChecksum(b.Sequence, data); actual != b.Checksum {
+		return &ChecksumError{Structure: ChecksumData, Block: int64(b.LogBlock), Stored: b.Checksum, Computed: actual}
+	}
+	return nil
+}
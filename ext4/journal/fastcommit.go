@@ -0,0 +1,213 @@
+package journal
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+// Fast commit tags. Fast commit records are ext4 structures and, unlike the
+// rest of the journal, stored little-endian.
+const (
+	FC_TAG_ADD_RANGE = 0x1
+	FC_TAG_DEL_RANGE = 0x2
+	FC_TAG_CREAT     = 0x3
+	FC_TAG_LINK      = 0x4
+	FC_TAG_UNLINK    = 0x5
+	FC_TAG_INODE     = 0x6
+	FC_TAG_PAD       = 0x7
+	FC_TAG_TAIL      = 0x8
+	FC_TAG_HEAD      = 0x9
+)
+
+const (
+	// defaultFcBlocks is the size of the fast commit area when the
+	// superblock does not record it.
+	defaultFcBlocks = 256
+	// fcTagSize is the size of the tag and length preceding every value.
+	fcTagSize = 4
+	// fcDentryInfoSize and fcInodeSize are the sizes of the fields that
+	// precede the name of a directory entry record and the raw inode of an
+	// inode record.
+	fcDentryInfoSize = 8
+	fcInodeSize      = 4
+	// fcMaxNameLen is the longest name of a directory entry.
+	fcMaxNameLen = 255
+	// fcMinInodeSize is the size of the inodes of revision 0 filesystems,
+	// the shortest valid logged inode.
+	fcMinInodeSize = 128
+	// fcSupportedFeatures are the features of the fast commit head that
+	// are understood. None are defined yet.
+	fcSupportedFeatures = 0
+)
+
+// FastCommitRecord is a record of a fast commit. Only the fields of its tag
+// are set.
+type FastCommitRecord struct {
+	// Tag is one of FC_TAG_ADD_RANGE, FC_TAG_DEL_RANGE, FC_TAG_CREAT,
+	// FC_TAG_LINK, FC_TAG_UNLINK and FC_TAG_INODE.
+	Tag uint16
+	// Ino is the inode the record applies to. For the directory entry
+	// tags it is the inode the entry refers to.
+	Ino uint32
+
+	// Parent and Name are the directory and name of a directory entry
+	// created, linked or unlinked.
+	Parent uint32
+	Name   string
+
+	// LogicalBlock and Len are the range of file blocks mapped or
+	// unmapped. Start is the first filesystem block of a mapped range.
+	LogicalBlock  uint32
+	Len           uint32
+	Start         uint64
+	Uninitialized bool
+
+	// Inode is the raw on-disk inode of FC_TAG_INODE.
+	Inode []byte
+}
+
+// FastCommit is a fast commit: the records up to a valid tail.
+type FastCommit struct {
+	// TID is the transaction the fast commit follows up, the one after
+	// the last full commit.
+	TID     uint32
+	Records []FastCommitRecord
+}
+
+// fcBlocks returns the number of blocks reserved at the end of the journal
+// for fast commits.
+func (j *Journal) fcBlocks() uint32 {
+	if !j.sb.FeatureFastCommit() {
+		return 0
+	}
+	if j.sb.NumFcBlocks != 0 {
+		return j.sb.NumFcBlocks
+	}
+	return defaultFcBlocks
+}
+
+// FastCommits returns the fast commits that recovery would replay after the
+// committed transactions, oldest first. As in the kernel, decoding stops at
+// the first record that is malformed or not followed by a tail with the
+// expected transaction and checksum; the records after the last valid tail
+// are dropped. It returns nothing when the journal is clean. inodeSize is
+// the inode size of the filesystem, the size of the largest logged inode.
+func (j *Journal) FastCommits(inodeSize int) ([]FastCommit, error) {
+	if !j.NeedsRecovery() || !j.sb.FeatureFastCommit() {
+		return nil, nil
+	}
+	txs, err := j.Transactions()
+	if err != nil {
+		return nil, err
+	}
+	tid := j.sb.Sequence
+	if len(txs) > 0 {
+		tid = txs[len(txs)-1].Sequence + 1
+	}
+
+	var (
+		fcs     []FastCommit
+		records []FastCommitRecord
+		crc     uint32
+	)
+	for block := j.logEnd() + 1; block < j.sb.MaxLen; block++ {
+		buf, err := j.readBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		if block == j.logEnd()+1 && binary.LittleEndian.Uint16(buf) != FC_TAG_HEAD {
+			return nil, nil
+		}
+
+		for off := 0; off+fcTagSize <= len(buf); {
+			tag := binary.LittleEndian.Uint16(buf[off:])
+			length := int(binary.LittleEndian.Uint16(buf[off+2:]))
+			end := off + fcTagSize + length
+			if end > len(buf) || !fcValueLenValid(tag, length, inodeSize) {
+				return fcs, nil
+			}
+			value := buf[off+fcTagSize : end]
+
+			switch tag {
+			case FC_TAG_TAIL:
+				crc = crc32c(crc, buf[off:off+fcTagSize+4])
+				if binary.LittleEndian.Uint32(value) != tid || binary.LittleEndian.Uint32(value[4:]) != crc {
+					return fcs, nil
+				}
+				fcs = append(fcs, FastCommit{TID: tid, Records: records})
+				records = nil
+				crc = 0
+			case FC_TAG_HEAD:
+				if binary.LittleEndian.Uint32(value)&^fcSupportedFeatures != 0 {
+					return nil, xerrors.Errorf("unsupported fast commit features: %#x", binary.LittleEndian.Uint32(value))
+				}
+				if binary.LittleEndian.Uint32(value[4:]) != tid {
+					return fcs, nil
+				}
+				crc = crc32c(crc, buf[off:end])
+			case FC_TAG_PAD:
+				crc = crc32c(crc, buf[off:end])
+			default:
+				records = append(records, parseFastCommitRecord(tag, value))
+				crc = crc32c(crc, buf[off:end])
+			}
+			off = end
+		}
+	}
+	return fcs, nil
+}
+
+// fcValueLenValid reports whether length is a valid value length for tag,
+// as ext4_fc_value_len_isvalid does. Unknown tags are invalid.
+func fcValueLenValid(tag uint16, length, inodeSize int) bool {
+	switch tag {
+	case FC_TAG_ADD_RANGE:
+		return length == 16
+	case FC_TAG_DEL_RANGE:
+		return length == 12
+	case FC_TAG_CREAT, FC_TAG_LINK, FC_TAG_UNLINK:
+		return length > fcDentryInfoSize && length <= fcDentryInfoSize+fcMaxNameLen
+	case FC_TAG_INODE:
+		return length >= fcInodeSize+fcMinInodeSize && length <= fcInodeSize+inodeSize
+	case FC_TAG_PAD:
+		return true
+	case FC_TAG_TAIL:
+		return length >= 8
+	case FC_TAG_HEAD:
+		return length == 8
+	}
+	return false
+}
+
+// parseFastCommitRecord decodes the value of a record whose length has been
+// validated.
+func parseFastCommitRecord(tag uint16, value []byte) FastCommitRecord {
+	le := binary.LittleEndian
+	r := FastCommitRecord{Tag: tag}
+	switch tag {
+	case FC_TAG_ADD_RANGE:
+		// The value is the inode followed by an ext4_extent.
+		r.Ino = le.Uint32(value)
+		r.LogicalBlock = le.Uint32(value[4:])
+		length := le.Uint16(value[8:])
+		if length > 0x8000 {
+			r.Uninitialized = true
+			length -= 0x8000
+		}
+		r.Len = uint32(length)
+		r.Start = uint64(le.Uint16(value[10:]))<<32 | uint64(le.Uint32(value[12:]))
+	case FC_TAG_DEL_RANGE:
+		r.Ino = le.Uint32(value)
+		r.LogicalBlock = le.Uint32(value[4:])
+		r.Len = le.Uint32(value[8:])
+	case FC_TAG_CREAT, FC_TAG_LINK, FC_TAG_UNLINK:
+		r.Parent = le.Uint32(value)
+		r.Ino = le.Uint32(value[4:])
+		r.Name = string(value[8:])
+	case FC_TAG_INODE:
+		r.Ino = le.Uint32(value)
+		r.Inode = append([]byte(nil), value[4:]...)
+	}
+	return r
+}
@@ -0,0 +1,200 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testFcBlocks = 8
+
+// fcWriter appends fast commit records to the fast commit area of a test
+// journal.
+type fcWriter struct {
+	tj    *testJournal
+	block uint32
+	off   int
+	crc   uint32
+}
+
+func newFcWriter(tj *testJournal) *fcWriter {
+	tj.sb.FeatureIncompat |= FEATURE_INCOMPAT_FAST_COMMIT
+	tj.sb.NumFcBlocks = testFcBlocks
+	tj.j.sb = tj.sb
+	return &fcWriter{tj: tj, block: testMaxLen - testFcBlocks + 1}
+}
+
+func (w *fcWriter) add(tag uint16, value []byte) {
+	if w.off+fcTagSize+len(value) > testBlockSize {
+		w.block++
+		w.off = 0
+	}
+	b := w.tj.block(w.block)[w.off:]
+	binary.LittleEndian.PutUint16(b, tag)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(value)))
+	copy(b[fcTagSize:], value)
+	w.crc = crc32c(w.crc, b[:fcTagSize+len(value)])
+	w.off += fcTagSize + len(value)
+}
+
+func (w *fcWriter) head(tid uint32) {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint32(value[4:], tid)
+	w.add(FC_TAG_HEAD, value)
+}
+
+// tail ends the fast commit, padding the rest of the block. corrupt stores
+// a wrong checksum.
+func (w *fcWriter) tail(tid uint32, corrupt bool) {
+	b := w.tj.block(w.block)[w.off:]
+	binary.LittleEndian.PutUint16(b, FC_TAG_TAIL)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(b)-fcTagSize))
+	binary.LittleEndian.PutUint32(b[fcTagSize:], tid)
+	crc := crc32c(w.crc, b[:fcTagSize+4])
+	if corrupt {
+		crc++
+	}
+	binary.LittleEndian.PutUint32(b[fcTagSize+4:], crc)
+	w.block++
+	w.off = 0
+	w.crc = 0
+}
+
+func fcValue(fields ...any) []byte {
+	buf := &bytes.Buffer{}
+	for _, f := range fields {
+		binary.Write(buf, binary.LittleEndian, f)
+	}
+	return buf.Bytes()
+}
+
+func TestFastCommits(t *testing.T) {
+	rawInode := bytes.Repeat([]byte{'i'}, 256)
+	want := []FastCommit{
+		{TID: 11, Records: []FastCommitRecord{
+			{Tag: FC_TAG_ADD_RANGE, Ino: 12, LogicalBlock: 7, Len: 3, Start: 1<<32 | 500, Uninitialized: true},
+			{Tag: FC_TAG_INODE, Ino: 12, Inode: rawInode},
+		}},
+		{TID: 11, Records: []FastCommitRecord{
+			{Tag: FC_TAG_CREAT, Parent: 2, Ino: 12, Name: "new"},
+			{Tag: FC_TAG_DEL_RANGE, Ino: 13, LogicalBlock: 4, Len: 2},
+			{Tag: FC_TAG_UNLINK, Parent: 2, Ino: 13, Name: "old"},
+		}},
+	}
+
+	write := func(tj *testJournal, headTID uint32) {
+		w := newFcWriter(tj)
+		tj.logBlocks(10, []uint64{100}, [][]byte{fill('a')})
+		tj.commit(10, time.Unix(1700000000, 0))
+
+		w.head(headTID)
+		w.add(FC_TAG_ADD_RANGE, fcValue(uint32(12), uint32(7), uint16(0x8000+3), uint16(1), uint32(500)))
+		w.add(FC_TAG_INODE, append(fcValue(uint32(12)), rawInode...))
+		w.tail(11, false)
+		w.add(FC_TAG_CREAT, append(fcValue(uint32(2), uint32(12)), "new"...))
+		w.add(FC_TAG_DEL_RANGE, fcValue(uint32(13), uint32(4), uint32(2)))
+		w.add(FC_TAG_PAD, make([]byte, 10))
+		w.add(FC_TAG_UNLINK, append(fcValue(uint32(2), uint32(13)), "old"...))
+		w.tail(11, false)
+		// The records of a fast commit without a valid tail are dropped.
+		w.add(FC_TAG_LINK, append(fcValue(uint32(2), uint32(14)), "lost"...))
+		w.tail(11, true)
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		tj := newTestJournal(t, FEATURE_INCOMPAT_CSUM_V3)
+		write(tj, 11)
+		fcs, err := tj.open().FastCommits(256)
+		if err != nil {
+			t.Fatalf("FastCommits() error: %v", err)
+		}
+		if !reflect.DeepEqual(fcs, want) {
+			t.Errorf("FastCommits() = %+v, want %+v", fcs, want)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		tj := newTestJournal(t, 0)
+		// Fast commits following up an older transaction.
+		write(tj, 10)
+		fcs, err := tj.open().FastCommits(256)
+		if err != nil || len(fcs) != 0 {
+			t.Errorf("FastCommits() = %+v, %v, want none", fcs, err)
+		}
+	})
+
+	t.Run("clean", func(t *testing.T) {
+		tj := newTestJournal(t, 0)
+		write(tj, 11)
+		tj.sb.Start = 0
+		fcs, err := tj.open().FastCommits(256)
+		if err != nil || len(fcs) != 0 {
+			t.Errorf("FastCommits() = %+v, %v, want none", fcs, err)
+		}
+	})
+}
+
+func TestFastCommitValueLen(t *testing.T) {
+	const inodeSize = 256
+	tests := []struct {
+		tag    uint16
+		length int
+		want   bool
+	}{
+		{FC_TAG_CREAT, fcDentryInfoSize, false},
+		{FC_TAG_CREAT, fcDentryInfoSize + 1, true},
+		{FC_TAG_LINK, fcDentryInfoSize + 255, true},
+		{FC_TAG_UNLINK, fcDentryInfoSize + 256, false},
+		{FC_TAG_INODE, fcInodeSize + 127, false},
+		{FC_TAG_INODE, fcInodeSize + 128, true},
+		{FC_TAG_INODE, fcInodeSize + inodeSize, true},
+		{FC_TAG_INODE, fcInodeSize + inodeSize + 1, false},
+		{FC_TAG_ADD_RANGE, 16, true},
+		{FC_TAG_DEL_RANGE, 16, false},
+		{0xFF, 8, false},
+	}
+	for _, tt := range tests {
+		if got := fcValueLenValid(tt.tag, tt.length, inodeSize); got != tt.want {
+			t.Errorf("fcValueLenValid(%d, %d) = %v, want %v", tt.tag, tt.length, got, tt.want)
+		}
+	}
+
+	// Decoding stops at a name longer than 255 bytes.
+	tj := newTestJournal(t, 0)
+	w := newFcWriter(tj)
+	tj.logBlocks(10, []uint64{100}, [][]byte{fill('a')})
+	tj.commit(10, time.Unix(1700000000, 0))
+	w.head(11)
+	w.add(FC_TAG_CREAT, append(fcValue(uint32(2), uint32(12)), "short"...))
+	w.tail(11, false)
+	w.add(FC_TAG_CREAT, append(fcValue(uint32(2), uint32(13)), bytes.Repeat([]byte{'n'}, 256)...))
+	w.tail(11, false)
+	fcs, err := tj.open().FastCommits(inodeSize)
+	if err != nil {
+		t.Fatalf("FastCommits() error: %v", err)
+	}
+	want := []FastCommit{{TID: 11, Records: []FastCommitRecord{{Tag: FC_TAG_CREAT, Parent: 2, Ino: 12, Name: "short"}}}}
+	if !reflect.DeepEqual(fcs, want) {
+		t.Errorf("FastCommits() = %+v, want %+v", fcs, want)
+	}
+}
+
+func TestFastCommitLogEnd(t *testing.T) {
+	tj := newTestJournal(t, 0)
+	newFcWriter(tj)
+	tj.sb.Start = testMaxLen - testFcBlocks - 1
+	tj.next = tj.sb.Start
+	tj.logBlocks(10, []uint64{100}, [][]byte{fill('a')})
+	tj.commit(10, time.Unix(1700000000, 0))
+
+	txs, err := tj.open().Transactions()
+	if err != nil {
+		t.Fatalf("Transactions() error: %v", err)
+	}
+	// The log wraps before the fast commit area.
+	if len(txs) != 1 || txs[0].CommitBlock != 2 {
+		t.Errorf("Transactions() = %+v, want one transaction committed in block 2", txs)
+	}
+}
@@ -0,0 +1,154 @@
+package journal
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// historyDescriptor is a descriptor block found by History.
+type historyDescriptor struct {
+	block uint32
+	tags  []Block
+}
+
+// History returns every transaction with a descriptor, revoke or commit
+// block still found in the log, oldest first: the transactions recovery
+// would replay as well as the older ones left behind after they were
+// checkpointed. It works on clean journals too.
+//
+// A transaction whose commit block is gone has a zero CommitBlock and may
+// be incomplete. Logged blocks that a later transaction has since
+// overwritten in the log are left out.
+func (j *Journal) History() ([]Transaction, error) {
+	var (
+		descriptors = map[uint32][]historyDescriptor{}
+		revoked     = map[uint32][]uint64{}
+		commits     = map[uint32]Transaction{}
+		// claims holds the log blocks written by each transaction and
+		// owner the latest transaction that wrote each log block.
+		claims = map[uint32]map[uint32]bool{}
+		owner  = map[uint32]uint32{}
+	)
+	claim := func(seq, block uint32) {
+		if claims[seq] == nil {
+			claims[seq] = map[uint32]bool{}
+		}
+		claims[seq][block] = true
+		if s, ok := owner[block]; !ok || tidGeq(seq, s) {
+			owner[block] = seq
+		}
+	}
+
+	for block := j.sb.First; block < j.logEnd(); block++ {
+		buf, err := j.readBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(buf[0:]) != Magic {
+			continue
+		}
+		seq := binary.BigEndian.Uint32(buf[8:])
+
+		switch binary.BigEndian.Uint32(buf[4:]) {
+		case BlockTypeDescriptor:
+			if err := j.verifyTail(ChecksumDescriptor, block, buf); err != nil {
+				continue
+			}
+			d := historyDescriptor{block: block, tags: j.parseTags(buf)}
+			claim(seq, block)
+			logBlock := block
+			for i := range d.tags {
+				logBlock = j.next(logBlock)
+				d.tags[i].Sequence = seq
+				d.tags[i].LogBlock = logBlock
+				claim(seq, logBlock)
+			}
+			descriptors[seq] = append(descriptors[seq], d)
+		case BlockTypeCommit:
+			if err := j.verifyCommit(block, buf); err != nil {
+				continue
+			}
+			tx := Transaction{CommitBlock: block}
+			if sec := binary.BigEndian.Uint64(buf[commitSecOffset:]); sec != 0 {
+				tx.CommitTime = time.Unix(int64(sec), int64(binary.BigEndian.Uint32(buf[commitNsecOffset:])))
+			}
+			commits[seq] = tx
+			claim(seq, block)
+		case BlockTypeRevoke:
+			if err := j.verifyTail(ChecksumRevoke, block, buf); err != nil {
+				continue
+			}
+			revoked[seq] = append(revoked[seq], j.parseRevoke(buf)...)
+			claim(seq, block)
+		}
+	}
+
+	var txs []Transaction
+	for seq, blocks := range claims {
+		tx := commits[seq]
+		tx.Sequence = seq
+		tx.Revoked = revoked[seq]
+		tx.StartBlock = j.startBlock(blocks)
+
+		ds := descriptors[seq]
+		sort.Slice(ds, func(a, b int) bool {
+			return j.distance(tx.StartBlock, ds[a].block) < j.distance(tx.StartBlock, ds[b].block)
+		})
+		for _, d := range ds {
+			for _, tag := range d.tags {
+				if owner[tag.LogBlock] == seq {
+					tx.Blocks = append(tx.Blocks, tag)
+				}
+			}
+		}
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(a, b int) bool {
+		return !tidGeq(txs[a].Sequence, txs[b].Sequence)
+	})
+	return txs, nil
+}
+
+// startBlock returns the first log block of a transaction that wrote
+// blocks. The blocks of a transaction are contiguous in the log, so it
+// starts at a block not preceded by one of its own. When a lost descriptor
+// leaves a gap there are several such blocks, and the start is the one the
+// other blocks follow most closely. Ties go to the lowest block.
+func (j *Journal) startBlock(blocks map[uint32]bool) uint32 {
+	start, span := j.sb.First, uint32(0)
+	found := false
+	for block := range blocks {
+		if blocks[j.prev(block)] {
+			continue
+		}
+		var s uint32
+		for b := range blocks {
+			if d := j.distance(block, b); d > s {
+				s = d
+			}
+		}
+		if !found || s < span || s == span && block < start {
+			start, span, found = block, s, true
+		}
+	}
+	return start
+}
+
+// prev returns the log block preceding block, wrapping around at the start
+// of the log.
+func (j *Journal) prev(block uint32) uint32 {
+	if block <= j.sb.First {
+		return j.logEnd() - 1
+	}
+	return block - 1
+}
+
+// distance returns the number of log blocks from block from to block to,
+// following the log.
+func (j *Journal) distance(from, to uint32) uint32 {
+	if to >= from {
+		return to - from
+	}
+	return j.logEnd() - from + to - j.sb.First
+}
@@ -0,0 +1,89 @@
+package journal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	when := time.Unix(1700000000, 0)
+	tj := newTestJournal(t, FEATURE_INCOMPAT_CSUM_V3)
+	// Transaction 10 is overwritten entirely by transaction 20, which
+	// wraps around the end of the log.
+	tj.logBlocks(10, []uint64{100}, [][]byte{fill('a')})
+	tj.commit(10, when)
+	tj.next = testMaxLen - 2
+	tj.logBlocks(20, []uint64{200, 201, 202}, [][]byte{fill('b'), fill('c'), fill('d')})
+	tj.commit(20, when)
+	// After a remount the log restarts from its first block, overwriting
+	// the wrapped part of transaction 20.
+	tj.next = 1
+	tj.revoke(21, []uint64{202})
+	tj.logBlocks(21, []uint64{300}, [][]byte{fill('e')})
+	tj.commit(21, when)
+	tj.sb.Start = 0
+
+	j := tj.open()
+	txs, err := j.History()
+	if err != nil {
+		t.Fatalf("History() error: %v", err)
+	}
+	if len(txs) != 2 {
+		t.Fatalf("got %d transactions, want 2", len(txs))
+	}
+
+	old := txs[0]
+	if old.Sequence != 20 || old.StartBlock != testMaxLen-2 || old.CommitBlock != 0 {
+		t.Errorf("transaction = %d at %d..%d, want 20 at %d without a commit block", old.Sequence, old.StartBlock, old.CommitBlock, testMaxLen-2)
+	}
+	if len(old.Blocks) != 1 || old.Blocks[0].Target != 200 {
+		t.Fatalf("Blocks = %+v, want only the block of 200 that was not overwritten", old.Blocks)
+	}
+	data, err := j.ReadBlock(old.Blocks[0])
+	if err != nil {
+		t.Fatalf("ReadBlock() error: %v", err)
+	}
+	if !bytes.Equal(data, fill('b')) {
+		t.Error("ReadBlock() returned the wrong data")
+	}
+
+	latest := txs[1]
+	if latest.Sequence != 21 || latest.StartBlock != 1 || latest.CommitBlock != 4 || !latest.CommitTime.Equal(when) {
+		t.Errorf("transaction = %d at %d..%d (%v), want 21 at 1..4", latest.Sequence, latest.StartBlock, latest.CommitBlock, latest.CommitTime)
+	}
+	if len(latest.Blocks) != 1 || latest.Blocks[0].Target != 300 || latest.Blocks[0].LogBlock != 3 {
+		t.Errorf("Blocks = %+v, want 300 in log block 3", latest.Blocks)
+	}
+	if len(latest.Revoked) != 1 || latest.Revoked[0] != 202 {
+		t.Errorf("Revoked = %v, want [202]", latest.Revoked)
+	}
+}
+
+func TestHistoryStartBlock(t *testing.T) {
+	when := time.Unix(1700000000, 0)
+	tj := newTestJournal(t, 0)
+	// Transaction 20 has two descriptors and wraps around the end of the
+	// log. Its second descriptor is overwritten by transaction 21, which
+	// leaves blocks at both ends of the log without a predecessor.
+	tj.next = testMaxLen - 3
+	tj.logBlocks(20, []uint64{200}, [][]byte{fill('a')})
+	tj.logBlocks(20, []uint64{201}, [][]byte{fill('b')})
+	tj.commit(20, when)
+	tj.next = testMaxLen - 1
+	tj.commit(21, when)
+	tj.sb.Start = 0
+
+	for i := 0; i < 10; i++ {
+		txs, err := tj.open().History()
+		if err != nil {
+			t.Fatalf("History() error: %v", err)
+		}
+		if len(txs) != 2 || txs[0].Sequence != 20 {
+			t.Fatalf("History() = %+v, want transactions 20 and 21", txs)
+		}
+		if got := txs[0].StartBlock; got != testMaxLen-3 {
+			t.Fatalf("StartBlock = %d, want %d", got, testMaxLen-3)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Package journal decodes the jbd2 journal used by ext3 and ext4.
+//
+// All structures of the journal are stored big-endian. Block numbers inside
+// the journal are relative to the start of the journal: block n is read at
+// byte offset n * block size of the reader given to Open.
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// Magic is the magic number at the start of every journal metadata block.
+const Magic = 0xC03B3998
+
+// Block types.
+const (
+	BlockTypeDescriptor   = 1
+	BlockTypeCommit       = 2
+	BlockTypeSuperblockV1 = 3
+	BlockTypeSuperblockV2 = 4
+	BlockTypeRevoke       = 5
+)
+
+// Journal features.
+const (
+	FEATURE_COMPAT_CHECKSUM = 0x1
+
+	FEATURE_INCOMPAT_REVOKE       = 0x1
+	FEATURE_INCOMPAT_64BIT        = 0x2
+	FEATURE_INCOMPAT_ASYNC_COMMIT = 0x4
+	FEATURE_INCOMPAT_CSUM_V2      = 0x8
+	FEATURE_INCOMPAT_CSUM_V3      = 0x10
+	FEATURE_INCOMPAT_FAST_COMMIT  = 0x20
+
+	featureIncompatSupported = FEATURE_INCOMPAT_REVOKE | FEATURE_INCOMPAT_64BIT |
+		FEATURE_INCOMPAT_ASYNC_COMMIT | FEATURE_INCOMPAT_CSUM_V2 | FEATURE_INCOMPAT_CSUM_V3 |
+		FEATURE_INCOMPAT_FAST_COMMIT
+)
+
+// Descriptor block tag flags.
+const (
+	TAG_FLAG_ESCAPE    = 0x1
+	TAG_FLAG_SAME_UUID = 0x2
+	TAG_FLAG_DELETED   = 0x4
+	TAG_FLAG_LAST_TAG  = 0x8
+)
+
+const (
+	superblockSize = 0x400
+	// checksumTypeCrc32c is the only superblock checksum type of csum v2/v3.
+	checksumTypeCrc32c = 4
+)
+
+// Header starts every journal metadata block.
+type Header struct {
+	Magic     uint32
+	BlockType uint32
+	Sequence  uint32
+}
+
+// Superblock is the jbd2 superblock, version 1 or 2. The fields past
+// ErrNo are only meaningful in version 2.
+type Superblock struct {
+	Header    Header
+	BlockSize uint32
+	// MaxLen is the total number of blocks of the journal.
+	MaxLen uint32
+	// First is the first block of the log.
+	First uint32
+	// Sequence is the first transaction expected in the log.
+	Sequence uint32
+	// Start is the block of the first transaction in the log. Zero means
+	// the journal is clean.
+	Start uint32
+	ErrNo int32
+
+	FeatureCompat   uint32
+	FeatureIncompat uint32
+	FeatureRoCompat uint32
+	UUID            [16]byte
+	NrUsers         uint32
+	DynSuper        uint32
+	MaxTransaction  uint32
+	MaxTransData    uint32
+	ChecksumType    uint8
+	Padding2        [3]uint8
+	NumFcBlocks     uint32
+	Head            uint32
+	Padding         [40]uint32
+	Checksum        uint32
+	Users           [16 * 48]byte
+}
+
+func (sb *Superblock) hasIncompat(feature uint32) bool {
+	return sb.Header.BlockType == BlockTypeSuperblockV2 && sb.FeatureIncompat&feature != 0
+}
+
+// Feature64bit reports whether block numbers are 64 bit.
+func (sb *Superblock) Feature64bit() bool {
+	return sb.hasIncompat(FEATURE_INCOMPAT_64BIT)
+}
+
+// FeatureCsumV2 reports whether metadata blocks carry csum v2 checksums.
+func (sb *Superblock) FeatureCsumV2() bool {
+	return sb.hasIncompat(FEATURE_INCOMPAT_CSUM_V2)
+}
+
+// FeatureCsumV3 reports whether metadata blocks carry csum v3 checksums.
+func (sb *Superblock) FeatureCsumV3() bool {
+	return sb.hasIncompat(FEATURE_INCOMPAT_CSUM_V3)
+}
+
+// FeatureFastCommit reports whether the journal has a fast commit area.
+func (sb *Superblock) FeatureFastCommit() bool {
+	return sb.hasIncompat(FEATURE_INCOMPAT_FAST_COMMIT)
+}
+
+// UserUUIDs returns the UUIDs of the filesystems sharing the journal. It
+// is only meaningful for an external journal.
+func (sb *Superblock) UserUUIDs() [][16]byte {
+	n := int(sb.NrUsers)
+	if max := len(sb.Users) / 16; n > max {
+		n = max
+	}
+	uuids := make([][16]byte, n)
+	for i := range uuids {
+		copy(uuids[i][:], sb.Users[i*16:])
+	}
+	return uuids
+}
+
+func (sb *Superblock) hasChecksums() bool {
+	return sb.FeatureCsumV2() || sb.FeatureCsumV3()
+}
+
+// Journal is a jbd2 journal.
+type Journal struct {
+	r         io.ReaderAt
+	sb        Superblock
+	blockSize int64
+	csumSeed  uint32
+}
+
+// Open reads the journal whose superblock is block 0 of r.
+func Open(r io.ReaderAt) (*Journal, error) {
+	return OpenAt(r, 0)
+}
+
+// OpenAt reads the journal whose superblock is at byte offset off of r, as
+// on an external journal device. Journal block numbers stay relative to the
+// start of r.
+func OpenAt(r io.ReaderAt, off int64) (*Journal, error) {
+	raw := make([]byte, superblockSize)
+	if _, err := r.ReadAt(raw, off); err != nil {
+		return nil, xerrors.Errorf("failed to read journal super block: %w", err)
+	}
+	var sb Superblock
+	if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, &sb); err != nil {
+		return nil, xerrors.Errorf("failed to binary read journal super block: %w", err)
+	}
+	if sb.Header.Magic != Magic {
+		return nil, xerrors.Errorf("invalid journal magic: %#x", sb.Header.Magic)
+	}
+	switch sb.Header.BlockType {
+	case BlockTypeSuperblockV1, BlockTypeSuperblockV2:
+	default:
+		return nil, xerrors.Errorf("invalid journal super block type: %d", sb.Header.BlockType)
+	}
+	if sb.BlockSize < 1024 || sb.BlockSize > 65536 || sb.BlockSize&(sb.BlockSize-1) != 0 {
+		return nil, xerrors.Errorf("invalid journal block size: %d", sb.BlockSize)
+	}
+	if sb.First == 0 || sb.First >= sb.MaxLen {
+		return nil, xerrors.Errorf("invalid journal log start %d (length %d)", sb.First, sb.MaxLen)
+	}
+	if sb.Header.BlockType == BlockTypeSuperblockV2 {
+		if unknown := sb.FeatureIncompat &^ featureIncompatSupported; unknown != 0 {
+			return nil, xerrors.Errorf("unsupported journal features: %#x", unknown)
+		}
+	}
+
+	j := &Journal{
+		r:         r,
+		sb:        sb,
+		blockSize: int64(sb.BlockSize),
+	}
+	if j.fcBlocks() >= sb.MaxLen-sb.First {
+		return nil, xerrors.Errorf("fast commit area of %d blocks leaves no log (length %d)", j.fcBlocks(), sb.MaxLen)
+	}
+	if sb.hasChecksums() {
+		if sb.ChecksumType != checksumTypeCrc32c {
+			return nil, xerrors.Errorf("unsupported journal checksum type: %d", sb.ChecksumType)
+		}
+		binary.BigEndian.PutUint32(raw[0xFC:], 0)
+		if actual := crc32c(^uint32(0), raw); actual != sb.Checksum {
+			return nil, &ChecksumError{Structure: ChecksumSuperblock, Block: off / j.blockSize, Stored: sb.Checksum, Computed: actual}
+		}
+		j.csumSeed = crc32c(^uint32(0), sb.UUID[:])
+	}
+	return j, nil
+}
+
+// Superblock returns the journal superblock.
+func (j *Journal) Superblock() Superblock {
+	return j.sb
+}
+
+// BlockSize returns the journal block size.
+func (j *Journal) BlockSize() int64 {
+	return j.blockSize
+}
+
+// NeedsRecovery reports whether the log holds transactions that have not
+// been checkpointed to the filesystem.
+func (j *Journal) NeedsRecovery() bool {
+	return j.sb.Start != 0
+}
+
+// readBlock reads journal block n.
+func (j *Journal) readBlock(n uint32) ([]byte, error) {
+	buf := make([]byte, j.blockSize)
+	if _, err := j.r.ReadAt(buf, int64(n)*j.blockSize); err != nil {
+		return nil, xerrors.Errorf("failed to read journal block %d: %w", n, err)
+	}
+	return buf, nil
+}
+
+// logEnd returns the block past the end of the log. With fast commits, the
+// fast commit area follows it.
+func (j *Journal) logEnd() uint32 {
+	return j.sb.MaxLen - j.fcBlocks()
+}
+
+// next returns the log block following block, wrapping around at the end
+// of the log.
+func (j *Journal) next(block uint32) uint32 {
+	block++
+	if block >= j.logEnd() {
+		block = j.sb.First
+	}
+	return block
+}
@@ -0,0 +1,329 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	testBlockSize = 1024
+	testMaxLen    = 64
+)
+
+// testJournal builds a journal image block by block.
+type testJournal struct {
+	t    *testing.T
+	data []byte
+	sb   Superblock
+	j    *Journal
+	// next is the next free log block.
+	next uint32
+}
+
+func newTestJournal(t *testing.T, incompat uint32) *testJournal {
+	tj := &testJournal{
+		t:    t,
+		data: make([]byte, testMaxLen*testBlockSize),
+		next: 1,
+	}
+	tj.sb = Superblock{
+		Header:          Header{Magic: Magic, BlockType: BlockTypeSuperblockV2},
+		BlockSize:       testBlockSize,
+		MaxLen:          testMaxLen,
+		First:           1,
+		Sequence:        10,
+		Start:           1,
+		FeatureIncompat: incompat | FEATURE_INCOMPAT_REVOKE,
+		UUID:            [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		NrUsers:         1,
+	}
+	if tj.sb.hasChecksums() {
+		tj.sb.ChecksumType = checksumTypeCrc32c
+	}
+	tj.j = &Journal{sb: tj.sb, blockSize: testBlockSize}
+	tj.j.csumSeed = crc32c(^uint32(0), tj.sb.UUID[:])
+	return tj
+}
+
+func (tj *testJournal) block(n uint32) []byte {
+	return tj.data[n*testBlockSize : (n+1)*testBlockSize]
+}
+
+func (tj *testJournal) alloc() uint32 {
+	n := tj.next
+	tj.next = tj.j.next(tj.next)
+	return n
+}
+
+func putHeader(b []byte, blockType, seq uint32) {
+	binary.BigEndian.PutUint32(b[0:], Magic)
+	binary.BigEndian.PutUint32(b[4:], blockType)
+	binary.BigEndian.PutUint32(b[8:], seq)
+}
+
+func (tj *testJournal) putTail(b []byte) {
+	if tj.sb.hasChecksums() {
+		binary.BigEndian.PutUint32(b[len(b)-4:], 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], crc32c(tj.j.csumSeed, b))
+	}
+}
+
+// logBlocks writes a descriptor block followed by one data block for each
+// target.
+func (tj *testJournal) logBlocks(seq uint32, targets []uint64, data [][]byte) {
+	desc := tj.block(tj.alloc())
+	putHeader(desc, BlockTypeDescriptor, seq)
+	off := 12
+	for i, target := range targets {
+		b := append([]byte(nil), data[i]...)
+		var flags uint32
+		if binary.BigEndian.Uint32(b) == Magic {
+			flags |= TAG_FLAG_ESCAPE
+			binary.BigEndian.PutUint32(b, 0)
+		}
+		if i > 0 {
+			flags |= TAG_FLAG_SAME_UUID
+		}
+		if i == len(targets)-1 {
+			flags |= TAG_FLAG_LAST_TAG
+		}
+		csum := tj.j.dataChecksum(seq, b)
+		if tj.sb.FeatureCsumV3() {
+			binary.BigEndian.PutUint32(desc[off:], uint32(target))
+			binary.BigEndian.PutUint32(desc[off+4:], flags)
+			binary.BigEndian.PutUint32(desc[off+8:], uint32(target>>32))
+			binary.BigEndian.PutUint32(desc[off+12:], csum)
+		} else {
+			binary.BigEndian.PutUint32(desc[off:], uint32(target))
+			binary.BigEndian.PutUint16(desc[off+4:], uint16(csum))
+			binary.BigEndian.PutUint16(desc[off+6:], uint16(flags))
+			if tj.sb.Feature64bit() {
+				binary.BigEndian.PutUint32(desc[off+8:], uint32(target>>32))
+			}
+		}
+		off += tj.j.tagSize()
+		if flags&TAG_FLAG_SAME_UUID == 0 {
+			copy(desc[off:], tj.sb.UUID[:])
+			off += 16
+		}
+		copy(tj.block(tj.alloc()), b)
+	}
+	tj.putTail(desc)
+}
+
+func (tj *testJournal) revoke(seq uint32, targets []uint64) {
+	b := tj.block(tj.alloc())
+	putHeader(b, BlockTypeRevoke, seq)
+	off := 16
+	for _, target := range targets {
+		if tj.sb.Feature64bit() {
+			binary.BigEndian.PutUint64(b[off:], target)
+			off += 8
+		} else {
+			binary.BigEndian.PutUint32(b[off:], uint32(target))
+			off += 4
+		}
+	}
+	binary.BigEndian.PutUint32(b[12:], uint32(off))
+	tj.putTail(b)
+}
+
+func (tj *testJournal) commit(seq uint32, when time.Time) uint32 {
+	n := tj.alloc()
+	b := tj.block(n)
+	putHeader(b, BlockTypeCommit, seq)
+	binary.BigEndian.PutUint64(b[commitSecOffset:], uint64(when.Unix()))
+	binary.BigEndian.PutUint32(b[commitNsecOffset:], uint32(when.Nanosecond()))
+	if tj.sb.hasChecksums() {
+		binary.BigEndian.PutUint32(b[commitChecksumOffset:], crc32c(tj.j.csumSeed, b))
+	}
+	return n
+}
+
+func (tj *testJournal) open() *Journal {
+	tj.t.Helper()
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, tj.sb)
+	raw := buf.Bytes()
+	if tj.sb.hasChecksums() {
+		binary.BigEndian.PutUint32(raw[0xFC:], crc32c(^uint32(0), raw))
+	}
+	copy(tj.data, raw)
+
+	j, err := Open(bytes.NewReader(tj.data))
+	if err != nil {
+		tj.t.Fatalf("Open() error: %v", err)
+	}
+	return j
+}
+
+func fill(c byte) []byte {
+	return bytes.Repeat([]byte{c}, testBlockSize)
+}
+
+func TestTransactions(t *testing.T) {
+	escaped := fill('e')
+	binary.BigEndian.PutUint32(escaped, Magic)
+	when := time.Unix(1700000000, 500)
+
+	tests := []struct {
+		name     string
+		incompat uint32
+		high     uint64
+	}{
+		{name: "32bit"},
+		{name: "64bit", incompat: FEATURE_INCOMPAT_64BIT, high: 1 << 32},
+		{name: "csum v2", incompat: FEATURE_INCOMPAT_CSUM_V2},
+		{name: "csum v3", incompat: FEATURE_INCOMPAT_CSUM_V3 | FEATURE_INCOMPAT_64BIT, high: 1 << 32},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tj := newTestJournal(t, tt.incompat)
+			tj.logBlocks(10, []uint64{tt.high + 100, 200}, [][]byte{fill('a'), escaped})
+			tj.commit(10, when)
+			tj.revoke(11, []uint64{200})
+			tj.logBlocks(11, []uint64{300}, [][]byte{fill('c')})
+			tj.commit(11, when)
+			// An uncommitted transaction ends the log.
+			tj.logBlocks(12, []uint64{400}, [][]byte{fill('d')})
+
+			j := tj.open()
+			txs, err := j.Transactions()
+			if err != nil {
+				t.Fatalf("Transactions() error: %v", err)
+			}
+			if len(txs) != 2 {
+				t.Fatalf("got %d transactions, want 2", len(txs))
+			}
+			if txs[0].Sequence != 10 || txs[1].Sequence != 11 {
+				t.Errorf("sequences = %d, %d, want 10, 11", txs[0].Sequence, txs[1].Sequence)
+			}
+			if !txs[0].CommitTime.Equal(when) {
+				t.Errorf("CommitTime = %v, want %v", txs[0].CommitTime, when)
+			}
+			if txs[0].StartBlock != 1 || txs[0].CommitBlock != 4 || txs[1].StartBlock != 5 {
+				t.Errorf("blocks = %d..%d, %d, want 1..4, 5", txs[0].StartBlock, txs[0].CommitBlock, txs[1].StartBlock)
+			}
+			if len(txs[1].Revoked) != 1 || txs[1].Revoked[0] != 200 {
+				t.Errorf("Revoked = %v, want [200]", txs[1].Revoked)
+			}
+
+			want := []struct {
+				target uint64
+				data   []byte
+			}{{tt.high + 100, fill('a')}, {200, escaped}}
+			if len(txs[0].Blocks) != len(want) {
+				t.Fatalf("got %d blocks, want %d", len(txs[0].Blocks), len(want))
+			}
+			for i, w := range want {
+				b := txs[0].Blocks[i]
+				if b.Target != w.target {
+					t.Errorf("block %d: Target = %d, want %d", i, b.Target, w.target)
+				}
+				data, err := j.ReadBlock(b)
+				if err != nil {
+					t.Fatalf("ReadBlock() error: %v", err)
+				}
+				if !bytes.Equal(data, w.data) {
+					t.Errorf("block %d: ReadBlock() returned the wrong data", i)
+				}
+			}
+		})
+	}
+}
+
+func TestTransactionsWrap(t *testing.T) {
+	tj := newTestJournal(t, FEATURE_INCOMPAT_CSUM_V3)
+	tj.sb.Start = testMaxLen - 2
+	tj.next = tj.sb.Start
+	tj.logBlocks(10, []uint64{100, 101}, [][]byte{fill('a'), fill('b')})
+	tj.commit(10, time.Unix(1700000000, 0))
+
+	txs, err := tj.open().Transactions()
+	if err != nil {
+		t.Fatalf("Transactions() error: %v", err)
+	}
+	if len(txs) != 1 {
+		t.Fatalf("got %d transactions, want 1", len(txs))
+	}
+	if got := txs[0].Blocks[1].LogBlock; got != 1 {
+		t.Errorf("LogBlock = %d, want 1", got)
+	}
+	if got := txs[0].CommitBlock; got != 2 {
+		t.Errorf("CommitBlock = %d, want 2", got)
+	}
+}
+
+func TestTransactionsChecksums(t *testing.T) {
+	t.Run("commit", func(t *testing.T) {
+		tj := newTestJournal(t, FEATURE_INCOMPAT_CSUM_V3)
+		tj.logBlocks(10, []uint64{100}, [][]byte{fill('a')})
+		tj.commit(10, time.Unix(1700000000, 0))
+		tj.logBlocks(11, []uint64{101}, [][]byte{fill('b')})
+		n := tj.commit(11, time.Unix(1700000000, 0))
+		tj.block(n)[commitSecOffset] ^= 0xFF
+
+		txs, err := tj.open().Transactions()
+		if err != nil {
+			t.Fatalf("Transactions() error: %v", err)
+		}
+		if len(txs) != 1 {
+			t.Errorf("got %d transactions, want the log to end at the bad commit block", len(txs))
+		}
+	})
+
+	t.Run("data", func(t *testing.T) {
+		tj := newTestJournal(t, FEATURE_INCOMPAT_CSUM_V3)
+		tj.logBlocks(10, []uint64{100}, [][]byte{fill('a')})
+		tj.commit(10, time.Unix(1700000000, 0))
+		tj.block(2)[0] = 'x'
+
+		j := tj.open()
+		txs, err := j.Transactions()
+		if err != nil {
+			t.Fatalf("Transactions() error: %v", err)
+		}
+		var csumErr *ChecksumError
+		if _, err := j.ReadBlock(txs[0].Blocks[0]); !errors.As(err, &csumErr) || csumErr.Structure != ChecksumData {
+			t.Errorf("ReadBlock() error = %v, want data block *ChecksumError", err)
+		}
+	})
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(sb *Superblock)
+	}{
+		{name: "magic", modify: func(sb *Superblock) { sb.Header.Magic = 0 }},
+		{name: "block type", modify: func(sb *Superblock) { sb.Header.BlockType = BlockTypeCommit }},
+		{name: "block size", modify: func(sb *Superblock) { sb.BlockSize = 1000 }},
+		{name: "unknown feature", modify: func(sb *Superblock) { sb.FeatureIncompat |= 0x1000 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tj := newTestJournal(t, 0)
+			tt.modify(&tj.sb)
+			buf := &bytes.Buffer{}
+			binary.Write(buf, binary.BigEndian, tj.sb)
+			if _, err := Open(bytes.NewReader(buf.Bytes())); err == nil {
+				t.Error("Open() succeeded, want error")
+			}
+		})
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		tj := newTestJournal(t, 0)
+		tj.sb.Start = 0
+		j := tj.open()
+		if j.NeedsRecovery() {
+			t.Error("NeedsRecovery() = true, want false")
+		}
+		if txs, err := j.Transactions(); err != nil || len(txs) != 0 {
+			t.Errorf("Transactions() = %v, %v, want none", txs, err)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package journal
+
+import "golang.org/x/xerrors"
+
+// tidGeq reports whether transaction a is b or later, allowing for the
+// sequence numbers to wrap around.
+func tidGeq(a, b uint32) bool {
+	return int32(a-b) >= 0
+}
+
+// Replay returns the contents of the filesystem blocks written by replaying
+// the committed transactions, keyed by filesystem block. As in the kernel, a
+// block is skipped when a revoke record in the same or a later transaction
+// covers it. Blocks whose data fails checksum verification are skipped too;
+// the first such *ChecksumError is returned along with the other blocks.
+func (j *Journal) Replay() (map[uint64][]byte, error) {
+	txs, err := j.Transactions()
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := map[uint64]uint32{}
+	for _, tx := range txs {
+		for _, target := range tx.Revoked {
+			if seq, ok := revoked[target]; !ok || tidGeq(tx.Sequence, seq) {
+				revoked[target] = tx.Sequence
+			}
+		}
+	}
+
+	blocks := map[uint64][]byte{}
+	var csumErr error
+	for _, tx := range txs {
+		for _, b := range tx.Blocks {
+			if seq, ok := revoked[b.Target]; ok && tidGeq(seq, tx.Sequence) {
+				continue
+			}
+			data, err := j.ReadBlock(b)
+			if err != nil {
+				var e *ChecksumError
+				if xerrors.As(err, &e) {
+					if csumErr == nil {
+						csumErr = err
+					}
+					continue
+				}
+				return nil, err
+			}
+			blocks[b.Target] = data
+		}
+	}
+	return blocks, csumErr
+}
@@ -0,0 +1,204 @@
+package journal
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Commit block layout.
+const (
+	commitChecksumOffset = 0x10
+	commitSecOffset      = 0x30
+	commitNsecOffset     = 0x38
+)
+
+// Transaction is a committed transaction of the log.
+type Transaction struct {
+	Sequence uint32
+	// StartBlock is the journal block of the first block of the
+	// transaction and CommitBlock the one of its commit block.
+	StartBlock  uint32
+	CommitBlock uint32
+	// CommitTime is zero when the commit block does not record it.
+	CommitTime time.Time
+	// Blocks are the filesystem blocks logged by the transaction, in log
+	// order. A block may be logged more than once.
+	Blocks []Block
+	// Revoked are the filesystem blocks revoked by the transaction.
+	Revoked []uint64
+}
+
+// Block is a filesystem block logged in the journal.
+type Block struct {
+	// Sequence is the transaction that logged the block.
+	Sequence uint32
+	// Target is the filesystem block the data belongs to.
+	Target uint64
+	// LogBlock is the journal block holding the data.
+	LogBlock uint32
+	// Flags are the TAG_FLAG_* flags of the descriptor tag.
+	Flags uint32
+	// Checksum is the data checksum of the tag, with csum v2 or v3.
+	Checksum uint32
+}
+
+// Transactions returns the committed transactions that recovery would
+// replay, oldest first. It returns nothing when the journal is clean.
+func (j *Journal) Transactions() ([]Transaction, error) {
+	if !j.NeedsRecovery() {
+		return nil, nil
+	}
+	return j.scan(j.sb.Start, j.sb.Sequence)
+}
+
+// scan walks the log from block, starting with transaction seq, until a
+// block that does not continue the log. Only transactions that end with a
+// valid commit block are returned.
+func (j *Journal) scan(block, seq uint32) ([]Transaction, error) {
+	var txs []Transaction
+	tx := Transaction{Sequence: seq, StartBlock: block}
+	for visited := uint32(0); visited < j.sb.MaxLen; visited++ {
+		buf, err := j.readBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		var h Header
+		h.Magic = binary.BigEndian.Uint32(buf[0:])
+		h.BlockType = binary.BigEndian.Uint32(buf[4:])
+		h.Sequence = binary.BigEndian.Uint32(buf[8:])
+		if h.Magic != Magic || h.Sequence != tx.Sequence {
+			return txs, nil
+		}
+
+		switch h.BlockType {
+		case BlockTypeDescriptor:
+			if err := j.verifyTail(ChecksumDescriptor, block, buf); err != nil {
+				return txs, nil
+			}
+			tags := j.parseTags(buf)
+			for _, tag := range tags {
+				block = j.next(block)
+				tag.Sequence = tx.Sequence
+				tag.LogBlock = block
+				tx.Blocks = append(tx.Blocks, tag)
+			}
+			visited += uint32(len(tags))
+		case BlockTypeCommit:
+			if err := j.verifyCommit(block, buf); err != nil {
+				return txs, nil
+			}
+			tx.CommitBlock = block
+			if sec := binary.BigEndian.Uint64(buf[commitSecOffset:]); sec != 0 {
+				tx.CommitTime = time.Unix(int64(sec), int64(binary.BigEndian.Uint32(buf[commitNsecOffset:])))
+			}
+			txs = append(txs, tx)
+			tx = Transaction{Sequence: tx.Sequence + 1, StartBlock: j.next(block)}
+		case BlockTypeRevoke:
+			if err := j.verifyTail(ChecksumRevoke, block, buf); err != nil {
+				return txs, nil
+			}
+			tx.Revoked = append(tx.Revoked, j.parseRevoke(buf)...)
+		default:
+			return txs, nil
+		}
+		block = j.next(block)
+	}
+	return nil, xerrors.New("journal log does not terminate")
+}
+
+// tagSize returns the size of a descriptor block tag, excluding the UUID.
+func (j *Journal) tagSize() int {
+	if j.sb.FeatureCsumV3() {
+		return 16
+	}
+	size := 12
+	if j.sb.FeatureCsumV2() {
+		size += 2
+	}
+	if !j.sb.Feature64bit() {
+		size -= 4
+	}
+	return size
+}
+
+// parseTags decodes the tags of descriptor block buf.
+func (j *Journal) parseTags(buf []byte) []Block {
+	end := len(buf)
+	if j.sb.hasChecksums() {
+		end -= 4
+	}
+	size := j.tagSize()
+
+	var tags []Block
+	for off := 12; off+size <= end; {
+		var tag Block
+		hi := uint64(0)
+		if j.sb.FeatureCsumV3() {
+			tag.Flags = binary.BigEndian.Uint32(buf[off+4:])
+			hi = uint64(binary.BigEndian.Uint32(buf[off+8:]))
+			tag.Checksum = binary.BigEndian.Uint32(buf[off+12:])
+		} else {
+			tag.Checksum = uint32(binary.BigEndian.Uint16(buf[off+4:]))
+			tag.Flags = uint32(binary.BigEndian.Uint16(buf[off+6:]))
+			if j.sb.Feature64bit() {
+				hi = uint64(binary.BigEndian.Uint32(buf[off+8:]))
+			}
+		}
+		tag.Target = uint64(binary.BigEndian.Uint32(buf[off:]))
+		if j.sb.Feature64bit() {
+			tag.Target |= hi << 32
+		}
+		tags = append(tags, tag)
+
+		off += size
+		if tag.Flags&TAG_FLAG_SAME_UUID == 0 {
+			off += 16
+		}
+		if tag.Flags&TAG_FLAG_LAST_TAG != 0 {
+			break
+		}
+	}
+	return tags
+}
+
+// parseRevoke decodes the records of revoke block buf.
+func (j *Journal) parseRevoke(buf []byte) []uint64 {
+	const headerSize = 16
+	count := int(binary.BigEndian.Uint32(buf[12:]))
+	if count > len(buf) {
+		count = len(buf)
+	}
+	size := 4
+	if j.sb.Feature64bit() {
+		size = 8
+	}
+
+	var blocks []uint64
+	for off := headerSize; off+size <= count; off += size {
+		if size == 8 {
+			blocks = append(blocks, binary.BigEndian.Uint64(buf[off:]))
+		} else {
+			blocks = append(blocks, uint64(binary.BigEndian.Uint32(buf[off:])))
+		}
+	}
+	return blocks
+}
+
+// ReadBlock returns the data of a logged block, as it is to be written to
+// the filesystem. With csum v2 or v3 a *ChecksumError is returned when the
+// data does not match the checksum of its tag.
+func (j *Journal) ReadBlock(b Block) ([]byte, error) {
+	buf, err := j.readBlock(b.LogBlock)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.verifyData(b, buf); err != nil {
+		return nil, err
+	}
+	if b.Flags&TAG_FLAG_ESCAPE != 0 {
+		binary.BigEndian.PutUint32(buf, Magic)
+	}
+	return buf, nil
+}
@@ -0,0 +1,35 @@
+package ext4
+
+// Errors returns the problems skipped in lenient mode and the journal copies
+// left out of DirectoryHistory, in the order they were encountered.
+func (ext4 *FileSystem) Errors() []error {
+	ext4.errsMu.Lock()
+	defer ext4.errsMu.Unlock()
+	errs := make([]error, len(ext4.errs))
+	copy(errs, ext4.errs)
+	return errs
+}
+
+// tolerate records err and reports whether lenient mode lets the caller skip
+// the damaged structure and carry on. Structures are read again on every
+// path lookup, so a problem is recorded only the first time it is seen.
+func (ext4 *FileSystem) tolerate(err error) bool {
+	if !ext4.lenient {
+		return false
+	}
+	ext4.record(err)
+	return true
+}
+
+// record records err for Errors, once.
+func (ext4 *FileSystem) record(err error) {
+	ext4.errsMu.Lock()
+	defer ext4.errsMu.Unlock()
+	if ext4.errsSeen == nil {
+		ext4.errsSeen = map[string]bool{}
+	}
+	if msg := err.Error(); !ext4.errsSeen[msg] {
+		ext4.errsSeen[msg] = true
+		ext4.errs = append(ext4.errs, err)
+	}
+}
@@ -0,0 +1,72 @@
+package ext4
+
+import (
+	"io/fs"
+	"sort"
+	"testing"
+)
+
+func walkNames(t *testing.T, fsys *FileSystem) ([]string, error) {
+	t.Helper()
+	var names []string
+	err := fs.WalkDir(fsys, "/", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != "/" {
+			names = append(names, path)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func TestLenient(t *testing.T) {
+	img := newTestImage(t)
+	img.AddFile(rootInodeNumber, "good.txt", []byte("good"))
+	// A directory entry referring to an inode that does not exist.
+	img.AddEntry(rootInodeNumber, 0xFFFFFF, "ghost", 1)
+	// A directory whose extent tree is damaged.
+	broken := img.AddDir(rootInodeNumber, "broken")
+	img.AddFile(broken, "lost.txt", []byte("lost"))
+	img.Inodes[broken].BlockOrExtents[0] = 0
+	dir := img.AddDir(rootInodeNumber, "dir")
+	img.AddFile(dir, "kept.txt", []byte("kept"))
+	// A file with an extent mapped past the end of the filesystem.
+	tail := img.AddFile(dir, "tail.txt", []byte("tail"))
+	img.Inodes[tail].BlockOrExtents = testExtentRoot(Extent{Block: 0, Len: 1, StartLo: testBlockCount + 10})
+
+	if _, err := walkNames(t, img.fs()); err == nil {
+		t.Fatalf("WalkDir() without lenient mode succeeded, want error")
+	}
+
+	fsys := img.fs(WithLenient())
+	names, err := walkNames(t, fsys)
+	if err != nil {
+		t.Fatalf("WalkDir() error: %v", err)
+	}
+	want := []string{"/broken", "/dir", "/dir/kept.txt", "/dir/tail.txt", "/good.txt"}
+	if len(names) != len(want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("got %v, want %v", names, want)
+			break
+		}
+	}
+
+	b, err := fs.ReadFile(fsys, "/dir/tail.txt")
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if string(b) != "\x00\x00\x00\x00" {
+		t.Errorf("ReadFile() = %q, want the skipped extent to read as a hole", b)
+	}
+
+	// The ghost entry, the broken directory and the out of range extent.
+	if errs := fsys.Errors(); len(errs) != 3 {
+		t.Errorf("Errors() = %v, want 3 errors", errs)
+	}
+}
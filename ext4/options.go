@@ -0,0 +1,79 @@
+package ext4
+
+import "io"
+
+// Option configures a FileSystem created by NewFS.
+type Option func(*FileSystem)
+
+// WithChecksumVerification enables verification of metadata checksums
+// (metadata_csum and gdt_csum). Structures that fail verification cause a
+// *ChecksumError to be returned.
+func WithChecksumVerification() Option {
+	return func(ext4 *FileSystem) {
+		ext4.verifyChecksums = true
+	}
+}
+
+// WithLenient enables lenient mode. Damaged directory entries, directory
+// blocks, extents and inodes are skipped instead of failing the whole
+// operation, and each problem is recorded for retrieval with Errors.
+func WithLenient() Option {
+	return func(ext4 *FileSystem) {
+		ext4.lenient = true
+	}
+}
+
+// WithDeletedEntries makes DirEntries also return the deleted entries still
+// found in the rec_len slack of directory blocks, with Deleted set. Path
+// lookups and ReadDir are not affected.
+func WithDeletedEntries() Option {
+	return func(ext4 *FileSystem) {
+		ext4.deletedEntries = true
+	}
+}
+
+// WithSuperblockBackup opens the filesystem with the backup superblock and
+// group descriptor table stored in group instead of the primary copies.
+// Group 0 selects the primary copies and disables the automatic fallback to
+// a backup when they are damaged.
+func WithSuperblockBackup(group int64) Option {
+	return func(ext4 *FileSystem) {
+		ext4.sbGroup = group
+		ext4.forceGroup = true
+	}
+}
+
+// WithBlockSize sets the block size used to locate backup superblocks.
+// Without it, every valid block size is tried.
+func WithBlockSize(size int64) Option {
+	return func(ext4 *FileSystem) {
+		ext4.blockSize = size
+	}
+}
+
+// WithBlocksPerGroup sets the number of blocks per group used to locate
+// backup superblocks, for filesystems made with mke2fs -g. Without it, the
+// default of 8 blocks per byte of block size is assumed.
+func WithBlocksPerGroup(n int64) Option {
+	return func(ext4 *FileSystem) {
+		ext4.blocksPerGroup = n
+	}
+}
+
+// WithJournalReplay replays the committed transactions of the journal when
+// the filesystem needs recovery, so that it reads as it would after being
+// mounted. The replayed blocks are kept in memory; the reader is never
+// written.
+func WithJournalReplay() Option {
+	return func(ext4 *FileSystem) {
+		ext4.replay = true
+	}
+}
+
+// WithExternalJournal sets the device holding the external journal of the
+// filesystem, used by Journal and WithJournalReplay.
+func WithExternalJournal(r io.ReaderAt) Option {
+	return func(ext4 *FileSystem) {
+		ext4.journalDev = r
+	}
+}
@@ -0,0 +1,152 @@
+package ext4
+
+import (
+	"encoding/binary"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// orphanBlockMagic ends every block of the orphan file, followed by
+	// the block checksum.
+	orphanBlockMagic    = 0x0b10ca04
+	orphanBlockTailSize = 8
+)
+
+// OrphanInode is an inode recorded as an orphan: a file unlinked while
+// still open, or a file whose truncation was in progress. The kernel
+// releases them on the next mount, so they are only found on images that
+// were not unmounted cleanly.
+type OrphanInode struct {
+	Ino   int64
+	Inode *Inode
+	// InOrphanFile reports whether the inode was recorded in the orphan
+	// file rather than in the orphan list.
+	InOrphanFile bool
+}
+
+// OrphanInodes returns the inodes of the orphan list, in list order,
+// followed by the ones of the orphan file.
+func (ext4 *FileSystem) OrphanInodes() ([]OrphanInode, error) {
+	orphans, err := ext4.orphanList()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read orphan list: %w", err)
+	}
+	if !ext4.sb.FeatureCompatOrphanFile() || ext4.sb.OrphanFileInum == 0 {
+		return orphans, nil
+	}
+	inos, err := ext4.orphanFileEntries()
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read orphan file: %w", err)
+	}
+	for _, ino := range inos {
+		inode, err := ext4.getInode(ino)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get orphan inode(%d): %w", ino, err)
+		}
+		orphans = append(orphans, OrphanInode{Ino: ino, Inode: inode, InOrphanFile: true})
+	}
+	return orphans, nil
+}
+
+// orphanList follows the orphan list headed by the superblock. The list is
+// linked through the dtime field of the inodes.
+func (ext4 *FileSystem) orphanList() ([]OrphanInode, error) {
+	var orphans []OrphanInode
+	seen := map[int64]bool{}
+	for ino := int64(ext4.sb.LastOrphan); ino != 0; {
+		if ino > int64(ext4.sb.InodeCount) {
+			return nil, xerrors.Errorf("orphan inode %d is out of range: %w", ino, ErrInodeNotFound)
+		}
+		if seen[ino] {
+			return nil, xerrors.Errorf("orphan list loops at inode %d", ino)
+		}
+		seen[ino] = true
+
+		inode, err := ext4.getInode(ino)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to get orphan inode(%d): %w", ino, err)
+		}
+		orphans = append(orphans, OrphanInode{Ino: ino, Inode: inode})
+		ino = int64(inode.Dtime)
+	}
+	return orphans, nil
+}
+
+// orphanFileEntries returns the inode numbers recorded in the orphan file,
+// in block order.
+func (ext4 *FileSystem) orphanFileEntries() ([]int64, error) {
+	ino := int64(ext4.sb.OrphanFileInum)
+	inode, err := ext4.getInode(ino)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get inode(%d): %w", ino, err)
+	}
+	dt, err := ext4.dataTable(ino, inode)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to map orphan file: %w", err)
+	}
+
+	blockSize := ext4.sb.GetBlockSize()
+	entriesSize := blockSize - orphanBlockTailSize
+	var inos []int64
+	for l := int64(0); l*blockSize < inode.GetSize(); l++ {
+		offset, ok := dt[l]
+		if !ok {
+			continue
+		}
+		b := make([]byte, blockSize)
+		if _, err := ext4.r.ReadAt(b, offset); err != nil {
+			return nil, xerrors.Errorf("failed to read block %d: %w", offset/blockSize, err)
+		}
+		if magic := binary.LittleEndian.Uint32(b[entriesSize:]); magic != orphanBlockMagic {
+			return nil, xerrors.Errorf("invalid magic %#x in block %d", magic, offset/blockSize)
+		}
+		if ext4.verifyChecksums && ext4.sb.hasMetadataChecksums() {
+			if err := verifyOrphanBlockChecksum(&ext4.sb, inode.Generation, b, offset/blockSize); err != nil {
+				if ext4.tolerate(err) {
+					continue
+				}
+				return nil, err
+			}
+		}
+		for i := int64(0); i < entriesSize; i += 4 {
+			if orphan := binary.LittleEndian.Uint32(b[i:]); orphan != 0 {
+				inos = append(inos, int64(orphan))
+			}
+		}
+	}
+	return inos, nil
+}
+
+// verifyOrphanBlockChecksum verifies the tail of orphan file block b. The
+// checksum is seeded like the ones of the orphan file inode and covers the
+// physical block number and the entries.
+func verifyOrphanBlockChecksum(sb *Superblock, generation uint32, b []byte, block int64) error {
+	var blockNr [8]byte
+	binary.LittleEndian.PutUint64(blockNr[:], uint64(block))
+	size := len(b) - orphanBlockTailSize
+	c := crc32c(sb.inodeChecksumSeed(int64(sb.OrphanFileInum), generation), blockNr[:])
+	actual := crc32c(c, b[:size])
+	expected := binary.LittleEndian.Uint32(b[size+4:])
+	if actual != expected {
+		return &ChecksumError{
+			Structure: ChecksumOrphanBlock,
+			Block:     block,
+			Index:     int64(sb.OrphanFileInum),
+			Stored:    expected,
+			Computed:  actual,
+		}
+	}
+	return nil
+}
+
+// OpenOrphan opens the content of inode ino, typically one returned by
+// OrphanInodes. As orphans have no name left, the file is named "<ino>".
+// Files with inline data are not supported.
+func (ext4 *FileSystem) OpenOrphan(ino int64) (*File, error) {
+	inode, err := ext4.getInode(ino)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get inode(%d): %w", ino, err)
+	}
+	return ext4.inodeFile(ino, inode)
+}
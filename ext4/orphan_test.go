@@ -0,0 +1,103 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// addOrphanFile creates an orphan file of one block recording inos.
+func (img *testImage) addOrphanFile(inos ...uint32) uint32 {
+	block := make([]byte, testBlockSize)
+	for i, ino := range inos {
+		binary.LittleEndian.PutUint32(block[4*i:], ino)
+	}
+	binary.LittleEndian.PutUint32(block[testBlockSize-orphanBlockTailSize:], orphanBlockMagic)
+	orphanFile := img.AddFile(rootInodeNumber, "orphan_file", block)
+	img.Dirs[rootInodeNumber].Entries = img.Dirs[rootInodeNumber].Entries[:len(img.Dirs[rootInodeNumber].Entries)-1]
+	img.SB.FeatureCompat |= FEATURE_COMPAT_ORPHAN_FILE
+	img.SB.OrphanFileInum = orphanFile
+
+	// Fill in the tail checksum of the block.
+	start := int64(binary.LittleEndian.Uint32(img.Inodes[orphanFile].BlockOrExtents[12+8:]))
+	var blockNr [8]byte
+	binary.LittleEndian.PutUint64(blockNr[:], uint64(start))
+	c := crc32c(img.SB.inodeChecksumSeed(int64(orphanFile), 0), blockNr[:])
+	c = crc32c(c, block[:testBlockSize-orphanBlockTailSize])
+	binary.LittleEndian.PutUint32(img.Data[start*testBlockSize+testBlockSize-4:], c)
+	return orphanFile
+}
+
+func TestOrphanInodes(t *testing.T) {
+	img := newTestImage(t)
+	img.SB.FeatureRoCompat |= FEATURE_RO_COMPAT_METADATA_CSUM
+	first := img.AddFile(rootInodeNumber, "first", []byte("first orphan"))
+	second := img.AddFile(rootInodeNumber, "second", []byte("second orphan"))
+	third := img.AddFile(rootInodeNumber, "third", []byte("third orphan"))
+	// The files were unlinked while still open.
+	root := img.Dirs[rootInodeNumber]
+	root.Entries = root.Entries[:len(root.Entries)-3]
+	for _, ino := range []uint32{first, second, third} {
+		img.Inodes[ino].LinksCount = 0
+	}
+	// The orphan list is linked through dtime, newest first.
+	img.SB.LastOrphan = second
+	img.Inodes[second].Dtime = first
+	img.addOrphanFile(third)
+	fsys := img.fs(WithChecksumVerification())
+
+	orphans, err := fsys.OrphanInodes()
+	if err != nil {
+		t.Fatalf("OrphanInodes() error: %v", err)
+	}
+	want := []OrphanInode{{Ino: int64(second)}, {Ino: int64(first)}, {Ino: int64(third), InOrphanFile: true}}
+	if len(orphans) != len(want) {
+		t.Fatalf("OrphanInodes() returned %d inodes, want %d", len(orphans), len(want))
+	}
+	for i, o := range orphans {
+		if o.Ino != want[i].Ino || o.InOrphanFile != want[i].InOrphanFile || o.Inode.LinksCount != 0 {
+			t.Errorf("orphan %d = inode %d (orphan file %v), want inode %d (orphan file %v)", i, o.Ino, o.InOrphanFile, want[i].Ino, want[i].InOrphanFile)
+		}
+	}
+
+	f, err := fsys.OpenOrphan(int64(third))
+	if err != nil {
+		t.Fatalf("OpenOrphan() error: %v", err)
+	}
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll() error: %v", err)
+	}
+	if string(content) != "third orphan" {
+		t.Errorf("content = %q, want %q", content, "third orphan")
+	}
+}
+
+func TestOrphanListLoop(t *testing.T) {
+	img := newTestImage(t)
+	a := img.AddFile(rootInodeNumber, "a", nil)
+	b := img.AddFile(rootInodeNumber, "b", nil)
+	img.SB.LastOrphan = a
+	img.Inodes[a].Dtime = b
+	img.Inodes[b].Dtime = a
+
+	if _, err := img.fs().OrphanInodes(); err == nil {
+		t.Error("OrphanInodes() of a looping list succeeded")
+	}
+}
+
+func TestOrphanFileChecksum(t *testing.T) {
+	img := newTestImage(t)
+	img.SB.FeatureRoCompat |= FEATURE_RO_COMPAT_METADATA_CSUM
+	orphan := img.AddFile(rootInodeNumber, "orphan", []byte("x"))
+	orphanFile := img.addOrphanFile(orphan)
+	start := int64(binary.LittleEndian.Uint32(img.Inodes[orphanFile].BlockOrExtents[12+8:]))
+	img.Data[start*testBlockSize+testBlockSize-1] ^= 0xff
+
+	if _, err := img.fs(WithChecksumVerification()).OrphanInodes(); err == nil {
+		t.Error("OrphanInodes() with a corrupted orphan file block succeeded")
+	}
+	if orphans, err := img.fs().OrphanInodes(); err != nil || len(orphans) != 1 {
+		t.Errorf("OrphanInodes() without verification = %v, %v", orphans, err)
+	}
+}
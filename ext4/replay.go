@@ -0,0 +1,107 @@
+package ext4
+
+import (
+	"io"
+
+	"golang.org/x/xerrors"
+)
+
+// replayJournal replays the committed transactions of the journal into an
+// in-memory overlay of the image, then reloads the superblock and group
+// descriptors through it and applies the fast commits that follow the
+// transactions. The source reader is never written.
+func (ext4 *FileSystem) replayJournal() error {
+	if !ext4.sb.FeatureIncompatRecover() {
+		return nil
+	}
+
+	// Inodes read before the replay may be stale, keep them out of the
+	// cache.
+	cache := ext4.cache
+	ext4.cache = &mockCache[string, any]{}
+	defer func() { ext4.cache = cache }()
+
+	j, err := ext4.Journal()
+	if err != nil {
+		return err
+	}
+	if j.BlockSize() != ext4.sb.GetBlockSize() {
+		return xerrors.Errorf("journal block size %d differs from the filesystem block size %d", j.BlockSize(), ext4.sb.GetBlockSize())
+	}
+	blocks, err := j.Replay()
+	if blocks == nil {
+		return xerrors.Errorf("failed to replay journal: %w", err)
+	}
+	if err != nil && !ext4.tolerate(xerrors.Errorf("failed to replay journal: %w", err)) {
+		return xerrors.Errorf("failed to replay journal: %w", err)
+	}
+
+	overlay := &overlayReader{
+		r:         ext4.r,
+		blockSize: ext4.sb.GetBlockSize(),
+		blocks:    make(map[int64][]byte, len(blocks)),
+	}
+	for block, data := range blocks {
+		overlay.blocks[int64(block)] = data
+	}
+	ext4.r = io.NewSectionReader(overlay, 0, ext4.r.Size())
+
+	if err := ext4.loadSuperblock(); err != nil {
+		return xerrors.Errorf("failed to parse replayed super block: %w", err)
+	}
+	if err := ext4.loadGroupDescriptors(); err != nil {
+		return xerrors.Errorf("failed to get replayed group Descriptor: %w", err)
+	}
+	if err := ext4.replayFastCommits(j, overlay); err != nil {
+		return xerrors.Errorf("failed to replay fast commits: %w", err)
+	}
+	// The kernel clears the flag once the journal has been replayed.
+	ext4.sb.FeatureIncompat &^= FEATURE_INCOMPAT_RECOVER
+	return nil
+}
+
+// overlayReader reads from r with some blocks replaced.
+type overlayReader struct {
+	r         io.ReaderAt
+	blockSize int64
+	blocks    map[int64][]byte
+}
+
+func (o *overlayReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := o.r.ReadAt(p, off)
+	for block := off / o.blockSize; block*o.blockSize < off+int64(n); block++ {
+		data, ok := o.blocks[block]
+		if !ok {
+			continue
+		}
+		start := block * o.blockSize
+		if start < off {
+			copy(p[:n], data[off-start:])
+		} else {
+			copy(p[start-off:n], data)
+		}
+	}
+	return n, err
+}
+
+// writeAt replaces bytes of the overlay, starting from the underlying data
+// for blocks not replaced yet.
+func (o *overlayReader) writeAt(p []byte, off int64) error {
+	for block := off / o.blockSize; block*o.blockSize < off+int64(len(p)); block++ {
+		data, ok := o.blocks[block]
+		if !ok {
+			data = make([]byte, o.blockSize)
+			if _, err := o.r.ReadAt(data, block*o.blockSize); err != nil {
+				return xerrors.Errorf("failed to read block %d: %w", block, err)
+			}
+			o.blocks[block] = data
+		}
+		start := block * o.blockSize
+		if start < off {
+			copy(data[off-start:], p)
+		} else {
+			copy(data, p[start-off:])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"sort"
+	"testing"
+
+	"github.com/masahiro331/go-ext4-filesystem/ext4/journal"
+)
+
+const (
+	testJournalInode  = 8
+	testJournalBlocks = 16
+)
+
+// testTransaction is a transaction written to the test journal.
+type testTransaction struct {
+	blocks  map[int64][]byte
+	revoked []int64
+}
+
+// addJournal creates a journal holding txs and marks the filesystem as
+// needing recovery. Logged blocks are written in ascending block order.
+func (img *testImage) addJournal(txs ...testTransaction) {
+	start := img.Alloc(testJournalBlocks)
+	img.SetInode(testJournalInode, &Inode{
+		Mode:           FileTypeRegular | 0o600,
+		LinksCount:     1,
+		SizeLo:         testJournalBlocks * testBlockSize,
+		BlocksLo:       testJournalBlocks * testBlockSize / SectorSize,
+		Flags:          EXTENTS_FL,
+		BlockOrExtents: testExtentRoot(Extent{Block: 0, Len: testJournalBlocks, StartLo: uint32(start)}),
+	})
+	img.SB.JournalInum = testJournalInode
+	img.SB.FeatureCompat |= FEATURE_COMPAT_HAS_JOURNAL
+	img.SB.FeatureIncompat |= FEATURE_INCOMPAT_RECOVER
+
+	writeTestJournal(img.Data[start*testBlockSize:(start+testJournalBlocks)*testBlockSize], 0, nil, txs...)
+}
+
+// writeTestJournal writes a journal holding txs to dev, with the journal
+// superblock in block sbBlock and the log in the blocks that follow.
+func writeTestJournal(dev []byte, sbBlock int, users [][16]byte, txs ...testTransaction) {
+	const firstSeq = 5
+	block := func(n int) []byte { return dev[n*testBlockSize : (n+1)*testBlockSize] }
+	header := func(b []byte, blockType uint32, seq uint32) {
+		binary.BigEndian.PutUint32(b[0:], journal.Magic)
+		binary.BigEndian.PutUint32(b[4:], blockType)
+		binary.BigEndian.PutUint32(b[8:], seq)
+	}
+
+	jsb := journal.Superblock{
+		Header:          journal.Header{Magic: journal.Magic, BlockType: journal.BlockTypeSuperblockV2},
+		BlockSize:       testBlockSize,
+		MaxLen:          uint32(len(dev) / testBlockSize),
+		First:           uint32(sbBlock + 1),
+		Sequence:        firstSeq,
+		Start:           uint32(sbBlock + 1),
+		FeatureIncompat: journal.FEATURE_INCOMPAT_REVOKE,
+		NrUsers:         uint32(len(users)),
+	}
+	for i, uuid := range users {
+		copy(jsb.Users[i*16:], uuid[:])
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, jsb)
+	copy(block(sbBlock), buf.Bytes())
+
+	n := sbBlock + 1
+	for i, tx := range txs {
+		seq := uint32(firstSeq + i)
+		if len(tx.revoked) > 0 {
+			b := block(n)
+			n++
+			header(b, journal.BlockTypeRevoke, seq)
+			for j, target := range tx.revoked {
+				binary.BigEndian.PutUint32(b[16+4*j:], uint32(target))
+			}
+			binary.BigEndian.PutUint32(b[12:], uint32(16+4*len(tx.revoked)))
+		}
+
+		var targets []int64
+		for target := range tx.blocks {
+			targets = append(targets, target)
+		}
+		sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+		if len(targets) > 0 {
+			desc := block(n)
+			n++
+			header(desc, journal.BlockTypeDescriptor, seq)
+			off := 12
+			for j, target := range targets {
+				flags := uint16(journal.TAG_FLAG_SAME_UUID)
+				if j == len(targets)-1 {
+					flags |= journal.TAG_FLAG_LAST_TAG
+				}
+				binary.BigEndian.PutUint32(desc[off:], uint32(target))
+				binary.BigEndian.PutUint16(desc[off+6:], flags)
+				off += 8
+				copy(block(n), tx.blocks[target])
+				n++
+			}
+		}
+		header(block(n), journal.BlockTypeCommit, seq)
+		n++
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	img := newTestImage(t)
+	a := img.AddFile(rootInodeNumber, "a.txt", []byte("old a"))
+	b := img.AddFile(rootInodeNumber, "b.txt", []byte("old b"))
+	// The start of the only extent, past the header and the extent's
+	// logical block, length and high start.
+	blockA := int64(binary.LittleEndian.Uint32(img.Inodes[a].BlockOrExtents[12+8:]))
+	blockB := int64(binary.LittleEndian.Uint32(img.Inodes[b].BlockOrExtents[12+8:]))
+
+	newA := make([]byte, testBlockSize)
+	copy(newA, "new a")
+	newB := make([]byte, testBlockSize)
+	copy(newB, "new b")
+	img.addJournal(
+		testTransaction{blocks: map[int64][]byte{blockA: newA, blockB: newB}},
+		// The revoke record cancels the earlier write to b.txt.
+		testTransaction{revoked: []int64{blockB}},
+	)
+
+	read := func(fsys *FileSystem, name string) string {
+		t.Helper()
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			t.Fatalf("ReadFile(%q) error: %v", name, err)
+		}
+		return string(content)
+	}
+
+	fsys := img.fs()
+	if got := read(fsys, "/a.txt"); got != "old a" {
+		t.Errorf("without replay a.txt = %q, want %q", got, "old a")
+	}
+
+	fsys = img.fs(WithJournalReplay())
+	if got := read(fsys, "/a.txt"); got != "new a" {
+		t.Errorf("a.txt = %q, want %q", got, "new a")
+	}
+	if got := read(fsys, "/b.txt"); got != "old b" {
+		t.Errorf("b.txt = %q, want the revoked block to be skipped", got)
+	}
+	if sb := fsys.GetSuperBlock(); sb.FeatureIncompatRecover() {
+		t.Error("the recover flag is still set after replay")
+	}
+}
+
+func TestOverlayReader(t *testing.T) {
+	base := bytes.Repeat([]byte{'.'}, 40)
+	o := &overlayReader{
+		r:         bytes.NewReader(base),
+		blockSize: 10,
+		blocks: map[int64][]byte{
+			1: bytes.Repeat([]byte{'a'}, 10),
+			3: bytes.Repeat([]byte{'b'}, 10),
+		},
+	}
+	p := make([]byte, 30)
+	n, err := o.ReadAt(p, 5)
+	if err != nil || n != 30 {
+		t.Fatalf("ReadAt() = %d, %v", n, err)
+	}
+	if want := ".....aaaaaaaaaa..........bbbbb"; string(p) != want {
+		t.Errorf("ReadAt() = %q, want %q", p, want)
+	}
+}
+
+// testJournalDevice builds an external journal device holding txs.
+func testJournalDevice(uuid [16]byte, users [][16]byte, txs ...testTransaction) []byte {
+	dev := make([]byte, 32*testBlockSize)
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, Superblock{
+		BlockCountLo:    32,
+		FirstDataBlock:  1,
+		BlockPerGroup:   8192,
+		Magic:           0xEF53,
+		FeatureIncompat: FEATURE_INCOMPAT_JOURNAL_DEV,
+		UUID:            uuid,
+	})
+	copy(dev[GroupZeroPadding:], buf.Bytes())
+	writeTestJournal(dev, 2, users, txs...)
+	return dev
+}
+
+func TestExternalJournal(t *testing.T) {
+	journalUUID := [16]byte{0xaa, 0xbb, 0xcc, 0xdd}
+	img := newTestImage(t)
+	a := img.AddFile(rootInodeNumber, "a.txt", []byte("old a"))
+	blockA := int64(binary.LittleEndian.Uint32(img.Inodes[a].BlockOrExtents[12+8:]))
+	img.SB.FeatureCompat |= FEATURE_COMPAT_HAS_JOURNAL
+	img.SB.FeatureIncompat |= FEATURE_INCOMPAT_RECOVER
+	img.SB.JournalUUID = journalUUID
+	b := img.bytes()
+
+	newA := make([]byte, testBlockSize)
+	copy(newA, "new a")
+	tx := testTransaction{blocks: map[int64][]byte{blockA: newA}}
+
+	notJournalDev := testJournalDevice(journalUUID, [][16]byte{img.SB.UUID}, tx)
+	notJournalDev[GroupZeroPadding+0x60] = 0 // s_feature_incompat
+
+	tests := []struct {
+		name    string
+		dev     []byte
+		wantErr bool
+	}{
+		{name: "replay", dev: testJournalDevice(journalUUID, [][16]byte{{1}, img.SB.UUID}, tx)},
+		{name: "missing device", wantErr: true},
+		{name: "wrong UUID", dev: testJournalDevice([16]byte{1}, [][16]byte{img.SB.UUID}, tx), wantErr: true},
+		{name: "not a user", dev: testJournalDevice(journalUUID, [][16]byte{{1}}, tx), wantErr: true},
+		{name: "not a journal device", dev: notJournalDev, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{WithJournalReplay()}
+			if tt.dev != nil {
+				opts = append(opts, WithExternalJournal(bytes.NewReader(tt.dev)))
+			}
+			fsys, err := NewFS(*io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), nil, opts...)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewFS() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewFS() error: %v", err)
+			}
+			content, err := fs.ReadFile(fsys, "/a.txt")
+			if err != nil {
+				t.Fatalf("ReadFile() error: %v", err)
+			}
+			if string(content) != "new a" {
+				t.Errorf("a.txt = %q, want %q", content, "new a")
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+// ResizeInodeNumber is the inode reserving the blocks used to grow the
+// group descriptor table.
+const ResizeInodeNumber = 7
+
+// BlockOwnerKind tells what a block is used for.
+type BlockOwnerKind int
+
+const (
+	OwnerSuperblock BlockOwnerKind = iota + 1
+	// OwnerGroupDescriptors covers the group descriptor table and the
+	// blocks reserved to grow it.
+	OwnerGroupDescriptors
+	OwnerBlockBitmap
+	OwnerInodeBitmap
+	OwnerInodeTable
+	// OwnerData is file or directory content.
+	OwnerData
+	// OwnerMapping is an extent tree or indirect block of an inode.
+	OwnerMapping
+	// OwnerXattr is an extended attribute block.
+	OwnerXattr
+	// OwnerJournal is a block of the journal inode.
+	OwnerJournal
+)
+
+func (k BlockOwnerKind) String() string {
+	switch k {
+	case OwnerSuperblock:
+		return "superblock"
+	case OwnerGroupDescriptors:
+		return "group descriptors"
+	case OwnerBlockBitmap:
+		return "block bitmap"
+	case OwnerInodeBitmap:
+		return "inode bitmap"
+	case OwnerInodeTable:
+		return "inode table"
+	case OwnerData:
+		return "data"
+	case OwnerMapping:
+		return "block map"
+	case OwnerXattr:
+		return "extended attributes"
+	case OwnerJournal:
+		return "journal"
+	}
+	return "unknown"
+}
+
+// BlockOwner is a user of a block.
+type BlockOwner struct {
+	Kind BlockOwnerKind
+	// Ino is the inode owning the block, zero for the group metadata.
+	Ino int64
+	// Group is the group the superblock, group descriptor, bitmap or
+	// inode table copy belongs to.
+	Group int64
+	// LogicalBlock is the block of the content of Ino held by the block,
+	// for OwnerData and OwnerJournal.
+	LogicalBlock int64
+	// Paths are the paths of Ino, empty when it is not reachable from the
+	// root directory.
+	Paths []string
+}
+
+func (o BlockOwner) hasLogicalBlock() bool {
+	return o.Kind == OwnerData || o.Kind == OwnerJournal
+}
+
+// ownerRun is a run of count blocks starting at start used by owner. For
+// data, the logical block of owner is the one of the first block.
+type ownerRun struct {
+	start int64
+	count int64
+	owner BlockOwner
+}
+
+// ReverseMap maps the blocks of a filesystem to their owners.
+type ReverseMap struct {
+	runs []ownerRun
+	// ends[i] is the largest end of runs[0..i], to find overlapping runs.
+	ends  []int64
+	paths map[int64][]string
+}
+
+// BuildReverseMap walks the group metadata and the block maps of every
+// inode in use to build the map of the blocks to their owners.
+func (ext4 *FileSystem) BuildReverseMap() (*ReverseMap, error) {
+	m := &ReverseMap{}
+	ext4.addGroupMetadata(m)
+
+	err := ext4.walkInodeTables(func(ino int64, raw []byte, allocated bool) error {
+		if !allocated {
+			return nil
+		}
+		inode, err := parseInode(raw)
+		if err != nil {
+			return xerrors.Errorf("failed to parse inode %d: %w", ino, err)
+		}
+		if err := ext4.addInodeBlocks(m, ino, inode); err != nil {
+			err = xerrors.Errorf("failed to map blocks of inode %d: %w", ino, err)
+			if ext4.tolerate(err) {
+				return nil
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if m.paths, err = ext4.pathIndex(); err != nil {
+		return nil, xerrors.Errorf("failed to resolve paths: %w", err)
+	}
+
+	sort.SliceStable(m.runs, func(i, j int) bool { return m.runs[i].start < m.runs[j].start })
+	m.ends = make([]int64, len(m.runs))
+	for i, r := range m.runs {
+		m.ends[i] = r.start + r.count
+		if i > 0 && m.ends[i-1] > m.ends[i] {
+			m.ends[i] = m.ends[i-1]
+		}
+	}
+	return m, nil
+}
+
+func (m *ReverseMap) add(start, count int64, owner BlockOwner) {
+	if count <= 0 {
+		return
+	}
+	if n := len(m.runs); n > 0 {
+		// Merge with the previous run when it continues it.
+		last := &m.runs[n-1]
+		logical := !owner.hasLogicalBlock() || last.owner.LogicalBlock+last.count == owner.LogicalBlock
+		if last.start+last.count == start && last.owner.Kind == owner.Kind && last.owner.Ino == owner.Ino &&
+			last.owner.Group == owner.Group && logical {
+			last.count += count
+			return
+		}
+	}
+	m.runs = append(m.runs, ownerRun{start: start, count: count, owner: owner})
+}
+
+// WhoOwns returns the owners of block, none when the block is free. Blocks
+// claimed several times, for instance on a damaged filesystem, have several
+// owners.
+func (m *ReverseMap) WhoOwns(block int64) []BlockOwner {
+	// Runs starting after block cannot hold it.
+	i := sort.Search(len(m.runs), func(i int) bool { return m.runs[i].start > block })
+	var owners []BlockOwner
+	for i--; i >= 0 && m.ends[i] > block; i-- {
+		r := m.runs[i]
+		if block >= r.start+r.count {
+			continue
+		}
+		owner := r.owner
+		if owner.hasLogicalBlock() {
+			owner.LogicalBlock += block - r.start
+		}
+		if owner.Ino != 0 {
+			owner.Paths = append([]string(nil), m.paths[owner.Ino]...)
+		}
+		owners = append(owners, owner)
+	}
+	return owners
+}
+
+// addGroupMetadata adds the superblock and group descriptor copies, the
+// bitmaps and the inode tables of every group.
+func (ext4 *FileSystem) addGroupMetadata(m *ReverseMap) {
+	is64bit := ext4.sb.FeatureInCompat64bit()
+	blockSize := ext4.sb.GetBlockSize()
+	inodeTableBlocks := (int64(ext4.sb.InodePerGroup)*int64(ext4.sb.InodeSize) + blockSize - 1) / blockSize
+
+	for g, gd := range ext4.gds {
+		group := int64(g)
+		layout := ext4.sb.GroupLayout(group)
+		if layout.Superblock {
+			m.add(ext4.sb.groupFirstBlock(group), 1, BlockOwner{Kind: OwnerSuperblock, Group: group})
+		}
+		if layout.DescriptorBlocks != 0 {
+			m.add(layout.DescriptorStart, layout.DescriptorBlocks, BlockOwner{Kind: OwnerGroupDescriptors, Group: group})
+		}
+		m.add(gd.GetBlockBitmapLoc(is64bit), 1, BlockOwner{Kind: OwnerBlockBitmap, Group: group})
+		m.add(gd.GetInodeBitmapLoc(is64bit), 1, BlockOwner{Kind: OwnerInodeBitmap, Group: group})
+		m.add(gd.GetInodeTableLoc(is64bit), inodeTableBlocks, BlockOwner{Kind: OwnerInodeTable, Group: group})
+	}
+}
+
+// addInodeBlocks adds the data, block map and extended attribute blocks of
+// inode ino.
+func (ext4 *FileSystem) addInodeBlocks(m *ReverseMap, ino int64, inode *Inode) error {
+	if acl := int64(inode.FileACLHigh)<<32 | int64(inode.FileACLLo); acl != 0 {
+		m.add(acl, 1, BlockOwner{Kind: OwnerXattr, Ino: ino})
+	}
+
+	// The reserved group descriptor blocks of the resize inode belong to
+	// the group metadata; only its double indirect block is its own.
+	if ino == ResizeInodeNumber {
+		var addressing BlockAddressing
+		if err := binary.Read(bytes.NewReader(inode.BlockOrExtents[:]), binary.LittleEndian, &addressing); err != nil {
+			return xerrors.Errorf("failed to read block addressing: %w", err)
+		}
+		if addressing.DoubleIndirectBlock != 0 {
+			m.add(int64(addressing.DoubleIndirectBlock), 1, BlockOwner{Kind: OwnerMapping, Ino: ino})
+		}
+		return nil
+	}
+	if !inode.HasBlocks() {
+		return nil
+	}
+
+	meta, err := ext4.MetadataBlocks(inode)
+	if err != nil {
+		return err
+	}
+	for _, b := range meta {
+		m.add(b, 1, BlockOwner{Kind: OwnerMapping, Ino: ino})
+	}
+
+	kind := OwnerData
+	if ino == int64(ext4.sb.JournalInum) {
+		kind = OwnerJournal
+	}
+	if inode.UsesExtents() {
+		// Uninitialized extents are allocated too.
+		extents, err := ext4.inodeExtents(ino, inode, ext4.inodeCsumSeed(ino, inode))
+		if err != nil {
+			return err
+		}
+		for _, e := range extents {
+			m.add(e.offset(), int64(e.GetLen()), BlockOwner{Kind: kind, Ino: ino, LogicalBlock: int64(e.Block)})
+		}
+		return nil
+	}
+	addrs, err := inode.GetBlockAddresses(ext4)
+	if err != nil {
+		return xerrors.Errorf("failed to get block addresses: %w", err)
+	}
+	for l, a := range addrs {
+		if a != 0 {
+			m.add(int64(a), 1, BlockOwner{Kind: kind, Ino: ino, LogicalBlock: int64(l)})
+		}
+	}
+	return nil
+}
+
+// HasBlocks reports whether the content of the inode lives in blocks
+// rather than in the inode itself. Device, fifo and socket inodes have no
+// blocks.
+func (i *Inode) HasBlocks() bool {
+	if i.Flags&INLINE_DATA_FL != 0 {
+		return false
+	}
+	if i.IsSymlink() && !i.UsesExtents() && i.GetSize() < int64(len(i.BlockOrExtents)) {
+		return false
+	}
+	return i.IsDir() || i.IsRegular() || i.IsSymlink() || i.Mode == 0
+}
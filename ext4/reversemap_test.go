@@ -0,0 +1,68 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestReverseMap(t *testing.T) {
+	img := newTestImage(t)
+	d := img.AddDir(rootInodeNumber, "d")
+	f := img.AddFile(d, "f", make([]byte, 2*testBlockSize))
+	img.AddEntry(rootInodeNumber, f, "link", 1)
+	img.Inodes[f].LinksCount++
+	start := int64(binary.LittleEndian.Uint32(img.Inodes[f].BlockOrExtents[12+8:]))
+	m, err := img.fs().BuildReverseMap()
+	if err != nil {
+		t.Fatalf("BuildReverseMap() error: %v", err)
+	}
+
+	for _, tt := range []struct {
+		block int64
+		want  []BlockOwner
+	}{
+		{1, []BlockOwner{{Kind: OwnerSuperblock}}},
+		{2, []BlockOwner{{Kind: OwnerGroupDescriptors}}},
+		{testBlockBitmap, []BlockOwner{{Kind: OwnerBlockBitmap}}},
+		{testInodeBitmap, []BlockOwner{{Kind: OwnerInodeBitmap}}},
+		{testInodeTable + 3, []BlockOwner{{Kind: OwnerInodeTable}}},
+		{img.Dirs[rootInodeNumber].Block, []BlockOwner{{Kind: OwnerData, Ino: rootInodeNumber, Paths: []string{"/"}}}},
+		{img.Dirs[d].Block, []BlockOwner{{Kind: OwnerData, Ino: int64(d), Paths: []string{"/d"}}}},
+		{start + 1, []BlockOwner{{Kind: OwnerData, Ino: int64(f), LogicalBlock: 1, Paths: []string{"/link", "/d/f"}}}},
+		{start + 2, nil},
+	} {
+		if got := m.WhoOwns(tt.block); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("WhoOwns(%d) = %+v, want %+v", tt.block, got, tt.want)
+		}
+	}
+
+	// The paths returned are the caller's.
+	m.WhoOwns(start)[0].Paths[0] = "/changed"
+	if got := m.WhoOwns(start)[0].Paths; !reflect.DeepEqual(got, []string{"/link", "/d/f"}) {
+		t.Errorf("WhoOwns(%d) paths = %q after changing a result", start, got)
+	}
+}
+
+func TestReverseMapSharedBlock(t *testing.T) {
+	img := newTestImage(t)
+	a := img.AddFile(rootInodeNumber, "a", make([]byte, testBlockSize))
+	b := img.AddFile(rootInodeNumber, "b", make([]byte, testBlockSize))
+	// A damaged filesystem where b also claims the block of a.
+	img.Inodes[b].BlockOrExtents = img.Inodes[a].BlockOrExtents
+	block := int64(binary.LittleEndian.Uint32(img.Inodes[a].BlockOrExtents[12+8:]))
+	m, err := img.fs().BuildReverseMap()
+	if err != nil {
+		t.Fatalf("BuildReverseMap() error: %v", err)
+	}
+
+	owners := m.WhoOwns(block)
+	if len(owners) != 2 {
+		t.Fatalf("WhoOwns(%d) = %+v, want 2 owners", block, owners)
+	}
+	for _, o := range owners {
+		if o.Ino != int64(a) && o.Ino != int64(b) {
+			t.Errorf("unexpected owner %+v", o)
+		}
+	}
+}
@@ -0,0 +1,839 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	_ fs.File = &StreamFile{}
+)
+
+var (
+	// ErrStreamDataPassed is reported when a file's data or mapping blocks
+	// appear in the stream before the metadata that locates them.
+	ErrStreamDataPassed = xerrors.New("file data preceded its metadata in the stream")
+	// ErrStreamNoPath is reported when no chain of directory entries from
+	// the root to the file was seen.
+	ErrStreamNoPath = xerrors.New("no path to file was found in the stream")
+	// ErrStreamTruncated is reported when the stream ended before all of a
+	// file's blocks were seen.
+	ErrStreamTruncated = xerrors.New("stream ended before file data was complete")
+	// ErrStreamUnsupported is reported for files, or filesystems, whose
+	// layout cannot be resolved in a single pass.
+	ErrStreamUnsupported = xerrors.New("unsupported file layout for streaming")
+	// ErrStreamBufferExceeded is returned by Stream when the blocks held
+	// until their owner is known exceed the buffer limit.
+	ErrStreamBufferExceeded = xerrors.New("stream buffer limit exceeded")
+)
+
+// DefaultStreamBufferLimit is the default number of bytes Stream buffers
+// while the owner of the blocks going by is not known yet.
+const DefaultStreamBufferLimit = 256 << 20
+
+// StreamOption configures Stream.
+type StreamOption func(*streamParser)
+
+// WithStreamBufferLimit sets the number of bytes of allocated blocks Stream
+// may buffer before their inode or mapping block has been read. This
+// happens for the blocks before the last inode table, which without
+// flex_bg lies near the end of the image. A limit of 0 removes it.
+func WithStreamBufferLimit(n int64) StreamOption {
+	return func(p *streamParser) {
+		p.earlyLimit = n
+	}
+}
+
+// StreamHandler is called by Stream for each regular file once all of its
+// data has passed by. The file is only valid during the call.
+type StreamHandler func(f *StreamFile) error
+
+// StreamFile is a regular file delivered by Stream.
+type StreamFile struct {
+	FileInfo
+	filePath string
+	reader   io.Reader
+}
+
+// UnresolvedFile describes a regular file that Stream could not deliver, or
+// a directory whose entries could not all be read.
+type UnresolvedFile struct {
+	Ino  int64
+	Path string // empty when the path could not be resolved
+	Dir  bool
+	Err  error
+}
+
+// FilePath returns the absolute path of the file.
+func (f *StreamFile) FilePath() string {
+	return f.filePath
+}
+
+func (f *StreamFile) Stat() (fs.FileInfo, error) {
+	return &f.FileInfo, nil
+}
+
+func (f *StreamFile) Read(p []byte) (int, error) {
+	return f.reader.Read(p)
+}
+
+func (f *StreamFile) Close() error {
+	return nil
+}
+
+type streamRefKind int
+
+const (
+	streamRefData streamRefKind = iota
+	streamRefDir
+	streamRefExtentIndex
+	streamRefIndirect
+)
+
+// streamRef records why a block further along the stream is needed.
+type streamRef struct {
+	kind streamRefKind
+	// target is the kind of the blocks an extent index or indirect block
+	// eventually points to.
+	target  streamRefKind
+	ino     int64
+	logical int64
+	// level is the depth of the extent node for streamRefExtentIndex and
+	// the indirection level for streamRefIndirect.
+	level int
+}
+
+// queuedRef is a reference satisfied from the early buffer, processed once
+// the mapping that produced it has been fully registered.
+type queuedRef struct {
+	ref  streamRef
+	data []byte
+}
+
+type streamName struct {
+	parent int64
+	name   string
+}
+
+// streamFileState is the state of a file or directory being collected. The
+// data blocks are kept by logical block as they arrive, so that holes and
+// the unused part of a bogus size take no memory.
+type streamFileState struct {
+	inode     *Inode
+	blocks    map[int64][]byte
+	remaining int
+	err       error
+	// delivered holds the paths the file was handed to the handler under.
+	delivered map[string]bool
+}
+
+func (st *streamFileState) fail(err error) {
+	if st.err == nil {
+		st.err = err
+	}
+	st.blocks = nil
+}
+
+func (st *streamFileState) complete() bool {
+	return st.remaining == 0 && st.err == nil
+}
+
+// inodeTableRange is the block range of one group's inode table.
+type inodeTableRange struct {
+	start int64
+	end   int64
+	group int64
+}
+
+type streamParser struct {
+	sb        Superblock
+	blockSize int64
+	current   int64
+
+	gdtStart  int64
+	gdtBuf    *bytes.Buffer
+	gds       []GroupDescriptor
+	tables    []inodeTableRange
+	tablesEnd int64
+
+	// bitmaps and inodeBitmaps hold the bitmaps seen before the inode
+	// tables, by group, and early the allocated blocks that went by while
+	// their owner could not be known yet: before the inode tables were
+	// parsed, or while extent index and indirect blocks are pending.
+	bitmapLocs      map[int64]int64
+	inodeBitmapLocs map[int64]int64
+	bitmaps         map[int64][]byte
+	inodeBitmaps    map[int64][]byte
+	early           map[int64][]byte
+	earlySize       int64
+	earlyLimit      int64
+	queue           []queuedRef
+	// pendingMaps counts the extent index and indirect blocks registered
+	// and not processed yet.
+	pendingMaps int
+
+	needs map[int64][]streamRef
+	files map[int64]*streamFileState
+	dirs  map[int64]*streamFileState
+	names map[int64][]streamName
+	ready map[int64]*streamFileState
+
+	fn StreamHandler
+}
+
+// Stream reads an ext4 image from r once, in increasing offset order, and
+// calls fn for every regular file whose data could be collected. It is
+// intended for non-seekable sources such as pipes.
+//
+// Metadata (group descriptors, inode tables, directory and mapping blocks)
+// is remembered as it goes by, and file data is buffered until the last
+// block of the file has been read. Files that cannot be resolved in one
+// pass, for example because their data precedes their inode, are returned
+// as UnresolvedFile, as are directories whose entries could not all be read.
+// A file with several hard links is delivered once per path. Holes take no
+// memory.
+//
+// Allocated blocks that precede the inode table or mapping block locating
+// them are buffered up to a limit, DefaultStreamBufferLimit unless set with
+// WithStreamBufferLimit; past it Stream fails with ErrStreamBufferExceeded.
+// Group descriptors stored in meta_bg meta groups are not supported.
+func Stream(r io.Reader, fn StreamHandler, opts ...StreamOption) ([]UnresolvedFile, error) {
+	head := make([]byte, GroupZeroPadding+SuperBlockSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, xerrors.Errorf("failed to read super block: %w", err)
+	}
+	sb, err := parseSuperBlock(bytes.NewReader(head))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse super block: %w", err)
+	}
+	if err := sb.validate(); err != nil {
+		return nil, xerrors.Errorf("invalid super block: %w", err)
+	}
+	// The descriptors past FirstMetaBg are spread across the image, after
+	// inode tables they describe.
+	if sb.FeatureIncompatMetaBg() && sb.FirstMetaBg < sb.GetGroupDescriptorCount() {
+		return nil, xerrors.Errorf("group descriptors in meta_bg meta groups: %w", ErrStreamUnsupported)
+	}
+
+	p := &streamParser{
+		sb:           sb,
+		blockSize:    sb.GetBlockSize(),
+		gdtStart:     int64(sb.FirstDataBlock) + 1,
+		gdtBuf:       bytes.NewBuffer(nil),
+		needs:        map[int64][]streamRef{},
+		files:        map[int64]*streamFileState{},
+		dirs:         map[int64]*streamFileState{},
+		names:        map[int64][]streamName{},
+		ready:        map[int64]*streamFileState{},
+		bitmaps:      map[int64][]byte{},
+		inodeBitmaps: map[int64][]byte{},
+		early:        map[int64][]byte{},
+		earlyLimit:   DefaultStreamBufferLimit,
+		fn:           fn,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	// Skip the remainder of the block holding the superblock.
+	consumed := int64(len(head))
+	if consumed < p.blockSize {
+		if _, err := io.CopyN(io.Discard, r, p.blockSize-consumed); err != nil {
+			return nil, xerrors.Errorf("failed to skip super block: %w", err)
+		}
+		consumed = p.blockSize
+	}
+
+	blockCount := sb.GetBlockCount()
+	buf := make([]byte, p.blockSize)
+	for p.current = consumed / p.blockSize; p.current < blockCount; p.current++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, xerrors.Errorf("failed to read block %d: %w", p.current, err)
+		}
+		if err := p.processBlock(buf); err != nil {
+			return nil, xerrors.Errorf("failed to process block %d: %w", p.current, err)
+		}
+	}
+
+	return p.finish(), nil
+}
+
+func (p *streamParser) processBlock(b []byte) error {
+	if p.gdtBuf != nil {
+		return p.processGroupDescriptorBlock(b)
+	}
+
+	if group, ok := p.bitmapLocs[p.current]; ok {
+		p.bitmaps[group] = append([]byte(nil), b...)
+		return nil
+	}
+	if group, ok := p.inodeBitmapLocs[p.current]; ok {
+		p.inodeBitmaps[group] = append([]byte(nil), b...)
+		return nil
+	}
+
+	if group, index, ok := p.inodeTableBlock(p.current); ok {
+		return p.processInodeTableBlock(group, index, b)
+	}
+
+	refs, ok := p.needs[p.current]
+	if !ok {
+		switch {
+		case p.current < p.tablesEnd || p.pendingMaps > 0:
+			// A mapping block still to come may point back to this block.
+			if p.allocated(p.current) {
+				p.early[p.current] = append([]byte(nil), b...)
+				p.earlySize += int64(len(b))
+				if p.earlyLimit > 0 && p.earlySize > p.earlyLimit {
+					return xerrors.Errorf("more than %d bytes precede the inode tables and mapping blocks locating them: %w", p.earlyLimit, ErrStreamBufferExceeded)
+				}
+			}
+		case len(p.early) > 0:
+			// Every block of every inode is known: nothing will be taken
+			// from the early buffer anymore.
+			p.early = map[int64][]byte{}
+			p.earlySize = 0
+		}
+		return nil
+	}
+	delete(p.needs, p.current)
+
+	for _, ref := range refs {
+		if err := p.processRef(ref, b); err != nil {
+			return err
+		}
+	}
+	return p.drain()
+}
+
+// drain processes references queued from the early buffer.
+func (p *streamParser) drain() error {
+	for len(p.queue) > 0 {
+		q := p.queue[0]
+		p.queue = p.queue[1:]
+		if err := p.processRef(q.ref, q.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocated reports whether block is in use according to the block bitmaps
+// seen so far. Blocks of groups whose bitmap is unknown are assumed in use.
+func (p *streamParser) allocated(block int64) bool {
+	rel := block - int64(p.sb.FirstDataBlock)
+	group := rel / int64(p.sb.BlockPerGroup)
+	bitmap, ok := p.bitmaps[group]
+	if !ok {
+		return true
+	}
+	bit := rel % int64(p.sb.BlockPerGroup)
+	if bit/8 >= int64(len(bitmap)) {
+		return true
+	}
+	return bitmap[bit/8]&(1<<(bit%8)) != 0
+}
+
+func (p *streamParser) processGroupDescriptorBlock(b []byte) error {
+	if p.current < p.gdtStart {
+		return nil
+	}
+	p.gdtBuf.Write(b)
+	if p.current < p.gdtStart+int64(p.sb.GetGroupDescriptorCount())-1 {
+		return nil
+	}
+
+	gds, err := p.sb.parseGroupDescriptors(p.gdtBuf)
+	if err != nil {
+		return xerrors.Errorf("failed to parse group descriptors: %w", err)
+	}
+	p.gdtBuf = nil
+
+	tableBlocks := int64(divWithRoundUp(int(p.sb.InodePerGroup)*int(p.sb.InodeSize), int(p.blockSize)))
+	p.gds = gds
+	p.bitmapLocs = map[int64]int64{}
+	p.inodeBitmapLocs = map[int64]int64{}
+	for i, gd := range gds {
+		start := gd.GetInodeTableLoc(p.sb.FeatureInCompat64bit())
+		p.tables = append(p.tables, inodeTableRange{start: start, end: start + tableBlocks, group: int64(i)})
+		if start+tableBlocks > p.tablesEnd {
+			p.tablesEnd = start + tableBlocks
+		}
+		if gd.Flags&BG_BLOCK_UNINIT == 0 {
+			p.bitmapLocs[gd.GetBlockBitmapLoc(p.sb.FeatureInCompat64bit())] = int64(i)
+		}
+		if gd.Flags&BG_INODE_UNINIT == 0 {
+			p.inodeBitmapLocs[gd.GetInodeBitmapLoc(p.sb.FeatureInCompat64bit())] = int64(i)
+		}
+	}
+	sort.Slice(p.tables, func(i, j int) bool {
+		return p.tables[i].start < p.tables[j].start
+	})
+	return nil
+}
+
+// inodeTableBlock reports whether block lies in an inode table, and if so
+// which group it belongs to and its index within that table.
+func (p *streamParser) inodeTableBlock(block int64) (int64, int64, bool) {
+	i := sort.Search(len(p.tables), func(i int) bool {
+		return p.tables[i].end > block
+	})
+	if i == len(p.tables) || block < p.tables[i].start {
+		return 0, 0, false
+	}
+	return p.tables[i].group, block - p.tables[i].start, true
+}
+
+// usedInodes returns the number of inode table entries of group that may
+// be in use: none with INODE_UNINIT, and not those never used according to
+// bg_itable_unused.
+func (p *streamParser) usedInodes(group int64) int64 {
+	gd := p.gds[group]
+	if gd.Flags&BG_INODE_UNINIT != 0 {
+		return 0
+	}
+	used := int64(p.sb.InodePerGroup)
+	if p.sb.FeatureRoCompatGdtCsum() || p.sb.FeatureRoCompatMetadataCsum() {
+		used -= gd.GetItableUnused(p.sb.FeatureInCompat64bit())
+	}
+	return used
+}
+
+// inodeAllocated reports whether the inode of slot in group is in use
+// according to the inode bitmap, assumed so when the bitmap is unknown.
+func (p *streamParser) inodeAllocated(group, slot int64) bool {
+	bitmap, ok := p.inodeBitmaps[group]
+	if !ok || slot/8 >= int64(len(bitmap)) {
+		return true
+	}
+	return bitmap[slot/8]&(1<<(slot%8)) != 0
+}
+
+func (p *streamParser) processInodeTableBlock(group, index int64, b []byte) error {
+	inodeSize := int64(p.sb.InodeSize)
+	perBlock := p.blockSize / inodeSize
+	used := p.usedInodes(group)
+	for i := int64(0); i < perBlock; i++ {
+		slot := index*perBlock + i
+		if slot >= used {
+			break
+		}
+		ino := group*int64(p.sb.InodePerGroup) + slot + 1
+		if p.systemInode(ino) {
+			continue
+		}
+		if !p.inodeAllocated(group, slot) {
+			continue
+		}
+
+		inode, err := parseInode(b[i*inodeSize : (i+1)*inodeSize])
+		if err != nil {
+			return xerrors.Errorf("failed to parse inode(%d): %w", ino, err)
+		}
+		if inode.Mode == 0 || inode.LinksCount == 0 || inode.Dtime != 0 {
+			continue
+		}
+
+		st := &streamFileState{inode: inode}
+		switch {
+		case inode.IsRegular():
+			p.files[ino] = st
+			p.mapInode(ino, st, streamRefData)
+			if err := p.tryDeliver(ino, st); err != nil {
+				return err
+			}
+		case inode.IsDir() && inode.Flags&INLINE_DATA_FL != 0:
+			p.dirs[ino] = st
+			if err := p.processInlineDir(ino, st); err != nil {
+				return err
+			}
+		case inode.IsDir():
+			p.dirs[ino] = st
+			p.mapInode(ino, st, streamRefDir)
+		}
+		if err := p.drain(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// systemInode reports whether ino holds filesystem metadata rather than a
+// user file: a reserved inode below FirstIno other than the root, or an
+// inode the superblock refers to such as the journal or the orphan file.
+func (p *streamParser) systemInode(ino int64) bool {
+	if ino != rootInodeNumber && ino < int64(p.sb.FirstIno) {
+		return true
+	}
+	for _, sys := range []uint32{p.sb.JournalInum, p.sb.UsrQuotaInum, p.sb.GrpQuotaInum, p.sb.PrjQuotaInum, p.sb.SnapshotInum, p.sb.OrphanFileInum} {
+		if sys != 0 && int64(sys) == ino {
+			return true
+		}
+	}
+	return false
+}
+
+// processInlineDir reads the entries of a directory stored in its inode.
+// The first four bytes hold the parent in place of "." and "..". Entries
+// continued in the system.data extended attribute are not supported.
+func (p *streamParser) processInlineDir(ino int64, st *streamFileState) error {
+	inode := st.inode
+	if inode.GetSize() > int64(len(inode.BlockOrExtents)) {
+		st.fail(ErrStreamUnsupported)
+		return nil
+	}
+	entries, err := extractDirectoryEntries(bytes.NewBuffer(append([]byte(nil), inode.BlockOrExtents[4:]...)))
+	if err != nil {
+		st.fail(err)
+		return nil
+	}
+	return p.addNames(ino, entries)
+}
+
+// addNames records the entries of directory dir.
+func (p *streamParser) addNames(dir int64, entries []DirectoryEntry2) error {
+	for _, entry := range entries {
+		p.names[int64(entry.Inode)] = append(p.names[int64(entry.Inode)], streamName{
+			parent: dir,
+			name:   entry.Name,
+		})
+	}
+	// New names may complete the path of files that are already buffered.
+	for ino, ready := range p.ready {
+		if err := p.tryDeliver(ino, ready); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapInode registers every block of the inode that is still to come.
+func (p *streamParser) mapInode(ino int64, st *streamFileState, target streamRefKind) {
+	inode := st.inode
+	if target == streamRefData {
+		st.blocks = map[int64][]byte{}
+		if inode.Flags&INLINE_DATA_FL != 0 {
+			size := inode.GetSize()
+			if size > int64(len(inode.BlockOrExtents)) {
+				st.fail(ErrStreamUnsupported)
+				return
+			}
+			st.blocks[0] = append([]byte(nil), inode.BlockOrExtents[:size]...)
+			return
+		}
+	}
+
+	if inode.UsesExtents() {
+		p.mapExtentNode(ino, st, target, inode.BlockOrExtents[:], extentDepthRoot)
+		return
+	}
+
+	var addressing BlockAddressing
+	if err := binary.Read(bytes.NewReader(inode.BlockOrExtents[:]), binary.LittleEndian, &addressing); err != nil {
+		st.fail(err)
+		return
+	}
+	for i, addr := range addressing.DirectBlock {
+		p.need(st, int64(addr), streamRef{kind: target, ino: ino, logical: int64(i)})
+	}
+
+	perBlock := p.blockSize / 4
+	logical := int64(len(addressing.DirectBlock))
+	span := int64(1)
+	for level, addr := range []uint32{
+		addressing.SingleIndirectBlock,
+		addressing.DoubleIndirectBlock,
+		addressing.TripleIndirectBlock,
+	} {
+		p.need(st, int64(addr), streamRef{kind: streamRefIndirect, target: target, ino: ino, logical: logical, level: level + 1})
+		span *= perBlock
+		logical += span
+	}
+}
+
+func (p *streamParser) mapExtentNode(ino int64, st *streamFileState, target streamRefKind, b []byte, expectedDepth int) {
+	header, r, err := parseExtentHeader(b, expectedDepth)
+	if err != nil {
+		st.fail(xerrors.Errorf("invalid extent node of inode(%d): %w", ino, err))
+		return
+	}
+
+	for i := uint16(0); i < header.Entries; i++ {
+		if header.Depth == 0 {
+			var e Extent
+			if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+				st.fail(xerrors.Errorf("failed to read leaf node extent: %w", err))
+				return
+			}
+			// Uninitialized extents read as zeros, as holes do.
+			if e.IsUninitialized() {
+				continue
+			}
+			for j := int64(0); j < int64(e.GetLen()); j++ {
+				p.need(st, e.offset()+j, streamRef{kind: target, ino: ino, logical: int64(e.Block) + j})
+			}
+			continue
+		}
+
+		var idx ExtentInternal
+		if err := binary.Read(r, binary.LittleEndian, &idx); err != nil {
+			st.fail(xerrors.Errorf("failed to read internal extent: %w", err))
+			return
+		}
+		leaf := int64(idx.LeafHigh)<<32 | int64(idx.LeafLow)
+		p.need(st, leaf, streamRef{kind: streamRefExtentIndex, target: target, ino: ino, level: int(header.Depth) - 1})
+	}
+}
+
+// need records that block is required by ref. A block that has already
+// gone by is taken from the early buffer, or makes the file unresolvable.
+func (p *streamParser) need(st *streamFileState, block int64, ref streamRef) {
+	if block == 0 || st.err != nil {
+		return
+	}
+	if block >= p.sb.GetBlockCount() {
+		st.fail(xerrors.Errorf("block %d is out of range", block))
+		return
+	}
+	if block > p.current {
+		p.needs[block] = append(p.needs[block], ref)
+	} else {
+		b, ok := p.early[block]
+		if !ok {
+			st.fail(ErrStreamDataPassed)
+			return
+		}
+		delete(p.early, block)
+		p.earlySize -= int64(len(b))
+		p.queue = append(p.queue, queuedRef{ref: ref, data: b})
+	}
+	st.remaining++
+	if ref.kind == streamRefExtentIndex || ref.kind == streamRefIndirect {
+		p.pendingMaps++
+	}
+}
+
+func (p *streamParser) processRef(ref streamRef, b []byte) error {
+	if ref.kind == streamRefExtentIndex || ref.kind == streamRefIndirect {
+		p.pendingMaps--
+	}
+	st, ok := p.files[ref.ino]
+	if !ok {
+		st, ok = p.dirs[ref.ino]
+	}
+	if !ok {
+		return nil
+	}
+	st.remaining--
+	if st.err != nil {
+		return nil
+	}
+
+	switch ref.kind {
+	case streamRefData:
+		// Blocks past the size of the file are not kept.
+		off := ref.logical * p.blockSize
+		if size := st.inode.GetSize(); off < size {
+			if rest := size - off; rest < int64(len(b)) {
+				b = b[:rest]
+			}
+			st.blocks[ref.logical] = append([]byte(nil), b...)
+		}
+	case streamRefDir:
+		entries, err := extractDirectoryEntries(bytes.NewBuffer(append([]byte(nil), b...)))
+		if err != nil {
+			st.fail(err)
+			break
+		}
+		if err := p.addNames(ref.ino, entries); err != nil {
+			return err
+		}
+	case streamRefExtentIndex:
+		p.mapExtentNode(ref.ino, st, ref.target, b, ref.level)
+	case streamRefIndirect:
+		perBlock := p.blockSize / 4
+		span := int64(1)
+		for i := 1; i < ref.level; i++ {
+			span *= perBlock
+		}
+		for i := int64(0); i < perBlock; i++ {
+			addr := int64(binary.LittleEndian.Uint32(b[i*4:]))
+			child := streamRef{kind: streamRefIndirect, target: ref.target, ino: ref.ino, logical: ref.logical + i*span, level: ref.level - 1}
+			if ref.level == 1 {
+				child.kind = ref.target
+			}
+			p.need(st, addr, child)
+		}
+	}
+
+	if _, ok := p.files[ref.ino]; ok {
+		return p.tryDeliver(ref.ino, st)
+	}
+	return nil
+}
+
+// resolvePaths returns the absolute paths of ino, one per hard link, that
+// the directory entries seen so far lead to.
+func (p *streamParser) resolvePaths(ino int64) []string {
+	var paths []string
+	for _, n := range p.names[ino] {
+		elems := []string{n.name}
+		seen := map[int64]bool{ino: true}
+		cur := n
+		for cur.parent != rootInodeNumber {
+			if seen[cur.parent] || len(p.names[cur.parent]) == 0 {
+				break
+			}
+			seen[cur.parent] = true
+			cur = p.names[cur.parent][0]
+			elems = append(elems, cur.name)
+		}
+		if cur.parent != rootInodeNumber {
+			continue
+		}
+		for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+			elems[i], elems[j] = elems[j], elems[i]
+		}
+		paths = append(paths, "/"+path.Join(elems...))
+	}
+	return paths
+}
+
+// tryDeliver hands a complete file to the handler under each of its paths
+// known so far. A file with several links is kept until it has been
+// delivered under as many paths as its link count.
+func (p *streamParser) tryDeliver(ino int64, st *streamFileState) error {
+	if !st.complete() {
+		return nil
+	}
+	if st.delivered == nil {
+		st.delivered = map[string]bool{}
+	}
+	for _, filePath := range p.resolvePaths(ino) {
+		if st.delivered[filePath] {
+			continue
+		}
+		st.delivered[filePath] = true
+
+		f := &StreamFile{
+			FileInfo: FileInfo{
+				name:  path.Base(filePath),
+				ino:   ino,
+				inode: st.inode,
+			},
+			filePath: filePath,
+			reader: &streamReader{
+				blocks:    st.blocks,
+				blockSize: p.blockSize,
+				size:      st.inode.GetSize(),
+			},
+		}
+		if err := p.fn(f); err != nil {
+			return xerrors.Errorf("stream handler error(%s): %w", filePath, err)
+		}
+	}
+	if len(st.delivered) < int(st.inode.LinksCount) {
+		p.ready[ino] = st
+		return nil
+	}
+	delete(p.ready, ino)
+	delete(p.files, ino)
+	return nil
+}
+
+func (p *streamParser) finish() []UnresolvedFile {
+	var unresolved []UnresolvedFile
+	// The files below these directories are reported without a path.
+	for ino, st := range p.dirs {
+		err := st.err
+		if err == nil && st.remaining > 0 {
+			err = ErrStreamTruncated
+		}
+		if err == nil {
+			continue
+		}
+		var filePath string
+		if paths := p.resolvePaths(ino); len(paths) > 0 {
+			filePath = paths[0]
+		}
+		if ino == rootInodeNumber {
+			filePath = "/"
+		}
+		unresolved = append(unresolved, UnresolvedFile{
+			Ino:  ino,
+			Path: filePath,
+			Dir:  true,
+			Err:  err,
+		})
+	}
+	// Files delivered under fewer paths than their link count are reported
+	// without a path for the names that could not be resolved.
+	for ino, st := range p.files {
+		var filePath string
+		if paths := p.resolvePaths(ino); len(paths) > 0 && len(st.delivered) == 0 {
+			filePath = paths[0]
+		}
+		err := st.err
+		switch {
+		case err != nil:
+		case st.remaining > 0:
+			err = ErrStreamTruncated
+		case filePath == "":
+			err = ErrStreamNoPath
+		}
+		unresolved = append(unresolved, UnresolvedFile{
+			Ino:  ino,
+			Path: filePath,
+			Err:  err,
+		})
+	}
+	sort.Slice(unresolved, func(i, j int) bool {
+		return unresolved[i].Ino < unresolved[j].Ino
+	})
+	return unresolved
+}
+
+// streamReader reads the blocks of a file collected by Stream. Holes read
+// as zeros.
+type streamReader struct {
+	blocks    map[int64][]byte
+	blockSize int64
+	size      int64
+	off       int64
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if rest := r.size - r.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	var n int
+	for n < len(p) {
+		logical, within := r.off/r.blockSize, r.off%r.blockSize
+		chunk := p[n:]
+		if rest := r.blockSize - within; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		var copied int
+		if b := r.blocks[logical]; within < int64(len(b)) {
+			copied = copy(chunk, b[within:])
+		}
+		for i := copied; i < len(chunk); i++ {
+			chunk[i] = 0
+		}
+		n += len(chunk)
+		r.off += int64(len(chunk))
+	}
+	return n, nil
+}
@@ -0,0 +1,326 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func streamAll(t *testing.T, image []byte) (map[string][]byte, []UnresolvedFile) {
+	t.Helper()
+	files := map[string][]byte{}
+	// io.MultiReader hides io.ReaderAt and io.Seeker from Stream.
+	unresolved, err := Stream(io.MultiReader(bytes.NewReader(image)), func(f *StreamFile) error {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		files[f.FilePath()] = b
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream() error: %v", err)
+	}
+	return files, unresolved
+}
+
+func TestStream(t *testing.T) {
+	img := newTestImage(t)
+	small := []byte("hello, stream")
+	large := bytes.Repeat([]byte("0123456789abcdef"), 200) // spans 4 blocks
+	img.AddFile(rootInodeNumber, "small.txt", small)
+	dir := img.AddDir(rootInodeNumber, "etc")
+	img.AddFile(dir, "large.bin", large)
+	img.AddFile(dir, "empty", nil)
+
+	files, unresolved := streamAll(t, img.bytes())
+	if len(unresolved) != 0 {
+		t.Fatalf("unexpected unresolved files: %+v", unresolved)
+	}
+
+	want := map[string][]byte{
+		"/small.txt":     small,
+		"/etc/large.bin": large,
+		"/etc/empty":     {},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got %d files, want %d: %v", len(files), len(want), files)
+	}
+	for name, content := range want {
+		got, ok := files[name]
+		if !ok {
+			t.Errorf("%s was not delivered", name)
+			continue
+		}
+		if !bytes.Equal(got, content) {
+			t.Errorf("%s content mismatch: got %d bytes, want %d", name, len(got), len(content))
+		}
+	}
+}
+
+func TestStreamUnresolved(t *testing.T) {
+	img := newTestImage(t)
+	img.AddFile(rootInodeNumber, "ok.txt", []byte("ok"))
+
+	// An inode whose data lives before the inode table.
+	passed := img.AddFile(rootInodeNumber, "passed.txt", []byte("x"))
+	img.Inodes[passed].BlockOrExtents = testExtentRoot(Extent{Block: 0, Len: 1, StartLo: testBlockBitmap})
+
+	// An inode that no directory refers to.
+	orphan := img.NextIno
+	img.NextIno++
+	img.SetInode(orphan, &Inode{
+		Mode:           FileTypeRegular | 0o644,
+		LinksCount:     1,
+		Flags:          EXTENTS_FL,
+		BlockOrExtents: testExtentRoot(),
+	})
+
+	// A file whose data lies beyond the end of the truncated stream.
+	tail := img.AddFile(rootInodeNumber, "tail.txt", []byte("tail"))
+	tailBlock := int64(testFirstDataBlock + 10)
+	img.Inodes[tail].BlockOrExtents = testExtentRoot(Extent{Block: 0, Len: 1, StartLo: uint32(tailBlock)})
+
+	image := img.bytes()[:tailBlock*testBlockSize]
+	files, unresolved := streamAll(t, image)
+
+	if _, ok := files["/ok.txt"]; !ok {
+		t.Errorf("/ok.txt was not delivered")
+	}
+
+	want := map[int64]error{
+		int64(passed): ErrStreamDataPassed,
+		int64(orphan): ErrStreamNoPath,
+		int64(tail):   ErrStreamTruncated,
+	}
+	if len(unresolved) != len(want) {
+		t.Fatalf("got %d unresolved files, want %d: %+v", len(unresolved), len(want), unresolved)
+	}
+	for _, u := range unresolved {
+		if !errors.Is(u.Err, want[u.Ino]) {
+			t.Errorf("inode %d: got error %v, want %v", u.Ino, u.Err, want[u.Ino])
+		}
+	}
+}
+
+// testExtentIndex moves the single leaf extent of ino into a new extent
+// block, allocated after the leaf's data, and points the inode at it.
+func testExtentIndex(img *testImage, ino uint32, leaf Extent) {
+	block := img.Alloc(1)
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, ExtentHeader{Magic: 0xF30A, Entries: 1, Max: 84})
+	binary.Write(buf, binary.LittleEndian, leaf)
+	img.WriteBlock(block, buf.Bytes())
+
+	var root [60]byte
+	buf = &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, ExtentHeader{Magic: 0xF30A, Entries: 1, Max: 4, Depth: 1})
+	binary.Write(buf, binary.LittleEndian, ExtentInternal{LeafLow: uint32(block)})
+	copy(root[:], buf.Bytes())
+	img.Inodes[ino].BlockOrExtents = root
+}
+
+func TestStreamIndexAfterData(t *testing.T) {
+	img := newTestImage(t)
+	dir := img.AddDir(rootInodeNumber, "dir")
+	content := bytes.Repeat([]byte("indexed"), 300)
+	start := img.NextBlock
+	file := img.AddFile(dir, "file", content)
+	img.AddFile(dir, "small", []byte("small"))
+
+	// The mapping blocks come after the blocks they point to, past the
+	// inode table.
+	testExtentIndex(img, dir, Extent{Block: 0, Len: 1, StartLo: uint32(img.Dirs[dir].Block)})
+	testExtentIndex(img, file, Extent{Block: 0, Len: 3, StartLo: uint32(start)})
+
+	files, unresolved := streamAll(t, img.bytes())
+	if len(unresolved) != 0 {
+		t.Fatalf("unexpected unresolved files: %+v", unresolved)
+	}
+	if got := files["/dir/file"]; !bytes.Equal(got, content) {
+		t.Errorf("/dir/file content mismatch: got %d bytes, want %d", len(got), len(content))
+	}
+	if got := files["/dir/small"]; string(got) != "small" {
+		t.Errorf("/dir/small content = %q, want %q", got, "small")
+	}
+}
+
+func TestStreamSparse(t *testing.T) {
+	img := newTestImage(t)
+	start := img.NextBlock
+	hole := img.AddFile(rootInodeNumber, "hole", []byte("data"))
+	img.Inodes[hole].SizeLo = 3*testBlockSize + 4
+	img.Inodes[hole].BlockOrExtents = testExtentRoot(Extent{Block: 3, Len: 1, StartLo: uint32(start)})
+
+	// A bogus size of 1TiB must not be allocated up front.
+	huge := img.AddFile(rootInodeNumber, "huge", []byte("huge"))
+	img.Inodes[huge].SizeHigh = 1 << 8
+
+	got := map[string][]byte{}
+	unresolved, err := Stream(io.MultiReader(bytes.NewReader(img.bytes())), func(f *StreamFile) error {
+		b := make([]byte, 3*testBlockSize+4)
+		n, err := io.ReadFull(f, b)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		got[f.FilePath()] = b[:n]
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream() error: %v", err)
+	}
+	if len(unresolved) != 0 {
+		t.Fatalf("unexpected unresolved files: %+v", unresolved)
+	}
+
+	want := append(make([]byte, 3*testBlockSize), "data"...)
+	if !bytes.Equal(got["/hole"], want) {
+		t.Errorf("/hole content mismatch: got %q", got["/hole"])
+	}
+	if b := got["/huge"]; !bytes.Equal(b[:4], []byte("huge")) || len(bytes.Trim(b[4:], "\x00")) != 0 {
+		t.Errorf("/huge content mismatch: got %q", b[:8])
+	}
+}
+
+func TestStreamSkipsUnusedInodes(t *testing.T) {
+	img := newTestImage(t)
+	img.AddFile(rootInodeNumber, "live", []byte("live"))
+
+	// Stale inodes left in the table: one freed in the inode bitmap, and
+	// one past the entries the group descriptor reports as used.
+	freed := img.AddFile(rootInodeNumber, "freed", []byte("freed"))
+	unused := img.AddFile(rootInodeNumber, "unused", []byte("unused"))
+	bit := freed - 1
+	img.Data[testInodeBitmap*testBlockSize+bit/8] &^= 1 << (bit % 8)
+	img.SB.FeatureRoCompat |= FEATURE_RO_COMPAT_GDT_CSUM
+	img.GD.ItableUnusedLo = uint16(testInodesPerGroup - unused + 1)
+
+	files, unresolved := streamAll(t, img.bytes())
+	if len(unresolved) != 0 {
+		t.Fatalf("unexpected unresolved files: %+v", unresolved)
+	}
+	if len(files) != 1 || string(files["/live"]) != "live" {
+		t.Errorf("got files %v, want only /live", files)
+	}
+}
+
+func TestStreamUnresolvedDirectory(t *testing.T) {
+	img := newTestImage(t)
+	dir := img.AddDir(rootInodeNumber, "dir")
+	file := img.AddFile(dir, "file", []byte("file"))
+	// The directory block lies before the inode table.
+	img.Inodes[dir].BlockOrExtents = testExtentRoot(Extent{Block: 0, Len: 1, StartLo: testBlockBitmap})
+
+	_, unresolved := streamAll(t, img.bytes())
+	if len(unresolved) != 2 {
+		t.Fatalf("got %d unresolved files, want 2: %+v", len(unresolved), unresolved)
+	}
+	if u := unresolved[0]; u.Ino != int64(dir) || !u.Dir || u.Path != "/dir" || !errors.Is(u.Err, ErrStreamDataPassed) {
+		t.Errorf("directory: got %+v", u)
+	}
+	if u := unresolved[1]; u.Ino != int64(file) || u.Dir || !errors.Is(u.Err, ErrStreamNoPath) {
+		t.Errorf("file: got %+v", u)
+	}
+}
+
+func TestStreamBufferLimit(t *testing.T) {
+	img := newTestImage(t)
+	start := img.NextBlock
+	file := img.AddFile(rootInodeNumber, "file", bytes.Repeat([]byte("indexed"), 300))
+	// The three data blocks are buffered until the index block after them.
+	testExtentIndex(img, file, Extent{Block: 0, Len: 3, StartLo: uint32(start)})
+	image := img.bytes()
+
+	handler := func(f *StreamFile) error { return nil }
+	_, err := Stream(io.MultiReader(bytes.NewReader(image)), handler, WithStreamBufferLimit(2*testBlockSize))
+	if !errors.Is(err, ErrStreamBufferExceeded) {
+		t.Errorf("Stream() error = %v, want %v", err, ErrStreamBufferExceeded)
+	}
+	if _, err := Stream(io.MultiReader(bytes.NewReader(image)), handler, WithStreamBufferLimit(3*testBlockSize)); err != nil {
+		t.Errorf("Stream() error: %v", err)
+	}
+}
+
+func TestStreamMetaBg(t *testing.T) {
+	img := newTestImage(t)
+	img.SB.FeatureIncompat |= FEATURE_INCOMPAT_META_BG
+
+	_, err := Stream(io.MultiReader(bytes.NewReader(img.bytes())), func(f *StreamFile) error { return nil })
+	if !errors.Is(err, ErrStreamUnsupported) {
+		t.Errorf("Stream() error = %v, want %v", err, ErrStreamUnsupported)
+	}
+}
+
+func TestStreamHardLinks(t *testing.T) {
+	img := newTestImage(t)
+	file := img.AddFile(rootInodeNumber, "a.txt", []byte("linked"))
+	dir := img.AddDir(rootInodeNumber, "dir")
+	img.AddEntry(dir, file, "b.txt", 1)
+	img.Link(file)
+	// The second link of this file lives in no directory that was seen.
+	lost := img.AddFile(rootInodeNumber, "lost.txt", []byte("lost"))
+	img.Link(lost)
+
+	files, unresolved := streamAll(t, img.bytes())
+	for _, name := range []string{"/a.txt", "/dir/b.txt"} {
+		if string(files[name]) != "linked" {
+			t.Errorf("%s: got %q, want %q", name, files[name], "linked")
+		}
+	}
+	if string(files["/lost.txt"]) != "lost" {
+		t.Errorf("/lost.txt: got %q, want %q", files["/lost.txt"], "lost")
+	}
+	if len(unresolved) != 1 {
+		t.Fatalf("got %d unresolved files, want 1: %+v", len(unresolved), unresolved)
+	}
+	if u := unresolved[0]; u.Ino != int64(lost) || u.Path != "" || !errors.Is(u.Err, ErrStreamNoPath) {
+		t.Errorf("got %+v, want inode %d without a path", u, lost)
+	}
+}
+
+func TestStreamSkipsSystemInodes(t *testing.T) {
+	img := newTestImage(t)
+	img.AddFile(rootInodeNumber, "file", []byte("file"))
+	img.addOrphanFile()
+
+	files, unresolved := streamAll(t, img.bytes())
+	if len(unresolved) != 0 {
+		t.Errorf("unexpected unresolved files: %+v", unresolved)
+	}
+	if len(files) != 1 || string(files["/file"]) != "file" {
+		t.Errorf("got files %v, want only /file", files)
+	}
+}
+
+func TestStreamInlineDirectory(t *testing.T) {
+	img := newTestImage(t)
+	img.SB.FeatureIncompat |= FEATURE_INCOMPAT_INLINE_DATA
+	file := img.AddFile(rootInodeNumber, "inline.txt", []byte("inline"))
+	root := img.Dirs[rootInodeNumber]
+	root.Entries = root.Entries[:len(root.Entries)-1]
+
+	// The parent takes the place of "." and "..", and the entries fill the
+	// rest of i_block.
+	var iblock [60]byte
+	binary.LittleEndian.PutUint32(iblock[:], rootInodeNumber)
+	entry := buildDirEntry(file, "inline.txt", 1)
+	binary.LittleEndian.PutUint16(entry[4:], uint16(len(iblock)-4))
+	copy(iblock[4:], entry)
+	dir := img.NextIno
+	img.NextIno++
+	inode := img.NewInode(FileTypeDir|0o755, 2, int64(len(iblock)), iblock)
+	inode.Flags = INLINE_DATA_FL
+	img.SetInode(dir, inode)
+	img.AddEntry(rootInodeNumber, dir, "inline", 2)
+	img.Link(rootInodeNumber)
+
+	files, unresolved := streamAll(t, img.bytes())
+	if len(unresolved) != 0 {
+		t.Fatalf("unexpected unresolved files: %+v", unresolved)
+	}
+	if string(files["/inline/inline.txt"]) != "inline" {
+		t.Errorf("got files %v, want /inline/inline.txt", files)
+	}
+}
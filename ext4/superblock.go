@@ -93,7 +93,18 @@ type Superblock struct {
 	LpfIno               uint32     `struc:"uint32,little"`
 	PrjQuotaInum         uint32     `struc:"uint32,little"`
 	ChecksumSeed         uint32     `struc:"uint32,little"`
-	Reserved             [98]uint32 `struc:"[98]uint32,little"`
+	WtimeHi              byte       `struc:"byte"`
+	MtimeHi              byte       `struc:"byte"`
+	MkfsTimeHi           byte       `struc:"byte"`
+	LastcheckHi          byte       `struc:"byte"`
+	FirstErrorTimeHi     byte       `struc:"byte"`
+	LastErrorTimeHi      byte       `struc:"byte"`
+	FirstErrorErrcode    byte       `struc:"byte"`
+	LastErrorErrcode     byte       `struc:"byte"`
+	Encoding             uint16     `struc:"uint16,little"`
+	EncodingFlags        uint16     `struc:"uint16,little"`
+	OrphanFileInum       uint32     `struc:"uint32,little"`
+	Reserved             [94]uint32 `struc:"[94]uint32,little"`
 	Checksum             uint32     `struc:"uint32,little"`
 }
 
@@ -118,6 +129,9 @@ func (sb *Superblock) FeatureCompatDirIndex() bool {
 func (sb *Superblock) FeatureCompatSparseSuper2() bool {
 	return (sb.FeatureCompat&FEATURE_COMPAT_SPARSE_SUPER2 != 0)
 }
+func (sb *Superblock) FeatureCompatOrphanFile() bool {
+	return (sb.FeatureCompat&FEATURE_COMPAT_ORPHAN_FILE != 0)
+}
 func (sb *Superblock) FeatureRoCompatSparseSuper() bool {
 	return (sb.FeatureRoCompat&FEATURE_RO_COMPAT_SPARSE_SUPER != 0)
 }
@@ -154,6 +168,9 @@ func (sb *Superblock) FeatureRoCompatReadonly() bool {
 func (sb *Superblock) FeatureRoCompatProject() bool {
 	return (sb.FeatureRoCompat&FEATURE_RO_COMPAT_PROJECT != 0)
 }
+func (sb *Superblock) FeatureRoCompatOrphanPresent() bool {
+	return (sb.FeatureRoCompat&FEATURE_RO_COMPAT_ORPHAN_PRESENT != 0)
+}
 
 func (sb *Superblock) FeatureIncompatCompression() bool {
 	return (sb.FeatureIncompat&FEATURE_INCOMPAT_COMPRESSION != 0)
@@ -216,12 +233,8 @@ func (sb *Superblock) GetGroupDescriptorTableCount() uint32 {
 
 func (sb *Superblock) GetGroupDescriptorCount() uint32 {
 	ngroups := int64(sb.GetGroupDescriptorTableCount())
-	var descSize int64 = 32
-	if sb.FeatureInCompat64bit() {
-		descSize = 64
-	}
 	blockSize := sb.GetBlockSize()
-	return uint32((ngroups*descSize + blockSize - 1) / blockSize)
+	return uint32((ngroups*int64(sb.groupDescriptorSize()) + blockSize - 1) / blockSize)
 }
 
 func (sb *Superblock) GetBlockSize() int64 {
@@ -231,3 +244,67 @@ func (sb *Superblock) GetBlockSize() int64 {
 func (sb *Superblock) GetGroupsPerFlex() int64 {
 	return 1 << sb.LogGroupPerFlex
 }
+
+// GroupHasSuperblock reports whether group holds a copy of the superblock
+// and the group descriptor table.
+func (sb *Superblock) GroupHasSuperblock(group int64) bool {
+	if group == 0 {
+		return true
+	}
+	if sb.FeatureCompatSparseSuper2() {
+		return group == int64(sb.BackupBgs[0]) || group == int64(sb.BackupBgs[1])
+	}
+	if group == 1 || !sb.FeatureRoCompatSparseSuper() {
+		return true
+	}
+	if group%2 == 0 {
+		return false
+	}
+	return isPowerOf(group, 3) || isPowerOf(group, 5) || isPowerOf(group, 7)
+}
+
+// GroupLayout describes the superblock and group descriptor blocks stored
+// at the start of a block group.
+type GroupLayout struct {
+	// Superblock reports whether the first block of the group is a copy of
+	// the superblock.
+	Superblock bool
+	// DescriptorStart and DescriptorBlocks are the first block and the
+	// number of group descriptor blocks stored in the group, reserved GDT
+	// blocks included.
+	DescriptorStart  int64
+	DescriptorBlocks int64
+}
+
+// GroupLayout returns the layout of group. Groups past FirstMetaBg meta
+// groups hold no copy of the old-style table; with meta_bg, the first,
+// second and last group of their meta group each hold one descriptor block.
+func (sb *Superblock) GroupLayout(group int64) GroupLayout {
+	l := GroupLayout{
+		Superblock:      sb.GroupHasSuperblock(group),
+		DescriptorStart: sb.groupFirstBlock(group),
+	}
+	if l.Superblock {
+		l.DescriptorStart++
+	}
+	descPerBlock := sb.GetBlockSize() / int64(sb.groupDescriptorSize())
+	if !sb.FeatureIncompatMetaBg() || group < int64(sb.FirstMetaBg)*descPerBlock {
+		if l.Superblock {
+			gdtBlocks := int64(sb.GetGroupDescriptorCount())
+			if sb.FeatureIncompatMetaBg() {
+				gdtBlocks = int64(sb.FirstMetaBg)
+			}
+			l.DescriptorBlocks = gdtBlocks + int64(sb.ReservedGdtBlocks)
+		}
+	} else if idx := group % descPerBlock; idx == 0 || idx == 1 || idx == descPerBlock-1 {
+		l.DescriptorBlocks = 1
+	}
+	return l
+}
+
+func isPowerOf(n, base int64) bool {
+	for n%base == 0 {
+		n /= base
+	}
+	return n == 1
+}
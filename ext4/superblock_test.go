@@ -103,6 +103,7 @@ func TestGetGroupDescriptorCount(t *testing.T) {
 		blockPerGroup   uint32
 		logBlockSize    uint32
 		featureIncompat uint32
+		descSize        uint16
 		want            uint32
 	}{
 		{
@@ -146,6 +147,7 @@ func TestGetGroupDescriptorCount(t *testing.T) {
 			blockPerGroup:   32768,
 			logBlockSize:    2,
 			featureIncompat: FEATURE_INCOMPAT_64BIT,
+			descSize:        64,
 			want:            1, // 64*64=4096, ceil(4096/4096)=1
 		},
 		{
@@ -154,8 +156,18 @@ func TestGetGroupDescriptorCount(t *testing.T) {
 			blockPerGroup:   32768,
 			logBlockSize:    2,
 			featureIncompat: FEATURE_INCOMPAT_64BIT,
+			descSize:        64,
 			want:            2, // 65*64=4160, ceil(4160/4096)=2
 		},
+		{
+			name:            "64bit mode: s_desc_size of 128 bytes",
+			blockCountLo:    64 * 32768,
+			blockPerGroup:   32768,
+			logBlockSize:    2,
+			featureIncompat: FEATURE_INCOMPAT_64BIT,
+			descSize:        128,
+			want:            2, // 64*128=8192, ceil(8192/4096)=2
+		},
 	}
 
 	for _, tt := range tests {
@@ -165,6 +177,7 @@ func TestGetGroupDescriptorCount(t *testing.T) {
 				BlockPerGroup:   tt.blockPerGroup,
 				LogBlockSize:    tt.logBlockSize,
 				FeatureIncompat: tt.featureIncompat,
+				DescSize:        tt.descSize,
 			}
 			got := sb.GetGroupDescriptorCount()
 			if got != tt.want {
@@ -248,3 +261,71 @@ func TestGetGroupDescriptor_SeekOffset(t *testing.T) {
 		})
 	}
 }
+
+func TestGroupLayout(t *testing.T) {
+	// 300 groups of 32768 4KiB blocks, 128 descriptors per block: 3 blocks
+	// of descriptors.
+	const perGroup = 32768
+	tests := []struct {
+		name            string
+		featureIncompat uint32
+		group           int64
+		want            GroupLayout
+	}{
+		{
+			name:  "group 0",
+			group: 0,
+			want:  GroupLayout{Superblock: true, DescriptorStart: 1, DescriptorBlocks: 3 + 5},
+		},
+		{
+			name:  "backup group",
+			group: 125,
+			want:  GroupLayout{Superblock: true, DescriptorStart: 125*perGroup + 1, DescriptorBlocks: 3 + 5},
+		},
+		{
+			name:  "group without superblock",
+			group: 128,
+			want:  GroupLayout{DescriptorStart: 128 * perGroup},
+		},
+		{
+			name:            "meta_bg: group before FirstMetaBg",
+			featureIncompat: FEATURE_INCOMPAT_META_BG,
+			group:           125,
+			want:            GroupLayout{Superblock: true, DescriptorStart: 125*perGroup + 1, DescriptorBlocks: 1 + 5},
+		},
+		{
+			name:            "meta_bg: first group of a meta group",
+			featureIncompat: FEATURE_INCOMPAT_META_BG,
+			group:           128,
+			want:            GroupLayout{DescriptorStart: 128 * perGroup, DescriptorBlocks: 1},
+		},
+		{
+			name:            "meta_bg: last group of a meta group",
+			featureIncompat: FEATURE_INCOMPAT_META_BG,
+			group:           255,
+			want:            GroupLayout{DescriptorStart: 255 * perGroup, DescriptorBlocks: 1},
+		},
+		{
+			name:            "meta_bg: backup superblock past FirstMetaBg",
+			featureIncompat: FEATURE_INCOMPAT_META_BG,
+			group:           243,
+			want:            GroupLayout{Superblock: true, DescriptorStart: 243*perGroup + 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sb := Superblock{
+				BlockCountLo:      300 * perGroup,
+				BlockPerGroup:     perGroup,
+				LogBlockSize:      2,
+				FeatureRoCompat:   FEATURE_RO_COMPAT_SPARSE_SUPER,
+				FeatureIncompat:   tt.featureIncompat,
+				ReservedGdtBlocks: 5,
+				FirstMetaBg:       1,
+			}
+			if got := sb.GroupLayout(tt.group); got != tt.want {
+				t.Errorf("GroupLayout(%d) = %+v, want %+v", tt.group, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package ext4
+
+import (
+	"path"
+
+	"golang.org/x/xerrors"
+)
+
+// treeWalkFunc is called by walkTree for every name, with the inode it
+// refers to and the file type of its entry.
+type treeWalkFunc func(name string, ino int64, fileType uint8) error
+
+// walkTree walks the directory tree breadth first, starting with the root
+// directory named "/". Directories are entered once, even if the tree loops.
+// The error returned by fn is returned as is.
+func (ext4 *FileSystem) walkTree(fn treeWalkFunc) error {
+	if err := fn("/", rootInodeNumber, direntDir); err != nil {
+		return err
+	}
+	type dir struct {
+		name string
+		ino  int64
+	}
+	entered := map[int64]bool{rootInodeNumber: true}
+	queue := []dir{{"/", rootInodeNumber}}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+
+		entries, err := ext4.listEntries(d.ino)
+		if err != nil {
+			err = xerrors.Errorf("failed to list directory %s: %w", d.name, err)
+			if ext4.tolerate(err) {
+				continue
+			}
+			return err
+		}
+		for _, e := range entries {
+			ino := int64(e.Inode)
+			name := path.Join(d.name, e.Name)
+			if err := fn(name, ino, e.Flags); err != nil {
+				return err
+			}
+			if entered[ino] {
+				continue
+			}
+			isDir := e.Flags == direntDir
+			if !ext4.sb.FeatureIncompatFiletype() {
+				inode, err := ext4.getInode(ino)
+				isDir = err == nil && inode.IsDir()
+			}
+			if isDir {
+				entered[ino] = true
+				queue = append(queue, dir{name, ino})
+			}
+		}
+	}
+	return nil
+}
+
+// inodePaths returns the paths of every inode reachable from the root
+// directory, in walk order.
+func (ext4 *FileSystem) inodePaths() (map[int64][]string, error) {
+	paths := map[int64][]string{}
+	err := ext4.walkTree(func(name string, ino int64, _ uint8) error {
+		paths[ino] = append(paths[ino], name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// pathIndex returns the paths of every inode reachable from the root
+// directory. The index is built by the first call and shared afterwards, so
+// it must not be modified.
+func (ext4 *FileSystem) pathIndex() (map[int64][]string, error) {
+	ext4.pathsOnce.Do(func() {
+		ext4.paths, ext4.pathsErr = ext4.inodePaths()
+	})
+	return ext4.paths, ext4.pathsErr
+}
@@ -0,0 +1,132 @@
+package ext4
+
+import (
+	"io/fs"
+
+	"golang.org/x/xerrors"
+)
+
+// WalkOption configures Walk.
+type WalkOption func(*walkConfig)
+
+type walkConfig struct {
+	hardLinks bool
+}
+
+// GroupHardLinks makes Walk report the paths of an inode after the first
+// one seen as hard links to it, with WalkEntry.Link set to that first path.
+func GroupHardLinks() WalkOption {
+	return func(c *walkConfig) {
+		c.hardLinks = true
+	}
+}
+
+// WalkEntry is a path visited by Walk.
+type WalkEntry struct {
+	// DirEntry is nil when the root cannot be read.
+	fs.DirEntry
+	Path string
+	// Ino is the inode Path refers to.
+	Ino int64
+	// Link is the first path seen for Ino when Path is a later hard link to
+	// it, with GroupHardLinks. It is empty otherwise.
+	Link string
+}
+
+// WalkFunc is called by Walk for every path. err and the value returned
+// have the same meaning as for fs.WalkDirFunc.
+type WalkFunc func(entry WalkEntry, err error) error
+
+// Walk walks the tree rooted at root in lexical order like fs.WalkDir,
+// reporting the inode of every path. Symbolic links are not followed.
+func (ext4 *FileSystem) Walk(root string, fn WalkFunc, opts ...WalkOption) error {
+	var c walkConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	first := map[int64]string{}
+	return fs.WalkDir(ext4, root, func(name string, d fs.DirEntry, err error) error {
+		entry := WalkEntry{DirEntry: d, Path: name}
+		if err != nil {
+			return fn(entry, err)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return fn(entry, err)
+		}
+		fi, ok := info.(FileInfo)
+		if !ok {
+			return fn(entry, xerrors.Errorf("unspecified error, entry is not file info %+v", info))
+		}
+		entry.Ino = fi.ino
+		// Directories cannot have hard links.
+		if c.hardLinks && !d.IsDir() {
+			if p, ok := first[fi.ino]; ok {
+				entry.Link = p
+			} else {
+				first[fi.ino] = name
+			}
+		}
+		return fn(entry, nil)
+	})
+}
+
+// Usage is the space used by a tree. Inodes with several hard links in the
+// tree are counted once.
+type Usage struct {
+	Dirs  int64
+	Files int64
+	// HardLinks is the number of paths to inodes already counted.
+	HardLinks int64
+	// Size is the sum of the sizes of the inodes.
+	Size int64
+	// Allocated is the space of the blocks allocated to the inodes, like du
+	// reports it.
+	Allocated int64
+}
+
+// DiskUsage returns the space used by the tree rooted at root.
+func (ext4 *FileSystem) DiskUsage(root string) (Usage, error) {
+	var u Usage
+	err := ext4.Walk(root, func(e WalkEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.Link != "" {
+			u.HardLinks++
+			return nil
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		inode := info.(FileInfo).inode
+		if inode.IsDir() {
+			u.Dirs++
+		} else {
+			u.Files++
+		}
+		u.Size += inode.GetSize()
+		u.Allocated += ext4.allocatedBytes(inode)
+		return nil
+	}, GroupHardLinks())
+	if err != nil {
+		return Usage{}, err
+	}
+	return u, nil
+}
+
+// allocatedBytes returns the space of the blocks allocated to inode,
+// including its block map and extended attribute blocks.
+func (ext4 *FileSystem) allocatedBytes(inode *Inode) int64 {
+	blocks := int64(inode.BlocksLo)
+	if !ext4.sb.FeatureRoCompatHugeFile() {
+		return blocks * SectorSize
+	}
+	blocks |= int64(inode.BlocksHigh) << 32
+	if inode.Flags&HUGE_FILE_FL != 0 {
+		return blocks * ext4.sb.GetBlockSize()
+	}
+	return blocks * SectorSize
+}
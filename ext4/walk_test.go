@@ -0,0 +1,66 @@
+package ext4
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWalkGroupHardLinks(t *testing.T) {
+	img := newTestImage(t)
+	bin := img.AddDir(rootInodeNumber, "bin")
+	perl := img.AddFile(bin, "perl", make([]byte, 3*testBlockSize))
+	img.AddEntry(bin, perl, "perl5", 1)
+	img.Inodes[perl].LinksCount++
+	other := img.AddFile(rootInodeNumber, "other", []byte("x"))
+	fsys := img.fs()
+
+	type visit struct {
+		path string
+		ino  int64
+		link string
+	}
+	walk := func(opts ...WalkOption) []visit {
+		var visits []visit
+		err := fsys.Walk("/", func(e WalkEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			visits = append(visits, visit{e.Path, e.Ino, e.Link})
+			return nil
+		}, opts...)
+		if err != nil {
+			t.Fatalf("Walk() error: %v", err)
+		}
+		return visits
+	}
+
+	want := []visit{
+		{"/", rootInodeNumber, ""},
+		{"/bin", int64(bin), ""},
+		{"/bin/perl", int64(perl), ""},
+		{"/bin/perl5", int64(perl), "/bin/perl"},
+		{"/other", int64(other), ""},
+	}
+	if got := walk(GroupHardLinks()); !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk(GroupHardLinks()) = %+v, want %+v", got, want)
+	}
+	want[3].link = ""
+	if got := walk(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk() = %+v, want %+v", got, want)
+	}
+
+	u, err := fsys.DiskUsage("/")
+	if err != nil {
+		t.Fatalf("DiskUsage() error: %v", err)
+	}
+	wantUsage := Usage{
+		Dirs:      2,
+		Files:     2,
+		HardLinks: 1,
+		Size:      5*testBlockSize + 1,
+		Allocated: 6 * testBlockSize,
+	}
+	if u != wantUsage {
+		t.Errorf("DiskUsage() = %+v, want %+v", u, wantUsage)
+	}
+}